@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/google-cloud-tools/kafka-minion/collector"
+	"github.com/google-cloud-tools/kafka-minion/kafka"
+	"github.com/google-cloud-tools/kafka-minion/storage"
+	"net/http"
+	"sort"
+)
+
+// debugGroup is the JSON representation of everything the storage knows about a consumer group
+type debugGroup struct {
+	Group        string           `json:"group"`
+	ProtocolType string           `json:"protocol_type"`
+	Protocol     string           `json:"protocol"`
+	Generation   int32            `json:"generation"`
+	Leader       string           `json:"leader"`
+	Members      []debugMember    `json:"members"`
+	Partitions   []debugPartition `json:"partitions"`
+}
+
+type debugMember struct {
+	MemberID   string             `json:"member_id"`
+	ClientID   string             `json:"client_id"`
+	ClientHost string             `json:"client_host"`
+	Assignment map[string][]int32 `json:"assignment"`
+
+	// Only set for members of Kafka Connect groups
+	Connectors []string           `json:"connectors,omitempty"`
+	Tasks      map[string][]int32 `json:"tasks,omitempty"`
+}
+
+type debugPartition struct {
+	Topic           string `json:"topic"`
+	Partition       int32  `json:"partition"`
+	CommittedOffset int64  `json:"committed_offset"`
+	HighWaterMark   *int64 `json:"high_water_mark"` // Null if the high water mark is not known yet
+	Lag             *int64 `json:"lag"`             // Null if the high water mark is not known yet
+	CommitTimestamp int64  `json:"commit_timestamp"`
+	Metadata        string `json:"metadata,omitempty"` // Truncated to storage.MaxCommitMetadataLength bytes
+}
+
+// DebugGroupsHandler returns a handler which responds with the in memory state of all consumer groups as JSON.
+// The optional query parameter "group" restricts the response to a single consumer group.
+func DebugGroupsHandler(cache *storage.MemoryStorage) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		groups := storedGroups(cache, r.URL.Query().Get("group"))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groups)
+	})
+}
+
+// storedGroups returns all consumer groups of the storage sorted by name, or only the given group if it's not empty
+func storedGroups(cache *storage.MemoryStorage, groupFilter string) []*debugGroup {
+	// All storage accessors return copies, thus the consumers are not blocked while the response is built
+	var offsets map[string]storage.ConsumerPartitionOffsetMetric
+	var metadataByGroup map[string]kafka.ConsumerGroupMetadata
+	if groupFilter != "" {
+		offsets = cache.GroupOffsets(groupFilter)
+		metadataByGroup = cache.GroupMetadata()
+	} else {
+		offsets, metadataByGroup = cache.Groups()
+	}
+	lowWaterMarks := cache.PartitionLowWaterMarks()
+	highWaterMarks := cache.PartitionHighWaterMarks()
+
+	groupsByName := make(map[string]*debugGroup)
+	getGroup := func(name string) *debugGroup {
+		if _, exists := groupsByName[name]; !exists {
+			groupsByName[name] = &debugGroup{
+				Group:      name,
+				Members:    make([]debugMember, 0),
+				Partitions: make([]debugPartition, 0),
+			}
+		}
+		return groupsByName[name]
+	}
+
+	for _, metadata := range metadataByGroup {
+		if groupFilter != "" && metadata.Group != groupFilter {
+			continue
+		}
+		group := getGroup(metadata.Group)
+		group.ProtocolType = metadata.Header.ProtocolType
+		group.Protocol = metadata.Header.Protocol
+		group.Generation = metadata.Header.Generation
+		group.Leader = metadata.Header.Leader
+		for _, member := range metadata.Members {
+			debugMember := debugMember{
+				MemberID:   member.MemberID,
+				ClientID:   member.ClientID,
+				ClientHost: member.ClientHost,
+				Assignment: member.Assignment,
+			}
+			if member.ConnectAssignment != nil {
+				debugMember.Connectors = member.ConnectAssignment.Connectors
+				debugMember.Tasks = member.ConnectAssignment.Tasks
+			}
+			group.Members = append(group.Members, debugMember)
+		}
+	}
+
+	for _, offset := range offsets {
+		partition := debugPartition{
+			Topic:           offset.Topic,
+			Partition:       offset.Partition,
+			CommittedOffset: offset.Offset,
+			CommitTimestamp: offset.Timestamp,
+			Metadata:        offset.Metadata,
+		}
+		if highWaterMark, exists := highWaterMarks[offset.Topic][offset.Partition]; exists {
+			if lowWaterMark, exists := lowWaterMarks[offset.Topic][offset.Partition]; exists {
+				lag := collector.CalculateLag(offset.Offset, lowWaterMark.WaterMark, highWaterMark.WaterMark)
+				partition.HighWaterMark = &highWaterMark.WaterMark
+				partition.Lag = &lag
+			}
+		}
+		group := getGroup(offset.Group)
+		group.Partitions = append(group.Partitions, partition)
+	}
+
+	groups := make([]*debugGroup, 0, len(groupsByName))
+	for _, group := range groupsByName {
+		sort.Slice(group.Members, func(i, j int) bool {
+			return group.Members[i].MemberID < group.Members[j].MemberID
+		})
+		sort.Slice(group.Partitions, func(i, j int) bool {
+			if group.Partitions[i].Topic != group.Partitions[j].Topic {
+				return group.Partitions[i].Topic < group.Partitions[j].Topic
+			}
+			return group.Partitions[i].Partition < group.Partitions[j].Partition
+		})
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Group < groups[j].Group
+	})
+
+	return groups
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google-cloud-tools/kafka-minion/kafka"
+	"github.com/google-cloud-tools/kafka-minion/options"
+	"github.com/google-cloud-tools/kafka-minion/storage"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestStorage returns a started storage which has processed all given requests
+func newTestStorage(t *testing.T, ctx context.Context, offsetRequests []*kafka.StorageRequest, clusterRequests []*kafka.StorageRequest) *storage.MemoryStorage {
+	t.Helper()
+
+	// The channels are unbuffered and each is served by a single storage worker, which only receives the next request
+	// once it has applied the previous one. Hence all requests have been applied once the trailing no-op requests
+	// (deleting a group and a topic which don't exist) have been received.
+	consumerOffsetCh := make(chan *kafka.StorageRequest)
+	clusterCh := make(chan *kafka.StorageRequest)
+	cache := storage.NewMemoryStorage(options.NewOptions(), consumerOffsetCh, clusterCh)
+	cache.Start(ctx)
+	for _, request := range offsetRequests {
+		consumerOffsetCh <- request
+	}
+	consumerOffsetCh <- &kafka.StorageRequest{RequestType: kafka.StorageDeleteGroupMetadata, ConsumerGroupName: "no-op-group"}
+	for _, request := range clusterRequests {
+		clusterCh <- request
+	}
+	clusterCh <- &kafka.StorageRequest{RequestType: kafka.StorageDeleteTopic, TopicName: "no-op-topic"}
+
+	return cache
+}
+
+func TestDebugGroupsHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	offsetRequests := []*kafka.StorageRequest{
+		{
+			RequestType: kafka.StorageAddConsumerOffset,
+			ConsumerOffset: &kafka.ConsumerPartitionOffset{Group: "sample-group", Topic: "orders", Partition: 1, Offset: 90, Timestamp: 1552723003465,
+				Metadata: strings.Repeat("x", storage.MaxCommitMetadataLength+1)},
+		},
+		{
+			RequestType:    kafka.StorageAddConsumerOffset,
+			ConsumerOffset: &kafka.ConsumerPartitionOffset{Group: "sample-group", Topic: "orders", Partition: 0, Offset: 40, Timestamp: 1552723003465},
+		},
+		{
+			RequestType:    kafka.StorageAddConsumerOffset,
+			ConsumerOffset: &kafka.ConsumerPartitionOffset{Group: "other-group", Topic: "orders", Partition: 0, Offset: 50, Timestamp: 1552723003465},
+		},
+		{
+			RequestType:   kafka.StorageAddGroupMetadata,
+			GroupMetadata: &kafka.ConsumerGroupMetadata{Group: "sample-group"},
+		},
+	}
+	clusterRequests := []*kafka.StorageRequest{
+		{
+			RequestType:        kafka.StorageAddPartitionHighWaterMark,
+			PartitionWaterMark: &kafka.PartitionWaterMark{TopicName: "orders", PartitionID: 0, WaterMark: 100},
+		},
+		{
+			RequestType:        kafka.StorageAddPartitionLowWaterMark,
+			PartitionWaterMark: &kafka.PartitionWaterMark{TopicName: "orders", PartitionID: 0, WaterMark: 10},
+		},
+	}
+	cache := newTestStorage(t, ctx, offsetRequests, clusterRequests)
+
+	recorder := httptest.NewRecorder()
+	DebugGroupsHandler(cache).ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/groups?group=sample-group", nil))
+	var groups []debugGroup
+	err := json.Unmarshal(recorder.Body.Bytes(), &groups)
+	if err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if len(groups) != 1 || groups[0].Group != "sample-group" {
+		t.Fatalf("Expected only sample-group in the response, got: %+v", groups)
+	}
+	partitions := groups[0].Partitions
+	if len(partitions) != 2 || partitions[0].Partition != 0 || partitions[1].Partition != 1 {
+		t.Fatalf("Expected partitions 0 and 1 sorted by partition, got: %+v", partitions)
+	}
+	if partitions[0].Lag == nil || *partitions[0].Lag != 60 {
+		t.Errorf("Expected a lag of 60 for partition 0, got: %v", partitions[0].Lag)
+	}
+	if partitions[1].Lag != nil || partitions[1].HighWaterMark != nil {
+		t.Errorf("Expected unknown lag for partition 1 without water marks, got: %v", partitions[1].Lag)
+	}
+	if partitions[0].Metadata != "" || partitions[1].Metadata != strings.Repeat("x", storage.MaxCommitMetadataLength)+"..." {
+		t.Errorf("Expected truncated commit metadata for partition 1 only, got: %q and %q", partitions[0].Metadata, partitions[1].Metadata)
+	}
+
+	recorder = httptest.NewRecorder()
+	DebugGroupsHandler(cache).ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/groups", nil))
+	err = json.Unmarshal(recorder.Body.Bytes(), &groups)
+	if err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(groups) != 2 || groups[0].Group != "other-group" {
+		t.Errorf("Expected all groups sorted by name, got: %+v", groups)
+	}
+}
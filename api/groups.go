@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/google-cloud-tools/kafka-minion/storage"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GroupsAPIPath is the path under which the groups API is served
+const GroupsAPIPath = "/api/v1/groups"
+
+const (
+	// defaultPageSize is the number of groups returned by the groups list if no limit is given
+	defaultPageSize = 100
+
+	// maxPageSize is the highest accepted limit for the groups list
+	maxPageSize = 1000
+)
+
+// groupList is a page of the names of all consumer groups, sorted by name
+type groupList struct {
+	Groups []string `json:"groups"`
+	Total  int      `json:"total"`
+	Offset int      `json:"offset"`
+	Limit  int      `json:"limit"`
+}
+
+// groupLag is the lag of a consumer group. The total lag only sums up the partitions whose lag is known.
+type groupLag struct {
+	Group      string           `json:"group"`
+	TotalLag   int64            `json:"total_lag"`
+	Partitions []debugPartition `json:"partitions"`
+}
+
+// apiError is the JSON body of all error responses
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// GroupsAPIHandler returns a read only handler which serves the consumer groups of the storage as JSON:
+//   - GET /api/v1/groups?offset=0&limit=100 returns a page of all group names
+//   - GET /api/v1/groups/{group} returns the members and partition offsets (including lag) of a group
+//   - GET /api/v1/groups/{group}/lag returns the total lag and the lag of each partition of a group
+//
+// Group names which contain a slash must be URL encoded.
+func GroupsAPIHandler(cache *storage.MemoryStorage) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "only GET requests are supported"})
+			return
+		}
+
+		// The escaped path is split, so that slashes within group names can be distinguished from path separators
+		path := strings.TrimPrefix(r.URL.EscapedPath(), GroupsAPIPath)
+		path = strings.Trim(path, "/")
+		if path == "" {
+			listGroups(w, r, cache)
+			return
+		}
+
+		segments := strings.Split(path, "/")
+		group, err := url.PathUnescape(segments[0])
+		if err != nil || len(segments) > 2 || (len(segments) == 2 && segments[1] != "lag") {
+			writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+			return
+		}
+		groups := storedGroups(cache, group)
+		if len(groups) == 0 {
+			writeJSON(w, http.StatusNotFound, apiError{Error: "consumer group not found"})
+			return
+		}
+
+		if len(segments) == 1 {
+			writeJSON(w, http.StatusOK, groups[0])
+			return
+		}
+		lag := groupLag{
+			Group:      group,
+			Partitions: groups[0].Partitions,
+		}
+		for _, partition := range lag.Partitions {
+			if partition.Lag != nil {
+				lag.TotalLag += *partition.Lag
+			}
+		}
+		writeJSON(w, http.StatusOK, lag)
+	})
+}
+
+func listGroups(w http.ResponseWriter, r *http.Request, cache *storage.MemoryStorage) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "offset must be a non negative number"})
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "limit must be a number between 1 and " + strconv.Itoa(maxPageSize)})
+		return
+	}
+
+	offsets, metadataByGroup := cache.Groups()
+	groupNames := make(map[string]bool)
+	for _, partitionOffset := range offsets {
+		groupNames[partitionOffset.Group] = true
+	}
+	for group := range metadataByGroup {
+		groupNames[group] = true
+	}
+	groups := make([]string, 0, len(groupNames))
+	for group := range groupNames {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	page := groupList{
+		Groups: make([]string, 0),
+		Total:  len(groups),
+		Offset: offset,
+		Limit:  limit,
+	}
+	if offset < len(groups) {
+		end := offset + limit
+		if end > len(groups) {
+			end = len(groups)
+		}
+		page.Groups = groups[offset:end]
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// queryInt returns the integer value of a query parameter or the default value if it's not set
+func queryInt(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	return strconv.Atoi(value)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
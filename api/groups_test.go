@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google-cloud-tools/kafka-minion/kafka"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGroupsAPIHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	offsetRequests := []*kafka.StorageRequest{
+		{
+			RequestType:    kafka.StorageAddConsumerOffset,
+			ConsumerOffset: &kafka.ConsumerPartitionOffset{Group: "sample-group", Topic: "orders", Partition: 0, Offset: 40},
+		},
+		{
+			RequestType:    kafka.StorageAddConsumerOffset,
+			ConsumerOffset: &kafka.ConsumerPartitionOffset{Group: "sample-group", Topic: "orders", Partition: 1, Offset: 70},
+		},
+		{
+			RequestType:    kafka.StorageAddConsumerOffset,
+			ConsumerOffset: &kafka.ConsumerPartitionOffset{Group: "sample-group", Topic: "payments", Partition: 0, Offset: 5},
+		},
+		{
+			RequestType:    kafka.StorageAddConsumerOffset,
+			ConsumerOffset: &kafka.ConsumerPartitionOffset{Group: "team/orders", Topic: "orders", Partition: 0, Offset: 100},
+		},
+		{
+			RequestType:   kafka.StorageAddGroupMetadata,
+			GroupMetadata: &kafka.ConsumerGroupMetadata{Group: "empty-group"},
+		},
+	}
+	clusterRequests := []*kafka.StorageRequest{
+		{
+			RequestType:        kafka.StorageAddPartitionHighWaterMark,
+			PartitionWaterMark: &kafka.PartitionWaterMark{TopicName: "orders", PartitionID: 0, WaterMark: 100},
+		},
+		{
+			RequestType:        kafka.StorageAddPartitionLowWaterMark,
+			PartitionWaterMark: &kafka.PartitionWaterMark{TopicName: "orders", PartitionID: 0, WaterMark: 10},
+		},
+		{
+			RequestType:        kafka.StorageAddPartitionHighWaterMark,
+			PartitionWaterMark: &kafka.PartitionWaterMark{TopicName: "orders", PartitionID: 1, WaterMark: 100},
+		},
+		{
+			RequestType:        kafka.StorageAddPartitionLowWaterMark,
+			PartitionWaterMark: &kafka.PartitionWaterMark{TopicName: "orders", PartitionID: 1, WaterMark: 10},
+		},
+	}
+	cache := newTestStorage(t, ctx, offsetRequests, clusterRequests)
+	handler := GroupsAPIHandler(cache)
+
+	request := func(method string, target string, body interface{}) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+		if body != nil && recorder.Code == http.StatusOK {
+			err := json.Unmarshal(recorder.Body.Bytes(), body)
+			if err != nil {
+				t.Fatalf("Failed to decode response of %v: %v", target, err)
+			}
+		}
+		return recorder.Code
+	}
+
+	// Group list with pagination
+	pages := []struct {
+		target string
+		groups []string
+	}{
+		{"/api/v1/groups", []string{"empty-group", "sample-group", "team/orders"}},
+		{"/api/v1/groups?limit=2", []string{"empty-group", "sample-group"}},
+		{"/api/v1/groups?offset=2&limit=2", []string{"team/orders"}},
+		{"/api/v1/groups?offset=5", []string{}},
+	}
+	for _, page := range pages {
+		var list groupList
+		if code := request("GET", page.target, &list); code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %v, got: %v", page.target, code)
+		}
+		if list.Total != 3 || fmt.Sprint(list.Groups) != fmt.Sprint(page.groups) {
+			t.Errorf("Group list of %v was incorrect, got: %+v, want groups: %v", page.target, list, page.groups)
+		}
+	}
+
+	// Single group, the group name with a slash is URL encoded
+	var group debugGroup
+	if code := request("GET", "/api/v1/groups/team%2Forders", &group); code != http.StatusOK {
+		t.Fatalf("Expected status 200 for an URL encoded group, got: %v", code)
+	}
+	if group.Group != "team/orders" || len(group.Partitions) != 1 {
+		t.Errorf("Expected team/orders with one partition, got: %+v", group)
+	}
+
+	// Lag, the partition without water marks is not part of the total lag
+	var lag groupLag
+	if code := request("GET", "/api/v1/groups/sample-group/lag", &lag); code != http.StatusOK {
+		t.Fatalf("Expected status 200 for the group lag, got: %v", code)
+	}
+	if lag.Group != "sample-group" || lag.TotalLag != 90 || len(lag.Partitions) != 3 {
+		t.Errorf("Expected a total lag of 90 over 3 partitions, got: %+v", lag)
+	}
+	if lag.Partitions[2].Topic != "payments" || lag.Partitions[2].Lag != nil {
+		t.Errorf("Expected an unknown lag for the payments partition, got: %+v", lag.Partitions[2])
+	}
+
+	errors := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{"GET", "/api/v1/groups/unknown-group", http.StatusNotFound},
+		{"GET", "/api/v1/groups/unknown-group/lag", http.StatusNotFound},
+		{"GET", "/api/v1/groups/sample-group/members", http.StatusNotFound},
+		{"GET", "/api/v1/groups?limit=0", http.StatusBadRequest},
+		{"GET", "/api/v1/groups?limit=1001", http.StatusBadRequest},
+		{"GET", "/api/v1/groups?offset=-1", http.StatusBadRequest},
+		{"DELETE", "/api/v1/groups/sample-group", http.StatusMethodNotAllowed},
+	}
+	for _, table := range errors {
+		if code := request(table.method, table.target, nil); code != table.code {
+			t.Errorf("Status of %v %v was incorrect, got: %v, want: %v", table.method, table.target, code, table.code)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"github.com/google-cloud-tools/kafka-minion/collector"
+	"github.com/google-cloud-tools/kafka-minion/sink"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"regexp"
+)
+
+// MetricsHandler returns a handler which serves all metrics of the default registry through the prometheus sink, so
+// that the endpoint serves the same samples which any other sink receives. The optional query parameter
+// "group" is a regex (matching the whole group name), which restricts the response to the consumer group series of
+// the matching groups. The given labels are added to all series of a filtered response, like they are added to the
+// series of the default registry.
+func MetricsHandler(c *collector.Collector, labels prometheus.Labels) http.Handler {
+	defaultHandler := promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(sink.NewPrometheusSink(prometheus.DefaultGatherer), promhttp.HandlerOpts{}),
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		groupFilter := r.URL.Query().Get("group")
+		if groupFilter == "" {
+			defaultHandler.ServeHTTP(w, r)
+			return
+		}
+
+		pattern, err := regexp.Compile("^(?:" + groupFilter + ")$")
+		if err != nil {
+			http.Error(w, "group must be a valid regex: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// A registry is created per request, as the collected groups depend on the request
+		registry := prometheus.NewRegistry()
+		var registerer prometheus.Registerer = registry
+		if len(labels) > 0 {
+			registerer = prometheus.WrapRegistererWith(labels, registry)
+		}
+		registerer.MustRegister(c.GroupCollector(pattern))
+		promhttp.HandlerFor(sink.NewPrometheusSink(registry), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
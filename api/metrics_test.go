@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"github.com/google-cloud-tools/kafka-minion/collector"
+	"github.com/google-cloud-tools/kafka-minion/kafka"
+	"github.com/google-cloud-tools/kafka-minion/options"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandlerFiltersGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	offsetRequests := []*kafka.StorageRequest{
+		{RequestType: kafka.StorageRegisterOffsetPartitions, PartitionCount: 1},
+		{RequestType: kafka.StorageMarkOffsetPartitionReady, PartitionID: 0},
+		{
+			RequestType:    kafka.StorageAddConsumerOffset,
+			ConsumerOffset: &kafka.ConsumerPartitionOffset{Group: "sample-group", Topic: "orders", Partition: 0, Offset: 40},
+		},
+		{
+			RequestType:    kafka.StorageAddConsumerOffset,
+			ConsumerOffset: &kafka.ConsumerPartitionOffset{Group: "other-group", Topic: "orders", Partition: 0, Offset: 50},
+		},
+	}
+	clusterRequests := []*kafka.StorageRequest{
+		{
+			RequestType:        kafka.StorageAddPartitionHighWaterMark,
+			PartitionWaterMark: &kafka.PartitionWaterMark{TopicName: "orders", PartitionID: 0, WaterMark: 100},
+		},
+		{
+			RequestType:        kafka.StorageAddPartitionLowWaterMark,
+			PartitionWaterMark: &kafka.PartitionWaterMark{TopicName: "orders", PartitionID: 0, WaterMark: 10},
+		},
+	}
+	cache := newTestStorage(t, ctx, offsetRequests, clusterRequests)
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	handler := MetricsHandler(collector.NewCollector(opts, &kafka.Filter{}, cache), prometheus.Labels{"cluster": "sample-cluster"})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics?group=sample-.*", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, Got: %v", http.StatusOK, recorder.Code)
+	}
+	body := recorder.Body.String()
+	expectedSeries := `kafka_minion_group_topic_partition_lag{cluster="sample-cluster",group="sample-group",`
+	if !strings.Contains(body, expectedSeries) {
+		t.Errorf("Expected the lag of sample-group, Got: %v", body)
+	}
+	if strings.Contains(body, `group="other-group"`) {
+		t.Errorf("Expected no series of other-group, Got: %v", body)
+	}
+	if strings.Contains(body, "kafka_minion_topic_partition_high_water_mark") {
+		t.Errorf("Expected no partition series in the filtered response, Got: %v", body)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics?group=sample-(", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %v for an invalid regex, Got: %v", http.StatusBadRequest, recorder.Code)
+	}
+}
@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientHostCacheTTL is the duration for which resolved (and unresolvable) client hosts are cached. Entries which
+// haven't been used within this duration are evicted, so that the cache doesn't grow while client addresses churn.
+const clientHostCacheTTL = 10 * time.Minute
+
+// maxConcurrentLookups is the max number of reverse DNS lookups which run at the same time. A rebalance of a large
+// group may bring thousands of new client addresses, which must not all be looked up at once.
+const maxConcurrentLookups = 8
+
+// normalizeClientHost strips the formatting of Java's InetAddress from a member's client host. Kafka reports client
+// hosts as "hostname/ip" or as "/ip" if the hostname is unknown.
+func normalizeClientHost(clientHost string) string {
+	index := strings.LastIndex(clientHost, "/")
+	if index == -1 {
+		return clientHost
+	}
+	if index > 0 {
+		return clientHost[:index]
+	}
+
+	return clientHost[1:]
+}
+
+// clientHostResolver resolves client hosts to hostnames by reverse DNS lookups. Lookups run in the background, so
+// that a scrape never waits for DNS. Until a lookup has completed the address itself is returned. Addresses which
+// can't be looked up, because maxConcurrentLookups are already running, are looked up on one of the next scrapes.
+type clientHostResolver struct {
+	timeout    time.Duration
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+
+	lock         sync.Mutex
+	cache        map[string]*resolvedClientHost
+	lastEviction time.Time
+
+	// lookups tracks the lookups which are currently running, each of them holds one of the lookup slots
+	lookups     sync.WaitGroup
+	lookupSlots chan struct{}
+}
+
+// resolvedClientHost is a cached lookup result. An empty name is a negative result, which is cached as well so
+// that unresolvable addresses don't cause a lookup on every scrape.
+type resolvedClientHost struct {
+	name      string
+	expiresAt time.Time
+	lastUsed  time.Time
+	pending   bool
+}
+
+func newClientHostResolver(timeout time.Duration) *clientHostResolver {
+	return &clientHostResolver{
+		timeout:     timeout,
+		lookupAddr:  net.DefaultResolver.LookupAddr,
+		cache:       make(map[string]*resolvedClientHost),
+		lookupSlots: make(chan struct{}, maxConcurrentLookups),
+	}
+}
+
+// Resolve returns the cached hostname of an address. If the address hasn't been looked up yet or its cache entry
+// has expired, a lookup is started and the address (or the previously resolved hostname) is returned.
+func (r *clientHostResolver) Resolve(addr string, now time.Time) string {
+	if net.ParseIP(addr) == nil {
+		// Only IP addresses can be resolved, client hosts which already are hostnames are kept as they are
+		return addr
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entry, exists := r.cache[addr]
+	if !exists {
+		entry = &resolvedClientHost{}
+		r.cache[addr] = entry
+	}
+	if !entry.pending && !now.Before(entry.expiresAt) {
+		select {
+		case r.lookupSlots <- struct{}{}:
+			entry.pending = true
+			r.lookups.Add(1)
+			go r.lookup(addr, entry)
+		default:
+		}
+	}
+	entry.lastUsed = now
+	r.evict(now)
+
+	if entry.name == "" {
+		return addr
+	}
+	return entry.name
+}
+
+// evict removes all cache entries which haven't been used within the cache TTL. The cache is only swept once per
+// TTL, it must be called with the lock being held.
+func (r *clientHostResolver) evict(now time.Time) {
+	if now.Sub(r.lastEviction) < clientHostCacheTTL {
+		return
+	}
+	r.lastEviction = now
+
+	for addr, entry := range r.cache {
+		// Pending lookups update their entry, which would be lost
+		if !entry.pending && now.Sub(entry.lastUsed) > clientHostCacheTTL {
+			delete(r.cache, addr)
+		}
+	}
+}
+
+func (r *clientHostResolver) lookup(addr string, entry *resolvedClientHost) {
+	defer r.lookups.Done()
+	defer func() { <-r.lookupSlots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	names, err := r.lookupAddr(ctx, addr)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry.pending = false
+	entry.expiresAt = time.Now().Add(clientHostCacheTTL)
+	if err != nil || len(names) == 0 {
+		entry.name = ""
+		return
+	}
+	entry.name = strings.TrimSuffix(names[0], ".")
+}
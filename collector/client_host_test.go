@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNormalizeClientHost(t *testing.T) {
+	tables := []struct {
+		clientHost string
+		normalized string
+	}{
+		{"/10.0.0.5", "10.0.0.5"},
+		{"consumer-1.example.com/10.0.0.5", "consumer-1.example.com"},
+		{"/2001:db8::1", "2001:db8::1"},
+		{"10.0.0.5", "10.0.0.5"},
+		{"", ""},
+	}
+
+	for _, table := range tables {
+		if normalized := normalizeClientHost(table.clientHost); normalized != table.normalized {
+			t.Errorf("Normalized client host of %q was incorrect, got: %q, want: %q", table.clientHost, normalized, table.normalized)
+		}
+	}
+}
+
+func TestClientHostResolver(t *testing.T) {
+	var lookupsLock sync.Mutex
+	lookups := make(map[string]int)
+	resolver := newClientHostResolver(time.Second)
+	resolver.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		lookupsLock.Lock()
+		defer lookupsLock.Unlock()
+		lookups[addr]++
+		if addr == "10.0.0.5" {
+			return []string{"consumer-1.example.com."}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	now := time.Now()
+	// The address is returned until the lookup has completed
+	if host := resolver.Resolve("10.0.0.5", now); host != "10.0.0.5" {
+		t.Errorf("Expected the address before the lookup has completed, got: %v", host)
+	}
+	resolver.Resolve("10.0.0.6", now)
+	resolver.lookups.Wait()
+
+	tables := []struct {
+		addr string
+		host string
+	}{
+		{"10.0.0.5", "consumer-1.example.com"},
+		{"10.0.0.6", "10.0.0.6"},
+		{"consumer-2.example.com", "consumer-2.example.com"},
+	}
+	for _, table := range tables {
+		if host := resolver.Resolve(table.addr, now); host != table.host {
+			t.Errorf("Resolved host of %v was incorrect, got: %v, want: %v", table.addr, host, table.host)
+		}
+	}
+	resolver.lookups.Wait()
+	if lookups["10.0.0.5"] != 1 || lookups["10.0.0.6"] != 1 || len(lookups) != 2 {
+		t.Errorf("Expected positive and negative results to be cached, got lookups: %v", lookups)
+	}
+
+	// Expired entries are looked up again, while the previous result is still returned
+	later := now.Add(2 * clientHostCacheTTL)
+	if host := resolver.Resolve("10.0.0.5", later); host != "consumer-1.example.com" {
+		t.Errorf("Expected the previous hostname while the lookup is pending, got: %v", host)
+	}
+	resolver.lookups.Wait()
+	if lookups["10.0.0.5"] != 2 {
+		t.Errorf("Expected an expired entry to be looked up again, got lookups: %v", lookups["10.0.0.5"])
+	}
+
+	// Entries which haven't been used within the TTL are evicted
+	resolver.lock.Lock()
+	_, isCached := resolver.cache["10.0.0.6"]
+	cacheSize := len(resolver.cache)
+	resolver.lock.Unlock()
+	if isCached || cacheSize != 1 {
+		t.Errorf("Expected the unused entry to be evicted, got %v cached entries", cacheSize)
+	}
+}
+
+func TestClientHostResolverBoundsConcurrentLookups(t *testing.T) {
+	var lookupsLock sync.Mutex
+	running, maxRunning := 0, 0
+	release := make(chan struct{})
+	resolver := newClientHostResolver(time.Second)
+	resolver.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		lookupsLock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lookupsLock.Unlock()
+		<-release
+		lookupsLock.Lock()
+		running--
+		lookupsLock.Unlock()
+		return []string{"consumer.example.com."}, nil
+	}
+
+	// A rebalance brings many new client addresses at once
+	now := time.Now()
+	addrs := make([]string, 3*maxConcurrentLookups)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("10.0.1.%d", i)
+		resolver.Resolve(addrs[i], now)
+	}
+	close(release)
+	resolver.lookups.Wait()
+	if maxRunning > maxConcurrentLookups {
+		t.Errorf("Expected at most %v concurrent lookups, Got: %v", maxConcurrentLookups, maxRunning)
+	}
+
+	// The addresses which didn't get a lookup slot are looked up on the next scrapes
+	for scrape := 0; scrape < 3; scrape++ {
+		for _, addr := range addrs {
+			resolver.Resolve(addr, now)
+		}
+		resolver.lookups.Wait()
+	}
+	for _, addr := range addrs {
+		if host := resolver.Resolve(addr, now); host != "consumer.example.com" {
+			t.Errorf("Expected %v to be resolved eventually, Got: %v", addr, host)
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package collector
 
 import (
+	"fmt"
+	"github.com/google-cloud-tools/kafka-minion/kafka"
 	"github.com/google-cloud-tools/kafka-minion/options"
 	"github.com/google-cloud-tools/kafka-minion/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"math"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -14,7 +21,21 @@ var (
 	groupPartitionCommitCountDesc *prometheus.Desc
 	groupPartitionLastCommitDesc  *prometheus.Desc
 	groupPartitionLagDesc         *prometheus.Desc
+	groupPartitionLagSecondsDesc  *prometheus.Desc
 	groupTopicLagDesc             *prometheus.Desc
+	groupMembersDesc              *prometheus.Desc
+	groupInfoDesc                 *prometheus.Desc
+	groupGenerationDesc           *prometheus.Desc
+	groupStalledDesc              *prometheus.Desc
+	groupPartitionOwnerDesc       *prometheus.Desc
+	groupMemberUserDataDesc       *prometheus.Desc
+	groupPartitionEpochBehindDesc *prometheus.Desc
+	groupPartitionBelowStartDesc  *prometheus.Desc
+	groupPartitionOffsetStaleDesc *prometheus.Desc
+	groupPartitionCommitTimeDesc  *prometheus.Desc
+	groupCappedLagDesc            *prometheus.Desc
+	groupRebalancingDesc          *prometheus.Desc
+	groupAssignmentImbalanceDesc  *prometheus.Desc
 
 	// Topic metrics
 	partitionCountDesc *prometheus.Desc
@@ -23,18 +44,50 @@ var (
 	partitionLowWaterMarkDesc  *prometheus.Desc
 	partitionHighWaterMarkDesc *prometheus.Desc
 	partitionMessageCountDesc  *prometheus.Desc
+
+	// Exporter metrics
+	readyDesc           *prometheus.Desc
+	groupsTotalDesc     *prometheus.Desc
+	topicsTotalDesc     *prometheus.Desc
+	partitionsTotalDesc *prometheus.Desc
 )
 
 // Collector collects and provides all Kafka metrics on each /metrics invocation, see:
 // https://godoc.org/github.com/prometheus/client_golang/prometheus#hdr-Custom_Collectors_and_constant_Metrics
 type Collector struct {
 	opts    *options.Options
+	filter  *kafka.Filter
 	storage *storage.MemoryStorage
 	logger  *log.Entry
+
+	// clientHosts resolves the client hosts of group members, it's nil if client hosts are not resolved
+	clientHosts *clientHostResolver
+
+	// Metrics about the collector itself, which are exposed along with the collected metrics
+	lastCollect            prometheus.Gauge
+	collectDuration        prometheus.Histogram
+	collectErrors          prometheus.Counter
+	groupCardinalityCapped *prometheus.CounterVec
+
+	// cappedGroups contains the groups which have been capped in the last full collection, so that their capped
+	// counter series can be deleted once they are not capped anymore
+	cappedGroupsLock sync.Mutex
+	cappedGroups     map[string]bool
+
+	// rebalances tracks the generation of each group and when it has last been seen rebalancing, so that groups
+	// are still reported as rebalancing for a while after the rebalance has completed
+	rebalancesLock sync.Mutex
+	rebalances     map[string]groupRebalance
+}
+
+// groupRebalance is the last known generation of a group and the time it has last been seen rebalancing
+type groupRebalance struct {
+	Generation int32
+	SeenAt     time.Time
 }
 
 // versionedConsumerGroup represents the information which one could interpret by looking at all consumer group names
-// For instance consumer group name "sample-group-1" has base name "sample-group-", version: 1 and is the latest as long
+// For instance consumer group name "sample-group-1" has base name "sample-group", version: 1 and is the latest as long
 // as there is no group with the same base name and a higher appending number than 1
 type versionedConsumerGroup struct {
 	BaseName string
@@ -45,7 +98,7 @@ type versionedConsumerGroup struct {
 
 // NewCollector returns a new prometheus collector, preinitialized with all the to be exposed metrics under respect
 // of the metrics prefix which can be passed via environment variables
-func NewCollector(opts *options.Options, storage *storage.MemoryStorage) *Collector {
+func NewCollector(opts *options.Options, filter *kafka.Filter, storage *storage.MemoryStorage) *Collector {
 	logger := log.WithFields(log.Fields{
 		"module": "collector",
 	})
@@ -66,16 +119,90 @@ func NewCollector(opts *options.Options, storage *storage.MemoryStorage) *Collec
 		"Timestamp when consumer group last committed an offset for a partition",
 		[]string{"group", "group_base_name", "group_is_latest", "group_version", "topic", "partition"}, prometheus.Labels{},
 	)
+	groupPartitionCommitTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group_topic_partition", "commit_timestamp_seconds"),
+		"Unix timestamp in seconds of the last commit of a consumer group for a partition",
+		[]string{"group", "topic", "partition"}, prometheus.Labels{},
+	)
 	groupPartitionLagDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(opts.MetricsPrefix, "group_topic_partition", "lag"),
 		"Number of messages the consumer group is behind for a partition",
 		[]string{"group", "group_base_name", "group_is_latest", "group_version", "topic", "partition"}, prometheus.Labels{},
 	)
+	groupPartitionLagSecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group_topic_partition", "lag_seconds"),
+		"Estimated age of the oldest message the consumer group hasn't consumed yet for a partition",
+		[]string{"group", "group_base_name", "group_is_latest", "group_version", "topic", "partition"}, prometheus.Labels{},
+	)
 	groupTopicLagDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(opts.MetricsPrefix, "group_topic", "lag"),
 		"Number of messages the consumer group is behind for a topic",
 		[]string{"group", "group_base_name", "group_is_latest", "group_version", "topic"}, prometheus.Labels{},
 	)
+	groupMembersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group", "members"),
+		"Number of members in a consumer group",
+		[]string{"group"}, prometheus.Labels{},
+	)
+	groupInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group", "info"),
+		"Protocol information about a consumer group, the value is always 1",
+		[]string{"group", "protocol_type", "protocol"}, prometheus.Labels{},
+	)
+	groupGenerationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group", "generation"),
+		"Latest generation of a consumer group, which is incremented by the coordinator after each rebalance",
+		[]string{"group"}, prometheus.Labels{},
+	)
+	groupStalledDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group", "stalled"),
+		"1 if a consumer group has no members, but a lag greater than zero, otherwise 0",
+		[]string{"group"}, prometheus.Labels{},
+	)
+	groupPartitionOwnerDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group_topic_partition", "owner"),
+		"Consumer group member which is assigned to a partition, the value is always 1",
+		[]string{"group", "topic", "partition", "client_id", "client_host"}, prometheus.Labels{},
+	)
+	groupMemberUserDataDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group_member", "userdata_bytes"),
+		"Size of the user data in the latest assignment of a consumer group member",
+		[]string{"group", "member"}, prometheus.Labels{},
+	)
+
+	groupPartitionEpochBehindDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group_topic_partition", "epoch_behind"),
+		"Number of leader epochs the last commit of a consumer group trails the latest leader epoch seen for a partition",
+		[]string{"group", "topic", "partition"}, prometheus.Labels{},
+	)
+
+	groupPartitionBelowStartDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group_topic_partition", "committed_below_start"),
+		"1 if the committed offset of a consumer group is below the partition's low water mark (log start offset), otherwise 0",
+		[]string{"group", "topic", "partition"}, prometheus.Labels{},
+	)
+
+	groupPartitionOffsetStaleDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group_topic_partition", "offset_stale"),
+		"1 if the last commit of a group for a partition is older than the stale commit threshold, otherwise 0",
+		[]string{"group", "topic", "partition"}, prometheus.Labels{},
+	)
+
+	groupCappedLagDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group", "capped_lag"),
+		"Sum of all partition lags of a consumer group whose partition series exceed the configured maximum",
+		[]string{"group"}, prometheus.Labels{},
+	)
+	groupRebalancingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group", "rebalancing"),
+		"1 if a consumer group is rebalancing or has been rebalancing within the rebalance hold duration, otherwise 0",
+		[]string{"group"}, prometheus.Labels{},
+	)
+	groupAssignmentImbalanceDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "group", "assignment_imbalance"),
+		"Max minus min number of partitions assigned to a member of a consumer group",
+		[]string{"group"}, prometheus.Labels{},
+	)
 
 	// Topic metrics
 	partitionCountDesc = prometheus.NewDesc(
@@ -85,10 +212,14 @@ func NewCollector(opts *options.Options, storage *storage.MemoryStorage) *Collec
 	)
 
 	// Partition metrics
+	highWaterMarkLabels := []string{"topic", "partition"}
+	if opts.MetricsIncludeRack {
+		highWaterMarkLabels = append(highWaterMarkLabels, "rack")
+	}
 	partitionHighWaterMarkDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(opts.MetricsPrefix, "topic_partition", "high_water_mark"),
 		"Highest known committed offset for this partition",
-		[]string{"topic", "partition"}, prometheus.Labels{},
+		highWaterMarkLabels, prometheus.Labels{},
 	)
 	partitionLowWaterMarkDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(opts.MetricsPrefix, "topic_partition", "low_water_mark"),
@@ -101,33 +232,205 @@ func NewCollector(opts *options.Options, storage *storage.MemoryStorage) *Collec
 		[]string{"topic", "partition"}, prometheus.Labels{},
 	)
 
+	// Exporter metrics
+	readyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "", "ready"),
+		"1 if the consumer offsets topic has been consumed and consumer group metrics are exposed, otherwise 0",
+		[]string{}, prometheus.Labels{},
+	)
+	groupsTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "", "groups_total"),
+		"Number of consumer groups in the storage (with committed offsets or group metadata)",
+		[]string{}, prometheus.Labels{},
+	)
+	topicsTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "", "topics_total"),
+		"Number of topics whose partition water marks are in the storage",
+		[]string{}, prometheus.Labels{},
+	)
+	partitionsTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.MetricsPrefix, "", "partitions_total"),
+		"Number of partitions whose water marks are in the storage",
+		[]string{}, prometheus.Labels{},
+	)
+
+	var clientHosts *clientHostResolver
+	if opts.MetricsResolveClientHost {
+		clientHosts = newClientHostResolver(opts.MetricsResolveTimeout)
+	}
+
 	return &Collector{
-		opts,
-		storage,
-		logger,
+		opts:        opts,
+		filter:      filter,
+		storage:     storage,
+		logger:      logger,
+		clientHosts: clientHosts,
+
+		lastCollect: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: prometheus.BuildFQName(opts.MetricsPrefix, "", "last_collect_timestamp_seconds"),
+			Help: "Unix timestamp of the last successful collection of all metrics",
+		}),
+		collectDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: prometheus.BuildFQName(opts.MetricsPrefix, "", "collect_duration_seconds"),
+			Help: "Time it took to collect all metrics",
+		}),
+		collectErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(opts.MetricsPrefix, "", "collect_errors_total"),
+			Help: "Number of collections which failed with a panic",
+		}),
+		groupCardinalityCapped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(opts.MetricsPrefix, "", "group_cardinality_capped_total"),
+			Help: "Number of collections in which the partition series of a consumer group have been collapsed",
+		}, []string{"group"}),
+		cappedGroups: make(map[string]bool),
+		rebalances:   make(map[string]groupRebalance),
 	}
 }
 
 // Describe sends a description of all to be exposed metric types to Prometheus
 func (e *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- groupPartitionOffsetDesc
+	ch <- groupPartitionCommitCountDesc
+	ch <- groupPartitionLastCommitDesc
+	ch <- groupPartitionCommitTimeDesc
+	ch <- groupPartitionLagDesc
+	ch <- groupPartitionLagSecondsDesc
+	ch <- groupTopicLagDesc
+	ch <- groupMembersDesc
+	ch <- groupInfoDesc
+	ch <- groupGenerationDesc
+	ch <- groupStalledDesc
+	ch <- groupPartitionOwnerDesc
+	ch <- groupMemberUserDataDesc
+	ch <- groupPartitionEpochBehindDesc
+	ch <- groupPartitionBelowStartDesc
+	ch <- groupPartitionOffsetStaleDesc
+	ch <- groupCappedLagDesc
+	ch <- groupRebalancingDesc
+	ch <- groupAssignmentImbalanceDesc
+
+	ch <- partitionCountDesc
+
+	ch <- partitionLowWaterMarkDesc
+	ch <- partitionHighWaterMarkDesc
+	ch <- partitionMessageCountDesc
+
+	ch <- readyDesc
+	ch <- groupsTotalDesc
+	ch <- topicsTotalDesc
+	ch <- partitionsTotalDesc
+
+	e.lastCollect.Describe(ch)
+	e.collectDuration.Describe(ch)
+	e.collectErrors.Describe(ch)
+	e.groupCardinalityCapped.Describe(ch)
 }
 
-// Collect is triggered by the Prometheus registry when the metrics endpoint has been invoked
+// Collect is triggered by the Prometheus registry when the metrics endpoint has been invoked. A panic while
+// collecting is recovered and counted, so that the other registered collectors can still be scraped.
 func (e *Collector) Collect(ch chan<- prometheus.Metric) {
-	log.Debug("Collector's collect has been invoked")
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			e.collectErrors.Inc()
+			e.logger.WithFields(log.Fields{
+				"error": fmt.Sprint(r),
+			}).Error("failed to collect metrics")
+		} else {
+			e.collectDuration.Observe(time.Since(start).Seconds())
+			e.lastCollect.Set(float64(time.Now().UnixNano()) / 1e9)
+		}
+		e.lastCollect.Collect(ch)
+		e.collectDuration.Collect(ch)
+		e.collectErrors.Collect(ch)
+		e.groupCardinalityCapped.Collect(ch)
+	}()
 
-	if e.storage.IsConsumed() == false {
-		log.Info("Offets topic has not yet been consumed until the end")
+	e.collect(ch)
+}
+
+// GroupCollector returns a collector which only exposes the ready gauge and the series of the consumer groups
+// matching the given pattern. Topic, partition and internal metrics are not exposed by the returned collector.
+func (e *Collector) GroupCollector(pattern *regexp.Regexp) prometheus.Collector {
+	return &groupCollector{collector: e, pattern: pattern}
+}
+
+// groupCollector exposes the consumer group series of a subset of all groups, see Collector.GroupCollector
+type groupCollector struct {
+	collector *Collector
+	pattern   *regexp.Regexp
+}
+
+// Describe sends all descriptors of the parent collector, the group collector only sends a subset of its series
+func (g *groupCollector) Describe(ch chan<- *prometheus.Desc) {
+	g.collector.Describe(ch)
+}
+
+// Collect is triggered by the Prometheus registry of a single request to the metrics endpoint. Like the parent
+// collector a panic while collecting is recovered and counted.
+func (g *groupCollector) Collect(ch chan<- prometheus.Metric) {
+	e := g.collector
+	defer func() {
+		if r := recover(); r != nil {
+			e.collectErrors.Inc()
+			e.logger.WithFields(log.Fields{
+				"error": fmt.Sprint(r),
+			}).Error("failed to collect filtered metrics")
+		}
+	}()
+
+	isConsumed := e.storage.IsConsumed()
+	ready := 0.0
+	if isConsumed {
+		ready = 1
+	}
+	ch <- prometheus.MustNewConstMetric(readyDesc, prometheus.GaugeValue, ready)
+	if !isConsumed {
 		return
 	}
 
-	consumerOffsets := e.storage.ConsumerOffsets()
+	partitionLowWaterMarks := e.storage.PartitionLowWaterMarks()
+	partitionHighWaterMarks := e.storage.PartitionHighWaterMarks()
+	consumerOffsets, groupMetadata := e.filterProtocolTypes(e.storage.Groups())
+	for key, offset := range consumerOffsets {
+		if !g.pattern.MatchString(offset.Group) {
+			delete(consumerOffsets, key)
+		}
+	}
+	for group := range groupMetadata {
+		if !g.pattern.MatchString(group) {
+			delete(groupMetadata, group)
+		}
+	}
+	e.collectGroups(ch, consumerOffsets, groupMetadata, partitionLowWaterMarks, partitionHighWaterMarks, false)
+}
+
+func (e *Collector) collect(ch chan<- prometheus.Metric) {
+	log.Debug("Collector's collect has been invoked")
+
 	partitionLowWaterMarks := e.storage.PartitionLowWaterMarks()
 	partitionHighWaterMarks := e.storage.PartitionHighWaterMarks()
 	topicConfigs := e.storage.TopicConfigs()
 
-	e.collectConsumerOffsets(ch, consumerOffsets, partitionLowWaterMarks, partitionHighWaterMarks)
+	// Topic and partition metrics don't depend on the offsets topic and can therefore always be exposed,
+	// consumer group metrics would be incomplete until the offsets topic has been consumed though.
+	isConsumed := e.storage.IsConsumed()
+	ready := 0.0
+	if isConsumed {
+		ready = 1
+	}
+	ch <- prometheus.MustNewConstMetric(readyDesc, prometheus.GaugeValue, ready)
+	// All series are built from this snapshot, so that a group which is deleted meanwhile is either exposed
+	// completely or not at all
+	consumerOffsets, groupMetadata := e.storage.Groups()
+	e.collectStorageSize(ch, consumerOffsets, groupMetadata, partitionHighWaterMarks)
+	if isConsumed {
+		consumerOffsets, groupMetadata = e.filterProtocolTypes(consumerOffsets, groupMetadata)
+		e.pruneRebalances(groupMetadata)
+		e.collectGroups(ch, consumerOffsets, groupMetadata, partitionLowWaterMarks, partitionHighWaterMarks, true)
+	} else {
+		log.Info("Offets topic has not yet been consumed until the end")
+	}
 
 	for _, config := range topicConfigs {
 		ch <- prometheus.MustNewConstMetric(
@@ -151,17 +454,7 @@ func (e *Collector) Collect(ch chan<- prometheus.Metric) {
 		}
 	}
 
-	for _, partitions := range partitionHighWaterMarks {
-		for _, partition := range partitions {
-			ch <- prometheus.MustNewConstMetric(
-				partitionHighWaterMarkDesc,
-				prometheus.GaugeValue,
-				float64(partition.WaterMark),
-				partition.TopicName,
-				strconv.Itoa(int(partition.PartitionID)),
-			)
-		}
-	}
+	e.collectHighWaterMarks(ch, partitionHighWaterMarks)
 
 	for _, partitions := range partitionHighWaterMarks {
 		for _, partition := range partitions {
@@ -180,6 +473,169 @@ func (e *Collector) Collect(ch chan<- prometheus.Metric) {
 	}
 }
 
+// collectGroups exposes all consumer group series of the given groups. Capped groups are only counted if countCapped
+// is true, so that filtered collections don't count the groups of a full collection again.
+func (e *Collector) collectGroups(ch chan<- prometheus.Metric, consumerOffsets map[string]storage.ConsumerPartitionOffsetMetric,
+	groupMetadata map[string]kafka.ConsumerGroupMetadata, lowWaterMarks map[string]storage.PartitionWaterMarks,
+	highWaterMarks map[string]storage.PartitionWaterMarks, countCapped bool) {
+	partitionOffsets, cappedOffsets := e.capGroupPartitions(consumerOffsets, countCapped)
+	e.collectConsumerOffsets(ch, partitionOffsets, lowWaterMarks, highWaterMarks)
+	e.collectCappedGroups(ch, cappedOffsets, lowWaterMarks, highWaterMarks)
+	e.collectLeaderEpochs(ch, partitionOffsets)
+	e.collectLagSeconds(ch, partitionOffsets, highWaterMarks, time.Now())
+	e.collectStaleCommits(ch, partitionOffsets, time.Now())
+	e.collectGroupMetadata(ch, groupMetadata, cappedOffsets)
+	e.collectRebalancingGroups(ch, groupMetadata, time.Now())
+	e.collectStalledGroups(ch, consumerOffsets, groupMetadata, lowWaterMarks, highWaterMarks)
+}
+
+// collectHighWaterMarks exposes the high water mark of each partition, along with the rack of the partition leader
+// if enabled
+func (e *Collector) collectHighWaterMarks(ch chan<- prometheus.Metric, highWaterMarks map[string]storage.PartitionWaterMarks) {
+	for _, partitions := range highWaterMarks {
+		for _, partition := range partitions {
+			labelValues := []string{partition.TopicName, strconv.Itoa(int(partition.PartitionID))}
+			if e.opts.MetricsIncludeRack {
+				labelValues = append(labelValues, partition.LeaderRack)
+			}
+			ch <- prometheus.MustNewConstMetric(
+				partitionHighWaterMarkDesc,
+				prometheus.GaugeValue,
+				float64(partition.WaterMark),
+				labelValues...,
+			)
+		}
+	}
+}
+
+// capGroupPartitions splits the offsets into those of groups within the configured maximum number of partitions and
+// those of groups exceeding it. The partition series of the latter are collapsed into one aggregate per group, so
+// that a single group consuming thousands of partitions can't explode the cardinality. If countCapped is true, each
+// capped group is counted in the group cardinality capped counter.
+func (e *Collector) capGroupPartitions(offsets map[string]storage.ConsumerPartitionOffsetMetric, countCapped bool) (map[string]storage.ConsumerPartitionOffsetMetric,
+	map[string]storage.ConsumerPartitionOffsetMetric) {
+	maxPartitions := e.opts.MetricsMaxPartitionsPerGroup
+	if maxPartitions <= 0 {
+		return offsets, nil
+	}
+	if countCapped {
+		e.cappedGroupsLock.Lock()
+		defer e.cappedGroupsLock.Unlock()
+	}
+
+	partitionCountByGroup := make(map[string]int)
+	for _, offset := range offsets {
+		partitionCountByGroup[offset.Group]++
+	}
+
+	partitionOffsets := make(map[string]storage.ConsumerPartitionOffsetMetric)
+	cappedOffsets := make(map[string]storage.ConsumerPartitionOffsetMetric)
+	for key, offset := range offsets {
+		if partitionCountByGroup[offset.Group] > maxPartitions {
+			cappedOffsets[key] = offset
+		} else {
+			partitionOffsets[key] = offset
+		}
+	}
+	if !countCapped {
+		return partitionOffsets, cappedOffsets
+	}
+
+	cappedGroups := make(map[string]bool)
+	for group, partitionCount := range partitionCountByGroup {
+		if partitionCount > maxPartitions {
+			cappedGroups[group] = true
+			e.groupCardinalityCapped.WithLabelValues(group).Inc()
+			e.logger.WithFields(log.Fields{
+				"group":          group,
+				"partitions":     partitionCount,
+				"max_partitions": maxPartitions,
+			}).Debug("collapsing partition series of consumer group")
+		}
+	}
+	// Groups which have been deleted or dropped below the cap are not counted anymore
+	for group := range e.cappedGroups {
+		if !cappedGroups[group] {
+			e.groupCardinalityCapped.DeleteLabelValues(group)
+		}
+	}
+	e.cappedGroups = cappedGroups
+
+	return partitionOffsets, cappedOffsets
+}
+
+// collectCappedGroups exposes the summed up lag of each group whose partition series have been capped. Partitions
+// with a missing water mark are left out.
+func (e *Collector) collectCappedGroups(ch chan<- prometheus.Metric, cappedOffsets map[string]storage.ConsumerPartitionOffsetMetric,
+	lowWaterMarks map[string]storage.PartitionWaterMarks, highWaterMarks map[string]storage.PartitionWaterMarks) {
+	lagByGroup := make(map[string]int64)
+	for _, offset := range cappedOffsets {
+		if _, exists := lagByGroup[offset.Group]; !exists {
+			lagByGroup[offset.Group] = 0
+		}
+		lowWaterMark, lowExists := lowWaterMarks[offset.Topic][offset.Partition]
+		highWaterMark, highExists := highWaterMarks[offset.Topic][offset.Partition]
+		if !lowExists || !highExists {
+			continue
+		}
+		lagByGroup[offset.Group] += CalculateLag(offset.Offset, lowWaterMark.WaterMark, highWaterMark.WaterMark)
+	}
+
+	for group, lag := range lagByGroup {
+		ch <- prometheus.MustNewConstMetric(
+			groupCappedLagDesc,
+			prometheus.GaugeValue,
+			float64(lag),
+			group,
+		)
+	}
+}
+
+// collectStorageSize reports the number of groups, topics and partitions in the storage, regardless of whether
+// they are exposed. It helps to size kafka minion and to detect a fast growing number of groups.
+func (e *Collector) collectStorageSize(ch chan<- prometheus.Metric, offsets map[string]storage.ConsumerPartitionOffsetMetric,
+	metadataByGroup map[string]kafka.ConsumerGroupMetadata, highWaterMarks map[string]storage.PartitionWaterMarks) {
+	groups := make(map[string]bool, len(metadataByGroup))
+	for group := range metadataByGroup {
+		groups[group] = true
+	}
+	for _, offset := range offsets {
+		groups[offset.Group] = true
+	}
+	partitionCount := 0
+	for _, partitions := range highWaterMarks {
+		partitionCount += len(partitions)
+	}
+
+	ch <- prometheus.MustNewConstMetric(groupsTotalDesc, prometheus.GaugeValue, float64(len(groups)))
+	ch <- prometheus.MustNewConstMetric(topicsTotalDesc, prometheus.GaugeValue, float64(len(highWaterMarks)))
+	ch <- prometheus.MustNewConstMetric(partitionsTotalDesc, prometheus.GaugeValue, float64(partitionCount))
+}
+
+// filterProtocolTypes removes the offsets and metadata of all groups whose protocol type is not allowed. The protocol
+// type is only part of the group metadata, hence groups without metadata (e. g. consumers which assign partitions
+// manually) are kept.
+func (e *Collector) filterProtocolTypes(offsets map[string]storage.ConsumerPartitionOffsetMetric,
+	metadataByGroup map[string]kafka.ConsumerGroupMetadata) (map[string]storage.ConsumerPartitionOffsetMetric, map[string]kafka.ConsumerGroupMetadata) {
+	deniedGroups := make(map[string]bool)
+	for group, metadata := range metadataByGroup {
+		if !e.filter.IsProtocolTypeAllowed(metadata.Header.ProtocolType) {
+			deniedGroups[group] = true
+			delete(metadataByGroup, group)
+		}
+	}
+	if len(deniedGroups) == 0 {
+		return offsets, metadataByGroup
+	}
+
+	for key, offset := range offsets {
+		if deniedGroups[offset.Group] {
+			delete(offsets, key)
+		}
+	}
+	return offsets, metadataByGroup
+}
+
 type groupLag struct {
 	versionedGroup *versionedConsumerGroup
 	lagByTopic     map[string]int64
@@ -233,6 +689,14 @@ func (e *Collector) collectConsumerOffsets(ch chan<- prometheus.Metric, offsets
 			offset.Topic,
 			strconv.Itoa(int(offset.Partition)),
 		)
+		ch <- prometheus.MustNewConstMetric(
+			groupPartitionCommitTimeDesc,
+			prometheus.GaugeValue,
+			float64(offset.Timestamp)/1000,
+			offset.Group,
+			offset.Topic,
+			strconv.Itoa(int(offset.Partition)),
+		)
 
 		if _, exists := lowWaterMarks[offset.Topic][offset.Partition]; !exists {
 			errorTopics[offset.Topic] = true
@@ -243,6 +707,21 @@ func (e *Collector) collectConsumerOffsets(ch chan<- prometheus.Metric, offsets
 			continue
 		}
 		partitionLowWaterMark := lowWaterMarks[offset.Topic][offset.Partition].WaterMark
+
+		// The committed offset has been deleted by the retention, the group will be reset once it restarts
+		belowStart := 0.0
+		if offset.Offset < partitionLowWaterMark {
+			belowStart = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			groupPartitionBelowStartDesc,
+			prometheus.GaugeValue,
+			belowStart,
+			offset.Group,
+			offset.Topic,
+			strconv.Itoa(int(offset.Partition)),
+		)
+
 		if _, exists := highWaterMarks[offset.Topic][offset.Partition]; !exists {
 			errorTopics[offset.Topic] = true
 			e.logger.WithFields(log.Fields{
@@ -253,17 +732,7 @@ func (e *Collector) collectConsumerOffsets(ch chan<- prometheus.Metric, offsets
 		}
 		partitionHighWaterMark := highWaterMarks[offset.Topic][offset.Partition].WaterMark
 
-		var lag int64
-		if offset.Offset > partitionHighWaterMark {
-			// Partition offsets are updated periodically, while consumer offsets continuously flow in. Hence it's possible
-			// that consumer offset might be ahead of the partition high watermark. For this case mark it as zero lag
-			lag = 0
-		} else if offset.Offset < partitionLowWaterMark {
-			// If last committed offset does not exist anymore due to delete policy (e. g. 1day retention, 3day old commit)
-			lag = partitionHighWaterMark - partitionLowWaterMark
-		} else {
-			lag = partitionHighWaterMark - offset.Offset
-		}
+		lag := CalculateLag(offset.Offset, partitionLowWaterMark, partitionHighWaterMark)
 
 		// Add partition lag to group:topic lag aggregation
 		if _, exists := groupLagsByGroupName[offset.Group]; !exists {
@@ -274,6 +743,16 @@ func (e *Collector) collectConsumerOffsets(ch chan<- prometheus.Metric, offsets
 		}
 		groupLagsByGroupName[offset.Group].lagByTopic[offset.Topic] += lag
 
+		// A committed offset ahead of the high water mark is clamped to zero lag by default. The group topic lag is
+		// always based on the clamped lag, so that it isn't reduced by partitions whose high water mark is stale.
+		if offset.Offset > partitionHighWaterMark {
+			switch e.opts.LagOnNegative {
+			case "raw":
+				lag = partitionHighWaterMark - offset.Offset
+			case "skip":
+				continue
+			}
+		}
 		ch <- prometheus.MustNewConstMetric(
 			groupPartitionLagDesc,
 			prometheus.GaugeValue,
@@ -311,6 +790,267 @@ func (e *Collector) collectConsumerOffsets(ch chan<- prometheus.Metric, offsets
 	}
 }
 
+// collectLagSeconds exposes the time based lag. Record timestamps are not fetched, instead the storage estimates
+// when the next message to consume has been produced by using the history of polled high water marks. Hence the
+// accuracy is limited by the water mark interval and the lag is only a lower bound if the consumer group is behind
+// all remembered high water marks. Partitions without lag always have a time based lag of 0.
+func (e *Collector) collectLagSeconds(ch chan<- prometheus.Metric, offsets map[string]storage.ConsumerPartitionOffsetMetric,
+	highWaterMarks map[string]storage.PartitionWaterMarks, now time.Time) {
+	consumerGroups := getVersionedConsumerGroups(offsets)
+
+	for _, offset := range offsets {
+		highWaterMark, exists := highWaterMarks[offset.Topic][offset.Partition]
+		if !exists {
+			continue
+		}
+
+		lagSeconds := 0.0
+		if offset.Offset < highWaterMark.WaterMark {
+			produceTime := e.storage.OffsetProduceTime(offset.Topic, offset.Partition, offset.Offset)
+			if produceTime.IsZero() {
+				continue
+			}
+			lagSeconds = math.Max(now.Sub(produceTime).Seconds(), 0)
+		}
+
+		group := consumerGroups[offset.Group]
+		ch <- prometheus.MustNewConstMetric(
+			groupPartitionLagSecondsDesc,
+			prometheus.GaugeValue,
+			lagSeconds,
+			offset.Group,
+			group.BaseName,
+			strconv.FormatBool(group.IsLatest),
+			strconv.Itoa(int(group.Version)),
+			offset.Topic,
+			strconv.Itoa(int(offset.Partition)),
+		)
+	}
+}
+
+// collectLeaderEpochs exposes how many leader epochs each commit trails. The partition metadata which is requested
+// by the cluster module doesn't contain leader epochs, hence the latest epoch of a partition is the highest epoch
+// which has been committed by any consumer group. Commits without a leader epoch are skipped.
+func (e *Collector) collectLeaderEpochs(ch chan<- prometheus.Metric, offsets map[string]storage.ConsumerPartitionOffsetMetric) {
+	latestEpochs := make(map[string]map[int32]int32)
+	for _, offset := range offsets {
+		if offset.LeaderEpoch < 0 {
+			continue
+		}
+		if _, exists := latestEpochs[offset.Topic]; !exists {
+			latestEpochs[offset.Topic] = make(map[int32]int32)
+		}
+		if epoch, exists := latestEpochs[offset.Topic][offset.Partition]; !exists || offset.LeaderEpoch > epoch {
+			latestEpochs[offset.Topic][offset.Partition] = offset.LeaderEpoch
+		}
+	}
+
+	for _, offset := range offsets {
+		if offset.LeaderEpoch < 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			groupPartitionEpochBehindDesc,
+			prometheus.GaugeValue,
+			float64(latestEpochs[offset.Topic][offset.Partition]-offset.LeaderEpoch),
+			offset.Group,
+			offset.Topic,
+			strconv.Itoa(int(offset.Partition)),
+		)
+	}
+}
+
+// CalculateLag returns the number of messages a consumer group is behind for a partition
+func CalculateLag(committedOffset int64, lowWaterMark int64, highWaterMark int64) int64 {
+	if committedOffset > highWaterMark {
+		// Partition offsets are updated periodically, while consumer offsets continuously flow in. Hence it's possible
+		// that consumer offset might be ahead of the partition high watermark. For this case mark it as zero lag
+		return 0
+	} else if committedOffset < lowWaterMark {
+		// If last committed offset does not exist anymore due to delete policy (e. g. 1day retention, 3day old commit)
+		return highWaterMark - lowWaterMark
+	}
+
+	return highWaterMark - committedOffset
+}
+
+// collectStaleCommits reports commits which are older than the stale commit threshold. A consumer which is alive but
+// stuck doesn't commit anymore, while the lag might not grow yet (e. g. because there are only few new messages).
+func (e *Collector) collectStaleCommits(ch chan<- prometheus.Metric, offsets map[string]storage.ConsumerPartitionOffsetMetric, now time.Time) {
+	if e.opts.StaleCommitThreshold <= 0 {
+		return
+	}
+
+	for _, offset := range offsets {
+		stale := 0.0
+		commitTime := time.Unix(0, offset.Timestamp*int64(time.Millisecond))
+		if now.Sub(commitTime) > e.opts.StaleCommitThreshold {
+			stale = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			groupPartitionOffsetStaleDesc,
+			prometheus.GaugeValue,
+			stale,
+			offset.Group,
+			offset.Topic,
+			strconv.Itoa(int(offset.Partition)),
+		)
+	}
+}
+
+func (e *Collector) collectGroupMetadata(ch chan<- prometheus.Metric, metadataByGroup map[string]kafka.ConsumerGroupMetadata,
+	cappedOffsets map[string]storage.ConsumerPartitionOffsetMetric) {
+	cappedGroups := make(map[string]bool)
+	for _, offset := range cappedOffsets {
+		cappedGroups[offset.Group] = true
+	}
+
+	for _, metadata := range metadataByGroup {
+		ch <- prometheus.MustNewConstMetric(
+			groupMembersDesc,
+			prometheus.GaugeValue,
+			float64(len(metadata.Members)),
+			metadata.Group,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			groupInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			metadata.Group,
+			metadata.Header.ProtocolType,
+			metadata.Header.Protocol,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			groupGenerationDesc,
+			prometheus.GaugeValue,
+			float64(metadata.Header.Generation),
+			metadata.Group,
+		)
+		if imbalance, isAssigned := metadata.AssignmentImbalance(); isAssigned {
+			ch <- prometheus.MustNewConstMetric(
+				groupAssignmentImbalanceDesc,
+				prometheus.GaugeValue,
+				float64(imbalance),
+				metadata.Group,
+			)
+		}
+
+		for _, member := range metadata.Members {
+			ch <- prometheus.MustNewConstMetric(
+				groupMemberUserDataDesc,
+				prometheus.GaugeValue,
+				float64(member.AssignmentUserDataBytes),
+				metadata.Group,
+				member.MemberID,
+			)
+		}
+
+		// Each metadata message contains the complete assignment of a group generation and replaces the previous one
+		if cappedGroups[metadata.Group] {
+			continue
+		}
+		for _, member := range metadata.Members {
+			clientHost := e.clientHost(member.ClientHost)
+			for topic, partitions := range member.Assignment {
+				for _, partition := range partitions {
+					ch <- prometheus.MustNewConstMetric(
+						groupPartitionOwnerDesc,
+						prometheus.GaugeValue,
+						1,
+						metadata.Group,
+						topic,
+						strconv.Itoa(int(partition)),
+						member.ClientID,
+						clientHost,
+					)
+				}
+			}
+		}
+	}
+}
+
+// clientHost returns the normalized client host of a group member, which is resolved to a hostname if enabled
+func (e *Collector) clientHost(clientHost string) string {
+	host := normalizeClientHost(clientHost)
+	if e.clientHosts == nil {
+		return host
+	}
+
+	return e.clientHosts.Resolve(host, time.Now())
+}
+
+// collectRebalancingGroups reports groups which are rebalancing, so that lag alerts can be suppressed meanwhile. A
+// group is considered rebalancing if its metadata looks like it has been written in the middle of a rebalance (see
+// ConsumerGroupMetadata.IsRebalancing) or if its generation has changed since the last collection. It's reported
+// until neither has been the case for the rebalance hold duration, so that it doesn't flap while the group rebalances.
+func (e *Collector) collectRebalancingGroups(ch chan<- prometheus.Metric, metadataByGroup map[string]kafka.ConsumerGroupMetadata, now time.Time) {
+	e.rebalancesLock.Lock()
+	defer e.rebalancesLock.Unlock()
+
+	for _, metadata := range metadataByGroup {
+		rebalance, known := e.rebalances[metadata.Group]
+		// The first generation which is seen is not a rebalance, it might have been completed long ago
+		if metadata.IsRebalancing() || (known && metadata.Header.Generation != rebalance.Generation) {
+			rebalance.SeenAt = now
+		}
+		rebalance.Generation = metadata.Header.Generation
+		e.rebalances[metadata.Group] = rebalance
+
+		rebalancing := 0.0
+		if !rebalance.SeenAt.IsZero() && now.Sub(rebalance.SeenAt) <= e.opts.MetricsRebalanceHold {
+			rebalancing = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			groupRebalancingDesc,
+			prometheus.GaugeValue,
+			rebalancing,
+			metadata.Group,
+		)
+	}
+}
+
+// pruneRebalances forgets the rebalances of all groups which don't exist anymore. It must be called with all groups,
+// rather than the groups of a filtered collection.
+func (e *Collector) pruneRebalances(metadataByGroup map[string]kafka.ConsumerGroupMetadata) {
+	e.rebalancesLock.Lock()
+	defer e.rebalancesLock.Unlock()
+
+	for group := range e.rebalances {
+		if _, exists := metadataByGroup[group]; !exists {
+			delete(e.rebalances, group)
+		}
+	}
+}
+
+// collectStalledGroups reports groups which have no members (nobody is consuming), but messages to consume. The
+// member count is only known from the group metadata, groups without metadata are therefore not reported.
+func (e *Collector) collectStalledGroups(ch chan<- prometheus.Metric, offsets map[string]storage.ConsumerPartitionOffsetMetric,
+	metadataByGroup map[string]kafka.ConsumerGroupMetadata, lowWaterMarks map[string]storage.PartitionWaterMarks,
+	highWaterMarks map[string]storage.PartitionWaterMarks) {
+	lagByGroup := make(map[string]int64)
+	for _, offset := range offsets {
+		lowWaterMark, lowExists := lowWaterMarks[offset.Topic][offset.Partition]
+		highWaterMark, highExists := highWaterMarks[offset.Topic][offset.Partition]
+		if !lowExists || !highExists {
+			continue
+		}
+		lagByGroup[offset.Group] += CalculateLag(offset.Offset, lowWaterMark.WaterMark, highWaterMark.WaterMark)
+	}
+
+	for group, metadata := range metadataByGroup {
+		stalled := 0.0
+		if len(metadata.Members) == 0 && lagByGroup[group] > 0 {
+			stalled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			groupStalledDesc,
+			prometheus.GaugeValue,
+			stalled,
+			group,
+		)
+	}
+}
+
 func getVersionedConsumerGroups(offsets map[string]storage.ConsumerPartitionOffsetMetric) map[string]*versionedConsumerGroup {
 	// This map contains all known consumer groups. Key is the full group name
 	groupsByName := make(map[string]*versionedConsumerGroup)
@@ -342,8 +1082,13 @@ func getVersionedConsumerGroups(offsets map[string]storage.ConsumerPartitionOffs
 // parseConsumerGroupName returns the "base name" of a consumer group and it's version
 // Given the name "sample-group-01" the base name would be "sample-group" and the version is "1"
 // If there's no appending number it's being considered as version 0
+// Separators ("-", "_" or ".") in front of the appending number are not part of the base name, so that "sample-group"
+// and "sample-group-1" share the same base name
 func parseConsumerGroupName(consumerGroupName string) *versionedConsumerGroup {
 	parsedVersion, baseName := parseVersion(consumerGroupName, "", len(consumerGroupName)-1)
+	if len(baseName) < len(consumerGroupName) {
+		baseName = strings.TrimRight(baseName, "-_.")
+	}
 	return &versionedConsumerGroup{BaseName: baseName, Name: consumerGroupName, Version: uint32(parsedVersion), IsLatest: false}
 }
 
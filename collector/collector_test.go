@@ -1,8 +1,18 @@
 package collector
 
 import (
+	"context"
+	"fmt"
+	"github.com/google-cloud-tools/kafka-minion/kafka"
+	"github.com/google-cloud-tools/kafka-minion/options"
 	"github.com/google-cloud-tools/kafka-minion/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetVersionedConsumerGroups(t *testing.T) {
@@ -56,12 +66,12 @@ func TestGetVersionedConsumerGroups(t *testing.T) {
 		baseName     string
 		isLatest     bool
 	}{
-		{"sample-group-1", 1, "sample-group-", false},
-		{"sample-group-2", 2, "sample-group-", false},
-		{"sample-group-3", 3, "sample-group-", true},
+		{"sample-group-1", 1, "sample-group", false},
+		{"sample-group-2", 2, "sample-group", false},
+		{"sample-group-3", 3, "sample-group", true},
 		{"another-group-v1", 1, "another-group-v", false},
 		{"another-group-v3", 3, "another-group-v", true},
-		{"console-consumer-40098", 40098, "console-consumer-", true},
+		{"console-consumer-40098", 40098, "console-consumer", true},
 	}
 
 	versionedGroups := getVersionedConsumerGroups(offsets)
@@ -92,6 +102,8 @@ func TestParseConsumerGroupName(t *testing.T) {
 		{"sample-group-2", 2, "sample-group", false},
 		{"sample-group-3", 3, "sample-group", false},
 		{"another-group", 0, "another-group", false},
+		{"another_group_4", 4, "another_group", false},
+		{"another-group-v3", 3, "another-group-v", false},
 	}
 	for _, table := range tables {
 		versioned := parseConsumerGroupName(table.groupName)
@@ -109,3 +121,674 @@ func TestParseConsumerGroupName(t *testing.T) {
 		}
 	}
 }
+
+func TestCalculateLag(t *testing.T) {
+	tables := []struct {
+		committedOffset int64
+		lowWaterMark    int64
+		highWaterMark   int64
+		lag             int64
+	}{
+		{1156, 0, 1200, 44},
+		{1200, 0, 1200, 0},
+		{1210, 0, 1200, 0},
+		{100, 500, 1200, 700},
+	}
+	for _, table := range tables {
+		lag := CalculateLag(table.committedOffset, table.lowWaterMark, table.highWaterMark)
+		if lag != table.lag {
+			t.Errorf("Lag for offset %v (low: %v, high: %v) was incorrect, got: %v, want: %v",
+				table.committedOffset, table.lowWaterMark, table.highWaterMark, lag, table.lag)
+		}
+	}
+}
+
+func TestCollectLagOnNegative(t *testing.T) {
+	offsets := map[string]storage.ConsumerPartitionOffsetMetric{
+		"sample-group:important-topic:0": {Group: "sample-group", Topic: "important-topic", Partition: 0, Offset: 100},
+		"sample-group:important-topic:1": {Group: "sample-group", Topic: "important-topic", Partition: 1, Offset: 320},
+	}
+	lowWaterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {0: {WaterMark: 0}, 1: {WaterMark: 0}},
+	}
+	highWaterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {0: {WaterMark: 150}, 1: {WaterMark: 300}},
+	}
+
+	tables := []struct {
+		lagOnNegative string
+		partitionLags map[string]float64
+	}{
+		{"clamp", map[string]float64{"sample-group,sample-group,true,0,0,important-topic": 50, "sample-group,sample-group,true,0,1,important-topic": 0}},
+		{"raw", map[string]float64{"sample-group,sample-group,true,0,0,important-topic": 50, "sample-group,sample-group,true,0,1,important-topic": -20}},
+		{"skip", map[string]float64{"sample-group,sample-group,true,0,0,important-topic": 50}},
+	}
+	for _, table := range tables {
+		opts := options.NewOptions()
+		opts.MetricsPrefix = "kafka_minion"
+		opts.LagOnNegative = table.lagOnNegative
+		c := NewCollector(opts, &kafka.Filter{}, nil)
+
+		collect := func(desc *prometheus.Desc) map[string]float64 {
+			ch := make(chan prometheus.Metric, 100)
+			c.collectConsumerOffsets(ch, offsets, lowWaterMarks, highWaterMarks)
+			close(ch)
+			return collectGaugeValues(t, ch, desc)
+		}
+
+		partitionLags := collect(groupPartitionLagDesc)
+		if !reflect.DeepEqual(partitionLags, table.partitionLags) {
+			t.Errorf("Partition lags with %v were incorrect, got: %v, want: %v", table.lagOnNegative, partitionLags, table.partitionLags)
+		}
+		// The group topic lag is always based on the clamped partition lags
+		topicLags := collect(groupTopicLagDesc)
+		if lag := topicLags["sample-group,sample-group,true,0,important-topic"]; lag != 50 {
+			t.Errorf("Group topic lag with %v was incorrect, got: %v, want: %v", table.lagOnNegative, lag, 50)
+		}
+	}
+}
+
+// collectGaugeValues returns all gauge values of the given descriptor which have been sent to the channel,
+// keyed by their concatenated label values.
+func collectGaugeValues(t *testing.T, ch chan prometheus.Metric, desc *prometheus.Desc) map[string]float64 {
+	values := make(map[string]float64)
+	for metric := range ch {
+		if metric.Desc() != desc {
+			continue
+		}
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			t.Fatalf("Failed to write metric: %v", err)
+		}
+		labels := make([]string, 0)
+		for _, label := range m.GetLabel() {
+			labels = append(labels, label.GetValue())
+		}
+		values[strings.Join(labels, ",")] = m.GetGauge().GetValue()
+	}
+	return values
+}
+
+func TestCollectGroupTopicLag(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+
+	offsets := map[string]storage.ConsumerPartitionOffsetMetric{
+		"sample-group:important-topic:0": {Group: "sample-group", Topic: "important-topic", Partition: 0, Offset: 100},
+		"sample-group:important-topic:1": {Group: "sample-group", Topic: "important-topic", Partition: 1, Offset: 250},
+		"sample-group:important-topic:2": {Group: "sample-group", Topic: "important-topic", Partition: 2, Offset: 320},
+		"sample-group:other-topic:0":     {Group: "sample-group", Topic: "other-topic", Partition: 0, Offset: 10},
+	}
+	lowWaterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {
+			0: {TopicName: "important-topic", PartitionID: 0, WaterMark: 0},
+			1: {TopicName: "important-topic", PartitionID: 1, WaterMark: 0},
+			2: {TopicName: "important-topic", PartitionID: 2, WaterMark: 0},
+			3: {TopicName: "important-topic", PartitionID: 3, WaterMark: 0},
+		},
+		"other-topic": {
+			0: {TopicName: "other-topic", PartitionID: 0, WaterMark: 0},
+		},
+	}
+	highWaterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {
+			0: {TopicName: "important-topic", PartitionID: 0, WaterMark: 150},
+			1: {TopicName: "important-topic", PartitionID: 1, WaterMark: 250},
+			2: {TopicName: "important-topic", PartitionID: 2, WaterMark: 300},
+			3: {TopicName: "important-topic", PartitionID: 3, WaterMark: 999},
+		},
+		"other-topic": {
+			0: {TopicName: "other-topic", PartitionID: 0, WaterMark: 17},
+		},
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.collectConsumerOffsets(ch, offsets, lowWaterMarks, highWaterMarks)
+	close(ch)
+	lags := collectGaugeValues(t, ch, groupTopicLagDesc)
+
+	// Partition 3 has no committed offset and must not be part of the sum, partition 2 is ahead of the
+	// high water mark and therefore accounts for zero lag: 50 + 0 + 0
+	tables := []struct {
+		labels string
+		lag    float64
+	}{
+		{"sample-group,sample-group,true,0,important-topic", 50},
+		{"sample-group,sample-group,true,0,other-topic", 7},
+	}
+	if len(lags) != len(tables) {
+		t.Errorf("Expected %v group topic lags, Got: %v", len(tables), lags)
+	}
+	for _, table := range tables {
+		if lag, exists := lags[table.labels]; !exists || lag != table.lag {
+			t.Errorf("Group topic lag for %v was incorrect, got: %v, want: %v", table.labels, lag, table.lag)
+		}
+	}
+}
+
+func TestCollectLeaderEpochs(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+
+	offsets := map[string]storage.ConsumerPartitionOffsetMetric{
+		"sample-group:important-topic:0": {Group: "sample-group", Topic: "important-topic", Partition: 0, LeaderEpoch: 7},
+		"stale-group:important-topic:0":  {Group: "stale-group", Topic: "important-topic", Partition: 0, LeaderEpoch: 5},
+		"sample-group:important-topic:1": {Group: "sample-group", Topic: "important-topic", Partition: 1, LeaderEpoch: 2},
+		"legacy-group:important-topic:0": {Group: "legacy-group", Topic: "important-topic", Partition: 0, LeaderEpoch: -1},
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.collectLeaderEpochs(ch, offsets)
+	close(ch)
+	epochsBehind := collectGaugeValues(t, ch, groupPartitionEpochBehindDesc)
+
+	// Label values are sorted by label name: group, partition, topic
+	tables := []struct {
+		labels string
+		behind float64
+	}{
+		{"sample-group,0,important-topic", 0},
+		{"stale-group,0,important-topic", 2},
+		{"sample-group,1,important-topic", 0},
+	}
+	if len(epochsBehind) != len(tables) {
+		t.Errorf("Expected %v epoch behind series, Got: %v", len(tables), epochsBehind)
+	}
+	for _, table := range tables {
+		if behind, exists := epochsBehind[table.labels]; !exists || behind != table.behind {
+			t.Errorf("Epochs behind for %v was incorrect, got: %v, want: %v", table.labels, behind, table.behind)
+		}
+	}
+}
+
+func TestCollectCommittedBelowStart(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+
+	offsets := map[string]storage.ConsumerPartitionOffsetMetric{
+		"sample-group:important-topic:0": {Group: "sample-group", Topic: "important-topic", Partition: 0, Offset: 99},
+		"sample-group:important-topic:1": {Group: "sample-group", Topic: "important-topic", Partition: 1, Offset: 100},
+		"sample-group:other-topic:0":     {Group: "sample-group", Topic: "other-topic", Partition: 0, Offset: 5},
+	}
+	waterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {
+			0: {TopicName: "important-topic", PartitionID: 0, WaterMark: 100},
+			1: {TopicName: "important-topic", PartitionID: 1, WaterMark: 100},
+		},
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.collectConsumerOffsets(ch, offsets, waterMarks, waterMarks)
+	close(ch)
+	belowStart := collectGaugeValues(t, ch, groupPartitionBelowStartDesc)
+
+	// Label values are sorted by label name: group, partition, topic. The low water mark of other-topic is unknown.
+	tables := []struct {
+		labels     string
+		belowStart float64
+	}{
+		{"sample-group,0,important-topic", 1},
+		{"sample-group,1,important-topic", 0},
+	}
+	if len(belowStart) != len(tables) {
+		t.Errorf("Expected %v committed below start series, Got: %v", len(tables), belowStart)
+	}
+	for _, table := range tables {
+		if value, exists := belowStart[table.labels]; !exists || value != table.belowStart {
+			t.Errorf("Committed below start for %v was incorrect, got: %v, want: %v", table.labels, value, table.belowStart)
+		}
+	}
+}
+
+func TestCollectCommitTimestamp(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+
+	offsets := map[string]storage.ConsumerPartitionOffsetMetric{
+		"sample-group:important-topic:0": {Group: "sample-group", Topic: "important-topic", Partition: 0, Timestamp: 1600000000500},
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.collectConsumerOffsets(ch, offsets, nil, nil)
+	close(ch)
+	timestamps := collectGaugeValues(t, ch, groupPartitionCommitTimeDesc)
+
+	// Label values are sorted by label name: group, partition, topic
+	if value, exists := timestamps["sample-group,0,important-topic"]; !exists || value != 1600000000.5 {
+		t.Errorf("Commit timestamp was incorrect, got: %v, want: %v", timestamps, 1600000000.5)
+	}
+}
+
+func TestCollectStaleCommits(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	opts.StaleCommitThreshold = 10 * time.Minute
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+
+	now := time.Unix(1600000000, 0)
+	millis := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+	offsets := map[string]storage.ConsumerPartitionOffsetMetric{
+		"sample-group:important-topic:0": {Group: "sample-group", Topic: "important-topic", Partition: 0, Timestamp: millis(now.Add(-11 * time.Minute))},
+		"sample-group:important-topic:1": {Group: "sample-group", Topic: "important-topic", Partition: 1, Timestamp: millis(now.Add(-9 * time.Minute))},
+		"sample-group:important-topic:2": {Group: "sample-group", Topic: "important-topic", Partition: 2, Timestamp: millis(now)},
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.collectStaleCommits(ch, offsets, now)
+	close(ch)
+	stale := collectGaugeValues(t, ch, groupPartitionOffsetStaleDesc)
+
+	// Label values are sorted by label name: group, partition, topic
+	tables := []struct {
+		labels string
+		stale  float64
+	}{
+		{"sample-group,0,important-topic", 1},
+		{"sample-group,1,important-topic", 0},
+		{"sample-group,2,important-topic", 0},
+	}
+	if len(stale) != len(tables) {
+		t.Errorf("Expected %v offset stale series, Got: %v", len(tables), stale)
+	}
+	for _, table := range tables {
+		if value, exists := stale[table.labels]; !exists || value != table.stale {
+			t.Errorf("Offset stale for %v was incorrect, got: %v, want: %v", table.labels, value, table.stale)
+		}
+	}
+
+	// A disabled threshold doesn't expose the metric at all
+	opts.StaleCommitThreshold = 0
+	ch = make(chan prometheus.Metric, 100)
+	c.collectStaleCommits(ch, offsets, now)
+	close(ch)
+	if len(ch) != 0 {
+		t.Errorf("Expected no offset stale series if the threshold is disabled, Got: %v", len(ch))
+	}
+}
+
+func TestFilterProtocolTypes(t *testing.T) {
+	opts := options.NewOptions()
+	opts.FilterProtocolTypes = []string{"consumer"}
+	filter, err := kafka.NewFilter(opts)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+	c := NewCollector(opts, filter, nil)
+
+	offsets := map[string]storage.ConsumerPartitionOffsetMetric{
+		"sample-group:important-topic:0":  {Group: "sample-group", Topic: "important-topic", Partition: 0},
+		"connect-sink:important-topic:0":  {Group: "connect-sink", Topic: "important-topic", Partition: 0},
+		"manual-assign:important-topic:0": {Group: "manual-assign", Topic: "important-topic", Partition: 0},
+	}
+	metadataByGroup := make(map[string]kafka.ConsumerGroupMetadata)
+	for group, protocolType := range map[string]string{"sample-group": "consumer", "connect-sink": "connect"} {
+		metadata := kafka.ConsumerGroupMetadata{Group: group}
+		metadata.Header.ProtocolType = protocolType
+		metadataByGroup[group] = metadata
+	}
+
+	offsets, metadataByGroup = c.filterProtocolTypes(offsets, metadataByGroup)
+	if _, exists := metadataByGroup["connect-sink"]; exists || len(metadataByGroup) != 1 {
+		t.Errorf("Expected only the metadata of sample-group to be kept, Got: %v", metadataByGroup)
+	}
+	// Groups without metadata have an unknown protocol type and are kept
+	if _, exists := offsets["connect-sink:important-topic:0"]; exists || len(offsets) != 2 {
+		t.Errorf("Expected offsets of sample-group and manual-assign to be kept, Got: %v", offsets)
+	}
+}
+
+func TestCollectRecoversPanics(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+
+	// Collecting without a storage panics
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	if errors := testutil.ToFloat64(c.collectErrors); errors != 1 {
+		t.Errorf("Expected 1 collect error, Got: %v", errors)
+	}
+	if len(ch) != 3 {
+		t.Errorf("Expected the collector's own metrics to be collected, Got: %v metrics", len(ch))
+	}
+
+	c = NewCollector(opts, &kafka.Filter{}, storage.NewMemoryStorage(opts, nil, nil))
+	ch = make(chan prometheus.Metric, 100)
+	before := time.Now()
+	c.Collect(ch)
+	if errors := testutil.ToFloat64(c.collectErrors); errors != 0 {
+		t.Errorf("Expected no collect errors, Got: %v", errors)
+	}
+	if last := testutil.ToFloat64(c.lastCollect); last < float64(before.Unix()) {
+		t.Errorf("Expected the last collect timestamp to be updated, Got: %v", last)
+	}
+}
+
+func TestCollectStalledGroups(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+
+	offsets := map[string]storage.ConsumerPartitionOffsetMetric{
+		"stalled-group:important-topic:0":   {Group: "stalled-group", Topic: "important-topic", Partition: 0, Offset: 50},
+		"active-group:important-topic:0":    {Group: "active-group", Topic: "important-topic", Partition: 0, Offset: 50},
+		"caught-up-group:important-topic:0": {Group: "caught-up-group", Topic: "important-topic", Partition: 0, Offset: 100},
+		"unknown-group:important-topic:0":   {Group: "unknown-group", Topic: "important-topic", Partition: 0, Offset: 50},
+	}
+	lowWaterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {0: {TopicName: "important-topic", PartitionID: 0, WaterMark: 0}},
+	}
+	highWaterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {0: {TopicName: "important-topic", PartitionID: 0, WaterMark: 100}},
+	}
+	metadataByGroup := map[string]kafka.ConsumerGroupMetadata{
+		"stalled-group":   {Group: "stalled-group"},
+		"active-group":    withMembers(kafka.ConsumerGroupMetadata{Group: "active-group"}, 2),
+		"caught-up-group": {Group: "caught-up-group"},
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.collectStalledGroups(ch, offsets, metadataByGroup, lowWaterMarks, highWaterMarks)
+	close(ch)
+	stalled := collectGaugeValues(t, ch, groupStalledDesc)
+
+	// There is no metadata (and therefore no member count) for unknown-group
+	expected := map[string]float64{"stalled-group": 1, "active-group": 0, "caught-up-group": 0}
+	if len(stalled) != len(expected) {
+		t.Errorf("Expected %v stalled series, Got: %v", len(expected), stalled)
+	}
+	for group, value := range expected {
+		if stalled[group] != value {
+			t.Errorf("Stalled for %v was incorrect, got: %v, want: %v", group, stalled[group], value)
+		}
+	}
+}
+
+func TestCollectRebalancingGroups(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	opts.MetricsRebalanceHold = 30 * time.Second
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+
+	metadata := func(group string, generation int32, protocol string) kafka.ConsumerGroupMetadata {
+		m := withMembers(kafka.ConsumerGroupMetadata{Group: group}, 2)
+		m.Header.Generation = generation
+		m.Header.Protocol = protocol
+		return m
+	}
+	start := time.Now()
+	tables := []struct {
+		now             time.Time
+		metadataByGroup map[string]kafka.ConsumerGroupMetadata
+		expected        map[string]float64
+	}{
+		// The first known generation of a group is not a rebalance, a group without protocol is rebalancing
+		{start, map[string]kafka.ConsumerGroupMetadata{
+			"stable-group":  metadata("stable-group", 1, "range"),
+			"joining-group": metadata("joining-group", 5, ""),
+			"bumped-group":  metadata("bumped-group", 3, "range"),
+		}, map[string]float64{"stable-group": 0, "joining-group": 1, "bumped-group": 0}},
+		// The joined group is still reported within the hold duration, the bumped generation is a rebalance
+		{start.Add(10 * time.Second), map[string]kafka.ConsumerGroupMetadata{
+			"stable-group":  metadata("stable-group", 1, "range"),
+			"joining-group": metadata("joining-group", 5, "range"),
+			"bumped-group":  metadata("bumped-group", 4, "range"),
+		}, map[string]float64{"stable-group": 0, "joining-group": 1, "bumped-group": 1}},
+		{start.Add(45 * time.Second), map[string]kafka.ConsumerGroupMetadata{
+			"stable-group":  metadata("stable-group", 1, "range"),
+			"joining-group": metadata("joining-group", 5, "range"),
+			"bumped-group":  metadata("bumped-group", 4, "range"),
+		}, map[string]float64{"stable-group": 0, "joining-group": 0, "bumped-group": 0}},
+	}
+
+	for i, table := range tables {
+		ch := make(chan prometheus.Metric, 100)
+		c.collectRebalancingGroups(ch, table.metadataByGroup, table.now)
+		close(ch)
+		rebalancing := collectGaugeValues(t, ch, groupRebalancingDesc)
+		if !reflect.DeepEqual(rebalancing, table.expected) {
+			t.Errorf("Rebalancing groups of collection %v were incorrect, got: %v, want: %v", i, rebalancing, table.expected)
+		}
+	}
+}
+
+// withMembers adds the given number of members without any assignment to the group metadata
+func withMembers(metadata kafka.ConsumerGroupMetadata, count int) kafka.ConsumerGroupMetadata {
+	for i := 0; i < count; i++ {
+		metadata.AddMember(fmt.Sprintf("member-%d", i), "client", nil)
+	}
+	return metadata
+}
+
+func TestCollectStorageSize(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+
+	offsets := map[string]storage.ConsumerPartitionOffsetMetric{
+		"sample-group:important-topic:0": {Group: "sample-group", Topic: "important-topic", Partition: 0, Offset: 100},
+		"sample-group:important-topic:1": {Group: "sample-group", Topic: "important-topic", Partition: 1, Offset: 250},
+		"other-group:important-topic:0":  {Group: "other-group", Topic: "important-topic", Partition: 0, Offset: 10},
+	}
+	metadataByGroup := map[string]kafka.ConsumerGroupMetadata{
+		"sample-group": {Group: "sample-group"},
+		"empty-group":  {Group: "empty-group"},
+	}
+	highWaterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {0: {WaterMark: 300}, 1: {WaterMark: 300}},
+		"other-topic":     {0: {WaterMark: 20}},
+	}
+
+	tables := []struct {
+		desc     *prometheus.Desc
+		expected float64
+	}{
+		{groupsTotalDesc, 3},
+		{topicsTotalDesc, 2},
+		{partitionsTotalDesc, 3},
+	}
+	for _, table := range tables {
+		ch := make(chan prometheus.Metric, 10)
+		c.collectStorageSize(ch, offsets, metadataByGroup, highWaterMarks)
+		close(ch)
+		values := collectGaugeValues(t, ch, table.desc)
+		if values[""] != table.expected {
+			t.Errorf("Expected %v for %v, Got: %v", table.expected, table.desc, values)
+		}
+	}
+}
+
+func TestCollectHighWaterMarksWithRack(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	opts.MetricsIncludeRack = true
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+
+	highWaterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {
+			0: {TopicName: "important-topic", PartitionID: 0, WaterMark: 150, LeaderRack: "eu-west-1a"},
+			1: {TopicName: "important-topic", PartitionID: 1, WaterMark: 250},
+		},
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	c.collectHighWaterMarks(ch, highWaterMarks)
+	close(ch)
+	waterMarks := collectGaugeValues(t, ch, partitionHighWaterMarkDesc)
+	expected := map[string]float64{
+		"0,eu-west-1a,important-topic": 150,
+		"1,,important-topic":           250,
+	}
+	if !reflect.DeepEqual(waterMarks, expected) {
+		t.Errorf("Expected high water marks %v, Got: %v", expected, waterMarks)
+	}
+}
+
+func TestCapGroupPartitions(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	opts.MetricsMaxPartitionsPerGroup = 2
+	c := NewCollector(opts, &kafka.Filter{}, nil)
+
+	offsets := map[string]storage.ConsumerPartitionOffsetMetric{
+		"sample-group:important-topic:0": {Group: "sample-group", Topic: "important-topic", Partition: 0, Offset: 100},
+		"sample-group:important-topic:1": {Group: "sample-group", Topic: "important-topic", Partition: 1, Offset: 250},
+		"greedy-group:important-topic:0": {Group: "greedy-group", Topic: "important-topic", Partition: 0, Offset: 100},
+		"greedy-group:important-topic:1": {Group: "greedy-group", Topic: "important-topic", Partition: 1, Offset: 200},
+		"greedy-group:other-topic:0":     {Group: "greedy-group", Topic: "other-topic", Partition: 0, Offset: 10},
+	}
+	lowWaterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {0: {WaterMark: 0}, 1: {WaterMark: 0}},
+		"other-topic":     {0: {WaterMark: 0}},
+	}
+	highWaterMarks := map[string]storage.PartitionWaterMarks{
+		"important-topic": {0: {WaterMark: 150}, 1: {WaterMark: 250}},
+		"other-topic":     {0: {WaterMark: 17}},
+	}
+
+	// Filtered collections split the offsets the same way, but don't count the capped groups
+	filteredOffsets, filteredCappedOffsets := c.capGroupPartitions(offsets, false)
+	if len(filteredOffsets) != 2 || len(filteredCappedOffsets) != 3 {
+		t.Fatalf("Expected 2 offsets within and 3 offsets above the cap, Got: %v and %v", filteredOffsets, filteredCappedOffsets)
+	}
+	partitionOffsets, cappedOffsets := c.capGroupPartitions(offsets, true)
+	if len(partitionOffsets) != 2 || len(cappedOffsets) != 3 {
+		t.Fatalf("Expected 2 offsets within and 3 offsets above the cap, Got: %v and %v", partitionOffsets, cappedOffsets)
+	}
+	for _, offset := range partitionOffsets {
+		if offset.Group != "sample-group" {
+			t.Errorf("Expected only offsets of sample-group to be within the cap, Got: %+v", offset)
+		}
+	}
+	if capped := testutil.ToFloat64(c.groupCardinalityCapped.WithLabelValues("greedy-group")); capped != 1 {
+		t.Errorf("Expected greedy-group to be capped once, Got: %v", capped)
+	}
+	// The counter of a group which isn't capped anymore is deleted
+	c.capGroupPartitions(map[string]storage.ConsumerPartitionOffsetMetric{
+		"greedy-group:important-topic:0": offsets["greedy-group:important-topic:0"],
+	}, true)
+	series := make(chan prometheus.Metric, 10)
+	c.groupCardinalityCapped.Collect(series)
+	if len(series) != 0 {
+		t.Errorf("Expected the capped counter of greedy-group to be deleted, Got: %v series", len(series))
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	c.collectCappedGroups(ch, cappedOffsets, lowWaterMarks, highWaterMarks)
+	close(ch)
+	lags := collectGaugeValues(t, ch, groupCappedLagDesc)
+	expected := map[string]float64{"greedy-group": 107}
+	if !reflect.DeepEqual(lags, expected) {
+		t.Errorf("Expected capped group lags %v, Got: %v", expected, lags)
+	}
+}
+
+// TestCollectWhileGroupsAreDeleted collects metrics while groups are deleted and added again concurrently. Run it
+// with -race to detect unsynchronized access to the storage.
+func TestCollectWhileGroupsAreDeleted(t *testing.T) {
+	opts := options.NewOptions()
+	opts.MetricsPrefix = "kafka_minion"
+	consumerOffsetCh := make(chan *kafka.StorageRequest, 100)
+	clusterCh := make(chan *kafka.StorageRequest, 100)
+	cache := storage.NewMemoryStorage(opts, consumerOffsetCh, clusterCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache.Start(ctx)
+
+	const groupCount = 20
+	const partitionCount = 4
+	// The offsets of a group are stored before its metadata, hence a consistent snapshot never contains the
+	// metadata of a group without its offsets
+	addGroup := func(group string) {
+		for partition := int32(0); partition < partitionCount; partition++ {
+			consumerOffsetCh <- &kafka.StorageRequest{
+				RequestType:    kafka.StorageAddConsumerOffset,
+				ConsumerOffset: &kafka.ConsumerPartitionOffset{Group: group, Topic: "important-topic", Partition: partition, Offset: 100},
+			}
+		}
+		consumerOffsetCh <- &kafka.StorageRequest{
+			RequestType:   kafka.StorageAddGroupMetadata,
+			GroupMetadata: &kafka.ConsumerGroupMetadata{Group: group},
+		}
+	}
+	// Groups are deleted through the worker as well, like tombstones. The metadata is deleted before the offsets.
+	deleteGroup := func(group string) {
+		consumerOffsetCh <- &kafka.StorageRequest{RequestType: kafka.StorageDeleteGroupMetadata, ConsumerGroupName: group}
+		for partition := int32(0); partition < partitionCount; partition++ {
+			consumerOffsetCh <- &kafka.StorageRequest{
+				RequestType:       kafka.StorageDeleteConsumerGroup,
+				ConsumerGroupName: group,
+				TopicName:         "important-topic",
+				PartitionID:       partition,
+			}
+		}
+	}
+	consumerOffsetCh <- &kafka.StorageRequest{RequestType: kafka.StorageRegisterOffsetPartitions, PartitionCount: 1}
+	consumerOffsetCh <- &kafka.StorageRequest{RequestType: kafka.StorageMarkOffsetPartitionReady, PartitionID: 0}
+	for partition := int32(0); partition < partitionCount; partition++ {
+		waterMark := &kafka.PartitionWaterMark{TopicName: "important-topic", PartitionID: partition, WaterMark: 150}
+		clusterCh <- &kafka.StorageRequest{RequestType: kafka.StorageAddPartitionLowWaterMark, PartitionWaterMark: waterMark}
+		clusterCh <- &kafka.StorageRequest{RequestType: kafka.StorageAddPartitionHighWaterMark, PartitionWaterMark: waterMark}
+	}
+	for i := 0; i < groupCount; i++ {
+		addGroup(fmt.Sprintf("sample-group-%d", i))
+	}
+
+	c := NewCollector(opts, &kafka.Filter{}, cache)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 0; round < 20; round++ {
+			for i := 0; i < groupCount; i++ {
+				group := fmt.Sprintf("sample-group-%d", i)
+				deleteGroup(group)
+				addGroup(group)
+			}
+		}
+	}()
+
+	for collecting := true; collecting; {
+		select {
+		case <-done:
+			collecting = false
+		default:
+		}
+
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("Failed to gather metrics: %v", err)
+		}
+		groupsWithOffsets := make(map[string]bool)
+		var groupsWithMembers []string
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() != "group" {
+						continue
+					}
+					switch family.GetName() {
+					case "kafka_minion_group_topic_partition_offset":
+						groupsWithOffsets[label.GetValue()] = true
+					case "kafka_minion_group_members":
+						groupsWithMembers = append(groupsWithMembers, label.GetValue())
+					}
+				}
+			}
+		}
+		for _, group := range groupsWithMembers {
+			if !groupsWithOffsets[group] {
+				t.Fatalf("Group %v has been exposed with its metadata but without its offsets", group)
+			}
+		}
+	}
+	if errors := testutil.ToFloat64(c.collectErrors); errors != 0 {
+		t.Errorf("Expected no failed collections, Got: %v", errors)
+	}
+}
@@ -0,0 +1,179 @@
+package kafka
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	awsIAMServiceName   = "kafka-cluster"
+	awsIAMTokenLifetime = 15 * time.Minute
+	awsIAMUserAgent     = "kafka-minion"
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+	// emptyPayloadHash is the hex encoded SHA256 hash of an empty payload
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// awsCredentials are the credentials used to sign requests with AWS Signature Version 4
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsIAMTokenProvider generates tokens for AWS MSK IAM authentication via SASL/OAUTHBEARER. A token is a base64
+// encoded URL for the kafka-cluster:Connect action which is presigned with AWS Signature Version 4.
+type awsIAMTokenProvider struct {
+	region      string
+	credentials func() (awsCredentials, error)
+	now         func() time.Time
+}
+
+func newAWSIAMTokenProvider(region string) *awsIAMTokenProvider {
+	return &awsIAMTokenProvider{
+		region:      region,
+		credentials: awsCredentialsFromEnv,
+		now:         time.Now,
+	}
+}
+
+// Token returns a new presigned token along with its expiry time
+func (p *awsIAMTokenProvider) Token() (string, time.Time, error) {
+	credentials, err := p.credentials()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingTime := p.now().UTC()
+	query := url.Values{}
+	query.Set("Action", "kafka-cluster:Connect")
+	if credentials.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+	presignedURL := presignV4(presignRequest{
+		Host:        fmt.Sprintf("kafka.%v.amazonaws.com", p.region),
+		Path:        "/",
+		Query:       query,
+		Region:      p.region,
+		Service:     awsIAMServiceName,
+		Expires:     awsIAMTokenLifetime,
+		PayloadHash: emptyPayloadHash,
+		Time:        signingTime,
+		Credentials: credentials,
+	})
+	presignedURL += "&User-Agent=" + awsURIEncode(awsIAMUserAgent)
+	token := base64.RawURLEncoding.EncodeToString([]byte(presignedURL))
+
+	return token, signingTime.Add(awsIAMTokenLifetime), nil
+}
+
+// awsCredentialsFromEnv reads the AWS credentials from the standard AWS environment variables
+func awsCredentialsFromEnv() (awsCredentials, error) {
+	credentials := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return credentials, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	return credentials, nil
+}
+
+// presignRequest contains all information which is required to presign a GET request
+type presignRequest struct {
+	Host        string
+	Path        string
+	Query       url.Values
+	Region      string
+	Service     string
+	Expires     time.Duration
+	PayloadHash string
+	Time        time.Time
+	Credentials awsCredentials
+}
+
+// presignV4 returns the presigned https URL for the given GET request. Only the host header is signed.
+func presignV4(req presignRequest) string {
+	amzDate := req.Time.Format("20060102T150405Z")
+	date := req.Time.Format("20060102")
+	credentialScope := strings.Join([]string{date, req.Region, req.Service, "aws4_request"}, "/")
+
+	query := url.Values{}
+	for key, values := range req.Query {
+		query[key] = values
+	}
+	query.Set("X-Amz-Algorithm", awsSigningAlgorithm)
+	query.Set("X-Amz-Credential", req.Credentials.AccessKeyID+"/"+credentialScope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int64(req.Expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	canonicalQuery := awsCanonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		req.Path,
+		canonicalQuery,
+		"host:" + req.Host + "\n",
+		"host",
+		req.PayloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		amzDate,
+		credentialScope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := []byte("AWS4" + req.Credentials.SecretAccessKey)
+	for _, part := range []string{date, req.Region, req.Service, "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	return "https://" + req.Host + req.Path + "?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+// awsCanonicalQuery returns the query string with sorted and URI encoded keys and values
+func awsCanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(key)+"="+awsURIEncode(value))
+		}
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode encodes all characters except the unreserved ones (A-Z, a-z, 0-9, '-', '.', '_' and '~')
+func awsURIEncode(input string) string {
+	var builder strings.Builder
+	for _, b := range []byte(input) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '.' || b == '_' || b == '~' {
+			builder.WriteByte(b)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+
+	return builder.String()
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
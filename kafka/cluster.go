@@ -1,7 +1,7 @@
 package kafka
 
 import (
-	"fmt"
+	"context"
 	"math/rand"
 	"strings"
 	"sync"
@@ -19,9 +19,11 @@ type Cluster struct {
 	// storageCh is used to persist partition watermarks in memory so that they can be exposed with prometheus
 	storageCh   chan<- *StorageRequest
 	client      sarama.Client
+	kafkaClient KafkaClient
 	admin       sarama.ClusterAdmin
 	logger      *log.Entry
 	options     *options.Options
+	filter      *Filter
 	topicByName map[string]*sarama.TopicMetadata
 }
 
@@ -31,6 +33,7 @@ type PartitionWaterMark struct {
 	PartitionID int32
 	WaterMark   int64
 	Timestamp   int64
+	LeaderRack  string // Only set for high water marks if racks are exposed, empty if the rack is unknown
 }
 
 // TopicConfiguration indicates config entries for a topic along with the partition count
@@ -61,7 +64,7 @@ var (
 
 // NewCluster creates a new cluster module and tries to connect to the kafka cluster
 // If it cannot connect to the cluster it will panic
-func NewCluster(opts *options.Options, storageCh chan<- *StorageRequest) *Cluster {
+func NewCluster(opts *options.Options, filter *Filter, storageCh chan<- *StorageRequest) *Cluster {
 	logger := log.WithFields(log.Fields{
 		"module": "cluster",
 	})
@@ -73,33 +76,62 @@ func NewCluster(opts *options.Options, storageCh chan<- *StorageRequest) *Cluste
 
 	clientConfig := saramaClientConfig(opts)
 	connectionLogger.Info("connecting to kafka cluster")
-	client, err := sarama.NewClient(opts.KafkaBrokers, clientConfig)
+	var client sarama.Client
+	err := connectWithRetries(opts, connectionLogger, func() error {
+		var err error
+		client, err = sarama.NewClient(opts.KafkaBrokers, clientConfig)
+		return err
+	})
 	if err != nil {
 		connectionLogger.WithFields(log.Fields{
-			"reason": err,
+			"reason": err.Error(),
 		}).Panicf("failed to start client")
 	}
 
-	admin, err := sarama.NewClusterAdmin(opts.KafkaBrokers, clientConfig)
+	var admin sarama.ClusterAdmin
+	err = connectWithRetries(opts, connectionLogger, func() error {
+		var err error
+		admin, err = sarama.NewClusterAdmin(opts.KafkaBrokers, clientConfig)
+		return err
+	})
 	if err != nil {
 		connectionLogger.WithFields(log.Fields{
-			"reason": err,
+			"reason": err.Error(),
 		}).Panicf("failed to start admin client")
 	}
 	connectionLogger.Info("successfully connected to kafka cluster")
 
+	kafkaClient := newSaramaKafkaClient(client, logger)
+	kafkaClient.watermarkJitter = opts.KafkaWatermarkJitter
+	kafkaClient.requestTimeout = opts.KafkaRequestTimeout
+	if opts.KafkaWatermarkJitter*2 >= opts.KafkaWatermarkInterval {
+		// High and low water marks are requested one after another, polls would take longer than the interval
+		logger.WithFields(log.Fields{
+			"jitter":   opts.KafkaWatermarkJitter.String(),
+			"interval": opts.KafkaWatermarkInterval.String(),
+		}).Warn("water mark jitter should be less than half of the water mark interval")
+	}
+
 	return &Cluster{
-		storageCh: storageCh,
-		client:    client,
-		admin:     admin,
-		logger:    logger,
-		options:   opts,
+		storageCh:   storageCh,
+		client:      client,
+		kafkaClient: kafkaClient,
+		admin:       admin,
+		logger:      logger,
+		options:     opts,
+		filter:      filter,
 	}
 }
 
-// Start starts cluster module
-func (module *Cluster) Start() {
-	go module.mainLoop()
+// Start starts cluster module. It stops refreshing the cluster metadata once the context is cancelled.
+func (module *Cluster) Start(ctx context.Context) {
+	go module.mainLoop(ctx)
+}
+
+// Close closes the kafka clients of the cluster module
+func (module *Cluster) Close() {
+	module.admin.Close()
+	module.kafkaClient.Close()
 }
 
 // IsHealthy returns true if there is at least one broker which can be talked to
@@ -111,14 +143,20 @@ func (module *Cluster) IsHealthy() bool {
 	return false
 }
 
-func (module *Cluster) mainLoop() {
+func (module *Cluster) mainLoop(ctx context.Context) {
 
 	go func() {
 		// Initially trigger offset refresh once manually to ensure up to date data before the first ticker fires
 		module.refreshAndSendTopicMetadata()
-		offsetRefresh := time.NewTicker(time.Second * 5)
-		for range offsetRefresh.C {
-			module.refreshAndSendTopicMetadata()
+		offsetRefresh := time.NewTicker(module.options.KafkaWatermarkInterval)
+		defer offsetRefresh.Stop()
+		for {
+			select {
+			case <-offsetRefresh.C:
+				module.refreshAndSendTopicMetadata()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -126,8 +164,14 @@ func (module *Cluster) mainLoop() {
 		// Initially trigger offset refresh once manually to ensure up to date data before the first ticker fires
 		module.refreshAndSendTopicConfig()
 		topicConfigRefresh := time.NewTicker(time.Second * 60)
-		for range topicConfigRefresh.C {
-			module.refreshAndSendTopicConfig()
+		defer topicConfigRefresh.Stop()
+		for {
+			select {
+			case <-topicConfigRefresh.C:
+				module.refreshAndSendTopicConfig()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 }
@@ -160,7 +204,14 @@ func (module *Cluster) refreshAndSendTopicConfig() {
 	}
 
 	metadataReq := &sarama.MetadataRequest{}
-	metadata, err := broker.GetMetadata(metadataReq)
+	var metadata *sarama.MetadataResponse
+	var requestErr error
+	err := withRequestTimeout(module.options.KafkaRequestTimeout, "metadata", func() {
+		metadata, requestErr = broker.GetMetadata(metadataReq)
+	})
+	if err == nil {
+		err = requestErr
+	}
 	if err != nil {
 		module.logger.WithFields(log.Fields{
 			"error": err.Error(),
@@ -174,6 +225,9 @@ func (module *Cluster) refreshAndSendTopicConfig() {
 	topicByName := make(map[string]*sarama.TopicMetadata)
 	for _, topic := range metadata.Topics {
 		topicByName[topic.Name] = topic
+		if !module.filter.IsTopicAllowed(topic.Name) {
+			continue
+		}
 		topicResource := &sarama.ConfigResource{
 			Type:        sarama.TopicResource,
 			Name:        topic.Name,
@@ -217,194 +271,101 @@ func (module *Cluster) refreshAndSendTopicMetadata() {
 		return
 	}
 
-	// Send requests in bulk to each broker for those partitions it is responsible/leader for
-	var wg = sync.WaitGroup{}
-	module.logger.Debug("starting to collect topic offsets")
-	highRequests, lowRequests, brokers := module.generateOffsetRequests(partitionIDsByTopicName)
-	for brokerID, request := range highRequests {
-		wg.Add(1)
-		logger := module.logger.WithFields(log.Fields{
-			"broker_id": brokerID,
-		})
-		go module.processHighWaterMarks(&wg, brokers[brokerID], request, logger)
-	}
-	wg.Wait() // Await offsets first, to prevent concurrent access on brokers
-	for brokerID, request := range lowRequests {
-		wg.Add(1)
-		logger := module.logger.WithFields(log.Fields{
-			"broker_id": brokerID,
-		})
-		go module.processLowWaterMarks(&wg, brokers[brokerID], request, logger)
-	}
-	wg.Wait()
-	module.logger.Debug("collected topic offsets")
-}
-
-// topicPartitions returns a map of all partition IDs (value) grouped by topic name (key)
-func (module *Cluster) topicPartitions() (map[string][]int32, error) {
-	err := module.client.RefreshMetadata()
-	if err != nil {
-		module.logger.WithFields(log.Fields{
-			"error": err.Error(),
-		}).Warn("could not refresh topic metadata")
-	}
-
-	// Get the current list of topics and make a map
-	topicNames, err := module.client.Topics()
-	if err != nil {
-		module.logger.WithFields(log.Fields{
-			"error": err.Error(),
-		}).Error("failed to fetch topic list")
-		return nil, fmt.Errorf("failed to fetch topic list")
-	}
-
-	partitionIDsByTopicName := make(map[string][]int32)
-	for _, topicName := range topicNames {
-		// Partitions() response is served from cached metadata if available. So there's usually no need to launch go routines for that
-		partitionIDs, err := module.client.Partitions(topicName)
-		if err != nil {
-			module.logger.WithFields(log.Fields{
-				"error": err.Error,
-				"topic": topicName,
-			}).Error("failed to fetch partition list")
-		}
-
-		partitionIDsByTopicName[topicName] = make([]int32, len(partitionIDs))
-		for _, partitionID := range partitionIDs {
-			partitionIDsByTopicName[topicName] = append(partitionIDsByTopicName[topicName], partitionID)
+	for topicName, partitionIDs := range partitionIDsByTopicName {
+		if module.filter.IsTopicAllowed(topicName) {
+			module.storageCh <- newUpdateTopicPartitionCountRequest(topicName, len(partitionIDs))
 		}
 	}
 
-	return partitionIDsByTopicName, nil
-}
-
-func (module *Cluster) generateOffsetRequests(partitionIDsByTopicName map[string][]int32) (map[int32]*sarama.OffsetRequest, map[int32]*sarama.OffsetRequest, map[int32]*sarama.Broker) {
-	// we must create two separate buckets for high & low watermarks, because adding a request block
-	// with same topic:partition but different time will still result in just one request, see:
-	// https://github.com/Shopify/sarama/blob/master/offset_request.go AddBlock() method
-	highWaterMarkRequests := make(map[int32]*sarama.OffsetRequest)
-	lowWaterMarkRequests := make(map[int32]*sarama.OffsetRequest)
-	brokers := make(map[int32]*sarama.Broker)
-
-	// Generate an OffsetRequest for each topic:partition and bucket it to the leader broker
-	for topic, partitionIDs := range partitionIDsByTopicName {
-		for _, partitionID := range partitionIDs {
-			broker, err := module.client.Leader(topic, partitionID)
-			if err != nil {
-				module.logger.WithFields(log.Fields{
-					"topic":     topic,
-					"partition": partitionID,
-					"error":     err.Error(),
-				}).Warn("failed to fetch leader for partition")
-				continue
-			}
-			if _, exists := highWaterMarkRequests[broker.ID()]; !exists {
-				highWaterMarkRequests[broker.ID()] = &sarama.OffsetRequest{}
-				lowWaterMarkRequests[broker.ID()] = &sarama.OffsetRequest{}
-			}
-			brokers[broker.ID()] = broker
-			highWaterMarkRequests[broker.ID()].AddBlock(topic, partitionID, sarama.OffsetNewest, 1)
-			lowWaterMarkRequests[broker.ID()].AddBlock(topic, partitionID, sarama.OffsetOldest, 1)
-		}
-	}
-
-	return highWaterMarkRequests, lowWaterMarkRequests, brokers
-}
-
-func (module *Cluster) processHighWaterMarks(wg *sync.WaitGroup, broker *sarama.Broker, request *sarama.OffsetRequest, logger *log.Entry) {
-	defer wg.Done()
-	response, err := broker.GetAvailableOffsets(request)
-	if err != nil {
-		logger.WithFields(log.Fields{
-			"error": err.Error(),
-		}).Error("failed to fetch high watermarks from broker")
-		broker.Close()
-		return
+	module.logger.Debug("starting to collect topic offsets")
+	highWaterMarks, lowWaterMarks := module.kafkaClient.FetchWatermarks(partitionIDsByTopicName)
+	var leaderRacks map[string]map[int32]string
+	if module.options.MetricsIncludeRack {
+		leaderRacks = module.kafkaClient.LeaderRacks(partitionIDsByTopicName)
 	}
 	ts := time.Now().Unix() * 1000
-	for topicName, responseBlock := range response.Blocks {
-
-		for partitionID, offsetResponse := range responseBlock {
-			if offsetResponse.Err != sarama.ErrNoError {
-				logger.WithFields(log.Fields{
-					"error":     offsetResponse.Err.Error(),
-					"topic":     topicName,
-					"partition": partitionID,
-				}).Warn("error in high OffsetResponse")
-				continue
-			}
-
+	for topicName, partitions := range highWaterMarks {
+		for partitionID, waterMark := range partitions {
 			if topicName == module.options.ConsumerOffsetsTopicName {
 				offsetWaterMarks.Lock.Lock()
 				offsetWaterMarks.PartitionsByID[partitionID] = consumerOffsetPartition{
 					PartitionID:   partitionID,
-					HighWaterMark: offsetResponse.Offsets[0],
+					HighWaterMark: waterMark,
 				}
 				offsetWaterMarks.Lock.Unlock()
 			}
 
 			// Skip topic in this for loop (instead of the outer one) because we still need __consumer_offset information
-			if !module.isTopicAllowed(topicName) {
+			if !module.filter.IsTopicAllowed(topicName) {
 				continue
 			}
-			logger.WithFields(log.Fields{
+			module.logger.WithFields(log.Fields{
 				"topic":     topicName,
 				"partition": partitionID,
-				"offset":    offsetResponse.Offsets[0],
+				"offset":    waterMark,
 				"timestamp": ts,
 			}).Debug("received partition high water mark")
 			entry := &PartitionWaterMark{
 				TopicName:   topicName,
 				PartitionID: partitionID,
-				WaterMark:   offsetResponse.Offsets[0],
+				WaterMark:   waterMark,
 				Timestamp:   ts,
+				LeaderRack:  leaderRacks[topicName][partitionID],
 			}
 			module.storageCh <- newAddPartitionHighWaterMarkRequest(entry)
 		}
 	}
-}
-
-func (module *Cluster) processLowWaterMarks(wg *sync.WaitGroup, broker *sarama.Broker, request *sarama.OffsetRequest, logger *log.Entry) {
-	defer wg.Done()
-	response, err := broker.GetAvailableOffsets(request)
-	if err != nil {
-		logger.WithFields(log.Fields{
-			"error": err.Error(),
-		}).Error("failed to fetch low watermarks from broker")
-		broker.Close()
-		return
-	}
-	ts := time.Now().Unix() * 1000
-	for topicName, responseBlock := range response.Blocks {
-		if !module.isTopicAllowed(topicName) {
+	for topicName, partitions := range lowWaterMarks {
+		if !module.filter.IsTopicAllowed(topicName) {
 			continue
 		}
 
-		for partitionID, offsetResponse := range responseBlock {
-			if offsetResponse.Err != sarama.ErrNoError {
-				logger.WithFields(log.Fields{
-					"error":     offsetResponse.Err.Error(),
-					"topic":     topicName,
-					"partition": partitionID,
-				}).Warn("error in low OffsetResponse")
-				continue
-			}
-
-			logger.WithFields(log.Fields{
+		for partitionID, waterMark := range partitions {
+			module.logger.WithFields(log.Fields{
 				"topic":     topicName,
 				"partition": partitionID,
-				"offset":    offsetResponse.Offsets[0],
+				"offset":    waterMark,
 				"timestamp": ts,
 			}).Debug("received partition low water mark")
 			entry := &PartitionWaterMark{
 				TopicName:   topicName,
 				PartitionID: partitionID,
-				WaterMark:   offsetResponse.Offsets[0],
+				WaterMark:   waterMark,
 				Timestamp:   ts,
 			}
 			module.storageCh <- newAddPartitionLowWaterMarkRequest(entry)
 		}
 	}
+	module.logger.Debug("collected topic offsets")
+}
+
+// topicPartitions returns a map of all partition IDs (value) grouped by topic name (key). The metadata is refreshed
+// first, so that new topics are polled right away. If the refresh fails, the client's cached metadata is used.
+func (module *Cluster) topicPartitions() (map[string][]int32, error) {
+	err := module.kafkaClient.RefreshMetadata()
+	if err != nil {
+		module.logger.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warn("could not refresh topic metadata")
+	}
+
+	partitionIDsByTopicName, err := module.kafkaClient.DescribeTopics()
+	if err != nil {
+		module.logger.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("failed to describe topics")
+		return nil, err
+	}
+
+	for topicName := range partitionIDsByTopicName {
+		// Filtered topics are not polled at all, except for the consumer offsets topic whose high water marks
+		// are needed to determine whether the offset consumer has caught up
+		if !module.filter.IsTopicAllowed(topicName) && topicName != module.options.ConsumerOffsetsTopicName {
+			delete(partitionIDsByTopicName, topicName)
+		}
+	}
+
+	return partitionIDsByTopicName, nil
 }
 
 // getAnyBroker return a random item from the brokers slice
@@ -428,13 +389,3 @@ func (module *Cluster) getAnyBroker() *sarama.Broker {
 
 	return connectedBrokers[n]
 }
-
-func (module *Cluster) isTopicAllowed(topicName string) bool {
-	if module.options.IgnoreSystemTopics {
-		if strings.HasPrefix(topicName, "__") || strings.HasPrefix(topicName, "_confluent") {
-			return false
-		}
-	}
-
-	return true
-}
@@ -1,6 +1,8 @@
 package kafka
 
 import (
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -9,7 +11,7 @@ import (
 	"github.com/google-cloud-tools/kafka-minion/options"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
-	"os"
+	"time"
 )
 
 // saramaClientConfig returns a sarama config pre initialized with SASL / TLS settings
@@ -18,56 +20,59 @@ import (
 func saramaClientConfig(opts *options.Options) *sarama.Config {
 	clientConfig := sarama.NewConfig()
 	clientConfig.ClientID = "kafka-lag-collector-1"
-	clientConfig.Version = sarama.V0_11_0_2
+	version, err := ParseKafkaVersion(opts.KafkaVersion)
+	if err != nil {
+		log.Panicf("Error configuring kafka version. %s", err)
+	}
+	clientConfig.Version = version
+
+	// The cached metadata of all topics is refreshed in the background. Topics and partitions which are discovered
+	// by a refresh are part of the next water mark poll.
+	clientConfig.Metadata.RefreshFrequency = opts.KafkaMetadataRefresh
+
+	// A connection attempt tries each broker in turn, hence it takes up to the dial timeout per unreachable broker
+	// before it fails and is retried with a backoff (see connectWithRetries). Unset values keep sarama's defaults.
+	if opts.KafkaMaxOpenRequests > 0 {
+		clientConfig.Net.MaxOpenRequests = opts.KafkaMaxOpenRequests
+	}
+	if opts.KafkaDialTimeout > 0 {
+		clientConfig.Net.DialTimeout = opts.KafkaDialTimeout
+	}
+	if opts.KafkaReadTimeout > 0 {
+		clientConfig.Net.ReadTimeout = opts.KafkaReadTimeout
+	}
+	clientConfig.Net.KeepAlive = opts.KafkaKeepAlive
+
+	// Offsets which are committed by transactional producers (TxnOffsetCommit) are regular offset commits in the
+	// consumer offsets topic, but they must only be applied if their transaction has been committed. Sarama skips
+	// the transaction markers (control records) and records of aborted transactions when reading committed only.
+	clientConfig.Consumer.IsolationLevel = sarama.ReadCommitted
+
+	// Request metrics of all clients are collected in one registry, which can be exposed with prometheus
+	clientConfig.MetricRegistry = saramaMetricRegistry
+
+	// Consume errors are counted per partition by the offset consumer, instead of being logged by sarama only
+	clientConfig.Consumer.Return.Errors = true
 
 	// SASL
 	if opts.SASLEnabled {
-		clientConfig.Net.SASL.Enable = true
-		clientConfig.Net.SASL.Handshake = opts.UseSASLHandshake
-
-		if opts.SASLUsername != "" {
-			clientConfig.Net.SASL.User = opts.SASLUsername
-		}
-		if opts.SASLPassword != "" {
-			clientConfig.Net.SASL.Password = opts.SASLPassword
+		err := configureSASL(clientConfig, opts)
+		if err != nil {
+			log.Panicf("Error configuring SASL. %s", err)
 		}
 	}
 
 	// Setup TLS
 	if opts.TLSEnabled {
-		// Ensure that Cert and Key can be read
-		canReadCertAndKey, err := canReadCertAndKey(opts.TLSCertFilePath, opts.TLSKeyFilePath)
+		tlsConfig, err := tlsConfig(opts)
 		if err != nil {
-			log.Panic(err)
+			log.Panicf("Error configuring TLS. %s", err)
 		}
-
 		clientConfig.Net.TLS.Enable = true
-		clientConfig.Net.TLS.Config = &tls.Config{
-			RootCAs:            x509.NewCertPool(),
-			InsecureSkipVerify: opts.TLSInsecureSkipTLSVerify,
-		}
-
-		// Load CA file
-		if opts.TLSCAFilePath != "" {
-			if ca, err := ioutil.ReadFile(opts.TLSCAFilePath); err == nil {
-				clientConfig.Net.TLS.Config.RootCAs.AppendCertsFromPEM(ca)
-			} else {
-				log.Panic(err)
-			}
-		}
-
-		// Load Cert file, if necessary it will be decrypted with a passphrase too
-		if canReadCertAndKey {
-			cert, err := getCert(opts)
-			if err == nil {
-				clientConfig.Net.TLS.Config.Certificates = cert
-			} else {
-				log.Panic(err)
-			}
-		}
+		clientConfig.Net.TLS.Config = tlsConfig
 	}
 
-	err := clientConfig.Validate()
+	err = clientConfig.Validate()
 	if err != nil {
 		log.Panicf("Error validating kafka client config. %s", err)
 	}
@@ -76,38 +81,136 @@ func saramaClientConfig(opts *options.Options) *sarama.Config {
 	return clientConfig
 }
 
-// canReadCertAndKey returns true if the certificate and key files already exists,
-// otherwise returns false. If lost one of cert and key, returns error.
-func canReadCertAndKey(certPath, keyPath string) (bool, error) {
-	certReadable := canReadFile(certPath)
-	keyReadable := canReadFile(keyPath)
-
-	if certReadable == false && keyReadable == false {
-		return false, nil
+// ParseKafkaVersion parses a kafka version (e. g. "2.1.0") which is known to sarama. The version determines the
+// request versions which are sent to the brokers, hence it must not be newer than the oldest broker of the cluster.
+func ParseKafkaVersion(version string) (sarama.KafkaVersion, error) {
+	kafkaVersion, err := sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return sarama.KafkaVersion{}, err
+	}
+	for _, supportedVersion := range sarama.SupportedVersions {
+		if kafkaVersion == supportedVersion {
+			return kafkaVersion, nil
+		}
 	}
 
-	if certReadable == false {
-		return false, fmt.Errorf("error reading %s, certificate and key must be supplied as a pair", certPath)
+	return sarama.KafkaVersion{}, fmt.Errorf("kafka version '%v' is not supported, the oldest supported version is '%v' and the newest is '%v'",
+		version, sarama.MinVersion, sarama.MaxVersion)
+}
+
+// maxConnectBackoff caps the exponentially growing delay between two connection attempts
+const maxConnectBackoff = 30 * time.Second
+
+// connectWithRetries calls connect until it succeeds or the configured number of retries is exhausted. The delay
+// between two attempts starts with the configured backoff and doubles after each failed attempt.
+func connectWithRetries(opts *options.Options, logger *log.Entry, connect func() error) error {
+	backoff := opts.KafkaConnectBackoff
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		if attempt > opts.KafkaConnectRetries {
+			return err
+		}
+
+		logger.WithFields(log.Fields{
+			"attempt":     attempt,
+			"max_retries": opts.KafkaConnectRetries,
+			"delay":       backoff.String(),
+			"error":       err.Error(),
+		}).Warn("failed to connect to kafka cluster, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
 	}
+}
 
-	if keyReadable == false {
-		return false, fmt.Errorf("error reading %s, certificate and key must be supplied as a pair", keyPath)
+// configureSASL sets the SASL settings of the given sarama config. It returns an error if the configured
+// mechanism is not supported or if credentials are missing, so that this doesn't cause confusing connection errors.
+func configureSASL(clientConfig *sarama.Config, opts *options.Options) error {
+	clientConfig.Net.SASL.Enable = true
+	clientConfig.Net.SASL.Handshake = opts.UseSASLHandshake
+
+	switch opts.SASLMechanism {
+	case sarama.SASLTypePlaintext:
+		if opts.SASLUsername == "" || opts.SASLPassword == "" {
+			return fmt.Errorf("SASL mechanism %v requires a username and password", opts.SASLMechanism)
+		}
+		clientConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		clientConfig.Net.SASL.User = opts.SASLUsername
+		clientConfig.Net.SASL.Password = opts.SASLPassword
+	case sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		if opts.SASLUsername == "" || opts.SASLPassword == "" {
+			return fmt.Errorf("SASL mechanism %v requires a username and password", opts.SASLMechanism)
+		}
+		hashGenerator := HashGeneratorFcn(sha256.New)
+		if opts.SASLMechanism == sarama.SASLTypeSCRAMSHA512 {
+			hashGenerator = sha512.New
+		}
+		clientConfig.Net.SASL.Mechanism = sarama.SASLMechanism(opts.SASLMechanism)
+		clientConfig.Net.SASL.User = opts.SASLUsername
+		clientConfig.Net.SASL.Password = opts.SASLPassword
+		clientConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return newSCRAMClient(hashGenerator)
+		}
+	case sarama.SASLTypeOAuth:
+		switch opts.SASLOAuthProvider {
+		case "aws-msk-iam":
+			if opts.SASLAWSRegion == "" {
+				return fmt.Errorf("token provider %v requires an AWS region", opts.SASLOAuthProvider)
+			}
+			clientConfig.Net.SASL.TokenProvider = newRefreshingTokenProvider(newAWSIAMTokenProvider(opts.SASLAWSRegion), time.Minute)
+		default:
+			return fmt.Errorf("token provider '%v' is not supported", opts.SASLOAuthProvider)
+		}
+		clientConfig.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+	default:
+		return fmt.Errorf("SASL mechanism '%v' is not supported", opts.SASLMechanism)
 	}
 
-	return true, nil
+	return nil
 }
 
-// If the file represented by path exists and
-// readable, returns true otherwise returns false.
-func canReadFile(path string) bool {
-	f, err := os.Open(path)
-	if err != nil {
-		return false
+// tlsConfig creates the TLS config for connecting to the brokers. If a CA file is configured it is used as the only
+// root CA, otherwise the system's root CAs are used. It returns an error if files can't be loaded or if only one of
+// the client certificate and key is configured.
+func tlsConfig(opts *options.Options) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: opts.TLSInsecureSkipTLSVerify,
+	}
+	if opts.TLSInsecureSkipTLSVerify {
+		log.Warn("TLS certificate verification is disabled (KAFKA_TLS_INSECURE_SKIP_TLS_VERIFY). " +
+			"Any certificate presented by the brokers will be accepted, do not use this in production!")
+	}
+
+	// Load CA file
+	if opts.TLSCAFilePath != "" {
+		ca, err := ioutil.ReadFile(opts.TLSCAFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("CA file '%v' doesn't contain any valid PEM encoded certificate", opts.TLSCAFilePath)
+		}
 	}
 
-	defer f.Close()
+	// Load Cert file, if necessary it will be decrypted with a passphrase too
+	if (opts.TLSCertFilePath == "") != (opts.TLSKeyFilePath == "") {
+		return nil, fmt.Errorf("TLS certificate and key must be supplied as a pair")
+	}
+	if opts.TLSCertFilePath != "" {
+		cert, err := getCert(opts)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = cert
+	}
 
-	return true
+	return config, nil
 }
 
 // getCert returns a Certificate from the CertFile and KeyFile in 'options',
@@ -117,7 +220,7 @@ func getCert(options *options.Options) ([]tls.Certificate, error) {
 		return nil, fmt.Errorf("No file path specified for TLS key and certificate in environment variables")
 	}
 
-	errMessage := "Could not load X509 key pair. "
+	errMessage := "Could not load X509 key pair. %v"
 
 	cert, err := ioutil.ReadFile(options.TLSCertFilePath)
 	if err != nil {
@@ -0,0 +1,203 @@
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/google-cloud-tools/kafka-minion/options"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigureSASL(t *testing.T) {
+	tables := []struct {
+		mechanism string
+		username  string
+		password  string
+		region    string
+		isValid   bool
+	}{
+		{"PLAIN", "minion", "secret", "", true},
+		{"PLAIN", "", "secret", "", false},
+		{"PLAIN", "minion", "", "", false},
+		{"SCRAM-SHA-256", "minion", "secret", "", true},
+		{"SCRAM-SHA-512", "minion", "secret", "", true},
+		{"SCRAM-SHA-512", "minion", "", "", false},
+		{"scram-sha-1", "minion", "secret", "", false},
+		{"OAUTHBEARER", "", "", "eu-west-1", true},
+		{"OAUTHBEARER", "", "", "", false},
+		{"GSSAPI", "minion", "secret", "", false},
+	}
+
+	for _, table := range tables {
+		opts := options.NewOptions()
+		opts.SASLEnabled = true
+		opts.SASLMechanism = table.mechanism
+		opts.SASLUsername = table.username
+		opts.SASLPassword = table.password
+		opts.SASLOAuthProvider = "aws-msk-iam"
+		opts.SASLAWSRegion = table.region
+		clientConfig := sarama.NewConfig()
+		err := configureSASL(clientConfig, opts)
+		if (err == nil) != table.isValid {
+			t.Errorf("SASL config with mechanism %v, username %q and password %q was incorrect, got error: %v, want valid: %v",
+				table.mechanism, table.username, table.password, err, table.isValid)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-minion-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	validCAPath := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(validCAPath, selfSignedCertPEM(t), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+	invalidCAPath := filepath.Join(dir, "invalid.pem")
+	err = ioutil.WriteFile(invalidCAPath, []byte("not a certificate"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	tables := []struct {
+		caFilePath   string
+		certFilePath string
+		keyFilePath  string
+		isValid      bool
+	}{
+		{"", "", "", true},
+		{validCAPath, "", "", true},
+		{invalidCAPath, "", "", false},
+		{filepath.Join(dir, "missing.pem"), "", "", false},
+		{validCAPath, validCAPath, "", false},
+		{validCAPath, "", validCAPath, false},
+	}
+
+	for _, table := range tables {
+		opts := options.NewOptions()
+		opts.TLSCAFilePath = table.caFilePath
+		opts.TLSCertFilePath = table.certFilePath
+		opts.TLSKeyFilePath = table.keyFilePath
+		config, err := tlsConfig(opts)
+		if (err == nil) != table.isValid {
+			t.Errorf("TLS config with CA %q, cert %q and key %q was incorrect, got error: %v, want valid: %v",
+				table.caFilePath, table.certFilePath, table.keyFilePath, err, table.isValid)
+			continue
+		}
+		if err == nil && table.caFilePath == "" && config.RootCAs != nil {
+			t.Errorf("Expected system root CAs to be used if no CA file is configured")
+		}
+	}
+}
+
+// selfSignedCertPEM returns a PEM encoded self signed certificate
+func selfSignedCertPEM(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka-minion-test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestConnectWithRetries(t *testing.T) {
+	opts := options.NewOptions()
+	opts.KafkaConnectRetries = 2
+	opts.KafkaConnectBackoff = time.Millisecond
+	logger := log.WithFields(log.Fields{})
+
+	attempts := 0
+	err := connectWithRetries(opts, logger, func() error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("cluster unreachable")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("Expected success after 3 attempts, got error: %v after %v attempts", err, attempts)
+	}
+
+	attempts = 0
+	err = connectWithRetries(opts, logger, func() error {
+		attempts++
+		return fmt.Errorf("cluster unreachable")
+	})
+	if err == nil || attempts != 3 {
+		t.Errorf("Expected an error after 3 attempts, got error: %v after %v attempts", err, attempts)
+	}
+}
+
+func TestSaramaClientConfigReadsCommittedOnly(t *testing.T) {
+	opts := options.NewOptions()
+	opts.KafkaVersion = "1.0.0"
+	clientConfig := saramaClientConfig(opts)
+	if clientConfig.Consumer.IsolationLevel != sarama.ReadCommitted {
+		t.Errorf("Expected offsets of aborted transactions to be skipped, got isolation level: %v", clientConfig.Consumer.IsolationLevel)
+	}
+}
+
+func TestSaramaClientConfigNet(t *testing.T) {
+	opts := options.NewOptions()
+	opts.KafkaVersion = "1.0.0"
+	opts.KafkaMaxOpenRequests = 1
+	opts.KafkaDialTimeout = 3 * time.Second
+	opts.KafkaReadTimeout = 20 * time.Second
+	opts.KafkaKeepAlive = time.Minute
+	clientConfig := saramaClientConfig(opts)
+	net := clientConfig.Net
+	if net.MaxOpenRequests != 1 || net.DialTimeout != 3*time.Second || net.ReadTimeout != 20*time.Second || net.KeepAlive != time.Minute {
+		t.Errorf("Expected the configured net settings, Got max open requests: %v, dial timeout: %v, read timeout: %v, keep alive: %v",
+			net.MaxOpenRequests, net.DialTimeout, net.ReadTimeout, net.KeepAlive)
+	}
+}
+
+func TestParseKafkaVersion(t *testing.T) {
+	tables := []struct {
+		version string
+		isValid bool
+	}{
+		{"0.11.0.2", true},
+		{"2.1.0", true},
+		{"2.4.0", true},
+		{"2.8.0", true},
+		{"3.0.0", false},
+		{"1.0", false},
+		{"2.1.1", false},
+		{"", false},
+	}
+
+	for _, table := range tables {
+		_, err := ParseKafkaVersion(table.version)
+		if (err == nil) != table.isValid {
+			t.Errorf("Kafka version %q was incorrect, got error: %v, want valid: %v", table.version, err, table.isValid)
+		}
+	}
+}
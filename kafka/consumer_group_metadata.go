@@ -3,8 +3,11 @@ package kafka
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"math"
+	"sort"
 	"strconv"
 )
 
@@ -16,6 +19,74 @@ type ConsumerGroupMetadata struct {
 	Group   string
 	Header  metadataHeader
 	Members []metadataMember
+
+	// InternalPosition is the position of the record in the offsets topic the metadata has been decoded from
+	InternalPosition InternalPosition
+}
+
+// AddMember appends a consumer member with the given partition assignment (topic name to partition IDs). Decoded
+// metadata already contains all members, it's meant for building group metadata by hand, e. g. in tests.
+func (m *ConsumerGroupMetadata) AddMember(memberID string, clientID string, assignment map[string][]int32) {
+	m.Members = append(m.Members, metadataMember{MemberID: memberID, ClientID: clientID, Assignment: assignment})
+}
+
+// IsRebalancing returns true if the group metadata looks like it has been written in the middle of a rebalance: the
+// group has members, but either no protocol has been selected yet, or members subscribed to topics but none of them
+// has been assigned any partition. A single member without partitions is not considered, as stable groups with more
+// members than partitions always have idle members. Kafka Connect members are not considered either, as their
+// assignment contains no partitions.
+func (m *ConsumerGroupMetadata) IsRebalancing() bool {
+	if len(m.Members) == 0 {
+		return false
+	}
+	if m.Header.Protocol == "" {
+		return true
+	}
+	isSubscribed := false
+	for _, member := range m.Members {
+		if member.ConnectAssignment != nil {
+			continue
+		}
+		if len(member.Assignment) > 0 {
+			return false
+		}
+		if len(member.Subscription) > 0 {
+			isSubscribed = true
+		}
+	}
+
+	return isSubscribed
+}
+
+// AssignmentImbalance returns the difference between the max and the min number of partitions assigned to a member.
+// Members without any partition are included, so an imbalance of 0 or 1 means the partitions are distributed as
+// evenly as possible. It returns false if no partition is assigned at all, e. g. for Kafka Connect groups.
+func (m *ConsumerGroupMetadata) AssignmentImbalance() (int, bool) {
+	isAssigned := false
+	maxPartitions, minPartitions := 0, math.MaxInt32
+	for _, member := range m.Members {
+		if member.ConnectAssignment != nil {
+			continue
+		}
+		partitions := 0
+		for _, topicPartitions := range member.Assignment {
+			partitions += len(topicPartitions)
+		}
+		if partitions > 0 {
+			isAssigned = true
+		}
+		if partitions > maxPartitions {
+			maxPartitions = partitions
+		}
+		if partitions < minPartitions {
+			minPartitions = partitions
+		}
+	}
+	if !isAssigned {
+		return 0, false
+	}
+
+	return maxPartitions - minPartitions, true
 }
 
 type metadataHeader struct {
@@ -28,17 +99,36 @@ type metadataHeader struct {
 
 type metadataMember struct {
 	MemberID         string
+	GroupInstanceID  string // Only set for static members (value version 3+)
 	ClientID         string
 	ClientHost       string
-	RebalanceTimeout int32
+	RebalanceTimeout int32 // Not part of version 0 records, hence it's always 0 for those
 	SessionTimeout   int32
+	Subscription     []string // Topics the member has subscribed to
 	Assignment       map[string][]int32
+	// AssignmentUserDataBytes is the size of the user data of the member's assignment (e. g. the standby tasks of a
+	// Kafka Streams instance). The user data itself is skipped to avoid storing large blobs.
+	AssignmentUserDataBytes int32
+	// ConnectAssignment is only set for members of Kafka Connect groups, whose assignments contain connectors and
+	// tasks instead of topic partitions
+	ConnectAssignment *connectAssignment
+}
+
+// connectAssignment is the assignment of a Kafka Connect worker (protocol type "connect")
+type connectAssignment struct {
+	Error        int16 // Set by the leader if the workers' configs are out of sync (e. g. 1 = config mismatch)
+	Leader       string
+	LeaderURL    string
+	ConfigOffset int64
+	Connectors   []string           // Connectors whose instance (rather than one of its tasks) runs on the worker
+	Tasks        map[string][]int32 // Task IDs which run on the worker by connector name
 }
 
 // newConsumerGroupMetadata decodes a kafka message (key and value) to return an instance of
 // the struct consumerGroupMetadata. It returns an error if it could not completely decode
-// the message.
-func newConsumerGroupMetadata(key *bytes.Buffer, value *bytes.Buffer, logger *log.Entry) (*ConsumerGroupMetadata, error) {
+// the message. In lenient mode members whose subscription or assignment can't be decoded are
+// kept without it, instead of failing the whole message.
+func newConsumerGroupMetadata(key *bytes.Buffer, value *bytes.Buffer, lenient bool, logger *log.Entry) (*ConsumerGroupMetadata, error) {
 	// Decode key (resolves to group id)
 	group, err := readString(key)
 	if err != nil {
@@ -46,6 +136,7 @@ func newConsumerGroupMetadata(key *bytes.Buffer, value *bytes.Buffer, logger *lo
 			"message_type": "metadata",
 			"reason":       "group",
 		}).Warn("failed to decode")
+		countDecodeError("metadata", "group")
 		return nil, err
 	}
 
@@ -58,6 +149,7 @@ func newConsumerGroupMetadata(key *bytes.Buffer, value *bytes.Buffer, logger *lo
 			"reason":       "no value version",
 			"group":        group,
 		}).Warn("failed to decode")
+		countDecodeError("metadata", "no value version")
 
 		return nil, err
 	}
@@ -66,8 +158,8 @@ func newConsumerGroupMetadata(key *bytes.Buffer, value *bytes.Buffer, logger *lo
 	// Decode value content
 	var metadata *ConsumerGroupMetadata
 	switch valueVersion {
-	case 0, 1, 2:
-		metadata, err = decodeGroupMetadata(valueVersion, group, value, logger.WithFields(log.Fields{
+	case 0, 1, 2, 3:
+		metadata, err = decodeGroupMetadata(valueVersion, group, value, lenient, logger.WithFields(log.Fields{
 			"message_type": "metadata",
 			"group":        group,
 		}))
@@ -78,6 +170,7 @@ func newConsumerGroupMetadata(key *bytes.Buffer, value *bytes.Buffer, logger *lo
 			"reason":       "value version",
 			"version":      valueVersion,
 		}).Warn("failed to decode")
+		countDecodeError("metadata", "value version")
 
 		return nil, fmt.Errorf("Failed to decode group metadata because value version is not supported")
 	}
@@ -89,7 +182,7 @@ func newConsumerGroupMetadata(key *bytes.Buffer, value *bytes.Buffer, logger *lo
 	return metadata, err
 }
 
-func decodeGroupMetadata(valueVersion int16, group string, valueBuffer *bytes.Buffer, logger *log.Entry) (*ConsumerGroupMetadata, error) {
+func decodeGroupMetadata(valueVersion int16, group string, valueBuffer *bytes.Buffer, lenient bool, logger *log.Entry) (*ConsumerGroupMetadata, error) {
 	// First decode header fields
 	var err error
 	metadataHeader := metadataHeader{}
@@ -98,6 +191,7 @@ func decodeGroupMetadata(valueVersion int16, group string, valueBuffer *bytes.Bu
 		logger.WithFields(log.Fields{
 			"error_at": "metadata header protocol type",
 		}).Warn("failed to decode")
+		countDecodeError("metadata", "metadata header protocol type")
 		return nil, err
 	}
 	err = binary.Read(valueBuffer, binary.BigEndian, &metadataHeader.Generation)
@@ -107,6 +201,7 @@ func decodeGroupMetadata(valueVersion int16, group string, valueBuffer *bytes.Bu
 			"error":         err.Error(),
 			"protocol_type": metadataHeader.ProtocolType,
 		}).Warn("failed to decode")
+		countDecodeError("metadata", "metadata header generation")
 		return nil, err
 	}
 	metadataHeader.Protocol, err = readString(valueBuffer)
@@ -116,6 +211,7 @@ func decodeGroupMetadata(valueVersion int16, group string, valueBuffer *bytes.Bu
 			"protocol_type": metadataHeader.ProtocolType,
 			"generation":    metadataHeader.Generation,
 		}).Warn("failed to decode")
+		countDecodeError("metadata", "metadata header protocol")
 		return nil, err
 	}
 	metadataHeader.Leader, err = readString(valueBuffer)
@@ -126,9 +222,11 @@ func decodeGroupMetadata(valueVersion int16, group string, valueBuffer *bytes.Bu
 			"generation":    metadataHeader.Generation,
 			"protocol":      metadataHeader.Protocol,
 		}).Warn("failed to decode")
+		countDecodeError("metadata", "metadata header leader")
 		return nil, err
 	}
 
+	// Version 2 (Kafka 2.1+) added the currentStateTimestamp to the header
 	if valueVersion >= 2 {
 		err = binary.Read(valueBuffer, binary.BigEndian, &metadataHeader.Timestamp)
 		if err != nil {
@@ -139,6 +237,7 @@ func decodeGroupMetadata(valueVersion int16, group string, valueBuffer *bytes.Bu
 				"protocol":      metadataHeader.Protocol,
 				"timestamp":     metadataHeader.Timestamp,
 			}).Warn("failed to decode")
+			countDecodeError("metadata", "metadata header timestamp")
 			return nil, err
 		}
 	}
@@ -159,22 +258,49 @@ func decodeGroupMetadata(valueVersion int16, group string, valueBuffer *bytes.Bu
 			"error_at": "member count",
 			"reason":   "no member size",
 		}).Warn("failed to decode")
+		countDecodeError("metadata", "no member size")
 		return nil, err
 	}
 
 	members := make([]metadataMember, 0)
+	var skippedMembers []string
 	for i := 0; i < int(memberCount); i++ {
-		member, errorAt := decodeMetadataMember(valueBuffer, valueVersion)
-		if errorAt != "" {
-			metadataLogger.WithFields(log.Fields{
-				"error_at": "metadata member",
-				"reason":   errorAt,
-			}).Warn("failed to decode")
+		member, err := decodeMetadataMember(valueBuffer, valueVersion, metadataHeader.ProtocolType)
+		if err != nil {
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				decodeErr = newDecodeError("metadata member", err)
+			}
+			if !lenient || !decodeErr.Skippable {
+				metadataLogger.WithFields(log.Fields{
+					"error_at": "metadata member",
+					"reason":   decodeErr.Field,
+					"error":    err.Error(),
+				}).Warn("failed to decode")
+				countDecodeError("metadata", decodeErr.Field)
+
+				return nil, err
+			}
 
-			return nil, fmt.Errorf("Decoding member, error at: %v", errorAt)
+			// The subscription and assignment are length prefixed, hence the following members can still be decoded
+			metadataLogger.WithFields(log.Fields{
+				"error_at":  "metadata member",
+				"reason":    decodeErr.Field,
+				"error":     err.Error(),
+				"member_id": member.MemberID,
+				"client_id": member.ClientID,
+			}).Warn("failed to decode member subscription or assignment, skipping it")
+			countDecodeError("metadata", decodeErr.Field)
+			skippedMembers = append(skippedMembers, member.MemberID)
 		}
 		members = append(members, member)
 	}
+	if len(skippedMembers) > 0 {
+		metadataLogger.WithFields(log.Fields{
+			"skipped_members": skippedMembers,
+		}).Warn("applied group metadata with members whose subscription or assignment couldn't be decoded")
+	}
+	logGroupMetadataSummary(metadataLogger, members)
 
 	return &ConsumerGroupMetadata{
 		Group:   group,
@@ -183,109 +309,327 @@ func decodeGroupMetadata(valueVersion int16, group string, valueBuffer *bytes.Bu
 	}, nil
 }
 
-func decodeMetadataMember(buf *bytes.Buffer, memberVersion int16) (metadataMember, string) {
+// logGroupMetadataSummary logs a single debug line per group metadata record. The assignments of each member are
+// only logged on trace level, because large groups would produce thousands of log lines per record otherwise.
+func logGroupMetadataSummary(logger *log.Entry, members []metadataMember) {
+	topics := make(map[string]bool)
+	partitionCount := 0
+	for _, member := range members {
+		for topic, partitions := range member.Assignment {
+			topics[topic] = true
+			partitionCount += len(partitions)
+			if logger.Logger.IsLevelEnabled(log.TraceLevel) {
+				logger.WithFields(log.Fields{
+					"member_id":   member.MemberID,
+					"client_id":   member.ClientID,
+					"client_host": member.ClientHost,
+					"topic":       topic,
+					"partitions":  partitions,
+				}).Trace("decoded group member assignment")
+			}
+		}
+	}
+
+	logger.WithFields(log.Fields{
+		"member_count":    len(members),
+		"topic_count":     len(topics),
+		"partition_count": partitionCount,
+	}).Debug("decoded group metadata")
+}
+
+// decodeMetadataMember decodes a single member of a group metadata record. If the member itself can't be decoded,
+// the buffer doesn't point to the next member and the returned DecodeError is not skippable. If the member's
+// subscription or assignment can't be decoded, the returned DecodeError is skippable. Both are length prefixed,
+// hence the member has still been read completely and only the undecodable part is missing.
+func decodeMetadataMember(buf *bytes.Buffer, memberVersion int16, protocolType string) (metadataMember, error) {
 	var err error
 	memberMetadata := metadataMember{}
 
 	memberMetadata.MemberID, err = readString(buf)
 	if err != nil {
-		return memberMetadata, "member_id"
+		return memberMetadata, newDecodeError("member_id", err)
+	}
+	// Version 3 (Kafka 2.3+) added the group instance id for static group membership (KIP-345)
+	if memberVersion >= 3 {
+		memberMetadata.GroupInstanceID, err = readString(buf)
+		if err != nil {
+			return memberMetadata, newDecodeError("group_instance_id", err)
+		}
 	}
 	memberMetadata.ClientID, err = readString(buf)
 	if err != nil {
-		return memberMetadata, "client_id"
+		return memberMetadata, newDecodeError("client_id", err)
 	}
 	memberMetadata.ClientHost, err = readString(buf)
 	if err != nil {
-		return memberMetadata, "client_host"
+		return memberMetadata, newDecodeError("client_host", err)
 	}
 	if memberVersion >= 1 {
 		err = binary.Read(buf, binary.BigEndian, &memberMetadata.RebalanceTimeout)
 		if err != nil {
-			return memberMetadata, "rebalance_timeout"
+			return memberMetadata, newDecodeError("rebalance_timeout", err)
 		}
 	}
 	err = binary.Read(buf, binary.BigEndian, &memberMetadata.SessionTimeout)
 	if err != nil {
-		return memberMetadata, "session_timeout"
+		return memberMetadata, newDecodeError("session_timeout", err)
 	}
 
+	var protocolErr *DecodeError
 	var subscriptionBytes int32
 	err = binary.Read(buf, binary.BigEndian, &subscriptionBytes)
 	if err != nil {
-		return memberMetadata, "subscription_bytes"
+		return memberMetadata, newDecodeError("subscription_bytes", err)
 	}
 	if subscriptionBytes > 0 {
-		buf.Next(int(subscriptionBytes))
+		subscriptionData := buf.Next(int(subscriptionBytes))
+		// Other protocol types (e. g. Kafka connect) use their own subscription format
+		if protocolType == "consumer" {
+			subscription, err := decodeMemberSubscription(bytes.NewBuffer(subscriptionData))
+			if err != nil {
+				protocolErr = err
+			} else {
+				memberMetadata.Subscription = subscription
+			}
+		}
 	}
 
 	var assignmentBytes int32
 	err = binary.Read(buf, binary.BigEndian, &assignmentBytes)
 	if err != nil {
-		return memberMetadata, "assignment_bytes"
+		return memberMetadata, newDecodeError("assignment_bytes", err)
 	}
 
-	if assignmentBytes > 0 {
+	if assignmentBytes > 0 && protocolType == "connect" {
 		assignmentData := buf.Next(int(assignmentBytes))
-		assignmentBuf := bytes.NewBuffer(assignmentData)
-		var consumerProtocolVersion int16
-		err = binary.Read(assignmentBuf, binary.BigEndian, &consumerProtocolVersion)
-		if err != nil {
-			return memberMetadata, "consumer_protocol_version"
-		}
-		if consumerProtocolVersion < 0 {
-			return memberMetadata, "consumer_protocol_version"
+		assignment, err := decodeConnectAssignment(bytes.NewBuffer(assignmentData))
+		if err != nil && protocolErr == nil {
+			protocolErr = err
 		}
-		assignment, errorAt := decodeMemberAssignmentV0(assignmentBuf)
-		if errorAt != "" {
-			return memberMetadata, "assignment"
+		memberMetadata.ConnectAssignment = assignment
+	} else if assignmentBytes > 0 {
+		assignmentData := buf.Next(int(assignmentBytes))
+		assignment, userDataBytes, err := decodeMemberAssignment(bytes.NewBuffer(assignmentData))
+		if err != nil && protocolErr == nil {
+			protocolErr = err
 		}
 		memberMetadata.Assignment = assignment
+		memberMetadata.AssignmentUserDataBytes = userDataBytes
+	}
+
+	if protocolErr != nil {
+		protocolErr.Skippable = true
+		return memberMetadata, protocolErr
+	}
+
+	return memberMetadata, nil
+}
+
+// decodeMemberAssignment decodes the consumer protocol assignment of a member, prefixed by the protocol version. It
+// returns the assigned partitions along with the size of the assignment's user data.
+func decodeMemberAssignment(buf *bytes.Buffer) (map[string][]int32, int32, *DecodeError) {
+	var consumerProtocolVersion int16
+	err := binary.Read(buf, binary.BigEndian, &consumerProtocolVersion)
+	if err != nil {
+		return nil, 0, newDecodeError("consumer_protocol_version", err)
+	}
+	if consumerProtocolVersion < 0 {
+		return nil, 0, newDecodeError("consumer_protocol_version", fmt.Errorf("negative version %d", consumerProtocolVersion))
+	}
+
+	var assignment map[string][]int32
+	var userDataBytes int32
+	var decodeErr *DecodeError
+	switch consumerProtocolVersion {
+	case 0:
+		assignment, userDataBytes, decodeErr = decodeMemberAssignmentV0(buf)
+	default:
+		assignment, userDataBytes, decodeErr = decodeMemberAssignmentV1(buf)
+	}
+	if decodeErr != nil {
+		return nil, 0, newDecodeError("assignment", decodeErr)
 	}
 
-	return memberMetadata, ""
+	return assignment, userDataBytes, nil
 }
 
-func decodeMemberAssignmentV0(buf *bytes.Buffer) (map[string][]int32, string) {
+// decodeMemberSubscription decodes the topic list of a consumer protocol subscription. Newer subscription
+// versions append further fields (owned partitions, generation, rack) which we don't need and therefore
+// ignore. Subscriptions with an unknown (negative) version are skipped.
+func decodeMemberSubscription(buf *bytes.Buffer) ([]string, *DecodeError) {
+	var err error
+	var version int16
+	var numTopics, userDataLen int32
+
+	err = binary.Read(buf, binary.BigEndian, &version)
+	if err != nil {
+		return nil, newDecodeError("subscription_version", err)
+	}
+	if version < 0 {
+		return nil, nil
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &numTopics)
+	if err != nil {
+		return nil, newDecodeError("subscription_topic_count", err)
+	}
+	topics := make([]string, 0)
+	for i := 0; i < int(numTopics); i++ {
+		topicName, err := readString(buf)
+		if err != nil {
+			return nil, newDecodeError("subscription_topic_name", err)
+		}
+		topics = append(topics, topicName)
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &userDataLen)
+	if err != nil {
+		return nil, newDecodeError("subscription_user_bytes", err)
+	}
+	if userDataLen > 0 {
+		buf.Next(int(userDataLen))
+	}
+
+	return topics, nil
+}
+
+func decodeMemberAssignmentV0(buf *bytes.Buffer) (map[string][]int32, int32, *DecodeError) {
 	var err error
 	var topics map[string][]int32
 	var numTopics, numPartitions, partitionID, userDataLen int32
 
 	err = binary.Read(buf, binary.BigEndian, &numTopics)
 	if err != nil {
-		return topics, "assignment_topic_count"
+		return topics, 0, newDecodeError("assignment_topic_count", err)
 	}
 
+	// Each topic requires at least its name's length (int16) and its partition count (int32). Validating the counts
+	// against the remaining bytes upfront prevents huge allocations caused by corrupt records.
+	if numTopics < 0 || int64(numTopics)*6 > int64(buf.Len()) {
+		return nil, 0, newDecodeError("assignment_topic_count", errInvalidCount(numTopics, buf))
+	}
 	topicCount := int(numTopics)
 	topics = make(map[string][]int32, numTopics)
 	for i := 0; i < topicCount; i++ {
 		topicName, err := readString(buf)
 		if err != nil {
-			return topics, "topic_name"
+			return topics, 0, newDecodeError("topic_name", err)
 		}
 
 		err = binary.Read(buf, binary.BigEndian, &numPartitions)
 		if err != nil {
-			return topics, "assignment_partition_count"
+			return topics, 0, newDecodeError("assignment_partition_count", err)
+		}
+		if numPartitions < 0 || int64(numPartitions)*4 > int64(buf.Len()) {
+			return topics, 0, newDecodeError("assignment_partition_count", errInvalidCount(numPartitions, buf))
 		}
 		partitionCount := int(numPartitions)
 		topics[topicName] = make([]int32, numPartitions)
 		for j := 0; j < partitionCount; j++ {
 			err = binary.Read(buf, binary.BigEndian, &partitionID)
 			if err != nil {
-				return topics, "assignment_partition_id"
+				return topics, 0, newDecodeError("assignment_partition_id", err)
+			}
+			if partitionID < 0 {
+				return topics, 0, newDecodeError("assignment_partition_id", fmt.Errorf("negative partition id %d", partitionID))
 			}
 			topics[topicName][j] = int32(partitionID)
 		}
+		// Assignors write the partitions in arbitrary order, sorting them keeps metrics and snapshots deterministic
+		sort.Slice(topics[topicName], func(a, b int) bool {
+			return topics[topicName][a] < topics[topicName][b]
+		})
 	}
 
 	err = binary.Read(buf, binary.BigEndian, &userDataLen)
 	if err != nil {
-		return topics, "user_bytes"
+		return topics, 0, newDecodeError("user_bytes", err)
 	}
-	if userDataLen > 0 {
-		buf.Next(int(userDataLen))
+	// Null user data has a length of -1
+	if userDataLen <= 0 {
+		return topics, 0, nil
+	}
+	userData := buf.Next(int(userDataLen))
+
+	return topics, int32(len(userData)), nil
+}
+
+// decodeMemberAssignmentV1 decodes consumer protocol assignments of version 1 and newer. Version 1 (and later 2 & 3)
+// only changed the subscription schema. Assignments still start with the assigned topic partitions followed by
+// the (nullable) user data. Fields which might be appended by future versions are not read.
+func decodeMemberAssignmentV1(buf *bytes.Buffer) (map[string][]int32, int32, *DecodeError) {
+	return decodeMemberAssignmentV0(buf)
+}
+
+// connectorTask is the task ID which is used to assign the connector instance itself rather than one of its tasks
+const connectorTask = -1
+
+// decodeConnectAssignment decodes the assignment of a Kafka Connect worker. Version 1+ (incremental cooperative
+// rebalancing) appends the revoked connectors and tasks and the delay of the next rebalance, which are not read.
+func decodeConnectAssignment(buf *bytes.Buffer) (*connectAssignment, *DecodeError) {
+	var err error
+	var version int16
+	assignment := &connectAssignment{}
+
+	err = binary.Read(buf, binary.BigEndian, &version)
+	if err != nil {
+		return nil, newDecodeError("connect_assignment_version", err)
+	}
+	if version < 0 {
+		return nil, newDecodeError("connect_assignment_version", fmt.Errorf("negative version %d", version))
+	}
+	err = binary.Read(buf, binary.BigEndian, &assignment.Error)
+	if err != nil {
+		return nil, newDecodeError("connect_assignment_error", err)
+	}
+	assignment.Leader, err = readString(buf)
+	if err != nil {
+		return nil, newDecodeError("connect_assignment_leader", err)
+	}
+	assignment.LeaderURL, err = readString(buf)
+	if err != nil {
+		return nil, newDecodeError("connect_assignment_leader_url", err)
+	}
+	err = binary.Read(buf, binary.BigEndian, &assignment.ConfigOffset)
+	if err != nil {
+		return nil, newDecodeError("connect_assignment_config_offset", err)
+	}
+
+	var numConnectors, numTasks, taskID int32
+	err = binary.Read(buf, binary.BigEndian, &numConnectors)
+	if err != nil {
+		return nil, newDecodeError("connect_assignment_connector_count", err)
+	}
+	// Each connector requires at least its name's length (int16) and its task count (int32)
+	if numConnectors < 0 || int64(numConnectors)*6 > int64(buf.Len()) {
+		return nil, newDecodeError("connect_assignment_connector_count", errInvalidCount(numConnectors, buf))
+	}
+	assignment.Connectors = make([]string, 0)
+	assignment.Tasks = make(map[string][]int32)
+	for i := 0; i < int(numConnectors); i++ {
+		connector, err := readString(buf)
+		if err != nil {
+			return nil, newDecodeError("connect_assignment_connector", err)
+		}
+		err = binary.Read(buf, binary.BigEndian, &numTasks)
+		if err != nil {
+			return nil, newDecodeError("connect_assignment_task_count", err)
+		}
+		if numTasks < 0 || int64(numTasks)*4 > int64(buf.Len()) {
+			return nil, newDecodeError("connect_assignment_task_count", errInvalidCount(numTasks, buf))
+		}
+		for j := 0; j < int(numTasks); j++ {
+			err = binary.Read(buf, binary.BigEndian, &taskID)
+			if err != nil {
+				return nil, newDecodeError("connect_assignment_task_id", err)
+			}
+			if taskID == connectorTask {
+				assignment.Connectors = append(assignment.Connectors, connector)
+				continue
+			}
+			assignment.Tasks[connector] = append(assignment.Tasks[connector], taskID)
+		}
 	}
 
-	return topics, ""
+	return assignment, nil
 }
@@ -0,0 +1,519 @@
+package kafka
+
+import (
+	"bytes"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"testing"
+)
+
+// groupMetadataKey returns the key of a group metadata message without the leading key version
+func groupMetadataKey(group string) *bytes.Buffer {
+	key := &bytes.Buffer{}
+	writeString(key, group)
+	return key
+}
+
+// memberAssignmentV0 encodes a consumer protocol assignment (version 0) for the given topic partitions
+func memberAssignmentV0(topic string, partitions []int32) []byte {
+	buf := &bytes.Buffer{}
+	writeInt16(buf, 0)
+	writeInt32(buf, 1)
+	writeString(buf, topic)
+	writeInt32(buf, int32(len(partitions)))
+	for _, partition := range partitions {
+		writeInt32(buf, partition)
+	}
+	writeInt32(buf, -1)
+	return buf.Bytes()
+}
+
+func TestNewConsumerGroupMetadata(t *testing.T) {
+	value := &bytes.Buffer{}
+	writeInt16(value, 1)
+	writeString(value, "consumer")
+	writeInt32(value, 5)
+	writeString(value, "range")
+	writeString(value, "consumer-1-5ad5c4f2")
+	writeInt32(value, 1)
+
+	writeString(value, "consumer-1-5ad5c4f2")
+	writeString(value, "consumer-1")
+	writeString(value, "/10.0.0.5")
+	writeInt32(value, 300000)
+	writeInt32(value, 10000)
+	writeBytes(value, []byte{})
+	writeBytes(value, memberAssignmentV0("orders", []int32{0, 1, 2}))
+
+	logger := log.WithFields(log.Fields{})
+	metadata, err := newConsumerGroupMetadata(groupMetadataKey("order-processor"), value, false, logger)
+	if err != nil {
+		t.Fatalf("Failed to decode group metadata: %v", err)
+	}
+
+	if metadata.Group != "order-processor" {
+		t.Errorf("Expected group: %v , Got: %v", "order-processor", metadata.Group)
+	}
+	wantHeader := metadataHeader{
+		ProtocolType: "consumer",
+		Generation:   5,
+		Protocol:     "range",
+		Leader:       "consumer-1-5ad5c4f2",
+	}
+	if metadata.Header != wantHeader {
+		t.Errorf("Expected header: %+v , Got: %+v", wantHeader, metadata.Header)
+	}
+	if len(metadata.Members) != 1 {
+		t.Fatalf("Expected 1 member, Got: %v", len(metadata.Members))
+	}
+	member := metadata.Members[0]
+	if member.ClientID != "consumer-1" || member.ClientHost != "/10.0.0.5" {
+		t.Errorf("Unexpected member client information: %+v", member)
+	}
+	wantAssignment := map[string][]int32{"orders": {0, 1, 2}}
+	if !reflect.DeepEqual(member.Assignment, wantAssignment) {
+		t.Errorf("Expected assignment: %v , Got: %v", wantAssignment, member.Assignment)
+	}
+}
+
+func TestNewConsumerGroupMetadataV3(t *testing.T) {
+	value := &bytes.Buffer{}
+	writeInt16(value, 3)
+	writeString(value, "consumer")
+	writeInt32(value, 12)
+	writeString(value, "cooperative-sticky")
+	writeString(value, "consumer-1-89d6e7a1")
+	writeInt64(value, 1571651527598)
+	writeInt32(value, 1)
+
+	writeString(value, "consumer-1-89d6e7a1")
+	writeString(value, "order-processor-0")
+	writeString(value, "consumer-1")
+	writeString(value, "/10.0.0.7")
+	writeInt32(value, 300000)
+	writeInt32(value, 45000)
+	writeBytes(value, []byte{})
+	writeBytes(value, memberAssignmentV0("orders", []int32{3}))
+
+	logger := log.WithFields(log.Fields{})
+	metadata, err := newConsumerGroupMetadata(groupMetadataKey("order-processor"), value, false, logger)
+	if err != nil {
+		t.Fatalf("Failed to decode group metadata: %v", err)
+	}
+
+	if metadata.Header.Timestamp != 1571651527598 {
+		t.Errorf("Expected current state timestamp: %v , Got: %v", 1571651527598, metadata.Header.Timestamp)
+	}
+	if len(metadata.Members) != 1 {
+		t.Fatalf("Expected 1 member, Got: %v", len(metadata.Members))
+	}
+	member := metadata.Members[0]
+	if member.GroupInstanceID != "order-processor-0" {
+		t.Errorf("Expected group instance id: %v , Got: %v", "order-processor-0", member.GroupInstanceID)
+	}
+	if member.ClientID != "consumer-1" || member.ClientHost != "/10.0.0.7" {
+		t.Errorf("Unexpected member client information: %+v", member)
+	}
+	if member.SessionTimeout != 45000 {
+		t.Errorf("Expected session timeout: %v , Got: %v", 45000, member.SessionTimeout)
+	}
+}
+
+func TestNewConsumerGroupMetadataWithoutMembers(t *testing.T) {
+	// Record written by the coordinator once the last member left the group, protocol and leader are null then
+	value := &bytes.Buffer{}
+	writeInt16(value, 2)
+	writeString(value, "consumer")
+	writeInt32(value, 8)
+	writeInt16(value, -1)
+	writeInt16(value, -1)
+	writeInt64(value, 1571651527598)
+	writeInt32(value, 0)
+
+	logger := log.WithFields(log.Fields{})
+	metadata, err := newConsumerGroupMetadata(groupMetadataKey("order-processor"), value, false, logger)
+	if err != nil {
+		t.Fatalf("Failed to decode group metadata: %v", err)
+	}
+	if metadata.Group != "order-processor" || metadata.Header.Generation != 8 {
+		t.Errorf("Unexpected group metadata: %+v", metadata)
+	}
+	if metadata.Members == nil || len(metadata.Members) != 0 {
+		t.Errorf("Expected an empty member list, Got: %#v", metadata.Members)
+	}
+}
+
+func TestNewConsumerGroupMetadataLenient(t *testing.T) {
+	// The assignment of the first member is truncated, the second member is valid
+	newValue := func() *bytes.Buffer {
+		value := &bytes.Buffer{}
+		writeInt16(value, 1)
+		writeString(value, "consumer")
+		writeInt32(value, 5)
+		writeString(value, "range")
+		writeString(value, "consumer-1-5ad5c4f2")
+		writeInt32(value, 2)
+
+		writeString(value, "consumer-1-5ad5c4f2")
+		writeString(value, "consumer-1")
+		writeString(value, "/10.0.0.5")
+		writeInt32(value, 300000)
+		writeInt32(value, 10000)
+		writeBytes(value, []byte{})
+		writeBytes(value, memberAssignmentV0("orders", []int32{0, 1})[:12])
+
+		writeString(value, "consumer-2-a1b2c3d4")
+		writeString(value, "consumer-2")
+		writeString(value, "/10.0.0.6")
+		writeInt32(value, 300000)
+		writeInt32(value, 10000)
+		writeBytes(value, []byte{})
+		writeBytes(value, memberAssignmentV0("orders", []int32{2}))
+		return value
+	}
+	logger := log.WithFields(log.Fields{})
+
+	_, err := newConsumerGroupMetadata(groupMetadataKey("order-processor"), newValue(), false, logger)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Field != "assignment" || !decodeErr.Skippable {
+		t.Errorf("Expected a skippable decode error of the assignment in strict mode, Got: %v", err)
+	}
+
+	metadata, err := newConsumerGroupMetadata(groupMetadataKey("order-processor"), newValue(), true, logger)
+	if err != nil {
+		t.Fatalf("Failed to decode group metadata in lenient mode: %v", err)
+	}
+	if len(metadata.Members) != 2 {
+		t.Fatalf("Expected 2 members, Got: %v", len(metadata.Members))
+	}
+	if metadata.Members[0].ClientID != "consumer-1" || metadata.Members[0].Assignment != nil {
+		t.Errorf("Expected consumer-1 without assignment, Got: %+v", metadata.Members[0])
+	}
+	want := map[string][]int32{"orders": {2}}
+	if metadata.Members[1].ClientID != "consumer-2" || !reflect.DeepEqual(metadata.Members[1].Assignment, want) {
+		t.Errorf("Expected consumer-2 with assignment %v, Got: %+v", want, metadata.Members[1])
+	}
+}
+
+// memberSubscription encodes a consumer protocol subscription for the given topics
+func memberSubscription(version int16, topics []string) []byte {
+	buf := &bytes.Buffer{}
+	writeInt16(buf, version)
+	writeInt32(buf, int32(len(topics)))
+	for _, topic := range topics {
+		writeString(buf, topic)
+	}
+	writeBytes(buf, []byte("user-data"))
+	return buf.Bytes()
+}
+
+func TestDecodeMemberSubscription(t *testing.T) {
+	tables := []struct {
+		data []byte
+		want []string
+	}{
+		{memberSubscription(0, []string{}), []string{}},
+		{memberSubscription(0, []string{"orders", "payments"}), []string{"orders", "payments"}},
+		{memberSubscription(1, []string{"orders"}), []string{"orders"}},
+		{memberSubscription(-1, []string{"orders"}), nil},
+	}
+
+	for _, table := range tables {
+		topics, err := decodeMemberSubscription(bytes.NewBuffer(table.data))
+		if err != nil {
+			t.Errorf("Failed to decode subscription: %v", err)
+		}
+		if !reflect.DeepEqual(topics, table.want) {
+			t.Errorf("Expected: %v , Got: %v", table.want, topics)
+		}
+	}
+}
+
+func TestDecodeMetadataMemberSubscription(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeString(buf, "consumer-1-5ad5c4f2")
+	writeString(buf, "consumer-1")
+	writeString(buf, "/10.0.0.5")
+	writeInt32(buf, 300000)
+	writeInt32(buf, 10000)
+	writeBytes(buf, memberSubscription(0, []string{"orders"}))
+	writeBytes(buf, memberAssignmentV0("orders", []int32{0}))
+	writeString(buf, "trailing")
+
+	member, err := decodeMetadataMember(buf, 1, "consumer")
+	if err != nil {
+		t.Fatalf("Failed to decode member: %v", err)
+	}
+	if !reflect.DeepEqual(member.Subscription, []string{"orders"}) {
+		t.Errorf("Expected subscription: %v , Got: %v", []string{"orders"}, member.Subscription)
+	}
+
+	// The buffer must point to the data behind the member
+	trailing, err := readString(buf)
+	if err != nil || trailing != "trailing" {
+		t.Errorf("Buffer was not advanced correctly, Got: %v", trailing)
+	}
+}
+
+func TestDecodeMetadataMemberTimeouts(t *testing.T) {
+	// Version 0 members do not have a rebalance timeout
+	v0 := &bytes.Buffer{}
+	writeString(v0, "consumer-1-5ad5c4f2")
+	writeString(v0, "consumer-1")
+	writeString(v0, "/10.0.0.5")
+	writeInt32(v0, 30000)
+	writeBytes(v0, []byte{})
+	writeBytes(v0, []byte{})
+
+	v1 := &bytes.Buffer{}
+	writeString(v1, "consumer-1-5ad5c4f2")
+	writeString(v1, "consumer-1")
+	writeString(v1, "/10.0.0.5")
+	writeInt32(v1, 300000)
+	writeInt32(v1, 30000)
+	writeBytes(v1, []byte{})
+	writeBytes(v1, []byte{})
+
+	tables := []struct {
+		buf              *bytes.Buffer
+		version          int16
+		rebalanceTimeout int32
+		sessionTimeout   int32
+	}{
+		{v0, 0, 0, 30000},
+		{v1, 1, 300000, 30000},
+	}
+
+	for _, table := range tables {
+		member, err := decodeMetadataMember(table.buf, table.version, "consumer")
+		if err != nil {
+			t.Fatalf("Failed to decode member version %v: %v", table.version, err)
+		}
+		if member.RebalanceTimeout != table.rebalanceTimeout {
+			t.Errorf("Expected rebalance timeout for version %v: %v , Got: %v", table.version, table.rebalanceTimeout, member.RebalanceTimeout)
+		}
+		if member.SessionTimeout != table.sessionTimeout {
+			t.Errorf("Expected session timeout for version %v: %v , Got: %v", table.version, table.sessionTimeout, member.SessionTimeout)
+		}
+	}
+}
+
+func TestDecodeMetadataMemberAssignmentV1(t *testing.T) {
+	// Assignment as written by librdkafka (cooperative-sticky assignor), consumer protocol version 1
+	assignment := []byte("\x00\x01" + // version
+		"\x00\x00\x00\x02" + // topic count
+		"\x00\x06orders\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x02" +
+		"\x00\x08payments\x00\x00\x00\x01\x00\x00\x00\x05" +
+		"\xff\xff\xff\xff") // null user data
+
+	buf := &bytes.Buffer{}
+	writeString(buf, "rdkafka-3c4e1f7a")
+	writeString(buf, "rdkafka")
+	writeString(buf, "/10.0.0.9")
+	writeInt32(buf, 300000)
+	writeInt32(buf, 45000)
+	writeBytes(buf, []byte{})
+	writeBytes(buf, assignment)
+
+	member, err := decodeMetadataMember(buf, 2, "consumer")
+	if err != nil {
+		t.Fatalf("Failed to decode member: %v", err)
+	}
+	want := map[string][]int32{"orders": {0, 2}, "payments": {5}}
+	if !reflect.DeepEqual(member.Assignment, want) {
+		t.Errorf("Expected assignment: %v , Got: %v", want, member.Assignment)
+	}
+}
+
+func TestDecodeMemberAssignmentV0SortsPartitions(t *testing.T) {
+	assignment := memberAssignmentV0("orders", []int32{7, 2, 11, 0, 5})
+	// Skip the consumer protocol version
+	topics, _, err := decodeMemberAssignmentV0(bytes.NewBuffer(assignment[2:]))
+	if err != nil {
+		t.Fatalf("Failed to decode assignment: %v", err)
+	}
+	want := []int32{0, 2, 5, 7, 11}
+	if !reflect.DeepEqual(topics["orders"], want) {
+		t.Errorf("Expected sorted partitions: %v , Got: %v", want, topics["orders"])
+	}
+}
+
+func TestDecodeMemberAssignmentUserData(t *testing.T) {
+	withUserData := memberAssignmentV0("orders", []int32{0})
+	// Replace the null user data with 5 bytes of user data
+	withUserData = append(withUserData[:len(withUserData)-4], []byte("\x00\x00\x00\x05standby")...)
+
+	tables := []struct {
+		name          string
+		assignment    []byte
+		userDataBytes int32
+	}{
+		{"null user data", memberAssignmentV0("orders", []int32{0}), 0},
+		{"user data", withUserData, 5},
+	}
+	for _, table := range tables {
+		_, userDataBytes, err := decodeMemberAssignment(bytes.NewBuffer(table.assignment))
+		if err != nil {
+			t.Fatalf("Failed to decode assignment with %v: %v", table.name, err)
+		}
+		if userDataBytes != table.userDataBytes {
+			t.Errorf("Expected %v user data bytes for assignment with %v, Got: %v", table.userDataBytes, table.name, userDataBytes)
+		}
+	}
+}
+
+func TestDecodeMemberAssignmentV0InvalidCounts(t *testing.T) {
+	tables := []struct {
+		name       string
+		assignment []byte
+		errorAt    string
+	}{
+		{"negative topic count", []byte("\xff\xff\xff\xff"), "assignment_topic_count"},
+		{"huge topic count", []byte("\x7f\xff\xff\xff\x00\x06orders"), "assignment_topic_count"},
+		{"negative partition count", []byte("\x00\x00\x00\x01\x00\x06orders\xff\xff\xff\xfe"), "assignment_partition_count"},
+		{"huge partition count", []byte("\x00\x00\x00\x01\x00\x06orders\x7f\xff\xff\xff\x00\x00\x00\x01"), "assignment_partition_count"},
+		{"truncated topic count", []byte("\x00\x00"), "assignment_topic_count"},
+		{"truncated partition count", []byte("\x00\x00\x00\x01\x00\x06orders\x00\x00"), "assignment_partition_count"},
+		{"truncated partition id", []byte("\x00\x00\x00\x01\x00\x06orders\x00\x00\x00\x01\x00\x00"), "assignment_partition_count"},
+		{"negative partition id", []byte("\x00\x00\x00\x01\x00\x06orders\x00\x00\x00\x01\xff\xff\xff\xff\xff\xff\xff\xff"), "assignment_partition_id"},
+		{"truncated user data", []byte("\x00\x00\x00\x01\x00\x06orders\x00\x00\x00\x01\x00\x00\x00\x03"), "user_bytes"},
+	}
+
+	for _, table := range tables {
+		_, _, decodeErr := decodeMemberAssignmentV0(bytes.NewBuffer(table.assignment))
+		if decodeErr == nil || decodeErr.Field != table.errorAt {
+			t.Errorf("Decoding assignment with %v failed with: %v, want failure at: %q", table.name, decodeErr, table.errorAt)
+		}
+	}
+}
+
+func TestNewConsumerGroupMetadataConnect(t *testing.T) {
+	// Subscription and assignment of a Kafka Connect worker using the "sessioned" protocol (version 2)
+	subscription := []byte("\x00\x02" + // version
+		"\x00\x15http://10.0.0.3:8083/" + // url
+		"\x00\x00\x00\x00\x00\x00\x00\x2a" + // config offset
+		"\xff\xff\xff\xff") // no previous assignment
+	assignment := []byte("\x00\x02" + // version
+		"\x00\x00" + // error
+		"\x00\x1cconnect-1-0d7d1a44-3f63-4c0e" + // leader
+		"\x00\x15http://10.0.0.3:8083/" + // leader url
+		"\x00\x00\x00\x00\x00\x00\x00\x2a" + // config offset
+		"\x00\x00\x00\x02" + // connector count
+		"\x00\x0as3-sink-v1\x00\x00\x00\x02\xff\xff\xff\xff\x00\x00\x00\x01" + // connector instance and task 1
+		"\x00\x0cjdbc-source1\x00\x00\x00\x01\x00\x00\x00\x00" + // task 0
+		"\x00\x00\x00\x00" + // revoked connector count
+		"\x00\x00\x00\x00") // scheduled delay
+
+	value := &bytes.Buffer{}
+	writeInt16(value, 3)
+	writeString(value, "connect")
+	writeInt32(value, 4)
+	writeString(value, "sessioned")
+	writeString(value, "connect-1-0d7d1a44-3f63-4c0e")
+	writeInt64(value, 1571651527598)
+	writeInt32(value, 1)
+
+	writeString(value, "connect-1-0d7d1a44-3f63-4c0e")
+	writeInt16(value, -1)
+	writeString(value, "connect-1")
+	writeString(value, "/10.0.0.3")
+	writeInt32(value, 60000)
+	writeInt32(value, 10000)
+	writeBytes(value, subscription)
+	writeBytes(value, assignment)
+
+	logger := log.WithFields(log.Fields{})
+	metadata, err := newConsumerGroupMetadata(groupMetadataKey("connect-cluster"), value, false, logger)
+	if err != nil {
+		t.Fatalf("Failed to decode group metadata: %v", err)
+	}
+	if len(metadata.Members) != 1 {
+		t.Fatalf("Expected 1 member, Got: %v", len(metadata.Members))
+	}
+	member := metadata.Members[0]
+	if len(member.Assignment) != 0 || len(member.Subscription) != 0 {
+		t.Errorf("Expected no topic partitions for a connect worker, Got: %v and %v", member.Assignment, member.Subscription)
+	}
+	connect := member.ConnectAssignment
+	if connect == nil {
+		t.Fatalf("Expected a connect assignment")
+	}
+	if connect.LeaderURL != "http://10.0.0.3:8083/" || connect.ConfigOffset != 42 {
+		t.Errorf("Unexpected connect assignment: %+v", connect)
+	}
+	if !reflect.DeepEqual(connect.Connectors, []string{"s3-sink-v1"}) {
+		t.Errorf("Expected connector instance of s3-sink-v1, Got: %v", connect.Connectors)
+	}
+	wantTasks := map[string][]int32{"s3-sink-v1": {1}, "jdbc-source1": {0}}
+	if !reflect.DeepEqual(connect.Tasks, wantTasks) {
+		t.Errorf("Expected tasks: %v, Got: %v", wantTasks, connect.Tasks)
+	}
+}
+
+func TestConsumerGroupMetadataIsRebalancing(t *testing.T) {
+	assigned := metadataMember{MemberID: "assigned", Subscription: []string{"orders"}, Assignment: map[string][]int32{"orders": {0}}}
+	unassigned := metadataMember{MemberID: "unassigned", Subscription: []string{"orders"}}
+	otherUnassigned := metadataMember{MemberID: "other-unassigned", Subscription: []string{"orders"}}
+	worker := metadataMember{MemberID: "worker", ConnectAssignment: &connectAssignment{}}
+	tables := []struct {
+		protocol      string
+		members       []metadataMember
+		isRebalancing bool
+	}{
+		{"range", []metadataMember{assigned}, false},
+		{"range", nil, false},
+		{"", nil, false},
+		{"", []metadataMember{assigned}, true},
+		{"range", []metadataMember{unassigned, otherUnassigned}, true},
+		// More members than partitions, stable
+		{"range", []metadataMember{assigned, unassigned}, false},
+		{"sessioned", []metadataMember{worker}, false},
+	}
+
+	for _, table := range tables {
+		metadata := ConsumerGroupMetadata{Group: "sample-group", Header: metadataHeader{Protocol: table.protocol}, Members: table.members}
+		if metadata.IsRebalancing() != table.isRebalancing {
+			t.Errorf("Rebalancing of group with protocol %q and members %v was incorrect, got: %v, want: %v",
+				table.protocol, table.members, metadata.IsRebalancing(), table.isRebalancing)
+		}
+	}
+}
+
+func TestConsumerGroupMetadataAssignmentImbalance(t *testing.T) {
+	three := metadataMember{MemberID: "three", Assignment: map[string][]int32{"orders": {0, 1}, "payments": {0}}}
+	two := metadataMember{MemberID: "two", Assignment: map[string][]int32{"orders": {2, 3}}}
+	idle := metadataMember{MemberID: "idle", Subscription: []string{"orders"}}
+	worker := metadataMember{MemberID: "worker", ConnectAssignment: &connectAssignment{}}
+	tables := []struct {
+		members    []metadataMember
+		imbalance  int
+		isAssigned bool
+	}{
+		{[]metadataMember{three, two}, 1, true},
+		{[]metadataMember{three, two, idle}, 3, true},
+		{[]metadataMember{two, worker}, 0, true},
+		{[]metadataMember{idle}, 0, false},
+		{[]metadataMember{worker}, 0, false},
+		{nil, 0, false},
+	}
+
+	for _, table := range tables {
+		metadata := ConsumerGroupMetadata{Group: "sample-group", Members: table.members}
+		imbalance, isAssigned := metadata.AssignmentImbalance()
+		if imbalance != table.imbalance || isAssigned != table.isAssigned {
+			t.Errorf("Imbalance of group with members %v was incorrect, got: %v, %v, want: %v, %v",
+				table.members, imbalance, isAssigned, table.imbalance, table.isAssigned)
+		}
+	}
+}
+
+func TestConsumerGroupMetadataAddMember(t *testing.T) {
+	metadata := ConsumerGroupMetadata{Group: "sample-group"}
+	metadata.AddMember("member-1", "client-1", map[string][]int32{"orders": {0, 1}})
+
+	expected := []metadataMember{{MemberID: "member-1", ClientID: "client-1", Assignment: map[string][]int32{"orders": {0, 1}}}}
+	if !reflect.DeepEqual(metadata.Members, expected) {
+		t.Errorf("Expected members %v, Got: %v", expected, metadata.Members)
+	}
+}
@@ -6,20 +6,56 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"strconv"
+	"time"
 )
 
 // ConsumerPartitionOffset represents a consumer group commit which can be decoded from the consumer_offsets topic
 type ConsumerPartitionOffset struct {
-	Group     string
-	Topic     string
-	Partition int32
-	Offset    int64
-	Timestamp int64
+	Group           string
+	Topic           string
+	Partition       int32
+	Offset          int64
+	LeaderEpoch     int32 // -1 if the message version doesn't contain the leader epoch (value version < 3)
+	Timestamp       int64 // Commit timestamp in milliseconds
+	ExpireTimestamp int64 // Expire timestamp in milliseconds, only set for value version 1
+
+	// Metadata is an opaque string which is committed along with the offset. Stream processors (e. g. Kafka Streams)
+	// sometimes store checkpoints in it.
+	Metadata string
+
+	// InternalPosition is the position of the record in the offsets topic the commit has been decoded from
+	InternalPosition InternalPosition
 }
 
 type offsetValue struct {
-	Offset    int64
-	Timestamp int64
+	Offset          int64
+	LeaderEpoch     int32
+	Metadata        string
+	Timestamp       int64
+	ExpireTimestamp int64
+}
+
+// CommitTime returns the time when the offset has been committed
+func (offset *ConsumerPartitionOffset) CommitTime() time.Time {
+	return millisToTime(offset.Timestamp)
+}
+
+// ExpireTime returns the time when the offset commit expires. It returns the zero time if the
+// offset commit didn't contain an expire timestamp.
+func (offset *ConsumerPartitionOffset) ExpireTime() time.Time {
+	return millisToTime(offset.ExpireTimestamp)
+}
+
+// Age returns the duration which has passed between the offset commit and the given time
+func (offset *ConsumerPartitionOffset) Age(now time.Time) time.Duration {
+	return now.Sub(offset.CommitTime())
+}
+
+func millisToTime(millis int64) time.Time {
+	if millis == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, millis*int64(time.Millisecond))
 }
 
 // newConsumerPartitionOffset decodes a key and value buffer to ConsumerPartitionOffset entry
@@ -33,6 +69,7 @@ func newConsumerPartitionOffset(key *bytes.Buffer, value *bytes.Buffer, logger *
 		logger.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Error("failed to decode group from consumer offset")
+		countDecodeError("offset", "group")
 		return nil, fmt.Errorf("could not decode group from offset key buffer: %v", err)
 	}
 	entry.Topic, err = readString(key)
@@ -40,7 +77,8 @@ func newConsumerPartitionOffset(key *bytes.Buffer, value *bytes.Buffer, logger *
 		logger.WithFields(log.Fields{
 			"group": entry.Group,
 			"error": err.Error(),
-		}).Error("failed to decode group from consumer offset")
+		}).Error("failed to decode topic from consumer offset")
+		countDecodeError("offset", "topic")
 		return nil, fmt.Errorf("could not decode topic from offset key buffer: %v", err)
 	}
 	err = binary.Read(key, binary.BigEndian, &entry.Partition)
@@ -50,6 +88,7 @@ func newConsumerPartitionOffset(key *bytes.Buffer, value *bytes.Buffer, logger *
 			"topic": entry.Topic,
 			"error": err.Error(),
 		}).Error("failed to decode partition from consumer offset")
+		countDecodeError("offset", "partition")
 		return nil, fmt.Errorf("could not decode partition from offset key buffer: %v", err)
 	}
 
@@ -67,6 +106,7 @@ func newConsumerPartitionOffset(key *bytes.Buffer, value *bytes.Buffer, logger *
 		offsetLogger.WithFields(log.Fields{
 			"reason": "no value version",
 		}).Warn("failed to decode")
+		countDecodeError("offset", "no value version")
 
 		return nil, fmt.Errorf("message value has no version")
 	}
@@ -75,24 +115,37 @@ func newConsumerPartitionOffset(key *bytes.Buffer, value *bytes.Buffer, logger *
 	// Decode message value using the right decoding function for given version
 	var decodedValue offsetValue
 	switch valueVersion {
-	case 0, 1:
+	case 0, 2:
+		// Version 2 has the same schema as version 0
 		decodedValue, err = decodeOffsetValueV0(value, offsetLogger.WithField("value_version", valueVersion))
+	case 1:
+		decodedValue, err = decodeOffsetValueV1(value, offsetLogger.WithField("value_version", valueVersion))
 	case 3:
 		decodedValue, err = decodeOffsetValueV3(value, offsetLogger.WithField("value_version", valueVersion))
 	default:
+		offsetLogger.WithFields(log.Fields{
+			"reason":  "value version",
+			"version": valueVersion,
+		}).Warn("failed to decode")
+		countDecodeError("offset", "value version")
 		err = fmt.Errorf("unknown value version to decode offsetValue. Given version: '%v'", valueVersion)
 	}
 	if err != nil {
 		return nil, err
 	}
 	entry.Offset = decodedValue.Offset
+	entry.LeaderEpoch = decodedValue.LeaderEpoch
 	entry.Timestamp = decodedValue.Timestamp
+	entry.ExpireTimestamp = decodedValue.ExpireTimestamp
+	entry.Metadata = decodedValue.Metadata
 
 	return &entry, nil
 }
 
 func decodeOffsetValueV0(value *bytes.Buffer, logger *log.Entry) (offsetValue, error) {
-	offset := offsetValue{}
+	offset := offsetValue{
+		LeaderEpoch: -1,
+	}
 
 	err := binary.Read(value, binary.BigEndian, &offset.Offset)
 	if err != nil {
@@ -100,14 +153,16 @@ func decodeOffsetValueV0(value *bytes.Buffer, logger *log.Entry) (offsetValue, e
 			"error_at": "offset",
 			"error":    err.Error(),
 		}).Error("failed to decode offset value")
+		countDecodeError("offset", "offset")
 		return offset, fmt.Errorf("failed to decode 'offset' field for OffsetValue V0: %v", err)
 	}
-	_, err = readString(value)
+	offset.Metadata, err = readString(value)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			"error_at": "metadata",
 			"error":    err.Error(),
 		}).Error("failed to decode offset value")
+		countDecodeError("offset", "metadata")
 		return offset, fmt.Errorf("failed to decode 'metadata' field for OffsetValue V0: %v", err)
 	}
 	err = binary.Read(value, binary.BigEndian, &offset.Timestamp)
@@ -116,12 +171,33 @@ func decodeOffsetValueV0(value *bytes.Buffer, logger *log.Entry) (offsetValue, e
 			"error_at": "timestamp",
 			"error":    err.Error(),
 		}).Error("failed to decode offset value")
+		countDecodeError("offset", "timestamp")
 		return offset, fmt.Errorf("failed to decode 'timestamp' field for OffsetValue V0: %v", err)
 	}
 
 	return offset, nil
 }
 
+// decodeOffsetValueV1 decodes the same fields as version 0 followed by the expire timestamp
+func decodeOffsetValueV1(value *bytes.Buffer, logger *log.Entry) (offsetValue, error) {
+	offset, err := decodeOffsetValueV0(value, logger)
+	if err != nil {
+		return offset, err
+	}
+
+	err = binary.Read(value, binary.BigEndian, &offset.ExpireTimestamp)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"error_at": "expire_timestamp",
+			"error":    err.Error(),
+		}).Error("failed to decode offset value")
+		countDecodeError("offset", "expire_timestamp")
+		return offset, fmt.Errorf("failed to decode 'expire_timestamp' field for OffsetValue V1: %v", err)
+	}
+
+	return offset, nil
+}
+
 func decodeOffsetValueV3(value *bytes.Buffer, logger *log.Entry) (offsetValue, error) {
 	offsetValue := offsetValue{}
 
@@ -131,28 +207,30 @@ func decodeOffsetValueV3(value *bytes.Buffer, logger *log.Entry) (offsetValue, e
 			"error_at": "offset",
 			"error":    err.Error(),
 		}).Error("failed to decode offset value")
+		countDecodeError("offset", "offset")
 		return offsetValue, fmt.Errorf("failed to decode 'offset' field for OffsetValue: %v", err)
 	}
 
 	// leaderEpoch refers to the number of leaders previously assigned by the controller.
 	// Every time a leader fails, the controller selects the new leader, increments the current "leader epoch" by 1
-	var leaderEpoch int32
-	err = binary.Read(value, binary.BigEndian, &leaderEpoch)
+	err = binary.Read(value, binary.BigEndian, &offsetValue.LeaderEpoch)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			"error_at": "leaderEpoch",
 			"error":    err.Error(),
 		}).Error("failed to decode offset value")
+		countDecodeError("offset", "leaderEpoch")
 		return offsetValue, fmt.Errorf("failed to decode 'leaderEpoch' field for OffsetValue V3: %v", err)
 	}
 
 	// metadata field contains additional metadata information which can optionally be set by a consumer
-	_, err = readString(value)
+	offsetValue.Metadata, err = readString(value)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			"error_at": "metadata",
 			"error":    err.Error(),
 		}).Error("failed to decode offset value")
+		countDecodeError("offset", "metadata")
 		return offsetValue, fmt.Errorf("failed to decode 'metadata' field for OffsetValue V3: %v", err)
 	}
 	err = binary.Read(value, binary.BigEndian, &offsetValue.Timestamp)
@@ -161,6 +239,7 @@ func decodeOffsetValueV3(value *bytes.Buffer, logger *log.Entry) (offsetValue, e
 			"error_at": "timestamp",
 			"error":    err.Error(),
 		}).Error("failed to decode offset value")
+		countDecodeError("offset", "timestamp")
 		return offsetValue, fmt.Errorf("failed to decode 'timestamp' field for OffsetValue: %v", err)
 	}
 
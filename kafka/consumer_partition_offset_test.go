@@ -0,0 +1,169 @@
+package kafka
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+// offsetCommitKey returns the key of an offset commit message without the leading key version
+func offsetCommitKey(group string, topic string, partition int32) *bytes.Buffer {
+	key := &bytes.Buffer{}
+	writeString(key, group)
+	writeString(key, topic)
+	writeInt32(key, partition)
+	return key
+}
+
+func TestNewConsumerPartitionOffset(t *testing.T) {
+	v0 := &bytes.Buffer{}
+	writeInt16(v0, 0)
+	writeInt64(v0, 1156)
+	writeString(v0, "checkpoint-0")
+	writeInt64(v0, 1552723003465)
+
+	v1 := &bytes.Buffer{}
+	writeInt16(v1, 1)
+	writeInt64(v1, 1156)
+	writeString(v1, "checkpoint-1")
+	writeInt64(v1, 1552723003465)
+	writeInt64(v1, 1552809403465)
+
+	v2 := &bytes.Buffer{}
+	writeInt16(v2, 2)
+	writeInt64(v2, 1156)
+	writeString(v2, "checkpoint-2")
+	writeInt64(v2, 1552723003465)
+
+	v3 := &bytes.Buffer{}
+	writeInt16(v3, 3)
+	writeInt64(v3, 1156)
+	writeInt32(v3, 4)
+	writeString(v3, "checkpoint-3")
+	writeInt64(v3, 1552723003465)
+
+	tables := []struct {
+		version int16
+		value   *bytes.Buffer
+	}{
+		{0, v0},
+		{1, v1},
+		{2, v2},
+		{3, v3},
+	}
+
+	logger := log.WithFields(log.Fields{})
+	for _, table := range tables {
+		offset, err := newConsumerPartitionOffset(offsetCommitKey("sample-group", "important-topic", 3), table.value, logger)
+		if err != nil {
+			t.Errorf("Failed to decode offset commit version %v: %v", table.version, err)
+			continue
+		}
+		if offset.Group != "sample-group" || offset.Topic != "important-topic" || offset.Partition != 3 {
+			t.Errorf("Unexpected offset key for version %v: %+v", table.version, offset)
+		}
+		if offset.Offset != 1156 {
+			t.Errorf("Expected offset for version %v: %v , Got: %v", table.version, 1156, offset.Offset)
+		}
+		if offset.Timestamp != 1552723003465 {
+			t.Errorf("Expected timestamp for version %v: %v , Got: %v", table.version, 1552723003465, offset.Timestamp)
+		}
+		expectedMetadata := fmt.Sprintf("checkpoint-%v", table.version)
+		if offset.Metadata != expectedMetadata {
+			t.Errorf("Expected metadata for version %v: %v , Got: %v", table.version, expectedMetadata, offset.Metadata)
+		}
+	}
+}
+
+func TestNewConsumerPartitionOffsetUnknownVersion(t *testing.T) {
+	value := &bytes.Buffer{}
+	writeInt16(value, 4)
+	writeInt64(value, 1156)
+
+	logger := log.WithFields(log.Fields{})
+	errorsBefore := testutil.ToFloat64(decodeErrors.WithLabelValues("offset", "value version"))
+	_, err := newConsumerPartitionOffset(offsetCommitKey("sample-group", "important-topic", 3), value, logger)
+	if err == nil {
+		t.Errorf("Expected an error for unknown value version")
+	}
+	errorsAfter := testutil.ToFloat64(decodeErrors.WithLabelValues("offset", "value version"))
+	if errorsAfter != errorsBefore+1 {
+		t.Errorf("Expected decode error counter to be incremented, got: %v, want: %v", errorsAfter, errorsBefore+1)
+	}
+}
+
+func TestNewConsumerPartitionOffsetLeaderEpoch(t *testing.T) {
+	// Offset commit value version 3 with offset 1156, leader epoch 7, metadata "" and commit timestamp 1552723003465
+	v3 := bytes.NewBufferString("\x00\x03" +
+		"\x00\x00\x00\x00\x00\x00\x04\x84" +
+		"\x00\x00\x00\x07" +
+		"\x00\x00" +
+		"\x00\x00\x01\x69\x85\x80\xc8\x49")
+	v1 := bytes.NewBufferString("\x00\x01" +
+		"\x00\x00\x00\x00\x00\x00\x04\x84" +
+		"\x00\x00" +
+		"\x00\x00\x01\x69\x85\x80\xc8\x49" +
+		"\x00\x00\x01\x69\x8a\xa7\x24\x49")
+
+	tables := []struct {
+		value       *bytes.Buffer
+		leaderEpoch int32
+	}{
+		{v3, 7},
+		{v1, -1},
+	}
+
+	logger := log.WithFields(log.Fields{})
+	for _, table := range tables {
+		offset, err := newConsumerPartitionOffset(offsetCommitKey("sample-group", "important-topic", 3), table.value, logger)
+		if err != nil {
+			t.Fatalf("Failed to decode offset commit: %v", err)
+		}
+		if offset.LeaderEpoch != table.leaderEpoch {
+			t.Errorf("Expected leader epoch: %v , Got: %v", table.leaderEpoch, offset.LeaderEpoch)
+		}
+		if offset.Offset != 1156 || offset.Timestamp != 1552723003465 {
+			t.Errorf("Unexpected offset or timestamp: %+v", offset)
+		}
+	}
+}
+
+func TestConsumerPartitionOffsetTimes(t *testing.T) {
+	v1 := &bytes.Buffer{}
+	writeInt16(v1, 1)
+	writeInt64(v1, 1156)
+	writeString(v1, "")
+	writeInt64(v1, 1552723003465)
+	writeInt64(v1, 1552809403465)
+
+	v3 := &bytes.Buffer{}
+	writeInt16(v3, 3)
+	writeInt64(v3, 1156)
+	writeInt32(v3, 4)
+	writeString(v3, "")
+	writeInt64(v3, 1552723003465)
+
+	logger := log.WithFields(log.Fields{})
+	offset, err := newConsumerPartitionOffset(offsetCommitKey("sample-group", "important-topic", 3), v1, logger)
+	if err != nil {
+		t.Fatalf("Failed to decode offset commit: %v", err)
+	}
+	if !offset.ExpireTime().Equal(offset.CommitTime().Add(24 * time.Hour)) {
+		t.Errorf("Expected expire time one day after commit time, Got: %v (commit time %v)", offset.ExpireTime(), offset.CommitTime())
+	}
+	now := time.Unix(0, 1552723063465*int64(time.Millisecond))
+	if offset.Age(now) != time.Minute {
+		t.Errorf("Expected age: %v , Got: %v", time.Minute, offset.Age(now))
+	}
+
+	offset, err = newConsumerPartitionOffset(offsetCommitKey("sample-group", "important-topic", 3), v3, logger)
+	if err != nil {
+		t.Fatalf("Failed to decode offset commit: %v", err)
+	}
+	if !offset.ExpireTime().IsZero() {
+		t.Errorf("Expected zero expire time for version 3, Got: %v", offset.ExpireTime())
+	}
+}
@@ -0,0 +1,86 @@
+package kafka
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"testing"
+)
+
+// fuzzLogger discards all log messages, decoders log a warning for most of the generated inputs
+func fuzzLogger() *log.Entry {
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	return log.NewEntry(logger)
+}
+
+// FuzzNewOffsetGroupMetadata feeds arbitrary keys (including the key version) and values into the offset commit
+// and group metadata decoders. Decoding must either fail with an error or return a result, but never panic.
+func FuzzNewOffsetGroupMetadata(f *testing.F) {
+	// Offset commit tombstone of a console consumer
+	f.Add([]byte("\x00\x01\x00\x16console-consumer-36268\x00\naccess-log\x00\x00\x00\x10"), []byte(""))
+	// Offset commit value version 3 with offset 1156 and leader epoch 7
+	f.Add([]byte("\x00\x01\x00\x0csample-group\x00\x0fimportant-topic\x00\x00\x00\x03"), []byte("\x00\x03"+
+		"\x00\x00\x00\x00\x00\x00\x04\x84"+
+		"\x00\x00\x00\x07"+
+		"\x00\x00"+
+		"\x00\x00\x01\x69\x85\x80\xc8\x49"))
+	// Group metadata tombstone and group metadata value version 1 with a single member
+	f.Add([]byte("\x00\x02\x00\x16console-consumer-36268"), []byte(nil))
+	value := &bytes.Buffer{}
+	writeInt16(value, 1)
+	writeString(value, "consumer")
+	writeInt32(value, 5)
+	writeString(value, "range")
+	writeString(value, "consumer-1-5ad5c4f2")
+	writeInt32(value, 1)
+	writeString(value, "consumer-1-5ad5c4f2")
+	writeString(value, "consumer-1")
+	writeString(value, "/10.0.0.5")
+	writeInt32(value, 300000)
+	writeInt32(value, 10000)
+	writeBytes(value, []byte{})
+	writeBytes(value, memberAssignmentV0("orders", []int32{0, 1, 2}))
+	f.Add([]byte("\x00\x02\x00\x0forder-processor"), value.Bytes())
+
+	logger := fuzzLogger()
+	f.Fuzz(func(t *testing.T, key []byte, value []byte) {
+		if len(key) < 2 {
+			return
+		}
+		// Skip the key version, both decoders are called regardless of it
+		offset, err := newConsumerPartitionOffset(bytes.NewBuffer(key[2:]), bytes.NewBuffer(value), logger)
+		if err == nil && offset == nil {
+			t.Errorf("Expected either an offset commit or an error")
+		}
+		metadata, err := newConsumerGroupMetadata(bytes.NewBuffer(key[2:]), bytes.NewBuffer(value), false, logger)
+		if err == nil && metadata == nil {
+			t.Errorf("Expected either group metadata or an error")
+		}
+	})
+}
+
+// FuzzDecodeMemberAssignmentV0 feeds arbitrary consumer protocol assignments (without the version) into the
+// assignment decoder, which must never panic
+func FuzzDecodeMemberAssignmentV0(f *testing.F) {
+	f.Add(memberAssignmentV0("orders", []int32{0, 1, 2})[2:])
+	// Assignment as written by librdkafka (cooperative-sticky assignor)
+	f.Add([]byte("\x00\x00\x00\x02" +
+		"\x00\x06orders\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x02" +
+		"\x00\x08payments\x00\x00\x00\x01\x00\x00\x00\x05" +
+		"\xff\xff\xff\xff"))
+
+	f.Fuzz(func(t *testing.T, assignment []byte) {
+		topics, _, err := decodeMemberAssignmentV0(bytes.NewBuffer(assignment))
+		if err != nil {
+			return
+		}
+		for topic, partitions := range topics {
+			for _, partitionID := range partitions {
+				if partitionID < 0 {
+					t.Errorf("Decoded negative partition id %v for topic %q without an error", partitionID, topic)
+				}
+			}
+		}
+	})
+}
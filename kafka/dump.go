@@ -0,0 +1,132 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+)
+
+// decodedRecord is the JSON representation of a record of an offsets topic dump, as it would be sent to the
+// storage module. Type is "skipped" if the record could not be decoded, the reason is logged.
+type decodedRecord struct {
+	Index          int                      `json:"index"`
+	Type           string                   `json:"type"`
+	Group          string                   `json:"group,omitempty"`
+	Topic          string                   `json:"topic,omitempty"`
+	Partition      *int32                   `json:"partition,omitempty"`
+	ConsumerOffset *ConsumerPartitionOffset `json:"consumer_offset,omitempty"`
+	GroupMetadata  *ConsumerGroupMetadata   `json:"group_metadata,omitempty"`
+}
+
+// DecodeDump decodes a dump of offsets topic records and writes each decoded record as JSON line to w. Each record
+// of the dump is framed as: key length (int32), key, value length (int32, -1 for tombstones), value. All integers
+// are big endian, just like in the Kafka protocol. The records are decoded by the same decoders as consumed
+// records, without any filters, so that decode issues can be reproduced offline. Keys and values which are larger
+// than maxRecordBytes (0 means unlimited) are discarded without being read into memory and the record is skipped,
+// so that a corrupt length prefix can't exhaust the memory.
+func DecodeDump(r io.Reader, w io.Writer, maxRecordBytes int) error {
+	storageChannel := make(chan *StorageRequest, 1)
+	consumer := &OffsetConsumer{
+		storageChannel: storageChannel,
+		logger: log.WithFields(log.Fields{
+			"module": "decode_dump",
+		}),
+		filter:         &Filter{},
+		maxRecordBytes: maxRecordBytes,
+	}
+	encoder := json.NewEncoder(w)
+
+	for index := 0; ; index++ {
+		key, keyOversized, err := readDumpBytes(r, maxRecordBytes)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read key of record %d: %v", index, err)
+		}
+		value, valueOversized, err := readDumpBytes(r, maxRecordBytes)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("failed to read value of record %d: %v", index, err)
+		}
+
+		if keyOversized || valueOversized {
+			consumer.logger.WithFields(log.Fields{
+				"index":     index,
+				"max_bytes": maxRecordBytes,
+			}).Warn("skipped record, because its key or value is larger than the max record size")
+		} else {
+			consumer.processMessage(&sarama.ConsumerMessage{
+				Topic:  "__consumer_offsets",
+				Offset: int64(index),
+				Key:    key,
+				Value:  value,
+			})
+		}
+		record := decodedRecord{Index: index, Type: "skipped"}
+		select {
+		case request := <-storageChannel:
+			record = newDecodedRecord(index, request)
+		default:
+		}
+		err = encoder.Encode(record)
+		if err != nil {
+			return fmt.Errorf("failed to write record %d: %v", index, err)
+		}
+	}
+}
+
+func newDecodedRecord(index int, request *StorageRequest) decodedRecord {
+	record := decodedRecord{Index: index}
+	switch request.RequestType {
+	case StorageAddConsumerOffset:
+		record.Type = "offset_commit"
+		record.ConsumerOffset = request.ConsumerOffset
+	case StorageDeleteConsumerGroup:
+		record.Type = "offset_commit_tombstone"
+		record.Group = request.ConsumerGroupName
+		record.Topic = request.TopicName
+		record.Partition = &request.PartitionID
+	case StorageAddGroupMetadata:
+		record.Type = "group_metadata"
+		record.GroupMetadata = request.GroupMetadata
+	case StorageDeleteGroupMetadata:
+		record.Type = "group_metadata_tombstone"
+		record.Group = request.ConsumerGroupName
+	}
+
+	return record
+}
+
+// readDumpBytes reads a length prefixed byte slice. Byte slices which are larger than maxBytes (0 means unlimited)
+// are discarded and reported as oversized instead. It returns io.EOF only if there are no bytes left at all.
+func readDumpBytes(r io.Reader, maxBytes int) ([]byte, bool, error) {
+	var length int32
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return nil, false, err
+	}
+	if length < 0 {
+		return nil, false, nil
+	}
+
+	if maxBytes > 0 && int(length) > maxBytes {
+		_, err = io.CopyN(ioutil.Discard, r, int64(length))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, true, err
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, false, err
+}
@@ -0,0 +1,97 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+// writeDumpRecord appends a record to an offsets topic dump. A nil value is written as tombstone.
+func writeDumpRecord(buf *bytes.Buffer, key []byte, value []byte) {
+	binary.Write(buf, binary.BigEndian, int32(len(key)))
+	buf.Write(key)
+	if value == nil {
+		binary.Write(buf, binary.BigEndian, int32(-1))
+		return
+	}
+	binary.Write(buf, binary.BigEndian, int32(len(value)))
+	buf.Write(value)
+}
+
+func TestDecodeDump(t *testing.T) {
+	dump := &bytes.Buffer{}
+	writeDumpRecord(dump, []byte("\x00\x01\x00\x09txn-group\x00\x08payments\x00\x00\x00\x00"), []byte("\x00\x03"+
+		"\x00\x00\x00\x00\x00\x00\x00\x2a"+
+		"\x00\x00\x00\x02"+
+		"\x00\x00"+
+		"\x00\x00\x01\x69\x85\x80\xc8\x49"))
+	writeDumpRecord(dump, []byte("\x00\x02\x00\x16console-consumer-36268"), nil)
+	writeDumpRecord(dump, []byte("\x00"), []byte("garbage"))
+
+	output := &bytes.Buffer{}
+	err := DecodeDump(dump, output, 0)
+	if err != nil {
+		t.Fatalf("Failed to decode dump: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 decoded records, Got: %v", lines)
+	}
+	records := make([]decodedRecord, len(lines))
+	for i, line := range lines {
+		err := json.Unmarshal([]byte(line), &records[i])
+		if err != nil {
+			t.Fatalf("Failed to unmarshal record %v: %v", line, err)
+		}
+	}
+	if records[0].Type != "offset_commit" || records[0].ConsumerOffset.Group != "txn-group" || records[0].ConsumerOffset.Offset != 42 {
+		t.Errorf("Unexpected offset commit: %v", lines[0])
+	}
+	if records[1].Type != "group_metadata_tombstone" || records[1].Group != "console-consumer-36268" {
+		t.Errorf("Unexpected group metadata tombstone: %v", lines[1])
+	}
+	if records[2].Type != "skipped" || records[2].Index != 2 {
+		t.Errorf("Expected record without key version to be skipped, Got: %v", lines[2])
+	}
+}
+
+func TestDecodeDumpTruncated(t *testing.T) {
+	dump := &bytes.Buffer{}
+	writeDumpRecord(dump, []byte("\x00\x02\x00\x16console-consumer-36268"), nil)
+	binary.Write(dump, binary.BigEndian, int32(10))
+	dump.WriteString("\x00\x02")
+
+	err := DecodeDump(dump, &bytes.Buffer{}, 0)
+	if err == nil {
+		t.Errorf("Expected an error for a truncated dump")
+	}
+}
+
+func TestDecodeDumpOversizedRecords(t *testing.T) {
+	dump := &bytes.Buffer{}
+	writeDumpRecord(dump, []byte("\x00\x02\x00\x16console-consumer-36268"), bytes.Repeat([]byte("x"), 64))
+	writeDumpRecord(dump, []byte("\x00\x02\x00\x16console-consumer-36268"), nil)
+
+	output := &bytes.Buffer{}
+	err := DecodeDump(dump, output, 32)
+	if err != nil {
+		t.Fatalf("Failed to decode dump: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"skipped"`) || !strings.Contains(lines[1], `"group_metadata_tombstone"`) {
+		t.Errorf("Expected the oversized record to be skipped and the next one to be decoded, Got: %v", lines)
+	}
+
+	// A corrupt length prefix must fail without allocating a buffer of its size
+	corrupt := &bytes.Buffer{}
+	binary.Write(corrupt, binary.BigEndian, int32(math.MaxInt32))
+	corrupt.WriteString("\x00\x02")
+	err = DecodeDump(corrupt, &bytes.Buffer{}, 32)
+	if err == nil {
+		t.Errorf("Expected an error for a corrupt length prefix")
+	}
+}
@@ -0,0 +1,184 @@
+package kafka
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google-cloud-tools/kafka-minion/options"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Filter decides which consumer groups and topics are processed. Messages of groups or topics which are not
+// allowed are dropped before they are sent to the storage module, so that they never show up in the exposed metrics.
+type Filter struct {
+	ignoreSystemTopics bool
+	groupAllowlist     []*regexp.Regexp
+	groupDenylist      []*regexp.Regexp
+	topicAllowlist     []*regexp.Regexp
+	topicDenylist      []*regexp.Regexp
+	protocolTypes      map[string]bool
+
+	// groupFile lists the group names of the group file, it's replaced whenever the group file is reloaded.
+	// A nil map means there is no group file configured.
+	groupFilePath string
+	groupFileLock sync.RWMutex
+	groupFile     map[string]bool
+}
+
+// NewFilter compiles all configured filter regexes. It returns an error if one of them is invalid.
+func NewFilter(opts *options.Options) (*Filter, error) {
+	groupAllowlist, err := compileRegexes(opts.FilterGroupAllowlist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid group allowlist: %v", err)
+	}
+	groupDenylist, err := compileRegexes(opts.FilterGroupDenylist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid group denylist: %v", err)
+	}
+	topicAllowlist, err := compileRegexes(opts.FilterTopicAllowlist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic allowlist: %v", err)
+	}
+	topicDenylist, err := compileRegexes(opts.FilterTopicDenylist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic denylist: %v", err)
+	}
+
+	protocolTypes := make(map[string]bool)
+	for _, protocolType := range opts.FilterProtocolTypes {
+		protocolTypes[protocolType] = true
+	}
+
+	filter := &Filter{
+		ignoreSystemTopics: opts.IgnoreSystemTopics,
+		groupAllowlist:     groupAllowlist,
+		groupDenylist:      groupDenylist,
+		topicAllowlist:     topicAllowlist,
+		topicDenylist:      topicDenylist,
+		protocolTypes:      protocolTypes,
+		groupFilePath:      opts.FilterGroupFile,
+	}
+	if filter.groupFilePath != "" {
+		err = filter.ReloadGroupFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return filter, nil
+}
+
+// ReloadGroupFile reads the configured group file again and replaces the previously loaded group names. If the
+// file can't be read, the previously loaded group names remain in place.
+func (f *Filter) ReloadGroupFile() error {
+	if f.groupFilePath == "" {
+		return fmt.Errorf("no group file configured")
+	}
+
+	groups, err := readGroupFile(f.groupFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read group file: %v", err)
+	}
+
+	f.groupFileLock.Lock()
+	defer f.groupFileLock.Unlock()
+	f.groupFile = groups
+
+	return nil
+}
+
+// readGroupFile returns all group names of a newline delimited file. Empty lines and lines starting with '#'
+// are ignored.
+func readGroupFile(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	groups := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		groups[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// IsGroupAllowed returns true if the group name matches the allowlist or is listed in the group file (or if there
+// is neither of them) and doesn't match the denylist. The denylist takes precedence over the allowlist.
+func (f *Filter) IsGroupAllowed(group string) bool {
+	if matchesAny(f.groupDenylist, group) {
+		return false
+	}
+
+	f.groupFileLock.RLock()
+	groupFile := f.groupFile
+	f.groupFileLock.RUnlock()
+	if len(f.groupAllowlist) == 0 && groupFile == nil {
+		return true
+	}
+
+	return groupFile[group] || matchesAny(f.groupAllowlist, group)
+}
+
+// IsTopicAllowed returns false for system topics (if they are ignored) and otherwise applies the topic
+// allowlist and denylist the same way as IsGroupAllowed does for groups.
+func (f *Filter) IsTopicAllowed(topicName string) bool {
+	if f.ignoreSystemTopics {
+		if strings.HasPrefix(topicName, "__") || strings.HasPrefix(topicName, "_confluent") {
+			return false
+		}
+	}
+	if matchesAny(f.topicDenylist, topicName) {
+		return false
+	}
+	if len(f.topicAllowlist) == 0 {
+		return true
+	}
+
+	return matchesAny(f.topicAllowlist, topicName)
+}
+
+// IsProtocolTypeAllowed returns true if the group protocol type (e. g. "consumer" or "connect") is one of the
+// configured protocol types or if there are none configured
+func (f *Filter) IsProtocolTypeAllowed(protocolType string) bool {
+	if len(f.protocolTypes) == 0 {
+		return true
+	}
+
+	return f.protocolTypes[protocolType]
+}
+
+// compileRegexes compiles each pattern so that it must match the whole input
+func compileRegexes(patterns []string) ([]*regexp.Regexp, error) {
+	regexes := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile regex '%v': %v", pattern, err)
+		}
+		regexes = append(regexes, regex)
+	}
+
+	return regexes, nil
+}
+
+func matchesAny(regexes []*regexp.Regexp, input string) bool {
+	for _, regex := range regexes {
+		if regex.MatchString(input) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,180 @@
+package kafka
+
+import (
+	"github.com/google-cloud-tools/kafka-minion/options"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsGroupAllowed(t *testing.T) {
+	tables := []struct {
+		allowlist []string
+		denylist  []string
+		group     string
+		allowed   bool
+	}{
+		{nil, nil, "console-consumer-40098", true},
+		{nil, []string{"console-consumer-.*"}, "console-consumer-40098", false},
+		{nil, []string{"console-consumer-.*"}, "sample-group", true},
+		{[]string{"sample-.*", "orders"}, nil, "sample-group", true},
+		{[]string{"sample-.*", "orders"}, nil, "orders", true},
+		{[]string{"sample-.*", "orders"}, nil, "orders-v2", false},
+		{[]string{"sample-.*"}, []string{"sample-group-test"}, "sample-group-test", false},
+	}
+
+	for _, table := range tables {
+		opts := options.NewOptions()
+		opts.FilterGroupAllowlist = table.allowlist
+		opts.FilterGroupDenylist = table.denylist
+		filter, err := NewFilter(opts)
+		if err != nil {
+			t.Fatalf("Failed to create filter: %v", err)
+		}
+		if allowed := filter.IsGroupAllowed(table.group); allowed != table.allowed {
+			t.Errorf("Group %v (allowlist: %v, denylist: %v) was incorrect, got: %v, want: %v",
+				table.group, table.allowlist, table.denylist, allowed, table.allowed)
+		}
+	}
+}
+
+func TestNewFilterInvalidRegex(t *testing.T) {
+	opts := options.NewOptions()
+	opts.FilterGroupDenylist = []string{"console-consumer-(.*"}
+	_, err := NewFilter(opts)
+	if err == nil {
+		t.Errorf("Expected an error for an invalid regex")
+	}
+}
+
+func TestIsTopicAllowed(t *testing.T) {
+	tables := []struct {
+		ignoreSystemTopics bool
+		allowlist          []string
+		denylist           []string
+		topic              string
+		allowed            bool
+	}{
+		{true, nil, nil, "__consumer_offsets", false},
+		{true, nil, nil, "_confluent-metrics", false},
+		{false, nil, nil, "__consumer_offsets", true},
+		{false, nil, []string{"__.*"}, "__consumer_offsets", false},
+		{true, []string{"orders\\..*"}, nil, "orders.created", true},
+		{true, []string{"orders\\..*"}, nil, "payments.created", false},
+		{true, []string{"orders\\..*"}, []string{"orders\\.test"}, "orders.test", false},
+	}
+
+	for _, table := range tables {
+		opts := options.NewOptions()
+		opts.IgnoreSystemTopics = table.ignoreSystemTopics
+		opts.FilterTopicAllowlist = table.allowlist
+		opts.FilterTopicDenylist = table.denylist
+		filter, err := NewFilter(opts)
+		if err != nil {
+			t.Fatalf("Failed to create filter: %v", err)
+		}
+		if allowed := filter.IsTopicAllowed(table.topic); allowed != table.allowed {
+			t.Errorf("Topic %v (allowlist: %v, denylist: %v) was incorrect, got: %v, want: %v",
+				table.topic, table.allowlist, table.denylist, allowed, table.allowed)
+		}
+	}
+}
+
+func TestIsProtocolTypeAllowed(t *testing.T) {
+	tables := []struct {
+		protocolTypes []string
+		protocolType  string
+		allowed       bool
+	}{
+		{nil, "consumer", true},
+		{nil, "connect", true},
+		{[]string{"consumer"}, "consumer", true},
+		{[]string{"consumer"}, "connect", false},
+		{[]string{"consumer", "connect"}, "connect", true},
+	}
+
+	for _, table := range tables {
+		opts := options.NewOptions()
+		opts.FilterProtocolTypes = table.protocolTypes
+		filter, err := NewFilter(opts)
+		if err != nil {
+			t.Fatalf("Failed to create filter: %v", err)
+		}
+		if allowed := filter.IsProtocolTypeAllowed(table.protocolType); allowed != table.allowed {
+			t.Errorf("Protocol type %v (allowed: %v) was incorrect, got: %v, want: %v",
+				table.protocolType, table.protocolTypes, allowed, table.allowed)
+		}
+	}
+}
+
+func TestReloadGroupFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-minion-filter")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "groups.txt")
+	err = ioutil.WriteFile(path, []byte("# Managed by the platform team\nsample-group\n\n  orders  \n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write group file: %v", err)
+	}
+	opts := options.NewOptions()
+	opts.FilterGroupAllowlist = []string{"payments-.*"}
+	opts.FilterGroupFile = path
+	filter, err := NewFilter(opts)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+
+	tables := []struct {
+		group   string
+		allowed bool
+	}{
+		{"sample-group", true},
+		{"orders", true},
+		{"payments-v2", true},
+		{"console-consumer-40098", false},
+		{"# Managed by the platform team", false},
+	}
+	for _, table := range tables {
+		if allowed := filter.IsGroupAllowed(table.group); allowed != table.allowed {
+			t.Errorf("Group %v was incorrect, got: %v, want: %v", table.group, allowed, table.allowed)
+		}
+	}
+
+	err = ioutil.WriteFile(path, []byte("orders\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write group file: %v", err)
+	}
+	err = filter.ReloadGroupFile()
+	if err != nil {
+		t.Fatalf("Failed to reload group file: %v", err)
+	}
+	if filter.IsGroupAllowed("sample-group") {
+		t.Errorf("Expected sample-group not to be allowed after it has been removed from the group file")
+	}
+	if !filter.IsGroupAllowed("orders") {
+		t.Errorf("Expected orders to be allowed after reloading the group file")
+	}
+
+	// The previously loaded groups are kept if the file can't be read
+	os.Remove(path)
+	err = filter.ReloadGroupFile()
+	if err == nil {
+		t.Errorf("Expected an error for a missing group file")
+	}
+	if !filter.IsGroupAllowed("orders") {
+		t.Errorf("Expected orders to be allowed after a failed reload")
+	}
+}
+
+func TestNewFilterMissingGroupFile(t *testing.T) {
+	opts := options.NewOptions()
+	opts.FilterGroupFile = filepath.Join(os.TempDir(), "kafka-minion-missing-groups.txt")
+	_, err := NewFilter(opts)
+	if err == nil {
+		t.Errorf("Expected an error for a missing group file")
+	}
+}
@@ -0,0 +1,331 @@
+package kafka
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KafkaClient abstracts the interactions with the Kafka cluster which are needed to poll partition water marks and
+// to consume the offsets topic, so that the modules building on top of it can be tested without a broker.
+type KafkaClient interface {
+	// DescribeTopics returns the partition IDs grouped by topic name. If topics are given, their metadata is
+	// refreshed first and only these topics are returned. Otherwise all topics are served from the metadata cache.
+	DescribeTopics(topics ...string) (map[string][]int32, error)
+
+	// RefreshMetadata refreshes the cached metadata of all topics, so that new topics and partitions are discovered
+	RefreshMetadata() error
+
+	// FetchWatermarks returns the high and low water marks of the given partitions grouped by topic name and
+	// partition ID. Partitions whose water marks could not be fetched are missing in the returned maps.
+	FetchWatermarks(partitionIDsByTopicName map[string][]int32) (highWaterMarks map[string]map[int32]int64, lowWaterMarks map[string]map[int32]int64)
+
+	// LeaderRacks returns the rack of each partition's leader broker grouped by topic name and partition ID. It's
+	// served from the metadata cache, partitions whose leader (or its rack) is unknown are missing.
+	LeaderRacks(partitionIDsByTopicName map[string][]int32) map[string]map[int32]string
+
+	// Consume starts consuming a partition at the given offset (or sarama.OffsetOldest / sarama.OffsetNewest)
+	Consume(topic string, partitionID int32, offset int64) (sarama.PartitionConsumer, error)
+
+	// Close closes the consumer and the connections to all brokers
+	Close() error
+}
+
+// saramaKafkaClient is the KafkaClient implementation which talks to the brokers using a sarama client
+type saramaKafkaClient struct {
+	client sarama.Client
+	logger *log.Entry
+
+	// watermarkJitter is the duration over which the water mark requests to the brokers are spread, so that not all
+	// brokers are hit at the same time. sleep is replaced by the tests.
+	watermarkJitter time.Duration
+	sleep           func(time.Duration)
+
+	// requestTimeout is the max duration of a water mark or metadata request (0 = no timeout)
+	requestTimeout time.Duration
+
+	// consumer is created on the first Consume call, because the cluster module never consumes any partition
+	consumerLock sync.Mutex
+	consumer     sarama.Consumer
+}
+
+func newSaramaKafkaClient(client sarama.Client, logger *log.Entry) *saramaKafkaClient {
+	return &saramaKafkaClient{
+		client: client,
+		logger: logger,
+		sleep:  time.Sleep,
+	}
+}
+
+// DescribeTopics returns the partition IDs grouped by topic name. It fails if the metadata request exceeds the
+// request timeout.
+func (c *saramaKafkaClient) DescribeTopics(topics ...string) (map[string][]int32, error) {
+	var partitionIDsByTopicName map[string][]int32
+	var describeErr error
+	err := withRequestTimeout(c.requestTimeout, "metadata", func() {
+		partitionIDsByTopicName, describeErr = c.describeTopics(topics...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return partitionIDsByTopicName, describeErr
+}
+
+// RefreshMetadata refreshes the metadata of all topics. It fails if the metadata request exceeds the request timeout.
+func (c *saramaKafkaClient) RefreshMetadata() error {
+	var refreshErr error
+	err := withRequestTimeout(c.requestTimeout, "metadata", func() {
+		refreshErr = c.client.RefreshMetadata()
+	})
+	if err != nil {
+		return err
+	}
+
+	return refreshErr
+}
+
+func (c *saramaKafkaClient) describeTopics(topics ...string) (map[string][]int32, error) {
+	if len(topics) > 0 {
+		err := c.client.RefreshMetadata(topics...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to refresh topic metadata: %v", err)
+		}
+	} else {
+		var err error
+		topics, err = c.client.Topics()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch topic list: %v", err)
+		}
+	}
+
+	partitionIDsByTopicName := make(map[string][]int32)
+	for _, topicName := range topics {
+		// Partitions() response is served from cached metadata if available. So there's usually no need to launch go routines for that
+		partitionIDs, err := c.client.Partitions(topicName)
+		if err != nil {
+			c.logger.WithFields(log.Fields{
+				"error": err.Error(),
+				"topic": topicName,
+			}).Error("failed to fetch partition list")
+			continue
+		}
+		partitionIDsByTopicName[topicName] = partitionIDs
+	}
+
+	return partitionIDsByTopicName, nil
+}
+
+// FetchWatermarks sends one offset request for the high water marks and one for the low water marks to each broker,
+// which contain all partitions the broker is the leader for
+func (c *saramaKafkaClient) FetchWatermarks(partitionIDsByTopicName map[string][]int32) (map[string]map[int32]int64, map[string]map[int32]int64) {
+	highWaterMarks := newWaterMarkCollection()
+	lowWaterMarks := newWaterMarkCollection()
+
+	var wg = sync.WaitGroup{}
+	highRequests, lowRequests, brokers := c.generateOffsetRequests(partitionIDsByTopicName)
+	delays := c.requestDelays(brokers)
+	for brokerID, request := range highRequests {
+		wg.Add(1)
+		logger := c.logger.WithFields(log.Fields{
+			"broker_id": brokerID,
+		})
+		go c.fetchWaterMarks(&wg, delays[brokerID], brokers[brokerID], request, highWaterMarks, "high", logger)
+	}
+	wg.Wait() // Await offsets first, to prevent concurrent access on brokers
+	for brokerID, request := range lowRequests {
+		wg.Add(1)
+		logger := c.logger.WithFields(log.Fields{
+			"broker_id": brokerID,
+		})
+		go c.fetchWaterMarks(&wg, delays[brokerID], brokers[brokerID], request, lowWaterMarks, "low", logger)
+	}
+	wg.Wait()
+
+	return highWaterMarks.WaterMarks, lowWaterMarks.WaterMarks
+}
+
+func (c *saramaKafkaClient) generateOffsetRequests(partitionIDsByTopicName map[string][]int32) (map[int32]*sarama.OffsetRequest, map[int32]*sarama.OffsetRequest, map[int32]*sarama.Broker) {
+	// we must create two separate buckets for high & low watermarks, because adding a request block
+	// with same topic:partition but different time will still result in just one request, see:
+	// https://github.com/Shopify/sarama/blob/master/offset_request.go AddBlock() method
+	highWaterMarkRequests := make(map[int32]*sarama.OffsetRequest)
+	lowWaterMarkRequests := make(map[int32]*sarama.OffsetRequest)
+	brokers := make(map[int32]*sarama.Broker)
+
+	// Generate an OffsetRequest for each topic:partition and bucket it to the leader broker
+	for topic, partitionIDs := range partitionIDsByTopicName {
+		for _, partitionID := range partitionIDs {
+			broker, err := c.client.Leader(topic, partitionID)
+			if err != nil {
+				c.logger.WithFields(log.Fields{
+					"topic":     topic,
+					"partition": partitionID,
+					"error":     err.Error(),
+				}).Warn("failed to fetch leader for partition")
+				continue
+			}
+			if _, exists := highWaterMarkRequests[broker.ID()]; !exists {
+				highWaterMarkRequests[broker.ID()] = &sarama.OffsetRequest{}
+				lowWaterMarkRequests[broker.ID()] = &sarama.OffsetRequest{}
+			}
+			brokers[broker.ID()] = broker
+			highWaterMarkRequests[broker.ID()].AddBlock(topic, partitionID, sarama.OffsetNewest, 1)
+			lowWaterMarkRequests[broker.ID()].AddBlock(topic, partitionID, sarama.OffsetOldest, 1)
+		}
+	}
+
+	return highWaterMarkRequests, lowWaterMarkRequests, brokers
+}
+
+// requestDelays returns the delay of the water mark requests by broker ID. The brokers are spread evenly over the
+// water mark jitter, ordered by their ID.
+func (c *saramaKafkaClient) requestDelays(brokers map[int32]*sarama.Broker) map[int32]time.Duration {
+	brokerIDs := make([]int32, 0, len(brokers))
+	for brokerID := range brokers {
+		brokerIDs = append(brokerIDs, brokerID)
+	}
+	sort.Slice(brokerIDs, func(i, j int) bool { return brokerIDs[i] < brokerIDs[j] })
+
+	delays := make(map[int32]time.Duration, len(brokerIDs))
+	for i, brokerID := range brokerIDs {
+		delays[brokerID] = c.watermarkJitter * time.Duration(i) / time.Duration(len(brokerIDs))
+	}
+
+	return delays
+}
+
+// waterMarkCollection collects the water marks which are concurrently fetched from all brokers
+type waterMarkCollection struct {
+	Lock       sync.Mutex
+	WaterMarks map[string]map[int32]int64
+}
+
+func newWaterMarkCollection() *waterMarkCollection {
+	return &waterMarkCollection{
+		WaterMarks: make(map[string]map[int32]int64),
+	}
+}
+
+func (c *saramaKafkaClient) fetchWaterMarks(wg *sync.WaitGroup, delay time.Duration, broker *sarama.Broker, request *sarama.OffsetRequest,
+	collection *waterMarkCollection, waterMarkType string, logger *log.Entry) {
+	defer wg.Done()
+	if delay > 0 {
+		c.sleep(delay)
+	}
+	var response *sarama.OffsetResponse
+	var requestErr error
+	err := withRequestTimeout(c.requestTimeout, "list_offsets", func() {
+		response, requestErr = broker.GetAvailableOffsets(request)
+	})
+	if err == nil {
+		err = requestErr
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("failed to fetch %v watermarks from broker", waterMarkType)
+		// Close waits for the pending responses (until the read timeout at most), hence it must not block the poll
+		// on a hung broker. The client reopens the connection once the broker is requested again.
+		go broker.Close()
+		return
+	}
+
+	collection.Lock.Lock()
+	defer collection.Lock.Unlock()
+	for topicName, responseBlock := range response.Blocks {
+		for partitionID, offsetResponse := range responseBlock {
+			if offsetResponse.Err != sarama.ErrNoError {
+				logger.WithFields(log.Fields{
+					"error":     offsetResponse.Err.Error(),
+					"topic":     topicName,
+					"partition": partitionID,
+				}).Warnf("error in %v OffsetResponse", waterMarkType)
+				continue
+			}
+			if _, exists := collection.WaterMarks[topicName]; !exists {
+				collection.WaterMarks[topicName] = make(map[int32]int64)
+			}
+			collection.WaterMarks[topicName][partitionID] = offsetResponse.Offsets[0]
+		}
+	}
+}
+
+// withRequestTimeout runs the request and returns an error if it doesn't complete within the timeout (0 = no
+// timeout). A timed out request is abandoned and counted, it keeps running in the background, hence the request
+// must not write anything the caller reads once the timeout has been returned.
+func withRequestTimeout(timeout time.Duration, requestType string, request func()) error {
+	if timeout <= 0 {
+		request()
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		request()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		requestTimeouts.WithLabelValues(requestType).Inc()
+		return fmt.Errorf("%v request timed out after %v", requestType, timeout)
+	}
+}
+
+// LeaderRacks returns the rack of each partition's leader. Brokers only report their rack in metadata responses
+// v1+ (Kafka 0.10+), which are cached by the client along with the partition leaders.
+func (c *saramaKafkaClient) LeaderRacks(partitionIDsByTopicName map[string][]int32) map[string]map[int32]string {
+	racks := make(map[string]map[int32]string)
+	for topic, partitionIDs := range partitionIDsByTopicName {
+		for _, partitionID := range partitionIDs {
+			broker, err := c.client.Leader(topic, partitionID)
+			if err != nil || broker.Rack() == "" {
+				continue
+			}
+			if _, exists := racks[topic]; !exists {
+				racks[topic] = make(map[int32]string)
+			}
+			racks[topic][partitionID] = broker.Rack()
+		}
+	}
+
+	return racks
+}
+
+// Consume starts consuming a partition at the given offset
+func (c *saramaKafkaClient) Consume(topic string, partitionID int32, offset int64) (sarama.PartitionConsumer, error) {
+	c.consumerLock.Lock()
+	defer c.consumerLock.Unlock()
+
+	if c.consumer == nil {
+		consumer, err := sarama.NewConsumerFromClient(c.client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create consumer: %v", err)
+		}
+		c.consumer = consumer
+	}
+
+	return c.consumer.ConsumePartition(topic, partitionID, offset)
+}
+
+// Close closes the consumer and the underlying sarama client
+func (c *saramaKafkaClient) Close() error {
+	c.consumerLock.Lock()
+	defer c.consumerLock.Unlock()
+
+	if c.consumer != nil {
+		err := c.consumer.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.client.Close()
+}
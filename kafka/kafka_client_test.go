@@ -0,0 +1,645 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/google-cloud-tools/kafka-minion/options"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockKafkaClient is a KafkaClient which serves topics and water marks from memory. Consumed partitions
+// are backed by mockPartitionConsumers whose messages can be pushed by the tests.
+type mockKafkaClient struct {
+	partitionIDsByTopicName map[string][]int32
+	highWaterMarks          map[string]map[int32]int64
+	lowWaterMarks           map[string]map[int32]int64
+	leaderRacks             map[string]map[int32]string
+	metadataRefreshes       int
+
+	lock      sync.Mutex
+	consumers map[int32]*mockPartitionConsumer
+	consumed  chan int32
+	closed    bool
+
+	// consumeFailures is the number of Consume calls which fail before partition consumers are created
+	consumeFailures int
+	// startOffsets contains the offset of the last Consume call by partition ID
+	startOffsets map[int32]int64
+}
+
+func newMockKafkaClient() *mockKafkaClient {
+	return &mockKafkaClient{
+		partitionIDsByTopicName: make(map[string][]int32),
+		highWaterMarks:          make(map[string]map[int32]int64),
+		lowWaterMarks:           make(map[string]map[int32]int64),
+		consumers:               make(map[int32]*mockPartitionConsumer),
+		consumed:                make(chan int32, 100),
+		startOffsets:            make(map[int32]int64),
+	}
+}
+
+func (c *mockKafkaClient) DescribeTopics(topics ...string) (map[string][]int32, error) {
+	partitionIDsByTopicName := make(map[string][]int32)
+	for topicName, partitionIDs := range c.partitionIDsByTopicName {
+		partitionIDsByTopicName[topicName] = partitionIDs
+	}
+	if len(topics) == 0 {
+		return partitionIDsByTopicName, nil
+	}
+
+	requested := make(map[string][]int32)
+	for _, topicName := range topics {
+		if partitionIDs, exists := partitionIDsByTopicName[topicName]; exists {
+			requested[topicName] = partitionIDs
+		}
+	}
+	return requested, nil
+}
+
+func (c *mockKafkaClient) RefreshMetadata() error {
+	c.metadataRefreshes++
+	return nil
+}
+
+func (c *mockKafkaClient) FetchWatermarks(partitionIDsByTopicName map[string][]int32) (map[string]map[int32]int64, map[string]map[int32]int64) {
+	pick := func(waterMarks map[string]map[int32]int64) map[string]map[int32]int64 {
+		picked := make(map[string]map[int32]int64)
+		for topicName, partitionIDs := range partitionIDsByTopicName {
+			for _, partitionID := range partitionIDs {
+				waterMark, exists := waterMarks[topicName][partitionID]
+				if !exists {
+					continue
+				}
+				if _, exists := picked[topicName]; !exists {
+					picked[topicName] = make(map[int32]int64)
+				}
+				picked[topicName][partitionID] = waterMark
+			}
+		}
+		return picked
+	}
+
+	return pick(c.highWaterMarks), pick(c.lowWaterMarks)
+}
+
+func (c *mockKafkaClient) LeaderRacks(partitionIDsByTopicName map[string][]int32) map[string]map[int32]string {
+	return c.leaderRacks
+}
+
+func (c *mockKafkaClient) Consume(topic string, partitionID int32, offset int64) (sarama.PartitionConsumer, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.startOffsets[partitionID] = offset
+	if lowWaterMark, exists := c.lowWaterMarks[topic][partitionID]; exists && offset >= 0 && offset < lowWaterMark {
+		return nil, sarama.ErrOffsetOutOfRange
+	}
+	if c.consumeFailures > 0 {
+		c.consumeFailures--
+		return nil, fmt.Errorf("leader not available")
+	}
+	consumer := &mockPartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage, 10),
+		errors:   make(chan *sarama.ConsumerError, 10),
+	}
+	c.consumers[partitionID] = consumer
+	c.consumed <- partitionID
+	return consumer, nil
+}
+
+func (c *mockKafkaClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return nil
+}
+
+// mockPartitionConsumer is a sarama.PartitionConsumer whose messages and errors are pushed by the tests
+type mockPartitionConsumer struct {
+	messages chan *sarama.ConsumerMessage
+	errors   chan *sarama.ConsumerError
+}
+
+func (c *mockPartitionConsumer) AsyncClose()                              {}
+func (c *mockPartitionConsumer) Close() error                             { return nil }
+func (c *mockPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+func (c *mockPartitionConsumer) Errors() <-chan *sarama.ConsumerError     { return c.errors }
+func (c *mockPartitionConsumer) HighWaterMarkOffset() int64               { return 0 }
+
+func TestClusterRefreshTopicMetadata(t *testing.T) {
+	opts := options.NewOptions()
+	opts.ConsumerOffsetsTopicName = "__consumer_offsets"
+	opts.IgnoreSystemTopics = true
+	opts.FilterTopicDenylist = []string{"^internal-.*"}
+	filter, err := NewFilter(opts)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+
+	client := newMockKafkaClient()
+	client.partitionIDsByTopicName = map[string][]int32{
+		"__consumer_offsets": {0},
+		"orders":             {0, 1},
+		"internal-audit":     {0},
+	}
+	client.highWaterMarks = map[string]map[int32]int64{
+		"__consumer_offsets": {0: 1234},
+		"orders":             {0: 10, 1: 20},
+		"internal-audit":     {0: 5},
+	}
+	client.lowWaterMarks = map[string]map[int32]int64{
+		"__consumer_offsets": {0: 0},
+		"orders":             {0: 1, 1: 2},
+		"internal-audit":     {0: 0},
+	}
+
+	storageCh := make(chan *StorageRequest, 100)
+	cluster := &Cluster{
+		storageCh:   storageCh,
+		kafkaClient: client,
+		logger:      log.WithFields(log.Fields{}),
+		options:     opts,
+		filter:      filter,
+	}
+	cluster.refreshAndSendTopicMetadata()
+	close(storageCh)
+
+	waterMarks := make(map[StorageRequestType]map[int32]int64)
+	partitionCounts := make(map[string]int)
+	for request := range storageCh {
+		if request.RequestType == StorageUpdateTopicPartitionCount {
+			partitionCounts[request.TopicName] = request.PartitionCount
+			continue
+		}
+		if request.PartitionWaterMark.TopicName != "orders" {
+			t.Errorf("Expected water marks of topic orders only, Got: %+v", request.PartitionWaterMark)
+			continue
+		}
+		if _, exists := waterMarks[request.RequestType]; !exists {
+			waterMarks[request.RequestType] = make(map[int32]int64)
+		}
+		waterMarks[request.RequestType][request.PartitionWaterMark.PartitionID] = request.PartitionWaterMark.WaterMark
+	}
+	high := waterMarks[StorageAddPartitionHighWaterMark]
+	low := waterMarks[StorageAddPartitionLowWaterMark]
+	if len(high) != 2 || high[0] != 10 || high[1] != 20 {
+		t.Errorf("Unexpected high water marks: %v", high)
+	}
+	if len(low) != 2 || low[0] != 1 || low[1] != 2 {
+		t.Errorf("Unexpected low water marks: %v", low)
+	}
+	if !reflect.DeepEqual(partitionCounts, map[string]int{"orders": 2}) {
+		t.Errorf("Expected the partition count of topic orders only, Got: %v", partitionCounts)
+	}
+	if client.metadataRefreshes != 1 {
+		t.Errorf("Expected the metadata to be refreshed once per poll, Got: %v refreshes", client.metadataRefreshes)
+	}
+
+	offsetWaterMarks.Lock.RLock()
+	partition := offsetWaterMarks.PartitionsByID[0]
+	offsetWaterMarks.Lock.RUnlock()
+	if partition.HighWaterMark != 1234 {
+		t.Errorf("Expected offsets topic high water mark: %v, Got: %v", 1234, partition.HighWaterMark)
+	}
+}
+
+func TestClusterRefreshTopicMetadataWithRack(t *testing.T) {
+	opts := options.NewOptions()
+	opts.ConsumerOffsetsTopicName = "__consumer_offsets"
+	opts.MetricsIncludeRack = true
+	filter, err := NewFilter(opts)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+
+	client := newMockKafkaClient()
+	client.partitionIDsByTopicName = map[string][]int32{"orders": {0, 1}}
+	client.highWaterMarks = map[string]map[int32]int64{"orders": {0: 10, 1: 20}}
+	client.lowWaterMarks = map[string]map[int32]int64{"orders": {0: 1, 1: 2}}
+	client.leaderRacks = map[string]map[int32]string{"orders": {0: "eu-west-1a"}}
+
+	storageCh := make(chan *StorageRequest, 10)
+	cluster := &Cluster{
+		storageCh:   storageCh,
+		kafkaClient: client,
+		logger:      log.WithFields(log.Fields{}),
+		options:     opts,
+		filter:      filter,
+	}
+	cluster.refreshAndSendTopicMetadata()
+	close(storageCh)
+
+	racks := make(map[int32]string)
+	for request := range storageCh {
+		if request.RequestType == StorageAddPartitionHighWaterMark {
+			racks[request.PartitionWaterMark.PartitionID] = request.PartitionWaterMark.LeaderRack
+		}
+	}
+	expected := map[int32]string{0: "eu-west-1a", 1: ""}
+	if !reflect.DeepEqual(racks, expected) {
+		t.Errorf("Expected leader racks %v, Got: %v", expected, racks)
+	}
+}
+
+func TestOffsetConsumerStart(t *testing.T) {
+	opts := options.NewOptions()
+	opts.ConsumerOffsetsTopicName = "__consumer_offsets"
+	opts.KafkaMetadataRefresh = time.Minute
+
+	client := newMockKafkaClient()
+	client.partitionIDsByTopicName = map[string][]int32{"__consumer_offsets": {0, 1}}
+
+	storageChannel := make(chan *StorageRequest, 10)
+	consumer := &OffsetConsumer{
+		storageChannel:   storageChannel,
+		logger:           log.WithFields(log.Fields{}),
+		client:           client,
+		offsetsTopicName: opts.ConsumerOffsetsTopicName,
+		options:          opts,
+		filter:           &Filter{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer.Start(ctx)
+
+	for i := 0; i < 2; i++ {
+		<-client.consumed
+	}
+	request := <-storageChannel
+	if request.RequestType != StorageRegisterOffsetPartitions || request.PartitionCount != 2 {
+		t.Fatalf("Expected registration of 2 offset partitions, Got: %+v", request)
+	}
+
+	client.lock.Lock()
+	partitionConsumer := client.consumers[1]
+	client.lock.Unlock()
+	partitionConsumer.messages <- &sarama.ConsumerMessage{
+		Topic:     opts.ConsumerOffsetsTopicName,
+		Partition: 1,
+		Offset:    7,
+		Key:       []byte("\x00\x02\x00\x16console-consumer-36268"),
+		Value:     nil,
+	}
+	request = <-storageChannel
+	if request.RequestType != StorageDeleteGroupMetadata || request.ConsumerGroupName != "console-consumer-36268" {
+		t.Errorf("Expected group metadata tombstone of console-consumer-36268, Got: %+v", request)
+	}
+
+	cancel()
+	consumer.Close()
+	if !client.closed {
+		t.Errorf("Expected kafka client to be closed")
+	}
+}
+
+func TestOffsetConsumerResumesFromSnapshot(t *testing.T) {
+	opts := options.NewOptions()
+	opts.ConsumerOffsetsTopicName = "__consumer_offsets"
+	opts.KafkaMetadataRefresh = time.Minute
+	opts.KafkaStartOffset = "newest"
+
+	client := newMockKafkaClient()
+	client.partitionIDsByTopicName = map[string][]int32{"__consumer_offsets": {0, 1, 2}}
+	// The messages after the last consumed offset of partition 1 have been deleted meanwhile
+	client.lowWaterMarks = map[string]map[int32]int64{"__consumer_offsets": {0: 0, 1: 100}}
+
+	storageChannel := make(chan *StorageRequest, 10)
+	consumer := &OffsetConsumer{
+		storageChannel:   storageChannel,
+		logger:           log.WithFields(log.Fields{}),
+		client:           client,
+		offsetsTopicName: opts.ConsumerOffsetsTopicName,
+		options:          opts,
+		filter:           &Filter{},
+	}
+	// Partition 2 has been added after the snapshot has been taken
+	consumer.SetResumeOffsets(map[int32]int64{0: 41, 1: 12})
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer.Start(ctx)
+	for i := 0; i < 3; i++ {
+		<-client.consumed
+	}
+
+	expected := map[int32]int64{0: 42, 1: sarama.OffsetOldest, 2: sarama.OffsetOldest}
+	client.lock.Lock()
+	if !reflect.DeepEqual(client.startOffsets, expected) {
+		t.Errorf("Expected start offsets %v, Got: %v", expected, client.startOffsets)
+	}
+	client.lock.Unlock()
+
+	cancel()
+	consumer.Close()
+}
+
+func TestOffsetConsumerStopsBetweenMessages(t *testing.T) {
+	opts := options.NewOptions()
+	opts.ConsumerOffsetsTopicName = "__consumer_offsets"
+	opts.KafkaMetadataRefresh = time.Minute
+
+	client := newMockKafkaClient()
+	client.partitionIDsByTopicName = map[string][]int32{"__consumer_offsets": {0}}
+
+	storageChannel := make(chan *StorageRequest, 10)
+	consumer := &OffsetConsumer{
+		storageChannel:   storageChannel,
+		logger:           log.WithFields(log.Fields{}),
+		client:           client,
+		offsetsTopicName: opts.ConsumerOffsetsTopicName,
+		options:          opts,
+		filter:           &Filter{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer.Start(ctx)
+	<-client.consumed
+	<-storageChannel
+
+	// Messages which are ready after the context has been cancelled must not be processed anymore
+	cancel()
+	client.lock.Lock()
+	partitionConsumer := client.consumers[0]
+	client.lock.Unlock()
+	for i := 0; i < cap(partitionConsumer.messages); i++ {
+		partitionConsumer.messages <- &sarama.ConsumerMessage{
+			Topic:  opts.ConsumerOffsetsTopicName,
+			Offset: int64(i),
+			Key:    []byte("\x00\x02\x00\x16console-consumer-36268"),
+		}
+	}
+	consumer.Close()
+	if len(storageChannel) != 0 {
+		t.Errorf("Expected no messages to be processed after cancellation, Got: %+v", <-storageChannel)
+	}
+}
+
+func TestOffsetConsumerRestartsFailedPartitionConsumers(t *testing.T) {
+	opts := options.NewOptions()
+	opts.ConsumerOffsetsTopicName = "__consumer_offsets"
+	opts.KafkaMetadataRefresh = time.Minute
+	opts.KafkaConnectBackoff = time.Millisecond
+
+	client := newMockKafkaClient()
+	client.partitionIDsByTopicName = map[string][]int32{"__consumer_offsets": {3}}
+	client.consumeFailures = 2
+
+	storageChannel := make(chan *StorageRequest, 10)
+	consumer := &OffsetConsumer{
+		storageChannel:   storageChannel,
+		logger:           log.WithFields(log.Fields{}),
+		client:           client,
+		offsetsTopicName: opts.ConsumerOffsetsTopicName,
+		options:          opts,
+		filter:           &Filter{},
+	}
+	errorsBefore := testutil.ToFloat64(partitionErrors.WithLabelValues("3"))
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer.Start(ctx)
+	<-client.consumed
+	<-storageChannel
+
+	client.lock.Lock()
+	partitionConsumer := client.consumers[3]
+	client.lock.Unlock()
+	partitionConsumer.messages <- &sarama.ConsumerMessage{
+		Topic:     opts.ConsumerOffsetsTopicName,
+		Partition: 3,
+		Offset:    7,
+		Key:       []byte("\x00\x02\x00\x16console-consumer-36268"),
+	}
+	<-storageChannel
+
+	// Sarama closes the messages channel if a partition can not be consumed anymore
+	close(partitionConsumer.messages)
+	<-client.consumed
+	client.lock.Lock()
+	startOffset := client.startOffsets[3]
+	client.lock.Unlock()
+	if startOffset != 8 {
+		t.Errorf("Expected the restarted partition consumer to start after the last processed message, Got offset: %v", startOffset)
+	}
+
+	cancel()
+	consumer.Close()
+	errors := testutil.ToFloat64(partitionErrors.WithLabelValues("3")) - errorsBefore
+	if errors != 3 {
+		t.Errorf("Expected 2 failed starts and 1 stopped partition consumer to be counted, Got: %v", errors)
+	}
+}
+
+func TestFetchWatermarksSpreadsRequests(t *testing.T) {
+	topic := "orders"
+	brokers := []*sarama.MockBroker{sarama.NewMockBroker(t, 1), sarama.NewMockBroker(t, 2), sarama.NewMockBroker(t, 3)}
+	metadataResponse := sarama.NewMockMetadataResponse(t)
+	offsetResponse := sarama.NewMockOffsetResponse(t)
+	for i, broker := range brokers {
+		defer broker.Close()
+		metadataResponse.SetBroker(broker.Addr(), broker.BrokerID())
+		metadataResponse.SetLeader(topic, int32(i), broker.BrokerID())
+		offsetResponse.SetOffset(topic, int32(i), sarama.OffsetOldest, 0)
+		offsetResponse.SetOffset(topic, int32(i), sarama.OffsetNewest, 1000)
+	}
+	for _, broker := range brokers {
+		broker.SetHandlerByMap(map[string]sarama.MockResponse{
+			"MetadataRequest": metadataResponse,
+			"OffsetRequest":   offsetResponse,
+		})
+	}
+
+	opts := options.NewOptions()
+	opts.KafkaVersion = "0.11.0.2"
+	client, err := sarama.NewClient([]string{brokers[0].Addr()}, saramaClientConfig(opts))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	var lock sync.Mutex
+	var delays []time.Duration
+	kafkaClient := newSaramaKafkaClient(client, log.WithFields(log.Fields{}))
+	kafkaClient.watermarkJitter = 300 * time.Millisecond
+	kafkaClient.sleep = func(delay time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		delays = append(delays, delay)
+	}
+
+	highWaterMarks, lowWaterMarks := kafkaClient.FetchWatermarks(map[string][]int32{topic: {0, 1, 2}})
+	if len(highWaterMarks[topic]) != 3 || len(lowWaterMarks[topic]) != 3 {
+		t.Fatalf("Expected water marks of 3 partitions, Got: %v high and %v low water marks", highWaterMarks, lowWaterMarks)
+	}
+
+	// The first broker is requested right away, the others are spread over the jitter (for high and low water marks)
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	expected := []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, 200 * time.Millisecond}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("Expected request delays %v, Got: %v", expected, delays)
+	}
+}
+
+// slowBrokerClient returns a kafka client connected to two mock brokers which lead one partition of the topic each.
+// The broker which leads partition 1 responds to offset requests with the given latency.
+func slowBrokerClient(t *testing.T, topic string, latency time.Duration, opts *options.Options) (*saramaKafkaClient, func()) {
+	fastBroker, slowBroker := sarama.NewMockBroker(t, 1), sarama.NewMockBroker(t, 2)
+	metadataResponse := sarama.NewMockMetadataResponse(t).
+		SetBroker(fastBroker.Addr(), fastBroker.BrokerID()).
+		SetBroker(slowBroker.Addr(), slowBroker.BrokerID()).
+		SetLeader(topic, 0, fastBroker.BrokerID()).
+		SetLeader(topic, 1, slowBroker.BrokerID())
+	offsetResponse := sarama.NewMockOffsetResponse(t)
+	for partitionID := int32(0); partitionID < 2; partitionID++ {
+		offsetResponse.SetOffset(topic, partitionID, sarama.OffsetOldest, 0)
+		offsetResponse.SetOffset(topic, partitionID, sarama.OffsetNewest, 1000)
+	}
+	for _, broker := range []*sarama.MockBroker{fastBroker, slowBroker} {
+		broker.SetHandlerByMap(map[string]sarama.MockResponse{
+			"MetadataRequest": metadataResponse,
+			"OffsetRequest":   offsetResponse,
+		})
+	}
+	// Only the offset requests are sent to the slow broker, the metadata is requested from the fast one
+	slowBroker.SetLatency(latency)
+
+	client, err := sarama.NewClient([]string{fastBroker.Addr()}, saramaClientConfig(opts))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	kafkaClient := newSaramaKafkaClient(client, log.WithFields(log.Fields{}))
+	kafkaClient.requestTimeout = opts.KafkaRequestTimeout
+
+	return kafkaClient, func() {
+		client.Close()
+		fastBroker.Close()
+		slowBroker.Close()
+	}
+}
+
+func TestFetchWatermarksTimesOutSlowBrokers(t *testing.T) {
+	topic := "orders"
+	opts := options.NewOptions()
+	opts.KafkaVersion = "0.11.0.2"
+	// The request timeout is shorter than the read timeout, the slow broker's requests are abandoned before the
+	// client gives up on them
+	opts.KafkaRequestTimeout = 100 * time.Millisecond
+	kafkaClient, closeClient := slowBrokerClient(t, topic, time.Second, opts)
+	defer closeClient()
+
+	timeoutsBefore := testutil.ToFloat64(requestTimeouts.WithLabelValues("list_offsets"))
+	start := time.Now()
+	highWaterMarks, lowWaterMarks := kafkaClient.FetchWatermarks(map[string][]int32{topic: {0, 1}})
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected the slow broker to time out, Got: fetching took %v", elapsed)
+	}
+
+	// The water marks of the fast broker are returned, the ones of the slow broker are missing
+	expectedHighWaterMarks := map[string]map[int32]int64{topic: {0: 1000}}
+	expectedLowWaterMarks := map[string]map[int32]int64{topic: {0: 0}}
+	if !reflect.DeepEqual(highWaterMarks, expectedHighWaterMarks) || !reflect.DeepEqual(lowWaterMarks, expectedLowWaterMarks) {
+		t.Errorf("Expected water marks %v and %v, Got: %v and %v", expectedHighWaterMarks, expectedLowWaterMarks, highWaterMarks, lowWaterMarks)
+	}
+	timeouts := testutil.ToFloat64(requestTimeouts.WithLabelValues("list_offsets")) - timeoutsBefore
+	if timeouts != 2 {
+		t.Errorf("Expected 2 timed out requests, Got: %v", timeouts)
+	}
+}
+
+func TestFetchWatermarksWithDefaultRequestTimeout(t *testing.T) {
+	topic := "orders"
+	// Load the defaults the way main does, so that the default timeouts are tested
+	os.Setenv("KAFKA_BROKERS", "localhost:9092")
+	defer os.Unsetenv("KAFKA_BROKERS")
+	opts := options.NewOptions()
+	if err := envconfig.Process("", opts); err != nil {
+		t.Fatalf("Failed to load the default options: %v", err)
+	}
+	// The slow broker responds after the request timeout, but long before the read timeout
+	kafkaClient, closeClient := slowBrokerClient(t, topic, opts.KafkaRequestTimeout+500*time.Millisecond, opts)
+	defer closeClient()
+
+	start := time.Now()
+	highWaterMarks, _ := kafkaClient.FetchWatermarks(map[string][]int32{topic: {0, 1}})
+	if elapsed := time.Since(start); elapsed >= opts.KafkaWatermarkInterval {
+		t.Errorf("Expected the poll to complete within the water mark interval %v, Got: fetching took %v", opts.KafkaWatermarkInterval, elapsed)
+	}
+	expectedHighWaterMarks := map[string]map[int32]int64{topic: {0: 1000}}
+	if !reflect.DeepEqual(highWaterMarks, expectedHighWaterMarks) {
+		t.Errorf("Expected high water marks %v, Got: %v", expectedHighWaterMarks, highWaterMarks)
+	}
+}
+
+// benchmarkWaterMarkClient returns a sarama client connected to a single mock broker which leads all partitions
+// of the given topic. The offset responses must have the same version as the requests sent by the benchmark.
+func benchmarkWaterMarkClient(b *testing.B, topic string, partitionCount int, offsetVersion int16) (sarama.Client, *sarama.MockBroker) {
+	broker := sarama.NewMockBroker(b, 1)
+	metadataResponse := sarama.NewMockMetadataResponse(b).SetBroker(broker.Addr(), broker.BrokerID())
+	offsetResponse := sarama.NewMockOffsetResponse(b).SetVersion(offsetVersion)
+	for i := 0; i < partitionCount; i++ {
+		metadataResponse.SetLeader(topic, int32(i), broker.BrokerID())
+		offsetResponse.SetOffset(topic, int32(i), sarama.OffsetOldest, 0)
+		offsetResponse.SetOffset(topic, int32(i), sarama.OffsetNewest, 1000)
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadataResponse,
+		"OffsetRequest":   offsetResponse,
+	})
+
+	opts := options.NewOptions()
+	opts.KafkaVersion = "0.11.0.2"
+	client, err := sarama.NewClient([]string{broker.Addr()}, saramaClientConfig(opts))
+	if err != nil {
+		b.Fatalf("Failed to create client: %v", err)
+	}
+	return client, broker
+}
+
+// BenchmarkFetchWatermarksNaive requests the high and low water mark of each partition separately
+func BenchmarkFetchWatermarksNaive(b *testing.B) {
+	topic := "orders"
+	partitionCount := 500
+	client, broker := benchmarkWaterMarkClient(b, topic, partitionCount, 1)
+	defer broker.Close()
+	defer client.Close()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < partitionCount; i++ {
+			if _, err := client.GetOffset(topic, int32(i), sarama.OffsetNewest); err != nil {
+				b.Fatalf("Failed to get high water mark: %v", err)
+			}
+			if _, err := client.GetOffset(topic, int32(i), sarama.OffsetOldest); err != nil {
+				b.Fatalf("Failed to get low water mark: %v", err)
+			}
+		}
+	}
+}
+
+// BenchmarkFetchWatermarksBatched requests the water marks of all partitions with one request per broker
+func BenchmarkFetchWatermarksBatched(b *testing.B) {
+	topic := "orders"
+	partitionCount := 500
+	client, broker := benchmarkWaterMarkClient(b, topic, partitionCount, 0)
+	defer broker.Close()
+	defer client.Close()
+
+	kafkaClient := newSaramaKafkaClient(client, log.WithFields(log.Fields{}))
+	partitionIDs, err := client.Partitions(topic)
+	if err != nil {
+		b.Fatalf("Failed to get partitions: %v", err)
+	}
+	partitionIDsByTopicName := map[string][]int32{topic: partitionIDs}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		highWaterMarks, lowWaterMarks := kafkaClient.FetchWatermarks(partitionIDsByTopicName)
+		if len(highWaterMarks[topic]) != partitionCount || len(lowWaterMarks[topic]) != partitionCount {
+			b.Fatalf("Expected water marks of %v partitions, Got: %v high and %v low water marks",
+				partitionCount, len(highWaterMarks[topic]), len(lowWaterMarks[topic]))
+		}
+	}
+}
@@ -8,8 +8,13 @@ import (
 // - How many kafka messages have been consumed (successfully and failed)
 // - How many offset commits (tombstones) have been decoded
 // - How many group metadata (tombstones) have been decoded
+// - How many records could not be decoded (by record type and reason)
+// - How many records have been skipped, because they exceed the max record size
+// - How far the partitions of the offsets topic have been consumed
+// - How often consuming a partition of the offsets topic has failed
 
-const internalMetricsName = "kafka_minion_internal"
+// The metrics are named without the metrics prefix, it's added when they are registered
+const internalMetricsName = "internal"
 
 var (
 	offsetCommit = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -30,6 +35,24 @@ var (
 		Help: "Number of read group meta data tombstone messages",
 	})
 
+	// decodeErrors is exposed without the internal prefix, e. g. as kafka_minion_decode_errors_total
+	decodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "decode_errors_total",
+		Help: "Number of records in the offsets topic which could not be decoded",
+	}, []string{"record_type", "reason"})
+	storageQueueBlocked = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(internalMetricsName, "offset_consumer", "storage_queue_blocked_seconds_total"),
+		Help: "Time the offset consumer has been blocked, because the storage queue was full",
+	})
+	unknownKeyVersion = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(internalMetricsName, "offset_consumer", "unknown_key_version_total"),
+		Help: "Number of records in the offsets topic which have been skipped because of an unknown key version",
+	}, []string{"version"})
+	oversizedRecords = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(internalMetricsName, "offset_consumer", "oversized_records_total"),
+		Help: "Number of records in the offsets topic which have been skipped, because their value exceeds the max record size",
+	})
+
 	messagesInSuccess = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: prometheus.BuildFQName(internalMetricsName, "kafka", "messages_in_success"),
 		Help: "Number of messages successfully consumed from a topic",
@@ -38,15 +61,51 @@ var (
 		Name: prometheus.BuildFQName(internalMetricsName, "kafka", "messages_in_failed"),
 		Help: "Number of messages failed to consume from a topic",
 	}, []string{"topic"})
+	requestTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(internalMetricsName, "kafka", "request_timeouts_total"),
+		Help: "Number of water mark and metadata requests which have been abandoned, because they exceeded the request timeout",
+	}, []string{"request"})
+
+	internalPartitionOffset = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(internalMetricsName, "topic_partition", "offset"),
+		Help: "Last consumed offset of a partition in the consumer offsets topic",
+	}, []string{"partition"})
+	internalPartitionHighWaterMark = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(internalMetricsName, "topic_partition", "high_water_mark"),
+		Help: "Last known high water mark of a partition in the consumer offsets topic",
+	}, []string{"partition"})
+	partitionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(internalMetricsName, "", "partition_errors_total"),
+		Help: "Number of errors while consuming a partition of the consumer offsets topic, including restarts of its consumer",
+	}, []string{"partition"})
 )
 
-func init() {
-	prometheus.MustRegister(offsetCommit)
-	prometheus.MustRegister(offsetCommitTombstone)
+// RegisterMetrics registers all internal metrics at the given registerer, their names are prefixed with the given
+// metrics prefix. They are registered on startup rather than in init() so that the prefix and constant labels (e. g.
+// the cluster label) can be applied by wrapping the registerer.
+func RegisterMetrics(registerer prometheus.Registerer, prefix string) {
+	registerer = prometheus.WrapRegistererWithPrefix(prefix+"_", registerer)
+	registerer.MustRegister(offsetCommit)
+	registerer.MustRegister(offsetCommitTombstone)
+
+	registerer.MustRegister(groupMetadata)
+	registerer.MustRegister(groupMetadataTombstone)
+	registerer.MustRegister(decodeErrors)
+	registerer.MustRegister(unknownKeyVersion)
+	registerer.MustRegister(oversizedRecords)
+	registerer.MustRegister(storageQueueBlocked)
 
-	prometheus.MustRegister(groupMetadata)
-	prometheus.MustRegister(groupMetadataTombstone)
+	registerer.MustRegister(messagesInSuccess)
+	registerer.MustRegister(messagesInFailed)
+	registerer.MustRegister(requestTimeouts)
+
+	registerer.MustRegister(internalPartitionOffset)
+	registerer.MustRegister(internalPartitionHighWaterMark)
+	registerer.MustRegister(partitionErrors)
+}
 
-	prometheus.MustRegister(messagesInSuccess)
-	prometheus.MustRegister(messagesInFailed)
+// countDecodeError increments the decode error counter. The reason should be the same string which is logged as
+// reason (or error_at) next to the "failed to decode" message.
+func countDecodeError(recordType string, reason string) {
+	decodeErrors.WithLabelValues(recordType, reason).Add(1)
 }
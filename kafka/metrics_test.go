@@ -0,0 +1,26 @@
+package kafka
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+)
+
+func TestRegisterMetricsWithPrefix(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	RegisterMetrics(registry, "custom_prefix")
+	countDecodeError("metadata", "no member size")
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	for _, name := range []string{"custom_prefix_internal_offset_consumer_offset_commits_tombstones_read", "custom_prefix_decode_errors_total"} {
+		if !names[name] {
+			t.Errorf("Expected metric %v to be registered, Got: %v", name, names)
+		}
+	}
+}
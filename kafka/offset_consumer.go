@@ -2,19 +2,26 @@ package kafka
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"github.com/Shopify/sarama"
 	"github.com/google-cloud-tools/kafka-minion/options"
 	log "github.com/sirupsen/logrus"
-	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-type consumerStatus struct {
-	PartitionLag int64
-	IsReady      bool // Indicates whether a partition consumer has caught up the partition lag or not
+// PartitionConsumerStatus describes the progress of a single partition consumer of the offsets topic
+type PartitionConsumerStatus struct {
+	PartitionID    int32
+	ConsumedOffset int64
+	HighWaterMark  int64 // -1 if the high water mark hasn't been fetched yet
+	PartitionLag   int64
+	IsReady        bool // Indicates whether a partition consumer has caught up the partition lag or not
 }
 
 // OffsetConsumer is a consumer module which reads consumer group information from the offsets topic in a Kafka cluster.
@@ -28,14 +35,36 @@ type OffsetConsumer struct {
 	storageChannel chan<- *StorageRequest
 
 	logger           *log.Entry
-	client           sarama.Client
+	client           KafkaClient
 	offsetsTopicName string
 	options          *options.Options
+	filter           *Filter
+
+	// decodeLenient keeps group metadata records whose members' subscription or assignment can't be decoded.
+	// It's a separate field, because offline decoding (see DecodeDump) runs without options.
+	decodeLenient bool
+
+	// maxRecordBytes is the max size of a record's value which is decoded, larger records are skipped. 0 means
+	// unlimited. It guards the decoders against corrupt records whose length prefixes would allocate huge buffers.
+	maxRecordBytes int
+
+	// workers limits the number of partition consumers which process a message at the same time. It's nil if the
+	// number of workers is not limited.
+	workers chan struct{}
+
+	// resumeOffsets contains the last consumed offset by partition ID of a previous run (e. g. restored from a snapshot)
+	resumeOffsets map[int32]int64
+
+	// consumedPartitions is only accessed by Start and the partition watcher afterwards
+	consumedPartitions map[int32]bool
+
+	statusLock      sync.RWMutex
+	partitionStatus map[int32]PartitionConsumerStatus
 }
 
 // NewOffsetConsumer creates a consumer which process all messages in the __consumer_offsets topic
 // If it cannot connect to the cluster it will panic
-func NewOffsetConsumer(opts *options.Options, storageChannel chan<- *StorageRequest) *OffsetConsumer {
+func NewOffsetConsumer(opts *options.Options, filter *Filter, storageChannel chan<- *StorageRequest) *OffsetConsumer {
 	logger := log.WithFields(log.Fields{
 		"module": "offset_consumer",
 	})
@@ -44,12 +73,33 @@ func NewOffsetConsumer(opts *options.Options, storageChannel chan<- *StorageRequ
 	connectionLogger := logger.WithFields(log.Fields{
 		"address": strings.Join(opts.KafkaBrokers, ","),
 	})
+	if opts.KafkaStartOffset != "oldest" && opts.KafkaStartOffset != "newest" {
+		logger.Panicf("invalid start offset '%v', must be either 'oldest' or 'newest'", opts.KafkaStartOffset)
+	}
+	if opts.KafkaMetadataRefresh <= 0 {
+		logger.Panicf("invalid metadata refresh interval '%v', must be greater than 0", opts.KafkaMetadataRefresh)
+	}
+	if opts.ConsumerMaxRecordBytes < 0 {
+		logger.Panicf("invalid max record bytes '%v', must not be negative", opts.ConsumerMaxRecordBytes)
+	}
+	if opts.ConsumerWorkers < 0 {
+		logger.Panicf("invalid number of consumer workers '%v', must not be negative", opts.ConsumerWorkers)
+	}
+	var workers chan struct{}
+	if opts.ConsumerWorkers > 0 {
+		workers = make(chan struct{}, opts.ConsumerWorkers)
+	}
 	clientConfig := saramaClientConfig(opts)
 	connectionLogger.Info("Connecting to kafka cluster")
-	client, err := sarama.NewClient(opts.KafkaBrokers, clientConfig)
+	var client sarama.Client
+	err := connectWithRetries(opts, connectionLogger, func() error {
+		var err error
+		client, err = sarama.NewClient(opts.KafkaBrokers, clientConfig)
+		return err
+	})
 	if err != nil {
 		connectionLogger.WithFields(log.Fields{
-			"reason": err,
+			"reason": err.Error(),
 		}).Panicf("failed to start client")
 	}
 	connectionLogger.Info("Successfully connected to kafka cluster")
@@ -58,75 +108,266 @@ func NewOffsetConsumer(opts *options.Options, storageChannel chan<- *StorageRequ
 		wg:               sync.WaitGroup{},
 		storageChannel:   storageChannel,
 		logger:           logger,
-		client:           client,
+		client:           newSaramaKafkaClient(client, logger),
 		offsetsTopicName: opts.ConsumerOffsetsTopicName,
 		options:          opts,
+		filter:           filter,
+		decodeLenient:    opts.DecodeLenient,
+		maxRecordBytes:   opts.ConsumerMaxRecordBytes,
+		partitionStatus:  make(map[int32]PartitionConsumerStatus),
+		workers:          workers,
 	}
 }
 
-// Start creates partition consumer for each partition in that topic and starts consuming them
-func (module *OffsetConsumer) Start() {
-	// Create the consumer from the client
-	consumer, err := sarama.NewConsumerFromClient(module.client)
-	if err != nil {
-		log.Panic("failed to get new consumer", err)
-	}
+// SetResumeOffsets sets the last consumed offsets (by partition ID) of a previous run. Partition consumers will
+// continue consuming right after these offsets. Partitions without an offset are consumed from the beginning.
+func (module *OffsetConsumer) SetResumeOffsets(offsets map[int32]int64) {
+	module.resumeOffsets = offsets
+}
+
+// Start creates partition consumer for each partition in that topic and starts consuming them. All partition
+// consumers stop once the context is cancelled.
+func (module *OffsetConsumer) Start(ctx context.Context) {
+	module.consumedPartitions = make(map[int32]bool)
 
 	// Get the partition count for the offsets topic
-	partitions, err := module.client.Partitions(module.offsetsTopicName)
+	topics, err := module.client.DescribeTopics(module.offsetsTopicName)
+	partitions := topics[module.offsetsTopicName]
+	if err == nil && len(partitions) == 0 {
+		err = fmt.Errorf("topic has no partitions")
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"topic": module.offsetsTopicName,
 			"error": err.Error(),
 		}).Panic("failed to get partition count")
 	}
-
-	// Start consumers for each partition with fan in
 	log.WithFields(log.Fields{
 		"topic": module.offsetsTopicName,
 		"count": len(partitions),
-	}).Infof("Starting '%d' partition consumers", len(partitions))
-	registerPartitionRequest := newRegisterOffsetPartitionsRequest(len(partitions))
-	module.storageChannel <- registerPartitionRequest
+	}).Info("discovered partitions of the offsets topic")
+	module.startPartitionConsumers(ctx, partitions)
+
+	go module.partitionWatcher(ctx)
+}
+
+// Close waits until all partition consumers have stopped and closes the kafka client afterwards
+func (module *OffsetConsumer) Close() {
+	module.wg.Wait()
+	module.client.Close()
+}
+
+// startPartitionConsumers registers and starts a partition consumer for each of the given partitions which isn't
+// consumed yet
+func (module *OffsetConsumer) startPartitionConsumers(ctx context.Context, partitions []int32) {
+	newPartitions := make([]int32, 0)
 	for _, partition := range partitions {
+		if !module.consumedPartitions[partition] {
+			newPartitions = append(newPartitions, partition)
+		}
+	}
+	if len(newPartitions) == 0 {
+		return
+	}
+
+	// Start consumers for each partition with fan in
+	log.WithFields(log.Fields{
+		"topic": module.offsetsTopicName,
+		"count": len(newPartitions),
+	}).Infof("Starting '%d' partition consumers", len(newPartitions))
+	registerPartitionRequest := newRegisterOffsetPartitionsRequest(len(newPartitions))
+	module.sendToStorage(registerPartitionRequest)
+	for _, partition := range newPartitions {
+		module.consumedPartitions[partition] = true
 		module.wg.Add(1)
-		go module.partitionConsumer(consumer, partition)
+		go module.partitionConsumer(ctx, partition)
 	}
 	log.WithFields(log.Fields{
 		"topic": module.offsetsTopicName,
-		"count": len(partitions),
+		"count": len(newPartitions),
 	}).Info("Spawned all consumers")
 }
 
+// partitionWatcher refreshes the offsets topic metadata in the metadata refresh interval, so that consumers are
+// started for partitions which have been added after startup (e. g. if an admin has increased the partition count)
+func (module *OffsetConsumer) partitionWatcher(ctx context.Context) {
+	ticker := time.NewTicker(module.options.KafkaMetadataRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		topics, err := module.client.DescribeTopics(module.offsetsTopicName)
+		if err != nil {
+			module.logger.WithFields(log.Fields{
+				"topic": module.offsetsTopicName,
+				"error": err.Error(),
+			}).Warn("failed to refresh offsets topic metadata")
+			continue
+		}
+		partitions := topics[module.offsetsTopicName]
+		if len(partitions) != len(module.consumedPartitions) {
+			module.logger.WithFields(log.Fields{
+				"topic":          module.offsetsTopicName,
+				"count":          len(partitions),
+				"previous_count": len(module.consumedPartitions),
+			}).Info("partition count of the offsets topic has changed")
+		}
+		module.startPartitionConsumers(ctx, partitions)
+	}
+}
+
 // partitionConsumer is a worker routine which consumes a single partition in the __consumer_offsets topic.
 // It processes all it's messages and pushes the information into the storage module. Additionally it
-// reports to the storage module when it has initially caught up the partition lag.
-func (module *OffsetConsumer) partitionConsumer(consumer sarama.Consumer, partitionID int32) {
+// reports to the storage module when it has initially caught up the partition lag. Messages of a partition must
+// be processed by this routine only: Kafka orders the commits of a group within its offsets topic partition and
+// the storage module applies them in the order they are sent, so that the latest commit always wins.
+// If the partition can not be consumed (anymore), the routine backs off and resumes right after the last
+// processed message, so that a partition is never dropped.
+func (module *OffsetConsumer) partitionConsumer(ctx context.Context, partitionID int32) {
 	defer module.wg.Done()
 
 	log.Debugf("Starting consumer %d", partitionID)
-	pconsumer, err := consumer.ConsumePartition(module.offsetsTopicName, partitionID, sarama.OffsetOldest)
-	if err != nil {
+	progress := partitionProgress{nextOffset: sarama.OffsetOldest}
+	if offset, exists := module.resumeOffsets[partitionID]; exists {
+		progress.nextOffset = offset + 1
+		progress.consumedOffset = offset
+		log.WithFields(log.Fields{
+			"topic":         module.offsetsTopicName,
+			"partition":     partitionID,
+			"resume_offset": progress.nextOffset,
+		}).Info("resuming to consume partition after the last consumed offset of the snapshot")
+	} else if len(module.resumeOffsets) > 0 {
+		// The partition has been added after the snapshot has been taken, all of its messages are missing
 		log.WithFields(log.Fields{
 			"topic":     module.offsetsTopicName,
 			"partition": partitionID,
-			"error":     err.Error(),
-		}).Panic("could not start consumer")
+		}).Info("partition is missing in the snapshot, consuming it from the oldest offset")
+	} else if module.options.KafkaStartOffset == "newest" {
+		// Resolve the newest offset upfront, so that the partition consumer is considered as caught up right away
+		highWaterMarks, _ := module.client.FetchWatermarks(map[string][]int32{module.offsetsTopicName: {partitionID}})
+		newestOffset, exists := highWaterMarks[module.offsetsTopicName][partitionID]
+		if !exists {
+			log.WithFields(log.Fields{
+				"topic":     module.offsetsTopicName,
+				"partition": partitionID,
+			}).Panic("could not get newest offset")
+		}
+		progress.nextOffset = newestOffset
+		progress.consumedOffset = newestOffset - 1
 	}
-	log.Debugf("Started consumer %d", partitionID)
-	defer pconsumer.AsyncClose()
+	progress.reportedOffset = progress.consumedOffset
 
+	partitionLabel := strconv.Itoa(int(partitionID))
+	backoff := module.options.KafkaConnectBackoff
+	for {
+		pconsumer, err := module.client.Consume(module.offsetsTopicName, partitionID, progress.nextOffset)
+		if err == sarama.ErrOffsetOutOfRange && progress.nextOffset >= 0 {
+			// The messages after the resume offset have already been deleted by the retention (e. g. because the
+			// snapshot is outdated), retrying wouldn't help
+			log.WithFields(log.Fields{
+				"topic":     module.offsetsTopicName,
+				"partition": partitionID,
+				"offset":    progress.nextOffset,
+			}).Warn("offset to consume from is out of range, consuming partition from the oldest offset")
+			progress.nextOffset = sarama.OffsetOldest
+			pconsumer, err = module.client.Consume(module.offsetsTopicName, partitionID, progress.nextOffset)
+		}
+		if err == nil {
+			log.Debugf("Started consumer %d", partitionID)
+			consumedBefore := progress.nextOffset
+			module.consumePartition(ctx, partitionID, pconsumer, &progress)
+			pconsumer.Close()
+			if ctx.Err() != nil {
+				break
+			}
+			err = fmt.Errorf("partition consumer has stopped")
+			if progress.nextOffset != consumedBefore {
+				// The partition has been consumed successfully for a while, the next failure starts a new backoff
+				backoff = module.options.KafkaConnectBackoff
+			}
+		}
+
+		partitionErrors.WithLabelValues(partitionLabel).Add(1)
+		log.WithFields(log.Fields{
+			"topic":       module.offsetsTopicName,
+			"partition":   partitionID,
+			"next_offset": progress.nextOffset,
+			"delay":       backoff.String(),
+			"error":       err.Error(),
+		}).Warn("failed to consume partition, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+
+	// Report the final progress so that it's part of the last storage snapshot
+	if progress.consumedOffset != progress.reportedOffset {
+		module.sendToStorage(newMarkOffsetPartitionConsumedRequest(partitionID, progress.consumedOffset))
+	}
+	log.Debugf("Stopped consumer %d", partitionID)
+}
+
+// partitionProgress tracks how far a partition consumer has consumed its partition. It outlives the sarama
+// partition consumers, which are recreated whenever a partition can not be consumed anymore.
+type partitionProgress struct {
+	// nextOffset is the offset (or sarama.OffsetOldest) to start consuming at, if the partition consumer is recreated
+	nextOffset     int64
+	consumedOffset int64
+	reportedOffset int64
+	isReady        bool
+}
+
+// consumePartition processes the messages of the partition consumer until the context is cancelled or the partition
+// consumer stops delivering messages (its messages channel is closed)
+func (module *OffsetConsumer) consumePartition(ctx context.Context, partitionID int32, pconsumer sarama.PartitionConsumer, progress *partitionProgress) {
 	ticker := time.NewTicker(5 * time.Second)
-	var consumedOffset int64
+	consumedTicker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer consumedTicker.Stop()
 
+	partitionLabel := strconv.Itoa(int(partitionID))
 	for {
 		select {
-		case msg := <-pconsumer.Messages():
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pconsumer.Messages():
+			if !ok {
+				return
+			}
+			// If messages are ready as well, select might keep picking them after the context has been cancelled
+			if ctx.Err() != nil {
+				return
+			}
 			messagesInSuccess.WithLabelValues(msg.Topic).Add(1)
-			module.processMessage(msg)
-			consumedOffset = msg.Offset
-		case err := <-pconsumer.Errors():
+			module.processMessageWithWorker(msg)
+			progress.consumedOffset = msg.Offset
+			progress.nextOffset = msg.Offset + 1
+		case <-consumedTicker.C:
+			// Report our progress so that it can be persisted in storage snapshots
+			if progress.consumedOffset != progress.reportedOffset {
+				module.sendToStorage(newMarkOffsetPartitionConsumedRequest(partitionID, progress.consumedOffset))
+				progress.reportedOffset = progress.consumedOffset
+			}
+		case err, ok := <-pconsumer.Errors():
+			if !ok {
+				continue
+			}
+			// Sarama retries transient errors (e. g. a leader which is not available during a broker restart)
+			// on its own, as long as it doesn't close the messages channel
 			messagesInFailed.WithLabelValues(err.Topic).Add(1)
+			partitionErrors.WithLabelValues(partitionLabel).Add(1)
 			log.WithFields(log.Fields{
 				"error":     err.Error(),
 				"topic":     err.Topic,
@@ -135,34 +376,112 @@ func (module *OffsetConsumer) partitionConsumer(consumer sarama.Consumer, partit
 		case <-ticker.C:
 			// Regularly check if we have completely consumed the offsets topic
 			// If that's the case report it to our storage module
-			var highWaterMark int64
-			highWaterMark = math.MaxInt64
-			offsetWaterMarks.Lock.RLock()
-			if val, exists := offsetWaterMarks.PartitionsByID[partitionID]; exists {
-				// Not sure why -1 is needed here, but otherwise there are lots of partition consumers with a remaining lag of 1
-				highWaterMark = val.HighWaterMark - 1
-				if highWaterMark < 0 {
-					highWaterMark = 0
-				}
-			}
-			offsetWaterMarks.Lock.RUnlock()
-			if consumedOffset >= highWaterMark {
+			status := module.updatePartitionStatus(partitionID, progress.consumedOffset)
+			if status.IsReady && !progress.isReady {
 				request := newMarkOffsetPartitionReadyRequest(partitionID)
-				module.storageChannel <- request
-				ticker.Stop()
-			} else {
+				module.sendToStorage(request)
+				progress.isReady = true
+			} else if !status.IsReady {
 				log.WithFields(log.Fields{
 					"partition":       partitionID,
-					"high_water_mark": highWaterMark,
-					"consumed_offset": consumedOffset,
-					"remaining_lag":   highWaterMark - consumedOffset,
+					"high_water_mark": status.HighWaterMark,
+					"consumed_offset": progress.consumedOffset,
+					"remaining_lag":   status.PartitionLag,
 				}).Debug("partition consumer has not caught up the lag yet")
 			}
 		}
 	}
 }
 
-// processMessage decodes the message and sends it to the storage module
+// updatePartitionStatus compares the consumed offset against the last known high water mark of the partition and
+// stores the resulting status. Once a partition consumer is ready it stays ready.
+func (module *OffsetConsumer) updatePartitionStatus(partitionID int32, consumedOffset int64) PartitionConsumerStatus {
+	status := PartitionConsumerStatus{
+		PartitionID:    partitionID,
+		ConsumedOffset: consumedOffset,
+		HighWaterMark:  -1,
+	}
+	offsetWaterMarks.Lock.RLock()
+	val, exists := offsetWaterMarks.PartitionsByID[partitionID]
+	offsetWaterMarks.Lock.RUnlock()
+	if exists {
+		status.HighWaterMark = val.HighWaterMark
+		// The high water mark is the offset of the next message, hence the last message has the offset hwm - 1
+		lastOffset := val.HighWaterMark - 1
+		if lastOffset < 0 {
+			lastOffset = 0
+		}
+		status.PartitionLag = lastOffset - consumedOffset
+		if status.PartitionLag < 0 {
+			status.PartitionLag = 0
+		}
+		status.IsReady = status.PartitionLag <= module.options.ConsumerOffsetsReadyLag
+	}
+
+	module.statusLock.Lock()
+	if previous, exists := module.partitionStatus[partitionID]; exists && previous.IsReady {
+		status.IsReady = true
+	}
+	module.partitionStatus[partitionID] = status
+	module.statusLock.Unlock()
+
+	partitionLabel := strconv.Itoa(int(partitionID))
+	internalPartitionOffset.WithLabelValues(partitionLabel).Set(float64(consumedOffset))
+	if exists {
+		internalPartitionHighWaterMark.WithLabelValues(partitionLabel).Set(float64(status.HighWaterMark))
+	}
+
+	return status
+}
+
+// PartitionStatus returns the status of all partition consumers sorted by partition ID
+func (module *OffsetConsumer) PartitionStatus() []PartitionConsumerStatus {
+	module.statusLock.RLock()
+	defer module.statusLock.RUnlock()
+
+	statuses := make([]PartitionConsumerStatus, 0, len(module.partitionStatus))
+	for _, status := range module.partitionStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].PartitionID < statuses[j].PartitionID
+	})
+
+	return statuses
+}
+
+// sendToStorage queues the request for the storage module. If the queue is full, it blocks until the storage module
+// has caught up rather than dropping the request, and adds the time it was blocked to the blocked seconds metric.
+func (module *OffsetConsumer) sendToStorage(request *StorageRequest) {
+	select {
+	case module.storageChannel <- request:
+		return
+	default:
+	}
+
+	start := time.Now()
+	module.storageChannel <- request
+	storageQueueBlocked.Add(time.Since(start).Seconds())
+}
+
+// processMessageWithWorker processes the message as soon as one of the workers is available. All partition
+// consumers run concurrently, the workers only bound the number of cores which are busy decoding messages. The
+// order of messages within a partition is preserved, as the partition consumer waits until its message has been
+// processed before it processes the next one.
+func (module *OffsetConsumer) processMessageWithWorker(msg *sarama.ConsumerMessage) {
+	if module.workers == nil {
+		module.processMessage(msg)
+		return
+	}
+
+	module.workers <- struct{}{}
+	module.processMessage(msg)
+	<-module.workers
+}
+
+// processMessage reads the key version of the message and routes it to the decoder for that key version, which
+// sends the decoded message to the storage module. Messages with key versions which are only known by newer Kafka
+// versions are skipped, as their key and value formats are unknown.
 func (module *OffsetConsumer) processMessage(msg *sarama.ConsumerMessage) {
 	logger := module.logger.WithFields(log.Fields{
 		"offset_topic":     msg.Topic,
@@ -180,24 +499,38 @@ func (module *OffsetConsumer) processMessage(msg *sarama.ConsumerMessage) {
 		logger.WithFields(log.Fields{
 			"reason": "no key version",
 		}).Warn("failed to decode offset message")
+		countDecodeError("unknown", "no key version")
+		return
+	}
+
+	if module.maxRecordBytes > 0 && len(msg.Value) > module.maxRecordBytes {
+		// The group name is read from a copy, as the key is not decoded any further
+		group, _ := readString(bytes.NewBuffer(key.Bytes()))
+		logger.WithFields(log.Fields{
+			"group":       group,
+			"key_version": keyVersion,
+			"bytes":       len(msg.Value),
+			"max_bytes":   module.maxRecordBytes,
+		}).Warn("skipped offset message whose value exceeds the max record size")
+		oversizedRecords.Add(1)
 		return
 	}
 
 	switch keyVersion {
 	case 0, 1:
-		module.processOffsetCommit(key, value, logger)
+		module.processOffsetCommit(key, value, InternalPosition{Partition: msg.Partition, Offset: msg.Offset}, logger)
 	case 2:
-		// module.processGroupMetadata(key, value, logger)
+		module.processGroupMetadata(key, value, InternalPosition{Partition: msg.Partition, Offset: msg.Offset}, logger)
 	default:
 		logger.WithFields(log.Fields{
-			"reason":  "unknown key version",
 			"version": keyVersion,
-		}).Warn("Failed to decode offset message")
+		}).Warn("skipped offset message with unknown key version")
+		unknownKeyVersion.WithLabelValues(strconv.Itoa(int(keyVersion))).Add(1)
 	}
 }
 
 // processOffsetCommit decodes all offset commit messages and sends them to the storage module
-func (module *OffsetConsumer) processOffsetCommit(key *bytes.Buffer, value *bytes.Buffer, logger *log.Entry) {
+func (module *OffsetConsumer) processOffsetCommit(key *bytes.Buffer, value *bytes.Buffer, position InternalPosition, logger *log.Entry) {
 	isTombstone := false
 	if value.Len() == 0 {
 		isTombstone = true
@@ -234,12 +567,16 @@ func (module *OffsetConsumer) processOffsetCommit(key *bytes.Buffer, value *byte
 			return
 		}
 
+		if !module.filter.IsGroupAllowed(group) {
+			return
+		}
+
 		logger.WithFields(log.Fields{
 			"group":     group,
 			"topic":     topic,
 			"partition": partitionID,
 		}).Debug("received a tombstone")
-		module.storageChannel <- newDeleteConsumerGroupRequest(group, topic, partitionID)
+		module.sendToStorage(newDeleteConsumerGroupRequest(group, topic, partitionID, position))
 
 		return
 	}
@@ -249,46 +586,107 @@ func (module *OffsetConsumer) processOffsetCommit(key *bytes.Buffer, value *byte
 		// Error is already logged inside of the function
 		return
 	}
+	offset.InternalPosition = position
 	logger.WithFields(log.Fields{
 		"group":     offset.Group,
 		"topic":     offset.Topic,
 		"partition": offset.Partition,
 	}).Debug("received consumer offset")
 
-	if !module.isTopicAllowed(offset.Topic) {
+	if !module.filter.IsGroupAllowed(offset.Group) {
+		logger.WithFields(log.Fields{
+			"group": offset.Group,
+		}).Debug("group is not allowed")
+		return
+	}
+	if !module.filter.IsTopicAllowed(offset.Topic) {
 		logger.WithFields(log.Fields{
 			"topic": offset.Topic,
 		}).Debug("topic is not allowed")
 		return
 	}
-	module.storageChannel <- newAddConsumerOffsetRequest(offset)
-}
-
-func (module *OffsetConsumer) isTopicAllowed(topicName string) bool {
-	if module.options.IgnoreSystemTopics {
-		if strings.HasPrefix(topicName, "__") || strings.HasPrefix(topicName, "_confluent") {
-			return false
-		}
-	}
-
-	return true
+	module.sendToStorage(newAddConsumerOffsetRequest(offset))
 }
 
 // processGroupMetadata decodes all group metadata messages and sends them to the storage module
-func (module *OffsetConsumer) processGroupMetadata(key *bytes.Buffer, value *bytes.Buffer, logger *log.Entry) {
+func (module *OffsetConsumer) processGroupMetadata(key *bytes.Buffer, value *bytes.Buffer, position InternalPosition, logger *log.Entry) {
 	isTombstone := false
 	if value.Len() == 0 {
 		isTombstone = true
 	}
+
+	// A tombstone for group metadata indicates that the consumer group has been deleted (e. g. because all
+	// of it's offsets have expired), thus we must remove that group from the storage as well.
 	if isTombstone {
+		groupMetadataTombstone.Add(1)
+		group, err := readString(key)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("failed to read group metadata tombstone's consumer group")
+			return
+		}
+
+		if !module.filter.IsGroupAllowed(group) {
+			return
+		}
+
+		logger.WithFields(log.Fields{
+			"group": group,
+		}).Debug("received a group metadata tombstone")
+		module.sendToStorage(newDeleteGroupMetadataRequest(group, position))
+
 		return
 	}
 
 	// Group metadata contains client information (such as owner's IP address), how many partitions are assigned to a group member etc
-	metadata, err := newConsumerGroupMetadata(key, value, logger)
+	metadata, err := newConsumerGroupMetadata(key, value, module.decodeLenient, logger)
 	if err != nil {
 		// Error is already logged inside of the function
 		return
 	}
-	module.storageChannel <- newAddGroupMetadata(metadata)
+	metadata.InternalPosition = position
+	if !module.filter.IsGroupAllowed(metadata.Group) {
+		return
+	}
+	// A group which only consumes filtered topics is dropped entirely, its offsets are not stored either. The
+	// metadata of a previous generation might still be stored, hence it's deleted.
+	if !module.hasAllowedTopic(metadata) {
+		logger.WithFields(log.Fields{
+			"group": metadata.Group,
+		}).Debug("group metadata only contains filtered topics")
+		module.sendToStorage(newDeleteGroupMetadataRequest(metadata.Group, position))
+		return
+	}
+	// Assignments of filtered topics would otherwise still be exposed as partition owners
+	for _, member := range metadata.Members {
+		for topic := range member.Assignment {
+			if !module.filter.IsTopicAllowed(topic) {
+				delete(member.Assignment, topic)
+			}
+		}
+	}
+	module.sendToStorage(newAddGroupMetadata(metadata))
+}
+
+// hasAllowedTopic returns false if all topics the members subscribed to or have been assigned are filtered. Groups
+// without any topics (e. g. empty groups or non consumer groups) are considered to have an allowed topic.
+func (module *OffsetConsumer) hasAllowedTopic(metadata *ConsumerGroupMetadata) bool {
+	hasTopics := false
+	for _, member := range metadata.Members {
+		for _, topic := range member.Subscription {
+			hasTopics = true
+			if module.filter.IsTopicAllowed(topic) {
+				return true
+			}
+		}
+		for topic := range member.Assignment {
+			hasTopics = true
+			if module.filter.IsTopicAllowed(topic) {
+				return true
+			}
+		}
+	}
+
+	return !hasTopics
 }
@@ -1,14 +1,23 @@
 package kafka
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/Shopify/sarama"
+	"github.com/google-cloud-tools/kafka-minion/options"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	log "github.com/sirupsen/logrus"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestProcessOffsetCommit(t *testing.T) {
+	storageChannel := make(chan *StorageRequest, 1)
 	mockConsumer := &OffsetConsumer{
-		logger: log.WithFields(log.Fields{}),
+		storageChannel: storageChannel,
+		logger:         log.WithFields(log.Fields{}),
+		filter:         &Filter{},
 	}
 
 	// Tombstone message
@@ -17,4 +26,467 @@ func TestProcessOffsetCommit(t *testing.T) {
 		Value: []byte(""),
 	}
 	mockConsumer.processMessage(tombstone)
+
+	request := <-storageChannel
+	if request.RequestType != StorageDeleteConsumerGroup {
+		t.Fatalf("Expected request type: %v , Got: %v", StorageDeleteConsumerGroup, request.RequestType)
+	}
+	if request.ConsumerGroupName != "console-consumer-36268" || request.TopicName != "access-log" || request.PartitionID != 16 {
+		t.Errorf("Unexpected tombstone request: %+v", request)
+	}
+}
+
+func TestProcessGroupMetadataTombstone(t *testing.T) {
+	storageChannel := make(chan *StorageRequest, 1)
+	mockConsumer := &OffsetConsumer{
+		storageChannel: storageChannel,
+		logger:         log.WithFields(log.Fields{}),
+		filter:         &Filter{},
+	}
+
+	tombstone := &sarama.ConsumerMessage{
+		Key:   []byte("\x00\x02\x00\x16console-consumer-36268"),
+		Value: nil,
+	}
+	mockConsumer.processMessage(tombstone)
+
+	request := <-storageChannel
+	if request.RequestType != StorageDeleteGroupMetadata {
+		t.Fatalf("Expected request type: %v , Got: %v", StorageDeleteGroupMetadata, request.RequestType)
+	}
+	if request.ConsumerGroupName != "console-consumer-36268" {
+		t.Errorf("Expected group: %v , Got: %v", "console-consumer-36268", request.ConsumerGroupName)
+	}
+}
+
+func TestProcessMessageUnknownKeyVersion(t *testing.T) {
+	storageChannel := make(chan *StorageRequest, 1)
+	mockConsumer := &OffsetConsumer{
+		storageChannel: storageChannel,
+		logger:         log.WithFields(log.Fields{}),
+		filter:         &Filter{},
+	}
+
+	// A key version which might be introduced by a future Kafka version, followed by a valid group name
+	skippedBefore := testutil.ToFloat64(unknownKeyVersion.WithLabelValues("3"))
+	mockConsumer.processMessage(&sarama.ConsumerMessage{
+		Key:   []byte("\x00\x03\x00\x16console-consumer-36268"),
+		Value: []byte("\x00\x00"),
+	})
+	skippedAfter := testutil.ToFloat64(unknownKeyVersion.WithLabelValues("3"))
+	if skippedAfter-skippedBefore != 1 {
+		t.Errorf("Expected the unknown key version to be counted once, Got: %v", skippedAfter-skippedBefore)
+	}
+	if len(storageChannel) != 0 {
+		t.Errorf("Expected message with unknown key version to be skipped, Got: %+v", <-storageChannel)
+	}
+}
+
+func TestProcessMessageOversizedRecord(t *testing.T) {
+	storageChannel := make(chan *StorageRequest, 1)
+	mockConsumer := &OffsetConsumer{
+		storageChannel: storageChannel,
+		logger:         log.WithFields(log.Fields{}),
+		filter:         &Filter{},
+		maxRecordBytes: 16,
+	}
+
+	// A group metadata record whose value would otherwise be decoded (and fail, as it's garbage)
+	skippedBefore := testutil.ToFloat64(oversizedRecords)
+	mockConsumer.processMessage(&sarama.ConsumerMessage{
+		Key:   []byte("\x00\x02\x00\x16console-consumer-36268"),
+		Value: bytes.Repeat([]byte("\xff"), 17),
+	})
+	if skipped := testutil.ToFloat64(oversizedRecords) - skippedBefore; skipped != 1 {
+		t.Errorf("Expected the oversized record to be counted once, Got: %v", skipped)
+	}
+	if len(storageChannel) != 0 {
+		t.Errorf("Expected the oversized record to be skipped, Got: %+v", <-storageChannel)
+	}
+
+	// Records within the limit (such as tombstones) are still processed
+	mockConsumer.processMessage(&sarama.ConsumerMessage{
+		Key:   []byte("\x00\x02\x00\x16console-consumer-36268"),
+		Value: nil,
+	})
+	if len(storageChannel) != 1 {
+		t.Errorf("Expected the tombstone to be processed")
+	}
+}
+
+func TestSendToStorageBlocksOnFullQueue(t *testing.T) {
+	storageChannel := make(chan *StorageRequest, 1)
+	mockConsumer := &OffsetConsumer{
+		storageChannel: storageChannel,
+		logger:         log.WithFields(log.Fields{}),
+	}
+
+	blockedBefore := testutil.ToFloat64(storageQueueBlocked)
+	mockConsumer.sendToStorage(newDeleteGroupMetadataRequest("sample-group-1", InternalPosition{}))
+	if blocked := testutil.ToFloat64(storageQueueBlocked) - blockedBefore; blocked != 0 {
+		t.Errorf("Expected no blocked time while the queue has capacity, Got: %v", blocked)
+	}
+
+	// The second request must wait until the first one has been taken from the full queue
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-storageChannel
+	}()
+	mockConsumer.sendToStorage(newDeleteGroupMetadataRequest("sample-group-2", InternalPosition{}))
+	if blocked := testutil.ToFloat64(storageQueueBlocked) - blockedBefore; blocked < 0.05 {
+		t.Errorf("Expected at least 50ms of blocked time, Got: %vs", blocked)
+	}
+	if request := <-storageChannel; request.ConsumerGroupName != "sample-group-2" {
+		t.Errorf("Expected the second request to be queued, Got: %+v", request)
+	}
+}
+
+func TestUpdatePartitionStatus(t *testing.T) {
+	opts := options.NewOptions()
+	opts.ConsumerOffsetsReadyLag = 5
+	mockConsumer := &OffsetConsumer{
+		options:         opts,
+		partitionStatus: make(map[int32]PartitionConsumerStatus),
+	}
+
+	// Unknown high water mark
+	status := mockConsumer.updatePartitionStatus(40, 0)
+	if status.IsReady || status.HighWaterMark != -1 {
+		t.Errorf("Expected partition without high water mark not to be ready, got: %+v", status)
+	}
+
+	offsetWaterMarks.Lock.Lock()
+	offsetWaterMarks.PartitionsByID[40] = consumerOffsetPartition{PartitionID: 40, HighWaterMark: 101}
+	offsetWaterMarks.Lock.Unlock()
+	defer func() {
+		offsetWaterMarks.Lock.Lock()
+		delete(offsetWaterMarks.PartitionsByID, 40)
+		offsetWaterMarks.Lock.Unlock()
+	}()
+
+	tables := []struct {
+		consumedOffset int64
+		lag            int64
+		isReady        bool
+	}{
+		{50, 50, false},
+		{95, 5, true},
+		// Once ready a partition stays ready
+		{90, 10, true},
+		{100, 0, true},
+	}
+	for _, table := range tables {
+		status := mockConsumer.updatePartitionStatus(40, table.consumedOffset)
+		if status.PartitionLag != table.lag || status.IsReady != table.isReady {
+			t.Errorf("Status for consumed offset %v was incorrect, got: %+v, want lag: %v, ready: %v",
+				table.consumedOffset, status, table.lag, table.isReady)
+		}
+	}
+	if statuses := mockConsumer.PartitionStatus(); len(statuses) != 1 || statuses[0].ConsumedOffset != 100 {
+		t.Errorf("Unexpected partition statuses: %+v", statuses)
+	}
+}
+
+func TestTransactionalOffsetCommits(t *testing.T) {
+	// Offset commits written by a transactional consumer (TxnOffsetCommit) for group "txn-group", topic "payments"
+	// and partition 0. They have the same framing as regular offset commits (key version 1, value version 3), the
+	// transaction is only visible in the record batch (producer id, transactional flag) and the transaction markers.
+	key := sarama.ByteEncoder("\x00\x01\x00\x09txn-group\x00\x08payments\x00\x00\x00\x00")
+	committedValue := sarama.ByteEncoder("\x00\x03" +
+		"\x00\x00\x00\x00\x00\x00\x00\x2a" +
+		"\x00\x00\x00\x02" +
+		"\x00\x00" +
+		"\x00\x00\x01\x69\x85\x80\xc8\x49")
+	abortedValue := sarama.ByteEncoder("\x00\x03" +
+		"\x00\x00\x00\x00\x00\x00\x00\x07" +
+		"\x00\x00\x00\x02" +
+		"\x00\x00" +
+		"\x00\x00\x01\x69\x85\x80\xd0\x19")
+
+	topic := "__consumer_offsets"
+	fetchResponse := &sarama.FetchResponse{Version: 4}
+	fetchResponse.AddRecordBatch(topic, 0, key, committedValue, 0, 1, true)
+	fetchResponse.AddControlRecord(topic, 0, 1, 1, sarama.ControlRecordCommit)
+	fetchResponse.AddRecordBatch(topic, 0, key, abortedValue, 2, 2, true)
+	fetchResponse.AddControlRecord(topic, 0, 3, 2, sarama.ControlRecordAbort)
+	block := fetchResponse.GetBlock(topic, 0)
+	block.HighWaterMarkOffset = 4
+	block.LastStableOffset = 4
+	block.AbortedTransactions = []*sarama.AbortedTransaction{{ProducerID: 2, FirstOffset: 2}}
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetVersion(1).
+			SetOffset(topic, 0, sarama.OffsetOldest, 0).
+			SetOffset(topic, 0, sarama.OffsetNewest, 4),
+		"FetchRequest": sarama.NewMockWrapper(fetchResponse),
+	})
+
+	opts := options.NewOptions()
+	opts.KafkaVersion = "0.11.0.2"
+	consumer, err := sarama.NewConsumer([]string{broker.Addr()}, saramaClientConfig(opts))
+	if err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+	defer consumer.Close()
+	partitionConsumer, err := consumer.ConsumePartition(topic, 0, sarama.OffsetOldest)
+	if err != nil {
+		t.Fatalf("Failed to consume partition: %v", err)
+	}
+	defer partitionConsumer.Close()
+
+	storageChannel := make(chan *StorageRequest, 1)
+	mockConsumer := &OffsetConsumer{
+		storageChannel: storageChannel,
+		logger:         log.WithFields(log.Fields{}),
+		filter:         &Filter{},
+	}
+	msg := <-partitionConsumer.Messages()
+	mockConsumer.processMessage(msg)
+	request := <-storageChannel
+	if request.ConsumerOffset == nil || request.ConsumerOffset.Offset != 42 {
+		t.Fatalf("Expected the committed transactional offset 42, Got: %+v", request.ConsumerOffset)
+	}
+
+	// Neither the transaction markers nor the aborted offset commit must be consumed
+	select {
+	case msg := <-partitionConsumer.Messages():
+		t.Errorf("Expected no further messages, Got message at offset %v", msg.Offset)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCompressedOffsetCommits(t *testing.T) {
+	// Offset commit for group "txn-group", topic "payments" and partition 0 with offset 42
+	key := sarama.ByteEncoder("\x00\x01\x00\x09txn-group\x00\x08payments\x00\x00\x00\x00")
+	value := sarama.ByteEncoder("\x00\x03" +
+		"\x00\x00\x00\x00\x00\x00\x00\x2a" +
+		"\x00\x00\x00\x02" +
+		"\x00\x00" +
+		"\x00\x00\x01\x69\x85\x80\xc8\x49")
+	topic := "__consumer_offsets"
+
+	// Brokers only return zstd batches to fetch requests of version 10+, which are sent for kafka 2.1.0+
+	tests := []struct {
+		codec        sarama.CompressionCodec
+		kafkaVersion string
+		fetchVersion int16
+	}{
+		{sarama.CompressionNone, "0.11.0.2", 4},
+		{sarama.CompressionGZIP, "0.11.0.2", 4},
+		{sarama.CompressionSnappy, "0.11.0.2", 4},
+		{sarama.CompressionLZ4, "0.11.0.2", 4},
+		{sarama.CompressionZSTD, "2.1.0", 10},
+	}
+	for _, test := range tests {
+		codec := test.codec
+		t.Run(codec.String(), func(t *testing.T) {
+			fetchResponse := &sarama.FetchResponse{Version: test.fetchVersion}
+			fetchResponse.AddRecordBatch(topic, 0, key, value, 0, 0, false)
+			block := fetchResponse.GetBlock(topic, 0)
+			block.RecordsSet[0].RecordBatch.Codec = codec
+			block.HighWaterMarkOffset = 1
+			block.LastStableOffset = 1
+
+			broker := sarama.NewMockBroker(t, 1)
+			defer broker.Close()
+			broker.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader(topic, 0, broker.BrokerID()),
+				"OffsetRequest": sarama.NewMockOffsetResponse(t).
+					SetVersion(1).
+					SetOffset(topic, 0, sarama.OffsetOldest, 0).
+					SetOffset(topic, 0, sarama.OffsetNewest, 1),
+				"FetchRequest": sarama.NewMockWrapper(fetchResponse),
+			})
+
+			opts := options.NewOptions()
+			opts.KafkaVersion = test.kafkaVersion
+			consumer, err := sarama.NewConsumer([]string{broker.Addr()}, saramaClientConfig(opts))
+			if err != nil {
+				t.Fatalf("Failed to create consumer: %v", err)
+			}
+			defer consumer.Close()
+			partitionConsumer, err := consumer.ConsumePartition(topic, 0, sarama.OffsetOldest)
+			if err != nil {
+				t.Fatalf("Failed to consume partition: %v", err)
+			}
+			defer partitionConsumer.Close()
+
+			storageChannel := make(chan *StorageRequest, 1)
+			mockConsumer := &OffsetConsumer{
+				storageChannel: storageChannel,
+				logger:         log.WithFields(log.Fields{}),
+				filter:         &Filter{},
+			}
+			select {
+			case msg := <-partitionConsumer.Messages():
+				mockConsumer.processMessage(msg)
+			case err := <-partitionConsumer.Errors():
+				t.Fatalf("Failed to consume %v compressed batch: %v", codec, err)
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out consuming %v compressed batch", codec)
+			}
+			request := <-storageChannel
+			if request.ConsumerOffset == nil || request.ConsumerOffset.Offset != 42 {
+				t.Errorf("Expected the offset 42 for %v compression, Got: %+v", codec, request.ConsumerOffset)
+			}
+		})
+	}
+}
+
+// BenchmarkReplay decodes the offset commits of 16 offsets topic partitions concurrently, like the partition
+// consumers do while replaying the offsets topic, with an increasing number of workers
+func BenchmarkReplay(b *testing.B) {
+	log.SetLevel(log.ErrorLevel)
+	const partitionCount = 16
+	message := &sarama.ConsumerMessage{
+		Topic: "__consumer_offsets",
+		Key:   []byte("\x00\x01\x00\x09txn-group\x00\x08payments\x00\x00\x00\x00"),
+		Value: []byte("\x00\x03" +
+			"\x00\x00\x00\x00\x00\x00\x00\x2a" +
+			"\x00\x00\x00\x02" +
+			"\x00\x00" +
+			"\x00\x00\x01\x69\x85\x80\xc8\x49"),
+	}
+
+	for _, workerCount := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workerCount), func(b *testing.B) {
+			storageChannel := make(chan *StorageRequest, 1000)
+			consumer := &OffsetConsumer{
+				storageChannel: storageChannel,
+				logger:         log.WithFields(log.Fields{}),
+				filter:         &Filter{},
+				workers:        make(chan struct{}, workerCount),
+			}
+			done := make(chan struct{})
+			go func() {
+				for range storageChannel {
+				}
+				close(done)
+			}()
+
+			start := time.Now()
+			wg := sync.WaitGroup{}
+			for partition := 0; partition < partitionCount; partition++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < b.N; i++ {
+						consumer.processMessageWithWorker(message)
+					}
+				}()
+			}
+			wg.Wait()
+			b.ReportMetric(float64(b.N*partitionCount)/time.Since(start).Seconds(), "records/s")
+			close(storageChannel)
+			<-done
+		})
+	}
+}
+
+func TestProcessGroupMetadataFilteredTopics(t *testing.T) {
+	opts := options.NewOptions()
+	opts.FilterTopicDenylist = []string{"internal-.*"}
+	filter, err := NewFilter(opts)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+	storageChannel := make(chan *StorageRequest, 1)
+	mockConsumer := &OffsetConsumer{
+		storageChannel: storageChannel,
+		logger:         log.WithFields(log.Fields{}),
+		filter:         filter,
+	}
+
+	// groupMetadata encodes a group metadata message (key version 2, value version 1) with a single member which has
+	// subscribed to all given topics, but is only assigned to partition 0 of the first one
+	groupMetadata := func(group string, topics []string) *sarama.ConsumerMessage {
+		key := &bytes.Buffer{}
+		writeInt16(key, 2)
+		writeString(key, group)
+		value := &bytes.Buffer{}
+		writeInt16(value, 1)
+		writeString(value, "consumer")
+		writeInt32(value, 1)
+		writeString(value, "range")
+		writeString(value, "consumer-1-5ad5c4f2")
+		writeInt32(value, 1)
+		writeString(value, "consumer-1-5ad5c4f2")
+		writeString(value, "consumer-1")
+		writeString(value, "/10.0.0.5")
+		writeInt32(value, 300000)
+		writeInt32(value, 10000)
+		writeBytes(value, memberSubscription(0, topics))
+		writeBytes(value, memberAssignmentV0(topics[0], []int32{0}))
+		return &sarama.ConsumerMessage{Key: key.Bytes(), Value: value.Bytes()}
+	}
+
+	mockConsumer.processMessage(groupMetadata("internal-group", []string{"internal-changelog", "internal-repartition"}))
+	request := <-storageChannel
+	if request.RequestType != StorageDeleteGroupMetadata || request.ConsumerGroupName != "internal-group" {
+		t.Errorf("Expected metadata of a group with filtered topics only to be deleted, Got: %+v", request)
+	}
+
+	mockConsumer.processMessage(groupMetadata("mixed-group", []string{"internal-changelog", "orders"}))
+	request = <-storageChannel
+	if request.RequestType != StorageAddGroupMetadata || request.GroupMetadata.Group != "mixed-group" {
+		t.Fatalf("Expected metadata of a group with an allowed topic to be stored, Got: %+v", request)
+	}
+	if len(request.GroupMetadata.Members[0].Assignment) != 0 {
+		t.Errorf("Expected the assignment of the filtered topic to be removed, Got: %v", request.GroupMetadata.Members[0].Assignment)
+	}
+
+	// Offsets of filtered topics are not stored, hence the group doesn't produce any series at all
+	mockConsumer.processMessage(&sarama.ConsumerMessage{
+		Key:   []byte("\x00\x01\x00\x0einternal-group\x00\x12internal-changelog\x00\x00\x00\x00"),
+		Value: []byte("\x00\x03\x00\x00\x00\x00\x00\x00\x00\x2a\x00\x00\x00\x02\x00\x00\x00\x00\x01\x69\x85\x80\xc8\x49"),
+	})
+	if len(storageChannel) != 0 {
+		t.Errorf("Expected offsets of filtered topics not to be stored, Got: %+v", <-storageChannel)
+	}
+}
+
+func TestProcessGroupMetadataWithoutMembers(t *testing.T) {
+	opts := options.NewOptions()
+	opts.FilterTopicAllowlist = []string{"orders"}
+	filter, err := NewFilter(opts)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+	storageChannel := make(chan *StorageRequest, 1)
+	mockConsumer := &OffsetConsumer{
+		storageChannel: storageChannel,
+		logger:         log.WithFields(log.Fields{}),
+		filter:         filter,
+	}
+
+	// All members left the group, but its offsets haven't expired yet
+	key := &bytes.Buffer{}
+	writeInt16(key, 2)
+	writeString(key, "order-processor")
+	value := &bytes.Buffer{}
+	writeInt16(value, 2)
+	writeString(value, "consumer")
+	writeInt32(value, 8)
+	writeInt16(value, -1)
+	writeInt16(value, -1)
+	writeInt64(value, 1571651527598)
+	writeInt32(value, 0)
+	mockConsumer.processMessage(&sarama.ConsumerMessage{Key: key.Bytes(), Value: value.Bytes()})
+
+	// The group must still be stored, otherwise it can't be reported as stalled
+	request := <-storageChannel
+	if request.RequestType != StorageAddGroupMetadata || request.GroupMetadata.Group != "order-processor" {
+		t.Fatalf("Expected metadata of the empty group to be stored, Got: %+v", request)
+	}
+	if len(request.GroupMetadata.Members) != 0 {
+		t.Errorf("Expected no members, Got: %+v", request.GroupMetadata.Members)
+	}
 }
@@ -9,7 +9,36 @@ import (
 // Protocol primitives helper file, see:
 // https://cwiki.apache.org/confluence/display/KAFKA/A+Guide+To+The+Kafka+Protocol#AGuideToTheKafkaProtocol-ProtocolPrimitiveTypes
 
+// DecodeError is returned if a field of a record couldn't be decoded. Field is the name of the field, which is used
+// as reason in the decode error metric too.
+type DecodeError struct {
+	Field string
+	Err   error
+
+	// Skippable is set if the field is length prefixed, so that the surrounding record can still be decoded
+	Skippable bool
+}
+
+func newDecodeError(field string, err error) *DecodeError {
+	return &DecodeError{Field: field, Err: err}
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode %v: %v", e.Field, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// errInvalidCount is the underlying error of an array length which is negative or exceeds the remaining bytes
+func errInvalidCount(count int32, buf *bytes.Buffer) error {
+	return fmt.Errorf("invalid count %d for %d remaining bytes", count, buf.Len())
+}
+
 // readString tries to read a string following the Kafka binary protocol. Strings are size delimited.
+// A negative size is considered as null string and returned as empty string.
 // It returns an error if it can not read a string on the given buffer.
 func readString(buf *bytes.Buffer) (string, error) {
 	var strlen int16
@@ -17,9 +46,12 @@ func readString(buf *bytes.Buffer) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if strlen == -1 {
+	if strlen < 0 {
 		return "", nil
 	}
+	if int(strlen) > buf.Len() {
+		return "", fmt.Errorf("string length %d exceeds the remaining %d bytes", strlen, buf.Len())
+	}
 
 	strbytes := make([]byte, strlen)
 	n, err := buf.Read(strbytes)
@@ -2,6 +2,7 @@ package kafka
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 )
 
@@ -34,3 +35,58 @@ func TestReadString(t *testing.T) {
 		}
 	}
 }
+
+func TestReadStringBounds(t *testing.T) {
+	tables := []struct {
+		name    string
+		buf     *bytes.Buffer
+		want    string
+		wantErr bool
+	}{
+		{"null string", bytes.NewBufferString("\xff\xff"), "", false},
+		{"negative length", bytes.NewBufferString("\xff\xfetest"), "", false},
+		{"empty string", bytes.NewBufferString("\x00\x00"), "", false},
+		{"exact fit", bytes.NewBufferString("\x00\x04test"), "test", false},
+		{"oversized length", bytes.NewBufferString("\x7f\xfftest"), "", true},
+		{"truncated string", bytes.NewBufferString("\x00\x05test"), "", true},
+		{"missing length", bytes.NewBufferString("\x00"), "", true},
+	}
+
+	for _, table := range tables {
+		result, err := readString(table.buf)
+		if table.wantErr && err == nil {
+			t.Errorf("%v: Expected an error, Got: %v", table.name, result)
+		}
+		if !table.wantErr && err != nil {
+			t.Errorf("%v: Unexpected error: %v", table.name, err)
+		}
+		if result != table.want {
+			t.Errorf("%v: Expected: %v , Got: %v", table.name, table.want, result)
+		}
+	}
+}
+
+// The helpers below encode Kafka protocol primitives so that tests can build binary records
+// which look like the ones we consume from the __consumer_offsets topic.
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, int16(len(s)))
+	buf.WriteString(s)
+}
+
+func writeInt16(buf *bytes.Buffer, i int16) {
+	binary.Write(buf, binary.BigEndian, i)
+}
+
+func writeInt32(buf *bytes.Buffer, i int32) {
+	binary.Write(buf, binary.BigEndian, i)
+}
+
+func writeInt64(buf *bytes.Buffer, i int64) {
+	binary.Write(buf, binary.BigEndian, i)
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeInt32(buf, int32(len(b)))
+	buf.Write(b)
+}
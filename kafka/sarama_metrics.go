@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"strings"
+)
+
+// saramaMetricRegistry is the go-metrics registry of all sarama clients, so that the request metrics of the cluster
+// module and the offset consumer are aggregated
+var saramaMetricRegistry = metrics.NewRegistry()
+
+// saramaMetricsQuantiles are the quantiles which are exposed for sarama's histograms (e. g. the request latency)
+var saramaMetricsQuantiles = []float64{0.5, 0.75, 0.95, 0.99}
+
+// SaramaMetricsCollector bridges the go-metrics registry of the sarama clients into prometheus. Meters (e. g.
+// request-rate) are exposed as counters, histograms (e. g. request-latency-in-ms) as summaries. Sarama creates
+// additional metrics per broker (request-rate-for-broker-1) and topic, these are exposed with a broker or topic label
+// in the sarama_broker or sarama_topic subsystem, so that the aggregated and the labeled series have distinct names.
+type SaramaMetricsCollector struct {
+	registry metrics.Registry
+	prefix   string
+}
+
+// NewSaramaMetricsCollector creates a collector for the metrics of all sarama clients created by kafka minion
+func NewSaramaMetricsCollector(prefix string) *SaramaMetricsCollector {
+	return &SaramaMetricsCollector{
+		registry: saramaMetricRegistry,
+		prefix:   prefix,
+	}
+}
+
+// Describe sends no descriptors, as sarama registers its metrics lazily (e. g. once a broker has been connected).
+// This makes the collector an unchecked collector.
+func (c *SaramaMetricsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect sends the current value of all sarama metrics
+func (c *SaramaMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.registry.Each(func(name string, metric interface{}) {
+		switch m := metric.(type) {
+		case metrics.Meter:
+			desc, labelValues := c.desc(name, "-rate", "_total")
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(m.Count()), labelValues...)
+		case metrics.Counter:
+			desc, labelValues := c.desc(name, "", "_total")
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(m.Count()), labelValues...)
+		case metrics.Histogram:
+			snapshot := m.Snapshot()
+			values := snapshot.Percentiles(saramaMetricsQuantiles)
+			quantiles := make(map[float64]float64, len(saramaMetricsQuantiles))
+			for i, quantile := range saramaMetricsQuantiles {
+				quantiles[quantile] = values[i]
+			}
+			desc, labelValues := c.desc(name, "", "")
+			ch <- prometheus.MustNewConstSummary(desc, uint64(snapshot.Count()), float64(snapshot.Sum()), quantiles, labelValues...)
+		}
+	})
+}
+
+// desc creates the descriptor for a sarama metric. A broker or topic part of the name (e. g. -for-broker-1) is
+// turned into a label, the given suffix of the remaining name is replaced with the prometheus suffix.
+func (c *SaramaMetricsCollector) desc(saramaName string, saramaSuffix string, suffix string) (*prometheus.Desc, []string) {
+	name := saramaName
+	subsystem := "sarama"
+	var labelNames, labelValues []string
+	for _, label := range []string{"broker", "topic"} {
+		separator := "-for-" + label + "-"
+		if i := strings.Index(name, separator); i >= 0 {
+			subsystem = "sarama_" + label
+			labelNames = []string{label}
+			labelValues = []string{name[i+len(separator):]}
+			name = name[:i]
+			break
+		}
+	}
+	help := "Sarama client metric " + name
+	name = strings.TrimSuffix(name, saramaSuffix) + suffix
+
+	desc := prometheus.NewDesc(
+		prometheus.BuildFQName(c.prefix, subsystem, strings.Replace(name, "-", "_", -1)),
+		help,
+		labelNames, nil,
+	)
+	return desc, labelValues
+}
@@ -0,0 +1,41 @@
+package kafka
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rcrowley/go-metrics"
+	"strings"
+	"testing"
+)
+
+func TestSaramaMetricsCollector(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterMeter("request-rate", registry).Mark(3)
+	metrics.GetOrRegisterMeter("request-rate-for-broker-1", registry).Mark(2)
+	metrics.GetOrRegisterMeter("request-rate-for-broker-2", registry).Mark(1)
+	histogram := metrics.GetOrRegisterHistogram("request-latency-in-ms-for-broker-1", registry, metrics.NewUniformSample(10))
+	histogram.Update(10)
+	histogram.Update(30)
+	c := &SaramaMetricsCollector{registry: registry, prefix: "kafka_minion"}
+
+	expected := `
+# HELP kafka_minion_sarama_broker_request_latency_in_ms Sarama client metric request-latency-in-ms
+# TYPE kafka_minion_sarama_broker_request_latency_in_ms summary
+kafka_minion_sarama_broker_request_latency_in_ms{broker="1",quantile="0.5"} 20
+kafka_minion_sarama_broker_request_latency_in_ms{broker="1",quantile="0.75"} 30
+kafka_minion_sarama_broker_request_latency_in_ms{broker="1",quantile="0.95"} 30
+kafka_minion_sarama_broker_request_latency_in_ms{broker="1",quantile="0.99"} 30
+kafka_minion_sarama_broker_request_latency_in_ms_sum{broker="1"} 40
+kafka_minion_sarama_broker_request_latency_in_ms_count{broker="1"} 2
+# HELP kafka_minion_sarama_broker_request_total Sarama client metric request-rate
+# TYPE kafka_minion_sarama_broker_request_total counter
+kafka_minion_sarama_broker_request_total{broker="1"} 2
+kafka_minion_sarama_broker_request_total{broker="2"} 1
+# HELP kafka_minion_sarama_request_total Sarama client metric request-rate
+# TYPE kafka_minion_sarama_request_total counter
+kafka_minion_sarama_request_total 3
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected))
+	if err != nil {
+		t.Errorf("Unexpected sarama metrics: %v", err)
+	}
+}
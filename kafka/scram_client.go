@@ -0,0 +1,199 @@
+package kafka
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// HashGeneratorFcn is a function which returns a new hash (e. g. sha256.New) used for the SCRAM exchange
+type HashGeneratorFcn func() hash.Hash
+
+// scramClient implements the client side of a SCRAM exchange (RFC 5802) and satisfies sarama's SCRAMClient
+// interface. Usernames are escaped as required by the RFC, but no SASLprep normalization is applied.
+type scramClient struct {
+	hashGenerator  HashGeneratorFcn
+	nonceGenerator func() (string, error)
+
+	userName string
+	password string
+	authzID  string
+
+	step            int
+	gs2Header       string
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+	done            bool
+}
+
+func newSCRAMClient(hashGenerator HashGeneratorFcn) *scramClient {
+	return &scramClient{
+		hashGenerator:  hashGenerator,
+		nonceGenerator: generateNonce,
+	}
+}
+
+// Begin prepares the client for the SCRAM exchange with the server
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	c.userName = userName
+	c.password = password
+	c.authzID = authzID
+	c.step = 0
+	c.done = false
+
+	return nil
+}
+
+// Step steps the client through the SCRAM exchange. It must be called with an empty challenge first
+func (c *scramClient) Step(challenge string) (string, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.clientFirstMessage()
+	case 2:
+		return c.clientFinalMessage(challenge)
+	case 3:
+		c.done = true
+		return "", c.verifyServerFinalMessage(challenge)
+	default:
+		return "", fmt.Errorf("SCRAM exchange is already finished")
+	}
+}
+
+// Done returns true when the SCRAM conversation is over
+func (c *scramClient) Done() bool {
+	return c.done
+}
+
+func (c *scramClient) clientFirstMessage() (string, error) {
+	nonce, err := c.nonceGenerator()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	c.clientNonce = nonce
+
+	c.gs2Header = "n,,"
+	if c.authzID != "" {
+		c.gs2Header = "n,a=" + escapeSASLName(c.authzID) + ","
+	}
+	c.clientFirstBare = "n=" + escapeSASLName(c.userName) + ",r=" + c.clientNonce
+
+	return c.gs2Header + c.clientFirstBare, nil
+}
+
+func (c *scramClient) clientFinalMessage(serverFirst string) (string, error) {
+	attributes := parseSCRAMAttributes(serverFirst)
+	if _, exists := attributes["m"]; exists {
+		return "", fmt.Errorf("server requires unsupported SCRAM extensions")
+	}
+	nonce := attributes["r"]
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return "", fmt.Errorf("server nonce doesn't extend the client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return "", fmt.Errorf("failed to decode salt: %v", err)
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations < 1 {
+		return "", fmt.Errorf("invalid iteration count '%v'", attributes["i"])
+	}
+
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(c.gs2Header)) + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	saltedPassword := c.hi([]byte(c.password), salt, iterations)
+	clientKey := c.hmac(saltedPassword, []byte("Client Key"))
+	storedKey := c.hash(clientKey)
+	clientSignature := c.hmac(storedKey, []byte(authMessage))
+	clientProof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		clientProof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	serverKey := c.hmac(saltedPassword, []byte("Server Key"))
+	c.serverSignature = c.hmac(serverKey, []byte(authMessage))
+
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientProof), nil
+}
+
+func (c *scramClient) verifyServerFinalMessage(serverFinal string) error {
+	attributes := parseSCRAMAttributes(serverFinal)
+	if serverError, exists := attributes["e"]; exists {
+		return fmt.Errorf("server rejected the SCRAM exchange: %v", serverError)
+	}
+	serverSignature, err := base64.StdEncoding.DecodeString(attributes["v"])
+	if err != nil {
+		return fmt.Errorf("failed to decode server signature: %v", err)
+	}
+	if !hmac.Equal(serverSignature, c.serverSignature) {
+		return fmt.Errorf("server signature doesn't match")
+	}
+
+	return nil
+}
+
+// hi is the PBKDF2 based key derivation function as defined in RFC 5802
+func (c *scramClient) hi(password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(c.hashGenerator, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
+
+func (c *scramClient) hmac(key []byte, message []byte) []byte {
+	mac := hmac.New(c.hashGenerator, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+func (c *scramClient) hash(message []byte) []byte {
+	h := c.hashGenerator()
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+// parseSCRAMAttributes splits a SCRAM message like "r=abc,s=def,i=4096" into its attributes
+func parseSCRAMAttributes(message string) map[string]string {
+	attributes := make(map[string]string)
+	for _, part := range strings.Split(message, ",") {
+		if len(part) < 2 || part[1] != '=' {
+			continue
+		}
+		attributes[part[:1]] = part[2:]
+	}
+
+	return attributes
+}
+
+// escapeSASLName replaces "=" and "," as required for usernames and authzIDs in SCRAM messages
+func escapeSASLName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+func generateNonce() (string, error) {
+	raw := make([]byte, 24)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawStdEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,84 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+// TestSCRAMClientSHA256 runs the SCRAM-SHA-256 example exchange of RFC 7677
+func TestSCRAMClientSHA256(t *testing.T) {
+	client := newSCRAMClient(sha256.New)
+	client.nonceGenerator = func() (string, error) {
+		return "rOprNGfwEbeRWgbNEkqO", nil
+	}
+	err := client.Begin("user", "pencil", "")
+	if err != nil {
+		t.Fatalf("Failed to begin SCRAM exchange: %v", err)
+	}
+
+	steps := []struct {
+		challenge string
+		response  string
+	}{
+		{"", "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"},
+		{
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		},
+		{"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", ""},
+	}
+	for i, step := range steps {
+		if client.Done() {
+			t.Fatalf("SCRAM exchange finished before step %v", i)
+		}
+		response, err := client.Step(step.challenge)
+		if err != nil {
+			t.Fatalf("Step %v failed: %v", i, err)
+		}
+		if response != step.response {
+			t.Errorf("Step %v response was incorrect, got: %v, want: %v", i, response, step.response)
+		}
+	}
+	if !client.Done() {
+		t.Errorf("Expected SCRAM exchange to be finished")
+	}
+}
+
+func TestSCRAMClientRejectsInvalidServer(t *testing.T) {
+	tables := []struct {
+		serverFirst string
+		serverFinal string
+	}{
+		// Server nonce doesn't start with the client nonce
+		{"r=differentNonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", ""},
+		// Invalid iteration count
+		{"r=rOprNGfwEbeRWgbNEkqO%hvYDpWU,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0", ""},
+		// Wrong server signature
+		{"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", "v=AAAA"},
+		// Server error
+		{"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", "e=invalid-proof"},
+	}
+
+	for _, table := range tables {
+		client := newSCRAMClient(sha256.New)
+		client.nonceGenerator = func() (string, error) {
+			return "rOprNGfwEbeRWgbNEkqO", nil
+		}
+		client.Begin("user", "pencil", "")
+		client.Step("")
+		_, err := client.Step(table.serverFirst)
+		if err == nil {
+			_, err = client.Step(table.serverFinal)
+		}
+		if err == nil {
+			t.Errorf("Expected an error for server messages %q and %q", table.serverFirst, table.serverFinal)
+		}
+	}
+}
+
+func TestEscapeSASLName(t *testing.T) {
+	escaped := escapeSASLName("a=b,c")
+	if escaped != "a=3Db=2Cc" {
+		t.Errorf("Escaped name was incorrect, got: %v, want: %v", escaped, "a=3Db=2Cc")
+	}
+}
@@ -0,0 +1,68 @@
+package kafka
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// selfTestFixtures contains a dump of known good offsets topic records (see DecodeDump for the format) along with
+// their expected decoded records. It covers all offset commit and group metadata value versions which are written
+// by currently supported Kafka versions.
+//
+//go:embed selftest/records.dump selftest/records.jsonl
+var selfTestFixtures embed.FS
+
+// SelfTest decodes the embedded known good records and returns an error if any of them isn't decoded as expected.
+// It's run on startup, so that a broken decoder fails fast rather than silently skipping all records.
+func SelfTest() error {
+	dump, err := selfTestFixtures.ReadFile("selftest/records.dump")
+	if err != nil {
+		return fmt.Errorf("failed to read self test records: %v", err)
+	}
+	expected, err := selfTestFixtures.ReadFile("selftest/records.jsonl")
+	if err != nil {
+		return fmt.Errorf("failed to read expected self test records: %v", err)
+	}
+
+	decoded := &bytes.Buffer{}
+	// The embedded records are known to be small, hence their size isn't limited
+	err = DecodeDump(bytes.NewReader(dump), decoded, 0)
+	if err != nil {
+		return fmt.Errorf("failed to decode self test records: %v", err)
+	}
+
+	return compareDecodedRecords(decoded.Bytes(), expected)
+}
+
+// compareDecodedRecords compares two sets of decoded records (JSON lines). The lines are compared as JSON values, so
+// that the comparison doesn't depend on the formatting.
+func compareDecodedRecords(decoded []byte, expected []byte) error {
+	decodedLines := bufio.NewScanner(bytes.NewReader(decoded))
+	expectedLines := bufio.NewScanner(bytes.NewReader(expected))
+	for index := 0; expectedLines.Scan(); index++ {
+		if !decodedLines.Scan() {
+			return fmt.Errorf("record %d has not been decoded, expected: %s", index, expectedLines.Text())
+		}
+		var decodedRecord, expectedRecord interface{}
+		err := json.Unmarshal(decodedLines.Bytes(), &decodedRecord)
+		if err != nil {
+			return fmt.Errorf("failed to parse decoded record %d: %v", index, err)
+		}
+		err = json.Unmarshal(expectedLines.Bytes(), &expectedRecord)
+		if err != nil {
+			return fmt.Errorf("failed to parse expected record %d: %v", index, err)
+		}
+		if !reflect.DeepEqual(decodedRecord, expectedRecord) {
+			return fmt.Errorf("record %d was decoded incorrectly, got: %s, want: %s", index, decodedLines.Text(), expectedLines.Text())
+		}
+	}
+	if decodedLines.Scan() {
+		return fmt.Errorf("unexpected decoded record: %s", decodedLines.Text())
+	}
+
+	return nil
+}
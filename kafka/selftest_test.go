@@ -0,0 +1,32 @@
+package kafka
+
+import (
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	err := SelfTest()
+	if err != nil {
+		t.Errorf("Expected the embedded records to be decoded as expected, Got: %v", err)
+	}
+}
+
+func TestCompareDecodedRecords(t *testing.T) {
+	tables := []struct {
+		decoded  string
+		expected string
+		isValid  bool
+	}{
+		{`{"index":0,"type":"group_metadata_tombstone","group":"billing"}`, `{"type":"group_metadata_tombstone", "index":0, "group":"billing"}`, true},
+		{`{"index":0,"type":"skipped"}`, `{"index":0,"type":"group_metadata_tombstone","group":"billing"}`, false},
+		{``, `{"index":0,"type":"skipped"}`, false},
+		{"{\"index\":0,\"type\":\"skipped\"}\n{\"index\":1,\"type\":\"skipped\"}", `{"index":0,"type":"skipped"}`, false},
+	}
+
+	for _, table := range tables {
+		err := compareDecodedRecords([]byte(table.decoded), []byte(table.expected))
+		if (err == nil) != table.isValid {
+			t.Errorf("Comparison of %q with %q was incorrect, got error: %v, want valid: %v", table.decoded, table.expected, err, table.isValid)
+		}
+	}
+}
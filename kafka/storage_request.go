@@ -37,8 +37,41 @@ const (
 
 	// StorageDeleteTopic is the request type to delete all topic information
 	StorageDeleteTopic StorageRequestType = 9
+
+	// StorageMarkOffsetPartitionConsumed is the request type to report the last consumed offset of a partition
+	// in the consumer offsets topic. It's sent after all messages up to this offset have been sent.
+	StorageMarkOffsetPartitionConsumed StorageRequestType = 10
+
+	// StorageUpdateTopicPartitionCount is the request type to update the partition count of a topic whose
+	// configuration is already known. It's sent on each metadata refresh, so that partition expansions show up
+	// before the next topic configuration refresh.
+	StorageUpdateTopicPartitionCount StorageRequestType = 11
+
+	// StorageDeleteFilteredGroups is the request type to delete all consumer groups which are not allowed by the
+	// filter anymore. It's sent through the offset consumer's channel, so that it's applied after all requests which
+	// have been queued before the filter changed.
+	StorageDeleteFilteredGroups StorageRequestType = 12
+
+	// StorageDeleteExpiredGroups is the request type to delete all consumer groups which haven't committed an offset
+	// within the group expiry. Like StorageDeleteFilteredGroups it's sent through the offset consumer's channel, so
+	// that a group is never deleted right after a newer commit of it has been applied.
+	StorageDeleteExpiredGroups StorageRequestType = 13
 )
 
+// InternalPosition is the position of a record in the offsets topic. All records of a group are written to the same
+// partition, hence the record with the higher offset in that partition is the newer one.
+type InternalPosition struct {
+	Partition int32
+	Offset    int64
+}
+
+// IsBefore returns true if the record at this position has been written before the record at the other position.
+// Positions in different partitions (e. g. after the partition count has been increased) can't be ordered, in this
+// case it returns false.
+func (p InternalPosition) IsBefore(other InternalPosition) bool {
+	return p.Partition == other.Partition && p.Offset < other.Offset
+}
+
 // StorageRequest is an entity to send messages / requests to the storage module.
 type StorageRequest struct {
 	RequestType        StorageRequestType
@@ -50,6 +83,9 @@ type StorageRequest struct {
 	TopicName          string
 	PartitionID        int32
 	PartitionCount     int
+	Offset             int64
+	InternalPosition   InternalPosition // Position of the tombstone for StorageDeleteConsumerGroup and StorageDeleteGroupMetadata requests
+	Filter             *Filter          // Filter of StorageDeleteFilteredGroups requests
 }
 
 func newAddPartitionLowWaterMarkRequest(lowWaterMark *PartitionWaterMark) *StorageRequest {
@@ -87,12 +123,21 @@ func newAddTopicConfig(config *TopicConfiguration) *StorageRequest {
 	}
 }
 
-func newDeleteConsumerGroupRequest(group string, topic string, partitionID int32) *StorageRequest {
+func newUpdateTopicPartitionCountRequest(topic string, partitionCount int) *StorageRequest {
+	return &StorageRequest{
+		RequestType:    StorageUpdateTopicPartitionCount,
+		TopicName:      topic,
+		PartitionCount: partitionCount,
+	}
+}
+
+func newDeleteConsumerGroupRequest(group string, topic string, partitionID int32, position InternalPosition) *StorageRequest {
 	return &StorageRequest{
 		RequestType:       StorageDeleteConsumerGroup,
 		ConsumerGroupName: group,
 		TopicName:         topic,
 		PartitionID:       partitionID,
+		InternalPosition:  position,
 	}
 }
 
@@ -110,10 +155,11 @@ func newMarkOffsetPartitionReadyRequest(partitionID int32) *StorageRequest {
 	}
 }
 
-func newDeleteGroupMetadataRequest(group string) *StorageRequest {
+func newDeleteGroupMetadataRequest(group string, position InternalPosition) *StorageRequest {
 	return &StorageRequest{
 		RequestType:       StorageDeleteGroupMetadata,
 		ConsumerGroupName: group,
+		InternalPosition:  position,
 	}
 }
 
@@ -123,3 +169,11 @@ func newDeleteTopicRequest(topic string) *StorageRequest {
 		TopicName:   topic,
 	}
 }
+
+func newMarkOffsetPartitionConsumedRequest(partitionID int32, offset int64) *StorageRequest {
+	return &StorageRequest{
+		RequestType: StorageMarkOffsetPartitionConsumed,
+		PartitionID: partitionID,
+		Offset:      offset,
+	}
+}
@@ -0,0 +1,63 @@
+package kafka
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// tokenProvider generates access tokens for SASL/OAUTHBEARER authentication along with their expiry time
+type tokenProvider interface {
+	Token() (token string, expiry time.Time, err error)
+}
+
+// refreshingTokenProvider implements sarama's AccessTokenProvider. It caches the token of the underlying provider
+// and fetches a new one as soon as the cached token is about to expire. Sarama requests a token for each broker
+// connection it (re)establishes, thus connections which are closed by the brokers because of an expired token
+// are reauthenticated with a fresh token without reconnecting the whole client.
+type refreshingTokenProvider struct {
+	provider tokenProvider
+	// refreshBefore is the duration before the token's expiry in which the token will be refreshed already
+	refreshBefore time.Duration
+	now           func() time.Time
+	logger        *log.Entry
+
+	lock   sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newRefreshingTokenProvider(provider tokenProvider, refreshBefore time.Duration) *refreshingTokenProvider {
+	return &refreshingTokenProvider{
+		provider:      provider,
+		refreshBefore: refreshBefore,
+		now:           time.Now,
+		logger: log.WithFields(log.Fields{
+			"module": "token_provider",
+		}),
+	}
+}
+
+// Token returns the cached token or fetches a new one if the cached token expires within refreshBefore
+func (p *refreshingTokenProvider) Token() (*sarama.AccessToken, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.token != "" && p.now().Add(p.refreshBefore).Before(p.expiry) {
+		return &sarama.AccessToken{Token: p.token}, nil
+	}
+
+	token, expiry, err := p.provider.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch access token: %v", err)
+	}
+	p.token = token
+	p.expiry = expiry
+	p.logger.WithFields(log.Fields{
+		"expiry": expiry,
+	}).Debug("fetched new access token")
+
+	return &sarama.AccessToken{Token: p.token}, nil
+}
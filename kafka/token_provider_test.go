@@ -0,0 +1,50 @@
+package kafka
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type mockTokenProvider struct {
+	calls    int
+	lifetime time.Duration
+	now      func() time.Time
+}
+
+func (m *mockTokenProvider) Token() (string, time.Time, error) {
+	m.calls++
+	return fmt.Sprintf("token-%d", m.calls), m.now().Add(m.lifetime), nil
+}
+
+func TestRefreshingTokenProvider(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	mock := &mockTokenProvider{lifetime: 15 * time.Minute, now: clock}
+	provider := newRefreshingTokenProvider(mock, time.Minute)
+	provider.now = clock
+
+	tables := []struct {
+		elapsed time.Duration
+		token   string
+	}{
+		{0, "token-1"},
+		{10 * time.Minute, "token-1"},
+		// Within a minute before the expiry the token must be refreshed already
+		{14*time.Minute + 30*time.Second, "token-2"},
+		{20 * time.Minute, "token-2"},
+		{30 * time.Minute, "token-3"},
+	}
+
+	start := now
+	for _, table := range tables {
+		now = start.Add(table.elapsed)
+		token, err := provider.Token()
+		if err != nil {
+			t.Fatalf("Failed to get token: %v", err)
+		}
+		if token.Token != table.token {
+			t.Errorf("Token after %v was incorrect, got: %v, want: %v", table.elapsed, token.Token, table.token)
+		}
+	}
+}
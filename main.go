@@ -1,21 +1,60 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/google-cloud-tools/kafka-minion/api"
 	"github.com/google-cloud-tools/kafka-minion/collector"
 	"github.com/google-cloud-tools/kafka-minion/kafka"
 	"github.com/google-cloud-tools/kafka-minion/options"
+	"github.com/google-cloud-tools/kafka-minion/sink"
 	"github.com/google-cloud-tools/kafka-minion/storage"
+	"github.com/google-cloud-tools/kafka-minion/version"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// metricsPrefixRegex matches valid prometheus metric name prefixes
+var metricsPrefixRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// reservedPaths are the HTTP paths which are served besides the metrics. The debug and API paths are reserved even if
+// they are disabled, so that enabling them later doesn't break the configured metrics path.
+var reservedPaths = []string{"/healthcheck", "/readycheck", "/ready", "/healthz", "/debug/groups", api.GroupsAPIPath}
+
 func main() {
+	printVersion := flag.Bool("version", false, "Print the version and exit")
+	decodeFile := flag.String("decode-file", "", "Decode a dump of offsets topic records, print them as JSON and exit")
+	selfTest := flag.Bool("selftest", false, "Verify the decoders against embedded known good records on startup")
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+	if *decodeFile != "" {
+		// Decoded records are printed to stdout, hence decode failures are logged to stderr
+		log.SetOutput(os.Stderr)
+		err := decodeDumpFile(*decodeFile)
+		if err != nil {
+			log.Fatal("Error decoding dump file. ", err)
+		}
+		return
+	}
+
 	// Initialize logger
 	log.SetOutput(os.Stdout)
 	log.SetFormatter(&log.JSONFormatter{})
@@ -35,34 +74,296 @@ func main() {
 	}
 	log.SetLevel(level)
 
-	log.Infof("Starting kafka minion version%v", opts.Version)
+	// Set log format from environment variables
+	switch opts.LogFormat {
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	default:
+		log.Fatalf("Log format '%v' is invalid, it must be either 'json' or 'text'", opts.LogFormat)
+	}
+	log.WithFields(log.Fields{
+		"level":  level.String(),
+		"format": opts.LogFormat,
+	}).Info("logger has been initialized")
+
+	// Verify the decoders before connecting, so that a broken decoder doesn't silently skip all records
+	if *selfTest {
+		err = kafka.SelfTest()
+		if err != nil {
+			log.Fatal("Decoder self test failed. ", err)
+		}
+		log.Info("decoder self test passed")
+	}
+
+	// Compile filters upfront so that invalid regexes cause a fast failure
+	filter, err := kafka.NewFilter(opts)
+	if err != nil {
+		log.Fatal("Error creating filters. ", err)
+	}
+
+	// Validate metrics prefix, so that the collector doesn't fail to register all its metrics later on
+	if !metricsPrefixRegex.MatchString(opts.MetricsPrefix) {
+		log.Fatalf("Metrics prefix '%v' is invalid, it must match the regex '%v'", opts.MetricsPrefix, metricsPrefixRegex)
+	}
+
+	// Validate the kafka version upfront, so that an unknown version causes a fast failure with a clear error
+	_, err = kafka.ParseKafkaVersion(opts.KafkaVersion)
+	if err != nil {
+		log.Fatalf("Kafka version '%v' is invalid: %v", opts.KafkaVersion, err)
+	}
+
+	// Validate the metrics exporter, so that a typo in the OTLP endpoint doesn't go unnoticed until the first push
+	switch opts.MetricsExporter {
+	case "prometheus":
+	case "otlp":
+		endpoint, err := url.Parse(opts.MetricsOTLPEndpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			log.Fatalf("OTLP endpoint '%v' is invalid, it must be an http(s) URL such as 'http://otel-collector:4318/v1/metrics'", opts.MetricsOTLPEndpoint)
+		}
+		if opts.MetricsOTLPInterval <= 0 {
+			log.Fatalf("OTLP interval '%v' is invalid, it must be greater than 0", opts.MetricsOTLPInterval)
+		}
+	default:
+		log.Fatalf("Metrics exporter '%v' is invalid, it must be either 'prometheus' or 'otlp'", opts.MetricsExporter)
+	}
+
+	if opts.LagOnNegative != "clamp" && opts.LagOnNegative != "raw" && opts.LagOnNegative != "skip" {
+		log.Fatalf("Lag on negative '%v' is invalid, it must be either 'clamp', 'raw' or 'skip'", opts.LagOnNegative)
+	}
+
+	if opts.KafkaRequestTimeout < 0 {
+		log.Fatalf("Request timeout '%v' is invalid, it must not be negative", opts.KafkaRequestTimeout)
+	}
+
+	if opts.StorageSnapshotPath != "" && opts.StorageSnapshotInterval <= 0 {
+		log.Fatalf("Storage snapshot interval '%v' is invalid, it must be greater than 0", opts.StorageSnapshotInterval)
+	}
+
+	if opts.StorageQueueSize < 1 {
+		log.Fatalf("Storage queue size '%v' is invalid, it must be at least 1", opts.StorageQueueSize)
+	}
+
+	// Validate the listen address and metrics path, so that we don't fail after connecting to the cluster
+	listenAddress := net.JoinHostPort(opts.TelemetryHost, strconv.Itoa(opts.TelemetryPort))
+	_, err = net.ResolveTCPAddr("tcp", listenAddress)
+	if err != nil {
+		log.Fatalf("Listen address '%v' is invalid: %v", listenAddress, err)
+	}
+	if !strings.HasPrefix(opts.TelemetryMetricsPath, "/") {
+		log.Fatalf("Metrics path '%v' is invalid, it must start with a '/'", opts.TelemetryMetricsPath)
+	}
+	if isReservedPath(opts.TelemetryMetricsPath) {
+		log.Fatalf("Metrics path '%v' is invalid, it must not be one of '%v' or start with '%v/' or '/debug/pprof/'",
+			opts.TelemetryMetricsPath, strings.Join(reservedPaths, "', '"), api.GroupsAPIPath)
+	}
+
+	log.WithFields(log.Fields{
+		"version":    version.Version,
+		"commit":     version.Commit,
+		"build_date": version.BuildDate,
+	}).Info("starting kafka minion")
 	// Create cross package shared dependencies
-	consumerOffsetsCh := make(chan *kafka.StorageRequest, 1000)
+	consumerOffsetsCh := make(chan *kafka.StorageRequest, opts.StorageQueueSize)
 	clusterCh := make(chan *kafka.StorageRequest, 200)
 
+	// All modules stop their background work once this context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Create storage module
-	cache := storage.NewMemoryStorage(consumerOffsetsCh, clusterCh)
-	cache.Start()
+	cache := storage.NewMemoryStorage(opts, consumerOffsetsCh, clusterCh)
+	if opts.StorageSnapshotPath != "" {
+		restoreSnapshot(cache, opts.StorageSnapshotPath)
+	}
+	cache.Start(ctx)
 
 	// Create cluster module
-	cluster := kafka.NewCluster(opts, clusterCh)
-	cluster.Start()
+	cluster := kafka.NewCluster(opts, filter, clusterCh)
+	cluster.Start(ctx)
 
 	// Create kafka consumer
-	consumer := kafka.NewOffsetConsumer(opts, consumerOffsetsCh)
-	consumer.Start()
+	consumer := kafka.NewOffsetConsumer(opts, filter, consumerOffsetsCh)
+	consumer.SetResumeOffsets(cache.ConsumedOffsets())
+	consumer.Start(ctx)
 
-	// Create prometheus collector
-	collector := collector.NewCollector(opts, cache)
-	prometheus.MustRegister(collector)
+	// Register internal metrics and create prometheus collector. The cluster label is added to all their series.
+	registerer := prometheus.DefaultRegisterer
+	var clusterLabels prometheus.Labels
+	if opts.MetricsClusterLabel != "" {
+		clusterLabels = prometheus.Labels{"cluster": opts.MetricsClusterLabel}
+		registerer = prometheus.WrapRegistererWith(clusterLabels, registerer)
+	}
+	kafka.RegisterMetrics(registerer, opts.MetricsPrefix)
+	cache.RegisterMetrics(registerer)
+	registerer.MustRegister(version.NewBuildInfoCollector(opts.MetricsPrefix))
+	if opts.KafkaExposeClientMetrics {
+		registerer.MustRegister(kafka.NewSaramaMetricsCollector(opts.MetricsPrefix))
+	}
+	collector := collector.NewCollector(opts, filter, cache)
+	registerer.MustRegister(collector)
+	if opts.MetricsExporter == "otlp" {
+		// Metrics are pushed in addition to being served on the metrics path, a push may take up to the push interval
+		go sink.Push(ctx, prometheus.DefaultGatherer, sink.NewOTLPSink(opts.MetricsOTLPEndpoint, opts.MetricsOTLPInterval), opts.MetricsOTLPInterval)
+	}
 
 	// Start listening on /metrics endpoint
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/healthcheck", healthCheck(cluster))
-	http.Handle("/readycheck", readyCheck(cache))
-	listenAddress := net.JoinHostPort(opts.TelemetryHost, strconv.Itoa(opts.TelemetryPort))
-	log.Infof("Listening on: '%s", listenAddress)
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
+	mux := http.NewServeMux()
+	mux.Handle(opts.TelemetryMetricsPath, api.MetricsHandler(collector, clusterLabels))
+	mux.Handle("/healthcheck", healthCheck(cluster))
+	mux.Handle("/readycheck", readyCheck(cache))
+	mux.Handle("/ready", ready(cache, consumer))
+	mux.Handle("/healthz", liveness())
+	if opts.TelemetryDebugEndpoints {
+		mux.Handle("/debug/groups", api.DebugGroupsHandler(cache))
+	}
+	if opts.TelemetryGroupsAPI {
+		groupsAPI := api.GroupsAPIHandler(cache)
+		mux.Handle(api.GroupsAPIPath, groupsAPI)
+		mux.Handle(api.GroupsAPIPath+"/", groupsAPI)
+	}
+	if opts.TelemetryPprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	server := &http.Server{Addr: listenAddress, Handler: mux}
+	go func() {
+		log.Infof("Listening on: '%s", listenAddress)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Remove inactive groups periodically, a group expiry of 0 disables the removal
+	if opts.StorageGroupExpiry > 0 {
+		go expireGroups(ctx, consumerOffsetsCh, time.Minute)
+	}
+
+	// Reload the group file on SIGHUP, so that the allowed groups can be changed without a restart
+	if opts.FilterGroupFile != "" {
+		reloadSignals := make(chan os.Signal, 1)
+		signal.Notify(reloadSignals, syscall.SIGHUP)
+		go func() {
+			for range reloadSignals {
+				reloadGroupFile(filter, consumerOffsetsCh, opts.FilterGroupFile)
+			}
+		}()
+	}
+
+	// Wait for a termination signal and shutdown gracefully
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.WithFields(log.Fields{
+		"signal": sig.String(),
+	}).Info("received signal, shutting down")
+	shutdown(cancel, opts, cache, cluster, consumer, server)
+}
+
+// shutdown stops consuming, writes a final storage snapshot, closes the kafka clients and drains the HTTP server.
+// All phases together are bounded by the configured shutdown timeout.
+func shutdown(cancel context.CancelFunc, opts *options.Options, cache *storage.MemoryStorage, cluster *kafka.Cluster,
+	consumer *kafka.OffsetConsumer, server *http.Server) {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+	defer shutdownCancel()
+
+	log.Info("stopping partition consumers")
+	cancel()
+	consumerClosed := make(chan struct{})
+	go func() {
+		consumer.Close()
+		close(consumerClosed)
+	}()
+	select {
+	case <-consumerClosed:
+		log.Info("stopped partition consumers")
+	case <-shutdownCtx.Done():
+		log.Warn("timed out while stopping partition consumers")
+	}
+
+	if opts.StorageSnapshotPath != "" {
+		// Requests which are still queued for the storage workers might be missing in the snapshot. Their
+		// records will be consumed again after the restart, as the consumed offsets are part of the snapshot too.
+		log.Info("writing final storage snapshot")
+		err := cache.WriteSnapshotFile(opts.StorageSnapshotPath)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"path":  opts.StorageSnapshotPath,
+				"error": err.Error(),
+			}).Error("failed to write final storage snapshot")
+		} else {
+			log.Infof("wrote final storage snapshot to '%v'", opts.StorageSnapshotPath)
+		}
+	}
+
+	log.Info("closing kafka clients")
+	cluster.Close()
+
+	log.Info("draining HTTP server")
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warn("failed to drain HTTP server")
+	}
+	log.Info("shutdown completed")
+}
+
+// restoreSnapshot loads a previously written storage snapshot. A missing or broken snapshot is not fatal,
+// the offsets topic will be consumed from the beginning instead.
+func restoreSnapshot(cache *storage.MemoryStorage, path string) {
+	err := cache.RestoreSnapshotFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Infof("No storage snapshot found at '%v', consuming offsets topic from the beginning", path)
+			return
+		}
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err.Error(),
+		}).Warn("failed to restore storage snapshot, consuming offsets topic from the beginning")
+		return
+	}
+	log.Infof("Restored storage snapshot from '%v'", path)
+}
+
+// reloadGroupFile reloads the allowed groups from the group file and requests the storage to remove all groups
+// which are not allowed anymore. Added groups show up with their next commit.
+func reloadGroupFile(filter *kafka.Filter, storageCh chan<- *kafka.StorageRequest, path string) {
+	err := filter.ReloadGroupFile()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err.Error(),
+		}).Error("failed to reload group file, keeping the previously loaded groups")
+		return
+	}
+	log.Infof("Reloaded group file '%v'", path)
+	storageCh <- &kafka.StorageRequest{RequestType: kafka.StorageDeleteFilteredGroups, Filter: filter}
+}
+
+// expireGroups periodically requests the storage to remove all consumer groups which haven't committed an offset
+// within the group expiry
+func expireGroups(ctx context.Context, storageCh chan<- *kafka.StorageRequest, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case storageCh <- &kafka.StorageRequest{RequestType: kafka.StorageDeleteExpiredGroups}:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 func healthCheck(cluster *kafka.Cluster) http.HandlerFunc {
@@ -87,3 +388,84 @@ func readyCheck(storage *storage.MemoryStorage) http.HandlerFunc {
 		}
 	})
 }
+
+// readyResponse is the JSON body of the /ready endpoint
+type readyResponse struct {
+	Ready             bool               `json:"ready"`
+	LaggingPartitions []laggingPartition `json:"lagging_partitions"`
+}
+
+type laggingPartition struct {
+	Partition      int32 `json:"partition"`
+	ConsumedOffset int64 `json:"consumed_offset"`
+	HighWaterMark  int64 `json:"high_water_mark"`
+	Lag            int64 `json:"lag"`
+}
+
+// ready behaves like readyCheck, but responds with a JSON body which lists all partitions of the
+// __consumer_offsets topic that haven't been caught up yet
+func ready(storage *storage.MemoryStorage, consumer *kafka.OffsetConsumer) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := readyResponse{
+			Ready:             storage.IsConsumed(),
+			LaggingPartitions: make([]laggingPartition, 0),
+		}
+		if !response.Ready {
+			for _, status := range consumer.PartitionStatus() {
+				if status.IsReady {
+					continue
+				}
+				response.LaggingPartitions = append(response.LaggingPartitions, laggingPartition{
+					Partition:      status.PartitionID,
+					ConsumedOffset: status.ConsumedOffset,
+					HighWaterMark:  status.HighWaterMark,
+					Lag:            status.PartitionLag,
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !response.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// liveness always returns 200 as long as the process is able to serve HTTP requests
+func liveness() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Alive"))
+	})
+}
+
+// isReservedPath returns true if the path is served by any other handler than the metrics handler
+func isReservedPath(path string) bool {
+	for _, reservedPath := range reservedPaths {
+		if path == reservedPath {
+			return true
+		}
+	}
+
+	return strings.HasPrefix(path, api.GroupsAPIPath+"/") || strings.HasPrefix(path, "/debug/pprof/")
+}
+
+// decodeDumpFile decodes all records of the given offsets topic dump and prints them to stdout
+func decodeDumpFile(path string) error {
+	// Decoding a dump doesn't connect to Kafka, hence only the record size limit is read from the environment
+	var dumpOpts struct {
+		ConsumerMaxRecordBytes int `envconfig:"KAFKA_CONSUMER_MAX_RECORD_BYTES" default:"10485760"`
+	}
+	err := envconfig.Process("", &dumpOpts)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return kafka.DecodeDump(bufio.NewReader(file), os.Stdout, dumpOpts.ConsumerMaxRecordBytes)
+}
@@ -1,27 +1,87 @@
 package options
 
+import "time"
+
 // Options are configuration options that can be set by Environment Variables
-// Version - Application version
 // Kafka Broker string
 type Options struct {
 	// General
 	// TelemetryHost - Host to listen on for the prometheus exporter
 	// TelemetryPort - Port to listen on for the prometheus exporter
-	// LogLevel - Logger's log granularity (debug, info, warn, error, fatal, panic)
-	// Version - Set by the dockerfile, will be logged once in the beginning
-	TelemetryHost string `envconfig:"TELEMETRY_HOST" default:"0.0.0.0"`
-	TelemetryPort int    `envconfig:"TELEMETRY_PORT" default:"8080"`
-	LogLevel      string `envconfig:"LOG_LEVEL" default:"INFO"`
-	Version       string `envconfig:"VERSION" required:"true"`
+	// TelemetryMetricsPath - HTTP path on which the prometheus metrics are served
+	// TelemetryDebugEndpoints - Whether or not to serve the /debug endpoints, which expose the in memory state as JSON
+	// TelemetryPprof - Whether or not to serve the net/http/pprof handlers under /debug/pprof/
+	// TelemetryGroupsAPI - Whether or not to serve the read only /api/v1/groups endpoints
+	// LogLevel - Logger's log granularity (trace, debug, info, warn, error, fatal, panic)
+	// LogFormat - Logger's output format (json or text)
+	// ShutdownTimeout - Max duration for stopping the consumers, writing the last snapshot and draining HTTP requests
+	TelemetryHost           string        `envconfig:"TELEMETRY_HOST" default:"0.0.0.0"`
+	TelemetryPort           int           `envconfig:"TELEMETRY_PORT" default:"8080"`
+	TelemetryMetricsPath    string        `envconfig:"TELEMETRY_METRICS_PATH" default:"/metrics"`
+	TelemetryDebugEndpoints bool          `envconfig:"TELEMETRY_DEBUG_ENDPOINTS" default:"false"`
+	TelemetryPprof          bool          `envconfig:"TELEMETRY_PPROF" default:"false"`
+	TelemetryGroupsAPI      bool          `envconfig:"TELEMETRY_GROUPS_API" default:"false"`
+	LogLevel                string        `envconfig:"LOG_LEVEL" default:"INFO"`
+	LogFormat               string        `envconfig:"LOG_FORMAT" default:"json"`
+	ShutdownTimeout         time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"20s"`
+
+	// Storage settings
+	// StorageGroupExpiry - Duration after which consumer groups which haven't committed any offsets are removed
+	// StorageSnapshotPath - File path to periodically store a snapshot of all consumer offsets, so that a restart
+	// can resume consuming the offsets topic instead of consuming it from the beginning (disabled if empty)
+	// StorageSnapshotInterval - Interval in which snapshots are written
+	// StorageQueueSize - Number of requests the offset consumer can queue for the storage before it blocks
+	StorageGroupExpiry      time.Duration `envconfig:"STORAGE_GROUP_EXPIRY" default:"168h"`
+	StorageSnapshotPath     string        `envconfig:"STORAGE_SNAPSHOT_PATH"`
+	StorageSnapshotInterval time.Duration `envconfig:"STORAGE_SNAPSHOT_INTERVAL" default:"1m"`
+	StorageQueueSize        int           `envconfig:"STORAGE_QUEUE_SIZE" default:"1000"`
 
 	// Exporter settings
 	// IgnoreSystemTopics - Don't expose metrics about system topics (any topic names which are "__" or "_confluent" prefixed)
-	IgnoreSystemTopics bool `envconfig:"EXPORTER_IGNORE_SYSTEM_TOPICS" default:"true"`
+	// StaleCommitThreshold - Age of a group's last commit for a partition after which the commit is considered as stale (0 = disabled)
+	// LagOnNegative - Partition lag if the committed offset is ahead of the high water mark: clamp (0), raw (negative) or skip
+	IgnoreSystemTopics   bool          `envconfig:"EXPORTER_IGNORE_SYSTEM_TOPICS" default:"true"`
+	StaleCommitThreshold time.Duration `envconfig:"EXPORTER_STALE_COMMIT_THRESHOLD" default:"10m"`
+	LagOnNegative        string        `envconfig:"EXPORTER_LAG_ON_NEGATIVE" default:"clamp"`
+
+	// Filter settings
+	// FilterGroupAllowlist - Regexes delimited by comma, only groups which match at least one of them are exposed
+	// FilterGroupDenylist - Regexes delimited by comma, groups which match any of them are not exposed (takes precedence)
+	// FilterTopicAllowlist - Regexes delimited by comma, only topics which match at least one of them are exposed
+	// FilterTopicDenylist - Regexes delimited by comma, topics which match any of them are not exposed (takes precedence)
+	// FilterProtocolTypes - Group protocol types delimited by comma (e. g. consumer or connect), only groups with one of them are exposed
+	// FilterGroupFile - Path to a file with one group name per line, these groups are allowed in addition to the group allowlist
+	FilterGroupAllowlist []string `envconfig:"FILTER_GROUP_ALLOWLIST"`
+	FilterGroupDenylist  []string `envconfig:"FILTER_GROUP_DENYLIST"`
+	FilterTopicAllowlist []string `envconfig:"FILTER_TOPIC_ALLOWLIST"`
+	FilterTopicDenylist  []string `envconfig:"FILTER_TOPIC_DENYLIST"`
+	FilterProtocolTypes  []string `envconfig:"FILTER_PROTOCOL_TYPES"`
+	FilterGroupFile      string   `envconfig:"FILTER_GROUP_FILE"`
 
 	// Kafka configurations
 	// KafkaBrokers - Addresses of all Kafka Brokers delimited by comma (e. g. "kafka-1:9092, kafka-2:9092")
-	// ConsumerOffsetsTopicName - Topic name of topic where kafka commits the consumer offsets
-	// SASLEnabled - Bool to enable/disable SASL authentication (only SASL_PLAINTEXT is supported)
+	// KafkaVersion - Version of the oldest broker in the cluster, it determines which request versions are used
+	// KafkaWatermarkInterval - Interval in which the partition low & high water marks are fetched
+	// KafkaWatermarkJitter - Duration over which the water mark requests to the brokers are spread (0 = all at once)
+	// KafkaMetadataRefresh - Interval of the background metadata refresh, each water mark poll refreshes the topic list too
+	// KafkaConnectRetries - Number of retries if the initial connection to the cluster fails
+	// KafkaConnectBackoff - Delay before the first retry, it doubles with each further retry (max 30s)
+	// KafkaMaxOpenRequests - Max number of unacknowledged requests per broker connection
+	// KafkaDialTimeout - Timeout for establishing a broker connection, each connection attempt may take this long per broker
+	// KafkaReadTimeout - Timeout for a response of a broker
+	// KafkaRequestTimeout - Max duration of a water mark or metadata request, including the client's retries (0 = no timeout). A poll waits for the high and the low water marks, so it should be less than half of KafkaWatermarkInterval
+	// KafkaKeepAlive - TCP keep alive period of broker connections (0 = Go default of 15s)
+	// ConsumerOffsetsTopicName - Topic name of topic where kafka commits the consumer offsets (or a mirrored copy of it)
+	// KafkaStartOffset - Offset to start consuming the offsets topic from if there is no snapshot (oldest or newest)
+	// ConsumerOffsetsReadyLag - Max number of remaining messages of a consumer offsets partition to consider it as consumed
+	// KafkaExposeClientMetrics - Whether or not to expose the request metrics of the sarama clients
+	// ConsumerMaxRecordBytes - Records of the offsets topic whose value is larger are skipped rather than decoded (0 = no limit)
+	// ConsumerWorkers - Max number of offsets topic partitions whose messages are decoded concurrently (0 = no limit)
+	// DecodeLenient - Whether or not to keep group metadata records if a member's subscription or assignment can't be decoded
+	// SASLEnabled - Bool to enable/disable SASL authentication
+	// SASLMechanism - SASL mechanism to use for authentication (PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or OAUTHBEARER)
+	// SASLOAuthProvider - Token provider which is used for the OAUTHBEARER mechanism (only aws-msk-iam is supported)
+	// SASLAWSRegion - AWS region of the MSK cluster, required by the aws-msk-iam token provider
 	// UseSASLHandshake -  Whether or not to send the Kafka SASL handshake first
 	// SASLUsername - SASL Username
 	// SASLPassword - SASL Password
@@ -31,22 +91,60 @@ type Options struct {
 	// TLSCertFilePath - Path to the TLS cert file
 	// TLSInsecureSkipTLSVerify - If InsecureSkipVerify is true, TLS accepts any certificate presented by the server and any host name in that certificate.
 	// TLSPassphrase - Passphrase to decrypt the TLS Key
-	KafkaBrokers             []string `envconfig:"KAFKA_BROKERS" required:"true"`
-	ConsumerOffsetsTopicName string   `envconfig:"KAFKA_CONSUMER_OFFSETS_TOPIC_NAME" default:"__consumer_offsets"`
-	SASLEnabled              bool     `envconfig:"KAFKA_SASL_ENABLED" default:"false"`
-	UseSASLHandshake         bool     `envconfig:"KAFKA_SASL_USE_HANDSHAKE" default:"true"`
-	SASLUsername             string   `envconfig:"KAFKA_SASL_USERNAME"`
-	SASLPassword             string   `envconfig:"KAFKA_SASL_PASSWORD"`
-	TLSEnabled               bool     `envconfig:"KAFKA_TLS_ENABLED" default:"false"`
-	TLSCAFilePath            string   `envconfig:"KAFKA_TLS_CA_FILE_PATH"`
-	TLSKeyFilePath           string   `envconfig:"KAFKA_TLS_KEY_FILE_PATH"`
-	TLSCertFilePath          string   `envconfig:"KAFKA_TLS_CERT_FILE_PATH"`
-	TLSInsecureSkipTLSVerify bool     `envconfig:"KAFKA_TLS_INSECURE_SKIP_TLS_VERIFY" default:"true"`
-	TLSPassphrase            string   `envconfig:"KAFKA_TLS_PASSPHRASE"`
+	KafkaBrokers             []string      `envconfig:"KAFKA_BROKERS" required:"true"`
+	KafkaVersion             string        `envconfig:"KAFKA_VERSION" default:"0.11.0.2"`
+	KafkaWatermarkInterval   time.Duration `envconfig:"KAFKA_WATERMARK_INTERVAL" default:"5s"`
+	KafkaWatermarkJitter     time.Duration `envconfig:"KAFKA_WATERMARK_JITTER" default:"0"`
+	KafkaMetadataRefresh     time.Duration `envconfig:"KAFKA_METADATA_REFRESH" default:"5m"`
+	KafkaConnectRetries      int           `envconfig:"KAFKA_CONNECT_RETRIES" default:"5"`
+	KafkaConnectBackoff      time.Duration `envconfig:"KAFKA_CONNECT_BACKOFF" default:"1s"`
+	KafkaMaxOpenRequests     int           `envconfig:"KAFKA_MAX_OPEN_REQUESTS" default:"5"`
+	KafkaDialTimeout         time.Duration `envconfig:"KAFKA_DIAL_TIMEOUT" default:"10s"`
+	KafkaReadTimeout         time.Duration `envconfig:"KAFKA_READ_TIMEOUT" default:"30s"`
+	KafkaRequestTimeout      time.Duration `envconfig:"KAFKA_REQUEST_TIMEOUT" default:"2s"`
+	KafkaKeepAlive           time.Duration `envconfig:"KAFKA_KEEPALIVE" default:"0"`
+	ConsumerOffsetsTopicName string        `envconfig:"KAFKA_CONSUMER_OFFSETS_TOPIC_NAME" default:"__consumer_offsets"`
+	KafkaStartOffset         string        `envconfig:"KAFKA_START_OFFSET" default:"oldest"`
+	ConsumerOffsetsReadyLag  int64         `envconfig:"KAFKA_CONSUMER_OFFSETS_READY_LAG" default:"10"`
+	ConsumerWorkers          int           `envconfig:"KAFKA_CONSUMER_WORKERS" default:"0"`
+	ConsumerMaxRecordBytes   int           `envconfig:"KAFKA_CONSUMER_MAX_RECORD_BYTES" default:"10485760"`
+	DecodeLenient            bool          `envconfig:"KAFKA_DECODE_LENIENT" default:"false"`
+	KafkaExposeClientMetrics bool          `envconfig:"KAFKA_EXPOSE_CLIENT_METRICS" default:"false"`
+	SASLEnabled              bool          `envconfig:"KAFKA_SASL_ENABLED" default:"false"`
+	SASLMechanism            string        `envconfig:"KAFKA_SASL_MECHANISM" default:"PLAIN"`
+	SASLOAuthProvider        string        `envconfig:"KAFKA_SASL_OAUTH_PROVIDER" default:"aws-msk-iam"`
+	SASLAWSRegion            string        `envconfig:"KAFKA_SASL_AWS_REGION"`
+	UseSASLHandshake         bool          `envconfig:"KAFKA_SASL_USE_HANDSHAKE" default:"true"`
+	SASLUsername             string        `envconfig:"KAFKA_SASL_USERNAME"`
+	SASLPassword             string        `envconfig:"KAFKA_SASL_PASSWORD"`
+	TLSEnabled               bool          `envconfig:"KAFKA_TLS_ENABLED" default:"false"`
+	TLSCAFilePath            string        `envconfig:"KAFKA_TLS_CA_FILE_PATH"`
+	TLSKeyFilePath           string        `envconfig:"KAFKA_TLS_KEY_FILE_PATH"`
+	TLSCertFilePath          string        `envconfig:"KAFKA_TLS_CERT_FILE_PATH"`
+	TLSInsecureSkipTLSVerify bool          `envconfig:"KAFKA_TLS_INSECURE_SKIP_TLS_VERIFY" default:"false"`
+	TLSPassphrase            string        `envconfig:"KAFKA_TLS_PASSPHRASE"`
 
 	// Prometheus exporter
 	// MetricsPrefix - A prefix for all exported prometheus metrics
-	MetricsPrefix string `envconfig:"METRICS_PREFIX" default:"kafka_minion"`
+	// MetricsClusterLabel - If set, all exported series get a constant "cluster" label with this value
+	// MetricsResolveClientHost - Whether or not to resolve the client hosts of group members to hostnames (reverse DNS)
+	// MetricsResolveTimeout - Timeout for a single reverse DNS lookup of a client host
+	// MetricsIncludeRack - Whether or not to add the rack of the partition leader as label to the high water mark metric
+	// MetricsMaxPartitionsPerGroup - Groups with more partitions are only exposed in aggregate, 0 means unlimited
+	// MetricsRebalanceHold - How long a group is still reported as rebalancing after a rebalance has been seen
+	// MetricsExporter - prometheus (metrics are only scraped from the metrics path) or otlp (metrics are pushed as well)
+	// MetricsOTLPEndpoint - URL of the OTLP/HTTP metrics endpoint, required by the otlp exporter
+	// MetricsOTLPInterval - Interval in which the metrics are pushed by the otlp exporter
+	MetricsPrefix                string        `envconfig:"METRICS_PREFIX" default:"kafka_minion"`
+	MetricsClusterLabel          string        `envconfig:"METRICS_CLUSTER_LABEL"`
+	MetricsResolveClientHost     bool          `envconfig:"METRICS_RESOLVE_CLIENT_HOST" default:"false"`
+	MetricsResolveTimeout        time.Duration `envconfig:"METRICS_RESOLVE_TIMEOUT" default:"1s"`
+	MetricsIncludeRack           bool          `envconfig:"METRICS_INCLUDE_RACK" default:"false"`
+	MetricsMaxPartitionsPerGroup int           `envconfig:"METRICS_MAX_PARTITIONS_PER_GROUP" default:"0"`
+	MetricsRebalanceHold         time.Duration `envconfig:"METRICS_REBALANCE_HOLD" default:"30s"`
+	MetricsExporter              string        `envconfig:"METRICS_EXPORTER" default:"prometheus"`
+	MetricsOTLPEndpoint          string        `envconfig:"METRICS_OTLP_ENDPOINT"`
+	MetricsOTLPInterval          time.Duration `envconfig:"METRICS_OTLP_INTERVAL" default:"30s"`
 }
 
 // NewOptions provides Application Options
@@ -0,0 +1,254 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google-cloud-tools/kafka-minion/version"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// otlpServiceName is sent as service.name resource attribute
+	otlpServiceName = "kafka-minion"
+
+	// otlpCumulative is the aggregation temporality of all counters, as prometheus counters are cumulative
+	otlpCumulative = 2
+)
+
+// OTLPSink pushes the samples to an OpenTelemetry collector using OTLP/HTTP with the JSON encoding, see:
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type OTLPSink struct {
+	endpoint string
+	client   *http.Client
+	now      func() time.Time
+	// startTime is the start of the cumulative counters, the sink is created on startup
+	startTime time.Time
+
+	lock    sync.Mutex
+	metrics []*otlpMetric
+	byName  map[string]*otlpMetric
+}
+
+// NewOTLPSink creates a sink which pushes the samples to the given OTLP/HTTP metrics endpoint
+// (e. g. http://otel-collector:4318/v1/metrics). A single push may take up to the given timeout.
+func NewOTLPSink(endpoint string, timeout time.Duration) *OTLPSink {
+	return &OTLPSink{
+		endpoint:  endpoint,
+		client:    &http.Client{Timeout: timeout},
+		now:       time.Now,
+		startTime: time.Now(),
+		byName:    make(map[string]*otlpMetric),
+	}
+}
+
+// The types below are the subset of the OTLP metrics protocol (ExportMetricsServiceRequest) which is sent
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"` // Only set for sums
+	TimeUnixNano      string          `json:"timeUnixNano"`                // 64 bit integers are encoded as strings in OTLP/JSON
+	AsDouble          otlpDouble      `json:"asDouble"`
+}
+
+// otlpDouble is a double value. encoding/json rejects NaN and infinite values (e. g. a quantile of a summary without
+// observations), they are encoded as strings as defined by the JSON mapping of protobuf instead.
+type otlpDouble float64
+
+// MarshalJSON implements json.Marshaler
+func (d otlpDouble) MarshalJSON() ([]byte, error) {
+	value := float64(d)
+	switch {
+	case math.IsNaN(value):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(value, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(value, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+
+	return json.Marshal(value)
+}
+
+type otlpAttribute struct {
+	Key   string             `json:"key"`
+	Value otlpAttributeValue `json:"value"`
+}
+
+type otlpAttributeValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// Gauge adds the current value of a gauge series
+func (s *OTLPSink) Gauge(name string, help string, labels map[string]string, value float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	metric := s.metric(name, help)
+	if metric.Gauge == nil {
+		metric.Gauge = &otlpGauge{}
+	}
+	metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, s.dataPoint(labels, value))
+}
+
+// Counter adds the current (cumulative) value of a counter series
+func (s *OTLPSink) Counter(name string, help string, labels map[string]string, value float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counter(name, help, labels, value)
+}
+
+// Histogram adds the sum and the count of a histogram series as counters, the buckets are not sent
+func (s *OTLPSink) Histogram(name string, help string, labels map[string]string, buckets map[float64]uint64, count uint64,
+	sum float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counter(name+"_sum", help, labels, sum)
+	s.counter(name+"_count", help, labels, float64(count))
+}
+
+// Summary adds the sum and the count of a summary series as counters, the quantiles are not sent
+func (s *OTLPSink) Summary(name string, help string, labels map[string]string, quantiles map[float64]float64, count uint64,
+	sum float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counter(name+"_sum", help, labels, sum)
+	s.counter(name+"_count", help, labels, float64(count))
+}
+
+// counter adds a data point to a cumulative sum, it must be called with the lock being held
+func (s *OTLPSink) counter(name string, help string, labels map[string]string, value float64) {
+	metric := s.metric(name, help)
+	if metric.Sum == nil {
+		metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+	}
+	dataPoint := s.dataPoint(labels, value)
+	// Backends need the start of cumulative sums to compute rates
+	dataPoint.StartTimeUnixNano = strconv.FormatInt(s.startTime.UnixNano(), 10)
+	metric.Sum.DataPoints = append(metric.Sum.DataPoints, dataPoint)
+}
+
+// metric returns the buffered metric with the given name, it must be called with the lock being held
+func (s *OTLPSink) metric(name string, help string) *otlpMetric {
+	metric, exists := s.byName[name]
+	if !exists {
+		metric = &otlpMetric{Name: name, Description: help}
+		s.byName[name] = metric
+		s.metrics = append(s.metrics, metric)
+	}
+
+	return metric
+}
+
+func (s *OTLPSink) dataPoint(labels map[string]string, value float64) otlpDataPoint {
+	// Attributes are sorted, so that the payload doesn't depend on the map order
+	attributes := make([]otlpAttribute, 0, len(labels))
+	for key, labelValue := range labels {
+		attributes = append(attributes, otlpAttribute{Key: key, Value: otlpAttributeValue{StringValue: labelValue}})
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Key < attributes[j].Key })
+
+	return otlpDataPoint{
+		Attributes:   attributes,
+		TimeUnixNano: strconv.FormatInt(s.now().UnixNano(), 10),
+		AsDouble:     otlpDouble(value),
+	}
+}
+
+// Flush sends all buffered samples in a single export request. The samples are dropped if the request fails, they
+// will be sent with their next value in the next push.
+func (s *OTLPSink) Flush(ctx context.Context) error {
+	s.lock.Lock()
+	metrics := s.metrics
+	s.metrics = nil
+	s.byName = make(map[string]*otlpMetric)
+	s.lock.Unlock()
+
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	request := otlpRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{{Key: "service.name", Value: otlpAttributeValue{StringValue: otlpServiceName}}},
+			},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: otlpServiceName, Version: version.Version},
+				Metrics: metrics,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode export request: %v", err)
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create export request: %v", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	response, err := s.client.Do(httpRequest.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to send export request: %v", err)
+	}
+	defer response.Body.Close()
+	// The body is drained, so that the connection can be reused
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("export request failed with status %v", response.Status)
+	}
+
+	return nil
+}
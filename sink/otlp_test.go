@@ -0,0 +1,130 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOTLPSinkFlush(t *testing.T) {
+	var requests []otlpRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected a JSON export request, Got content type: %v", r.Header.Get("Content-Type"))
+		}
+		var request otlpRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			t.Errorf("Failed to decode export request: %v", err)
+		}
+		requests = append(requests, request)
+	}))
+	defer server.Close()
+
+	sink := NewOTLPSink(server.URL+"/v1/metrics", time.Second)
+	sink.now = func() time.Time { return time.Unix(1, 0) }
+	sink.startTime = time.Unix(0, 5)
+	sink.Gauge("group_lag", "Lag of the group", map[string]string{"topic": "orders", "group": "sample-group"}, 42)
+	sink.Gauge("group_lag", "Lag of the group", map[string]string{"topic": "orders", "group": "other-group"}, 7)
+	sink.Counter("offset_commits_total", "", map[string]string{"group": "sample-group"}, 3)
+	err := sink.Flush(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	// Flushed samples are not sent again
+	err = sink.Flush(context.Background())
+	if err != nil || len(requests) != 1 {
+		t.Fatalf("Expected a single export request, Got: %v requests, error: %v", len(requests), err)
+	}
+
+	metrics := requests[0].ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 2 || metrics[0].Name != "group_lag" || metrics[1].Name != "offset_commits_total" {
+		t.Fatalf("Expected the metrics group_lag and offset_commits_total, Got: %+v", metrics)
+	}
+	if metrics[0].Description != "Lag of the group" {
+		t.Errorf("Expected the help to be sent as description, Got: %q", metrics[0].Description)
+	}
+	expectedPoint := otlpDataPoint{
+		Attributes: []otlpAttribute{
+			{Key: "group", Value: otlpAttributeValue{StringValue: "sample-group"}},
+			{Key: "topic", Value: otlpAttributeValue{StringValue: "orders"}},
+		},
+		TimeUnixNano: "1000000000",
+		AsDouble:     42,
+	}
+	if metrics[0].Gauge == nil || len(metrics[0].Gauge.DataPoints) != 2 || !reflect.DeepEqual(metrics[0].Gauge.DataPoints[0], expectedPoint) {
+		t.Errorf("Expected gauge data points starting with %+v, Got: %+v", expectedPoint, metrics[0].Gauge)
+	}
+	sum := metrics[1].Sum
+	if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != otlpCumulative || sum.DataPoints[0].AsDouble != 3 ||
+		sum.DataPoints[0].StartTimeUnixNano != "5" {
+		t.Errorf("Expected a cumulative monotonic sum with value 3 starting at 5ns, Got: %+v", sum)
+	}
+}
+
+func TestOTLPSinkFlushFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	sink := NewOTLPSink(server.URL, time.Second)
+	sink.Gauge("group_lag", "", nil, 42)
+	err := sink.Flush(context.Background())
+	if err == nil {
+		t.Errorf("Expected an error if the collector rejects the export request")
+	}
+}
+
+func TestOTLPSinkFlushNonFiniteValues(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	sink := NewOTLPSink(server.URL, time.Second)
+	sink.Gauge("nan", "", nil, math.NaN())
+	sink.Gauge("inf", "", nil, math.Inf(1))
+	sink.Gauge("negative_inf", "", nil, math.Inf(-1))
+	sink.Histogram("empty_duration_seconds", "", nil, nil, 0, 0)
+	err := sink.Flush(context.Background())
+	if err != nil {
+		t.Fatalf("Expected non-finite values not to fail the push, Got: %v", err)
+	}
+
+	var request struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name  string
+					Gauge *struct {
+						DataPoints []struct {
+							AsDouble interface{}
+						}
+					}
+				}
+			}
+		}
+	}
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		t.Fatalf("Failed to decode export request: %v", err)
+	}
+	expected := map[string]interface{}{"nan": "NaN", "inf": "Infinity", "negative_inf": "-Infinity"}
+	got := make(map[string]interface{})
+	for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		if metric.Gauge != nil {
+			got[metric.Name] = metric.Gauge.DataPoints[0].AsDouble
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the non-finite values %v, Got: %v", expected, got)
+	}
+}
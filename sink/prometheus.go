@@ -0,0 +1,125 @@
+package sink
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"sort"
+	"sync"
+)
+
+// PrometheusSink is the default sink. Prometheus pulls the metrics rather than receiving pushes, hence the sink is a
+// prometheus.Gatherer for the metrics endpoint: each scrape forwards the metrics of the source gatherer into the sink
+// and returns the flushed samples. Thereby the metrics endpoint serves the samples which any other sink receives.
+type PrometheusSink struct {
+	source prometheus.Gatherer
+
+	// scrapeLock serializes scrapes, the buffered samples belong to the scrape which holds it
+	scrapeLock sync.Mutex
+
+	lock     sync.Mutex
+	families []*dto.MetricFamily
+	byName   map[string]*dto.MetricFamily
+	flushed  []*dto.MetricFamily
+}
+
+// NewPrometheusSink creates a sink which serves the metrics of the given source gatherer
+func NewPrometheusSink(source prometheus.Gatherer) *PrometheusSink {
+	return &PrometheusSink{
+		source: source,
+		byName: make(map[string]*dto.MetricFamily),
+	}
+}
+
+// Gather forwards the metrics of the source gatherer into the sink and returns them. Like the gatherers of the
+// prometheus client, it returns the metrics which could be gathered along with the error if gathering fails.
+func (s *PrometheusSink) Gather() ([]*dto.MetricFamily, error) {
+	s.scrapeLock.Lock()
+	defer s.scrapeLock.Unlock()
+
+	err := Forward(s.source, s)
+	s.Flush(context.Background())
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flushed, err
+}
+
+// Gauge adds the current value of a gauge series
+func (s *PrometheusSink) Gauge(name string, help string, labels map[string]string, value float64) {
+	s.add(name, help, dto.MetricType_GAUGE, &dto.Metric{
+		Label: labelPairs(labels),
+		Gauge: &dto.Gauge{Value: &value},
+	})
+}
+
+// Counter adds the current (cumulative) value of a counter series
+func (s *PrometheusSink) Counter(name string, help string, labels map[string]string, value float64) {
+	s.add(name, help, dto.MetricType_COUNTER, &dto.Metric{
+		Label:   labelPairs(labels),
+		Counter: &dto.Counter{Value: &value},
+	})
+}
+
+// Histogram adds the current state of a histogram series
+func (s *PrometheusSink) Histogram(name string, help string, labels map[string]string, buckets map[float64]uint64, count uint64,
+	sum float64) {
+	histogram := &dto.Histogram{SampleCount: &count, SampleSum: &sum}
+	for upperBound, cumulativeCount := range buckets {
+		upperBound, cumulativeCount := upperBound, cumulativeCount
+		histogram.Bucket = append(histogram.Bucket, &dto.Bucket{UpperBound: &upperBound, CumulativeCount: &cumulativeCount})
+	}
+	sort.Slice(histogram.Bucket, func(i, j int) bool { return histogram.Bucket[i].GetUpperBound() < histogram.Bucket[j].GetUpperBound() })
+
+	s.add(name, help, dto.MetricType_HISTOGRAM, &dto.Metric{Label: labelPairs(labels), Histogram: histogram})
+}
+
+// Summary adds the current state of a summary series
+func (s *PrometheusSink) Summary(name string, help string, labels map[string]string, quantiles map[float64]float64, count uint64,
+	sum float64) {
+	summary := &dto.Summary{SampleCount: &count, SampleSum: &sum}
+	for rank, value := range quantiles {
+		rank, value := rank, value
+		summary.Quantile = append(summary.Quantile, &dto.Quantile{Quantile: &rank, Value: &value})
+	}
+	sort.Slice(summary.Quantile, func(i, j int) bool { return summary.Quantile[i].GetQuantile() < summary.Quantile[j].GetQuantile() })
+
+	s.add(name, help, dto.MetricType_SUMMARY, &dto.Metric{Label: labelPairs(labels), Summary: summary})
+}
+
+// Flush replaces the samples which are served by the samples which have been added since the last flush. It never
+// fails.
+func (s *PrometheusSink) Flush(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.flushed = s.families
+	s.families = nil
+	s.byName = make(map[string]*dto.MetricFamily)
+	return nil
+}
+
+func (s *PrometheusSink) add(name string, help string, metricType dto.MetricType, metric *dto.Metric) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	family, exists := s.byName[name]
+	if !exists {
+		family = &dto.MetricFamily{Name: &name, Help: &help, Type: &metricType}
+		s.byName[name] = family
+		s.families = append(s.families, family)
+	}
+	family.Metric = append(family.Metric, metric)
+}
+
+// labelPairs returns the labels sorted by name, as the prometheus client does
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for name, value := range labels {
+		name, value := name, value
+		pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+
+	return pairs
+}
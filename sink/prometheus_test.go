@@ -0,0 +1,74 @@
+package sink
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestPrometheusSinkGather(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	lag := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "group_lag", Help: "Lag of the group"}, []string{"group", "topic"})
+	commits := prometheus.NewCounter(prometheus.CounterOpts{Name: "offset_commits_total", Help: "Number of commits"})
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "collect_duration_seconds", Help: "Duration", Buckets: []float64{1, 2}})
+	latency := prometheus.NewSummary(prometheus.SummaryOpts{Name: "request_latency_seconds", Help: "Latency"})
+	registry.MustRegister(lag, commits, duration, latency)
+	lag.WithLabelValues("sample-group", "orders").Set(42)
+	lag.WithLabelValues("other-group", "orders").Set(math.NaN())
+	commits.Add(3)
+	duration.Observe(0.5)
+	duration.Observe(1.5)
+
+	expected, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	sink := NewPrometheusSink(registry)
+	families, err := sink.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics through the sink: %v", err)
+	}
+	// NaN never equals itself, hence the samples are compared by their text representation
+	if len(families) != len(expected) {
+		t.Fatalf("Expected %v metric families, Got: %v", len(expected), len(families))
+	}
+	for i := range expected {
+		if families[i].String() != expected[i].String() {
+			t.Errorf("Expected the metric family %v, Got: %v", expected[i], families[i])
+		}
+	}
+
+	// Each scrape serves the current samples only
+	lag.DeleteLabelValues("other-group", "orders")
+	families, _ = sink.Gather()
+	for _, family := range families {
+		if family.GetName() == "group_lag" && (len(family.GetMetric()) != 1 || family.GetMetric()[0].GetGauge().GetValue() != 42) {
+			t.Errorf("Expected a single group_lag series after deleting one, Got: %v", family)
+		}
+	}
+}
+
+func TestPrometheusSinkGatherPartially(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	lag := prometheus.NewGauge(prometheus.GaugeOpts{Name: "group_lag"})
+	registry.MustRegister(lag)
+	failing := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, errors.New("inconsistent collector")
+	})
+
+	families, err := NewPrometheusSink(prometheus.Gatherers{registry, failing}).Gather()
+	if err == nil {
+		t.Errorf("Expected the gather error to be returned")
+	}
+	expected := []string{"group_lag"}
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected the gathered families %v, Got: %v", expected, names)
+	}
+}
@@ -0,0 +1,105 @@
+// Package sink emits the collected metrics. The metrics are still collected by the prometheus collectors, the sinks
+// only receive the gathered samples. The prometheus sink serves them on the metrics endpoint, other sinks push them
+// to systems which don't scrape it, e. g. an OpenTelemetry collector.
+package sink
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// MetricSink receives the samples of all series. Samples are buffered until they are flushed.
+type MetricSink interface {
+	// Gauge adds the current value of a gauge series
+	Gauge(name string, help string, labels map[string]string, value float64)
+
+	// Counter adds the current (cumulative) value of a counter series
+	Counter(name string, help string, labels map[string]string, value float64)
+
+	// Histogram adds the current state of a histogram series. The buckets map their upper bounds to the cumulative
+	// number of observations.
+	Histogram(name string, help string, labels map[string]string, buckets map[float64]uint64, count uint64, sum float64)
+
+	// Summary adds the current state of a summary series. The quantiles map the quantile ranks to their values.
+	Summary(name string, help string, labels map[string]string, quantiles map[float64]float64, count uint64, sum float64)
+
+	// Flush sends all samples which have been added since the last flush
+	Flush(ctx context.Context) error
+}
+
+// Forward gathers all metrics and adds their samples to the sink. Untyped metrics are forwarded as gauges. If
+// gathering fails, the metrics which could be gathered are still forwarded before the error is returned.
+func Forward(gatherer prometheus.Gatherer, sink MetricSink) error {
+	families, err := gatherer.Gather()
+	for _, family := range families {
+		name, help := family.GetName(), family.GetHelp()
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string, len(metric.GetLabel()))
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				sink.Counter(name, help, labels, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				sink.Gauge(name, help, labels, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				sink.Gauge(name, help, labels, metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				buckets := make(map[float64]uint64, len(histogram.GetBucket()))
+				for _, bucket := range histogram.GetBucket() {
+					buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+				}
+				sink.Histogram(name, help, labels, buckets, histogram.GetSampleCount(), histogram.GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				quantiles := make(map[float64]float64, len(summary.GetQuantile()))
+				for _, quantile := range summary.GetQuantile() {
+					quantiles[quantile.GetQuantile()] = quantile.GetValue()
+				}
+				sink.Summary(name, help, labels, quantiles, summary.GetSampleCount(), summary.GetSampleSum())
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %v", err)
+	}
+
+	return nil
+}
+
+// Push forwards all metrics to the sink and flushes it in the given interval, until the context is cancelled
+func Push(ctx context.Context, gatherer prometheus.Gatherer, sink MetricSink, interval time.Duration) {
+	logger := log.WithFields(log.Fields{
+		"module": "sink",
+	})
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := Forward(gatherer, sink)
+			if err != nil {
+				// Gather returns the metrics which could be gathered along with the error, hence they are still sent
+				logger.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Warn("failed to forward all metrics to the sink")
+			}
+			err = sink.Flush(ctx)
+			if err != nil {
+				logger.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Error("failed to push metrics")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"reflect"
+	"testing"
+)
+
+// recordingSink records all samples by their name followed by the group label
+type recordingSink struct {
+	help       map[string]string
+	gauges     map[string]float64
+	counters   map[string]float64
+	histograms map[string]map[float64]uint64
+	summaries  map[string]map[float64]float64
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{
+		help:       make(map[string]string),
+		gauges:     make(map[string]float64),
+		counters:   make(map[string]float64),
+		histograms: make(map[string]map[float64]uint64),
+		summaries:  make(map[string]map[float64]float64),
+	}
+}
+
+func (s *recordingSink) Gauge(name string, help string, labels map[string]string, value float64) {
+	s.help[name] = help
+	s.gauges[name+labels["group"]] = value
+}
+
+func (s *recordingSink) Counter(name string, help string, labels map[string]string, value float64) {
+	s.help[name] = help
+	s.counters[name+labels["group"]] = value
+}
+
+func (s *recordingSink) Histogram(name string, help string, labels map[string]string, buckets map[float64]uint64, count uint64,
+	sum float64) {
+	s.help[name] = help
+	s.histograms[name+labels["group"]] = buckets
+	s.counters[name+"_sum"+labels["group"]] = sum
+	s.counters[name+"_count"+labels["group"]] = float64(count)
+}
+
+func (s *recordingSink) Summary(name string, help string, labels map[string]string, quantiles map[float64]float64, count uint64,
+	sum float64) {
+	s.help[name] = help
+	s.summaries[name+labels["group"]] = quantiles
+	s.counters[name+"_sum"+labels["group"]] = sum
+	s.counters[name+"_count"+labels["group"]] = float64(count)
+}
+
+func (s *recordingSink) Flush(ctx context.Context) error { return nil }
+
+func TestForward(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	lag := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "group_lag", Help: "Lag of the group"}, []string{"group"})
+	commits := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "offset_commits_total"}, []string{"group"})
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "collect_duration_seconds", Buckets: []float64{1, 2}})
+	latency := prometheus.NewSummary(prometheus.SummaryOpts{Name: "request_latency_seconds", Objectives: map[float64]float64{0.5: 0.05}})
+	registry.MustRegister(lag, commits, duration, latency)
+	lag.WithLabelValues("sample-group").Set(42)
+	commits.WithLabelValues("sample-group").Add(3)
+	duration.Observe(0.5)
+	duration.Observe(1.5)
+	latency.Observe(0.25)
+
+	sink := newRecordingSink()
+	err := Forward(registry, sink)
+	if err != nil {
+		t.Fatalf("Failed to forward metrics: %v", err)
+	}
+
+	expectedGauges := map[string]float64{"group_lagsample-group": 42}
+	if !reflect.DeepEqual(sink.gauges, expectedGauges) {
+		t.Errorf("Expected gauges %v, Got: %v", expectedGauges, sink.gauges)
+	}
+	expectedCounters := map[string]float64{
+		"offset_commits_totalsample-group": 3,
+		"collect_duration_seconds_sum":     2,
+		"collect_duration_seconds_count":   2,
+		"request_latency_seconds_sum":      0.25,
+		"request_latency_seconds_count":    1,
+	}
+	if !reflect.DeepEqual(sink.counters, expectedCounters) {
+		t.Errorf("Expected counters %v, Got: %v", expectedCounters, sink.counters)
+	}
+	expectedBuckets := map[float64]uint64{1: 1, 2: 2}
+	if !reflect.DeepEqual(sink.histograms["collect_duration_seconds"], expectedBuckets) {
+		t.Errorf("Expected histogram buckets %v, Got: %v", expectedBuckets, sink.histograms["collect_duration_seconds"])
+	}
+	expectedQuantiles := map[float64]float64{0.5: 0.25}
+	if !reflect.DeepEqual(sink.summaries["request_latency_seconds"], expectedQuantiles) {
+		t.Errorf("Expected summary quantiles %v, Got: %v", expectedQuantiles, sink.summaries["request_latency_seconds"])
+	}
+	if sink.help["group_lag"] != "Lag of the group" {
+		t.Errorf("Expected the help of group_lag to be forwarded, Got: %q", sink.help["group_lag"])
+	}
+}
+
+func TestForwardPartiallyGatheredMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	lag := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "group_lag"}, []string{"group"})
+	registry.MustRegister(lag)
+	lag.WithLabelValues("sample-group").Set(42)
+	failing := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, errors.New("inconsistent collector")
+	})
+
+	sink := newRecordingSink()
+	err := Forward(prometheus.Gatherers{registry, failing}, sink)
+	if err == nil {
+		t.Errorf("Expected the gather error to be returned")
+	}
+	expectedGauges := map[string]float64{"group_lagsample-group": 42}
+	if !reflect.DeepEqual(sink.gauges, expectedGauges) {
+		t.Errorf("Expected the gathered gauges %v, Got: %v", expectedGauges, sink.gauges)
+	}
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"sync"
+)
+
+// stringInterner deduplicates group and topic names. Each decoded record of the offsets topic allocates its own
+// copy of the names, while thousands of stored offsets refer to the same group and topic names.
+type stringInterner struct {
+	lock    sync.Mutex
+	strings map[string]string
+}
+
+func newStringInterner() *stringInterner {
+	return &stringInterner{
+		strings: make(map[string]string),
+	}
+}
+
+// Intern returns the previously interned string which equals s, or stores s if there is none
+func (i *stringInterner) Intern(s string) string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if interned, exists := i.strings[s]; exists {
+		return interned
+	}
+	i.strings[s] = s
+	return s
+}
+
+// Forget removes s from the interned strings, e. g. once a consumer group has been deleted
+func (i *stringInterner) Forget(s string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	delete(i.strings, s)
+}
@@ -1,11 +1,18 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"github.com/google-cloud-tools/kafka-minion/kafka"
+	"github.com/google-cloud-tools/kafka-minion/options"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"math"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 // PartitionWaterMarks represents a map of PartitionWaterMarks grouped by PartitionID
@@ -14,7 +21,8 @@ type PartitionWaterMarks = map[int32]kafka.PartitionWaterMark
 // MemoryStorage stores the latest committed offsets for each group, topic, partition combination and offers an interface
 // to access these information
 type MemoryStorage struct {
-	logger *log.Entry
+	logger  *log.Entry
+	options *options.Options
 
 	// Channels for receiving storage requests
 	consumerOffsetCh <-chan *kafka.StorageRequest
@@ -24,6 +32,17 @@ type MemoryStorage struct {
 	groups     *consumerGroup
 	partitions *partition
 	topics     *topic
+
+	// names interns the group and topic names of the stored offsets
+	names *stringInterner
+
+	commitInterval  *prometheus.HistogramVec
+	offsetRollbacks *prometheus.CounterVec
+	groupRebalances *prometheus.CounterVec
+	offsetCommits   *prometheus.CounterVec
+	metadataRecords *prometheus.CounterVec
+	groupDiscovery  prometheus.Counter
+	queueLength     prometheus.GaugeFunc
 }
 
 // consumerStatus holds information about the partition consumers consuming the __consumer_offsets topic
@@ -31,6 +50,7 @@ type consumerStatus struct {
 	Lock                       sync.RWMutex
 	NotReadyPartitionConsumers int
 	OffsetTopicConsumed        bool
+	ConsumedOffsets            map[int32]int64
 }
 
 // consumerGroup contains all consumer group data such as offsets or metadata
@@ -40,6 +60,15 @@ type consumerGroup struct {
 
 	MetadataLock sync.RWMutex
 	Metadata     map[string]kafka.ConsumerGroupMetadata
+
+	// LastSeen contains the latest commit time of each consumer group, so that inactive groups can be removed
+	LastSeenLock sync.RWMutex
+	LastSeen     map[string]time.Time
+
+	// Known contains all groups which have been seen with a commit or metadata record since they were added
+	// to the storage, so that the first sight of a new group can be reported
+	KnownLock sync.Mutex
+	Known     map[string]bool
 }
 
 type partition struct {
@@ -48,8 +77,19 @@ type partition struct {
 
 	HighWaterMarksLock sync.RWMutex
 	HighWaterMarks     map[string]PartitionWaterMarks
+	// HighWaterMarkHistory contains the first observation of the most recent high water marks of each partition.
+	// It's protected by the HighWaterMarksLock.
+	HighWaterMarkHistory map[string]map[int32][]kafka.PartitionWaterMark
 }
 
+// maxHighWaterMarkHistory is the number of distinct high water marks which are remembered per partition, in order to
+// estimate when a committed offset has been produced
+const maxHighWaterMarkHistory = 120
+
+// MaxCommitMetadataLength is the max number of bytes of the commit metadata which is stored per partition. Kafka
+// accepts up to 4KB (offset.metadata.max.bytes) by default, which would multiply the memory usage per partition.
+const MaxCommitMetadataLength = 256
+
 type topic struct {
 	ConfigsLock sync.RWMutex
 	Configs     map[string]kafka.TopicConfiguration
@@ -62,25 +102,34 @@ type ConsumerPartitionOffsetMetric struct {
 	Topic            string
 	Partition        int32
 	Offset           int64
+	LeaderEpoch      int32 // -1 if the commit didn't contain the leader epoch
 	Timestamp        int64
 	TotalCommitCount float64
+	Metadata         string // Opaque string which has been committed along with the offset, see MaxCommitMetadataLength
+
+	// LastAppliedInternalPosition is the position of the commit's record in the offsets topic
+	LastAppliedInternalPosition kafka.InternalPosition
 }
 
 // NewMemoryStorage creates a new storage and preinitializes the required maps which store the PartitionOffset information
-func NewMemoryStorage(consumerOffsetCh <-chan *kafka.StorageRequest, clusterCh <-chan *kafka.StorageRequest) *MemoryStorage {
+func NewMemoryStorage(opts *options.Options, consumerOffsetCh <-chan *kafka.StorageRequest, clusterCh <-chan *kafka.StorageRequest) *MemoryStorage {
 	groups := &consumerGroup{
 		Offsets:  make(map[string]ConsumerPartitionOffsetMetric),
 		Metadata: make(map[string]kafka.ConsumerGroupMetadata),
+		LastSeen: make(map[string]time.Time),
+		Known:    make(map[string]bool),
 	}
 
 	status := &consumerStatus{
 		NotReadyPartitionConsumers: math.MaxInt32,
 		OffsetTopicConsumed:        false,
+		ConsumedOffsets:            make(map[int32]int64),
 	}
 
 	partitions := &partition{
-		LowWaterMarks:  make(map[string]PartitionWaterMarks),
-		HighWaterMarks: make(map[string]PartitionWaterMarks),
+		LowWaterMarks:        make(map[string]PartitionWaterMarks),
+		HighWaterMarks:       make(map[string]PartitionWaterMarks),
+		HighWaterMarkHistory: make(map[string]map[int32][]kafka.PartitionWaterMark),
 	}
 
 	topics := &topic{
@@ -91,6 +140,7 @@ func NewMemoryStorage(consumerOffsetCh <-chan *kafka.StorageRequest, clusterCh <
 		logger: log.WithFields(log.Fields{
 			"module": "storage",
 		}),
+		options: opts,
 
 		consumerOffsetCh: consumerOffsetCh,
 		clusterCh:        clusterCh,
@@ -99,15 +149,28 @@ func NewMemoryStorage(consumerOffsetCh <-chan *kafka.StorageRequest, clusterCh <
 		groups:     groups,
 		partitions: partitions,
 		topics:     topics,
+		names:      newStringInterner(),
+
+		commitInterval:  newCommitIntervalHistogram(opts.MetricsPrefix),
+		offsetRollbacks: newOffsetRollbackCounter(opts.MetricsPrefix),
+		groupRebalances: newGroupRebalanceCounter(opts.MetricsPrefix),
+		offsetCommits:   newOffsetCommitCounter(opts.MetricsPrefix),
+		metadataRecords: newGroupMetadataRecordCounter(opts.MetricsPrefix),
+		groupDiscovery:  newGroupDiscoveryCounter(opts.MetricsPrefix),
+		queueLength:     newQueueLengthGauge(opts.MetricsPrefix, consumerOffsetCh),
 	}
 }
 
 // Start starts listening for incoming offset entries on the input channel so that they can be stored
-func (module *MemoryStorage) Start() {
+func (module *MemoryStorage) Start(ctx context.Context) {
 	go module.consumerOffsetWorker()
 	go module.clusterWorker()
+	go module.snapshotWorker(ctx)
 }
 
+// consumerOffsetWorker applies all requests of the offset consumer in the order they have been sent. There must be
+// only one worker, because the commits of a group are consumed from a single offsets topic partition and a newer
+// commit must never be overwritten by an older one which has been processed concurrently.
 func (module *MemoryStorage) consumerOffsetWorker() {
 	for request := range module.consumerOffsetCh {
 		switch request.RequestType {
@@ -116,11 +179,19 @@ func (module *MemoryStorage) consumerOffsetWorker() {
 		case kafka.StorageAddGroupMetadata:
 			module.storeGroupMetadata(request.GroupMetadata)
 		case kafka.StorageDeleteConsumerGroup:
-			module.deleteOffsetEntry(request.ConsumerGroupName, request.TopicName, request.PartitionID)
+			module.deleteOffsetEntry(request.ConsumerGroupName, request.TopicName, request.PartitionID, request.InternalPosition)
+		case kafka.StorageDeleteGroupMetadata:
+			module.deleteGroupMetadata(request.ConsumerGroupName, request.InternalPosition)
 		case kafka.StorageRegisterOffsetPartitions:
 			module.registerOffsetPartitions(request.PartitionCount)
 		case kafka.StorageMarkOffsetPartitionReady:
 			module.markOffsetPartitionReady(request.PartitionID)
+		case kafka.StorageMarkOffsetPartitionConsumed:
+			module.markOffsetPartitionConsumed(request.PartitionID, request.Offset)
+		case kafka.StorageDeleteFilteredGroups:
+			module.deleteFilteredGroups(request.Filter)
+		case kafka.StorageDeleteExpiredGroups:
+			module.deleteExpiredGroups(time.Now())
 
 		default:
 			log.WithFields(log.Fields{
@@ -141,6 +212,8 @@ func (module *MemoryStorage) clusterWorker() {
 			module.storePartitionHighWaterMark(request.PartitionWaterMark)
 		case kafka.StorageAddTopicConfiguration:
 			module.storeTopicConfig(request.TopicConfig)
+		case kafka.StorageUpdateTopicPartitionCount:
+			module.updateTopicPartitionCount(request.TopicName, request.PartitionCount)
 		case kafka.StorageDeleteTopic:
 			module.deleteTopic(request.TopicName)
 
@@ -154,6 +227,118 @@ func (module *MemoryStorage) clusterWorker() {
 	log.Panic("Partition Offset storage channel closed")
 }
 
+// deleteExpiredGroups removes all consumer groups which haven't committed an offset within the configured group
+// expiry. It must be called by the consumer offset worker, otherwise it could delete a group right after a newer
+// commit of it has been applied.
+func (module *MemoryStorage) deleteExpiredGroups(now time.Time) {
+	expiredGroups := make(map[string]time.Time)
+	module.groups.LastSeenLock.RLock()
+	for group, lastSeen := range module.groups.LastSeen {
+		if now.Sub(lastSeen) > module.options.StorageGroupExpiry {
+			expiredGroups[group] = lastSeen
+		}
+	}
+	module.groups.LastSeenLock.RUnlock()
+
+	for group, lastSeen := range expiredGroups {
+		module.logger.WithFields(log.Fields{
+			"group":     group,
+			"last_seen": lastSeen,
+		}).Info("consumer group has not committed offsets within the group expiry, deleting it from storage")
+		module.DeleteGroup(group)
+	}
+}
+
+// deleteFilteredGroups removes all consumer groups which are not allowed by the filter (anymore), e. g. because
+// they have been removed from the group file. It must be called by the consumer offset worker, otherwise queued
+// requests of a removed group would add it again.
+func (module *MemoryStorage) deleteFilteredGroups(filter *kafka.Filter) {
+	filteredGroups := make(map[string]bool)
+	module.groups.OffsetsLock.RLock()
+	for _, offset := range module.groups.Offsets {
+		if !filter.IsGroupAllowed(offset.Group) {
+			filteredGroups[offset.Group] = true
+		}
+	}
+	module.groups.OffsetsLock.RUnlock()
+	module.groups.MetadataLock.RLock()
+	for group := range module.groups.Metadata {
+		if !filter.IsGroupAllowed(group) {
+			filteredGroups[group] = true
+		}
+	}
+	module.groups.MetadataLock.RUnlock()
+
+	for group := range filteredGroups {
+		module.logger.WithFields(log.Fields{
+			"group": group,
+		}).Info("consumer group is not allowed by the filter anymore, deleting it from storage")
+		module.DeleteGroup(group)
+	}
+}
+
+// MarkGroupSeen remembers the given time as last activity of a consumer group, unless a more recent
+// activity is already known
+func (module *MemoryStorage) MarkGroupSeen(group string, seen time.Time) {
+	module.groups.LastSeenLock.Lock()
+	defer module.groups.LastSeenLock.Unlock()
+
+	if lastSeen, exists := module.groups.LastSeen[group]; !exists || seen.After(lastSeen) {
+		module.groups.LastSeen[group] = seen
+	}
+}
+
+// markGroupKnown remembers the group and reports it as discovered if it hasn't been known before. Groups which
+// show up while the offsets topic hasn't been consumed yet existed before kafka minion started, hence they are
+// remembered, but not reported.
+func (module *MemoryStorage) markGroupKnown(group string) {
+	module.groups.KnownLock.Lock()
+	if module.groups.Known[group] {
+		module.groups.KnownLock.Unlock()
+		return
+	}
+	module.groups.Known[group] = true
+	module.groups.KnownLock.Unlock()
+
+	if !module.IsConsumed() {
+		return
+	}
+	module.groupDiscovery.Inc()
+	module.logger.WithFields(log.Fields{
+		"group": group,
+	}).Info("discovered new consumer group")
+}
+
+// DeleteGroup removes all offsets and metadata of a consumer group. Both are removed while holding both locks, so
+// that a concurrent Groups call either returns the complete group or nothing of it.
+func (module *MemoryStorage) DeleteGroup(group string) {
+	module.groups.OffsetsLock.Lock()
+	module.groups.MetadataLock.Lock()
+	for key, offset := range module.groups.Offsets {
+		if offset.Group == group {
+			delete(module.groups.Offsets, key)
+			module.offsetRollbacks.DeleteLabelValues(group, offset.Topic, strconv.Itoa(int(offset.Partition)))
+		}
+	}
+	delete(module.groups.Metadata, group)
+	module.groups.MetadataLock.Unlock()
+	module.groups.OffsetsLock.Unlock()
+	module.groupRebalances.DeleteLabelValues(group)
+	module.offsetCommits.DeleteLabelValues(group)
+	module.metadataRecords.DeleteLabelValues(group)
+
+	module.groups.LastSeenLock.Lock()
+	delete(module.groups.LastSeen, group)
+	module.groups.LastSeenLock.Unlock()
+	module.groups.KnownLock.Lock()
+	delete(module.groups.Known, group)
+	module.groups.KnownLock.Unlock()
+	module.names.Forget(group)
+
+	// The deleted offsets were the baseline for the commit intervals, a returning group starts from scratch
+	module.commitInterval.DeleteLabelValues(group)
+}
+
 func (module *MemoryStorage) deleteTopic(topicName string) {
 	module.topics.ConfigsLock.Lock()
 	module.partitions.LowWaterMarksLock.Lock()
@@ -164,6 +349,7 @@ func (module *MemoryStorage) deleteTopic(topicName string) {
 
 	delete(module.partitions.LowWaterMarks, topicName)
 	delete(module.partitions.HighWaterMarks, topicName)
+	delete(module.partitions.HighWaterMarkHistory, topicName)
 	delete(module.topics.Configs, topicName)
 }
 
@@ -177,6 +363,50 @@ func (module *MemoryStorage) storePartitionHighWaterMark(offset *kafka.Partition
 	}
 
 	module.partitions.HighWaterMarks[offset.TopicName][offset.PartitionID] = *offset
+
+	// Only the first time a high water mark has been observed is relevant to estimate when messages were produced
+	if _, exists := module.partitions.HighWaterMarkHistory[offset.TopicName]; !exists {
+		module.partitions.HighWaterMarkHistory[offset.TopicName] = make(map[int32][]kafka.PartitionWaterMark)
+	}
+	history := module.partitions.HighWaterMarkHistory[offset.TopicName][offset.PartitionID]
+	if len(history) > 0 && history[len(history)-1].WaterMark == offset.WaterMark {
+		return
+	}
+	history = append(history, *offset)
+	if len(history) > maxHighWaterMarkHistory {
+		history = history[len(history)-maxHighWaterMarkHistory:]
+	}
+	module.partitions.HighWaterMarkHistory[offset.TopicName][offset.PartitionID] = history
+}
+
+// OffsetProduceTime estimates when the message at the given offset has been produced, by interpolating between the
+// two remembered high water marks around the offset. If the offset is older than all remembered high water marks,
+// the oldest observation is returned as upper bound. It returns the zero time if no high water marks are known for
+// the partition or if the offset hasn't been produced yet.
+func (module *MemoryStorage) OffsetProduceTime(topicName string, partitionID int32, offset int64) time.Time {
+	module.partitions.HighWaterMarksLock.RLock()
+	defer module.partitions.HighWaterMarksLock.RUnlock()
+
+	history := module.partitions.HighWaterMarkHistory[topicName][partitionID]
+	// The message at offset is produced once the high water mark is greater than offset
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].WaterMark > offset
+	})
+	if i == len(history) {
+		return time.Time{}
+	}
+	if i == 0 {
+		return millisToTime(history[0].Timestamp)
+	}
+
+	previous, next := history[i-1], history[i]
+	ratio := float64(offset-previous.WaterMark+1) / float64(next.WaterMark-previous.WaterMark)
+	millis := previous.Timestamp + int64(ratio*float64(next.Timestamp-previous.Timestamp))
+	return millisToTime(millis)
+}
+
+func millisToTime(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond))
 }
 
 func (module *MemoryStorage) storePartitionLowWaterMark(offset *kafka.PartitionWaterMark) {
@@ -192,10 +422,51 @@ func (module *MemoryStorage) storePartitionLowWaterMark(offset *kafka.PartitionW
 }
 
 func (module *MemoryStorage) storeGroupMetadata(metadata *kafka.ConsumerGroupMetadata) {
+	module.markGroupKnown(metadata.Group)
+
 	module.groups.MetadataLock.Lock()
 	defer module.groups.MetadataLock.Unlock()
 
+	if previous, exists := module.groups.Metadata[metadata.Group]; exists {
+		// Like commits, a record which is older than the stored one (e. g. consumed again after a snapshot restore)
+		// must not replace it, even if it belongs to the same generation
+		if metadata.InternalPosition.IsBefore(previous.InternalPosition) {
+			module.logger.WithFields(log.Fields{
+				"group":             metadata.Group,
+				"internal_position": metadata.InternalPosition,
+			}).Debug("discarded group metadata which is older than the last applied one")
+			return
+		}
+		// Each record contains the complete member set of a generation, an older generation must not replace it
+		if metadata.Header.Generation < previous.Header.Generation {
+			module.logger.WithFields(log.Fields{
+				"group":               metadata.Group,
+				"generation":          metadata.Header.Generation,
+				"previous_generation": previous.Header.Generation,
+			}).Debug("discarded group metadata of an older generation")
+			return
+		}
+		// The first known generation of a group is not counted, as it might be the result of any number of rebalances
+		if metadata.Header.Generation > previous.Header.Generation {
+			module.groupRebalances.WithLabelValues(metadata.Group).Inc()
+		}
+	}
 	module.groups.Metadata[metadata.Group] = *metadata
+	module.metadataRecords.WithLabelValues(metadata.Group).Inc()
+}
+
+func (module *MemoryStorage) deleteGroupMetadata(group string, position kafka.InternalPosition) {
+	module.groups.MetadataLock.Lock()
+	defer module.groups.MetadataLock.Unlock()
+
+	// A tombstone which is older than the stored metadata is outdated
+	if metadata, exists := module.groups.Metadata[group]; exists && position.IsBefore(metadata.InternalPosition) {
+		return
+	}
+
+	delete(module.groups.Metadata, group)
+	module.groupRebalances.DeleteLabelValues(group)
+	module.metadataRecords.DeleteLabelValues(group)
 }
 
 func (module *MemoryStorage) storeTopicConfig(config *kafka.TopicConfiguration) {
@@ -205,18 +476,45 @@ func (module *MemoryStorage) storeTopicConfig(config *kafka.TopicConfiguration)
 	module.topics.Configs[config.TopicName] = *config
 }
 
+// updateTopicPartitionCount updates the partition count of a known topic configuration. Topics whose configuration
+// is unknown yet are skipped, they would be exposed without their cleanup policy otherwise.
+func (module *MemoryStorage) updateTopicPartitionCount(topicName string, partitionCount int) {
+	module.topics.ConfigsLock.Lock()
+	defer module.topics.ConfigsLock.Unlock()
+
+	config, exists := module.topics.Configs[topicName]
+	if !exists {
+		return
+	}
+	config.PartitionCount = partitionCount
+	module.topics.Configs[topicName] = config
+}
+
 func (module *MemoryStorage) registerOffsetPartitions(partitionCount int) {
 	module.status.Lock.Lock()
 	defer module.status.Lock.Unlock()
 
+	if module.status.OffsetTopicConsumed {
+		// Partitions which are added later on don't affect the readiness anymore
+		module.logger.Infof("Registered %v additional __consumer_offsets partitions", partitionCount)
+		return
+	}
+
 	module.logger.Infof("Registered %v __consumer_offsets partitions which have to be consumed before metrics can be exposed", partitionCount)
-	module.status.NotReadyPartitionConsumers = partitionCount
+	if module.status.NotReadyPartitionConsumers == math.MaxInt32 {
+		module.status.NotReadyPartitionConsumers = partitionCount
+	} else {
+		module.status.NotReadyPartitionConsumers += partitionCount
+	}
 }
 
 func (module *MemoryStorage) markOffsetPartitionReady(partitionID int32) {
 	module.status.Lock.Lock()
 	defer module.status.Lock.Unlock()
 
+	if module.status.OffsetTopicConsumed {
+		return
+	}
 	module.status.NotReadyPartitionConsumers--
 	if module.status.NotReadyPartitionConsumers == 0 {
 		module.logger.Info("Offset topic has been consumed")
@@ -224,31 +522,80 @@ func (module *MemoryStorage) markOffsetPartitionReady(partitionID int32) {
 	}
 }
 
+func (module *MemoryStorage) markOffsetPartitionConsumed(partitionID int32, offset int64) {
+	module.status.Lock.Lock()
+	defer module.status.Lock.Unlock()
+
+	module.status.ConsumedOffsets[partitionID] = offset
+}
+
 func (module *MemoryStorage) storeOffsetEntry(offset *kafka.ConsumerPartitionOffset) {
+	module.markGroupKnown(offset.Group)
+	module.MarkGroupSeen(offset.Group, offset.CommitTime())
+
 	module.groups.OffsetsLock.Lock()
 	defer module.groups.OffsetsLock.Unlock()
 
 	key := fmt.Sprintf("%v:%v:%v", offset.Group, offset.Topic, offset.Partition)
 	var commitCount float64
 	if entry, exists := module.groups.Offsets[key]; exists {
+		// Newer records of a key win, the order is decided by the position in the offsets topic rather than the commit
+		// timestamp. Otherwise records which are consumed again after a snapshot restore could replace newer ones.
+		if offset.InternalPosition.IsBefore(entry.LastAppliedInternalPosition) {
+			module.logger.WithFields(log.Fields{
+				"group":             offset.Group,
+				"topic":             offset.Topic,
+				"partition":         offset.Partition,
+				"internal_position": offset.InternalPosition,
+			}).Debug("discarded offset commit which is older than the last applied one")
+			return
+		}
 		commitCount = entry.TotalCommitCount
+
+		if offset.Offset < entry.Offset {
+			// Still store the lower offset, so that the lag reflects where the group will continue to consume
+			module.offsetRollbacks.WithLabelValues(offset.Group, offset.Topic, strconv.Itoa(int(offset.Partition))).Inc()
+			module.logger.WithFields(log.Fields{
+				"group":           offset.Group,
+				"topic":           offset.Topic,
+				"partition":       offset.Partition,
+				"offset":          offset.Offset,
+				"previous_offset": entry.Offset,
+			}).Warn("consumer group committed an offset lower than its previous commit")
+		}
+
+		// Commits may arrive out of order (e. g. after a coordinator change), these intervals are not meaningful
+		interval := offset.Timestamp - entry.Timestamp
+		if interval >= 0 {
+			module.commitInterval.WithLabelValues(offset.Group).Observe(float64(interval) / 1000)
+		}
 	}
 	commitCount++
+	module.offsetCommits.WithLabelValues(offset.Group).Inc()
 	module.groups.Offsets[key] = ConsumerPartitionOffsetMetric{
-		Group:            offset.Group,
-		Topic:            offset.Topic,
+		Group:            module.names.Intern(offset.Group),
+		Topic:            module.names.Intern(offset.Topic),
 		Partition:        offset.Partition,
 		Offset:           offset.Offset,
+		LeaderEpoch:      offset.LeaderEpoch,
 		Timestamp:        offset.Timestamp,
 		TotalCommitCount: commitCount,
+		Metadata:         truncateMetadata(offset.Metadata),
+
+		LastAppliedInternalPosition: offset.InternalPosition,
 	}
 }
 
-func (module *MemoryStorage) deleteOffsetEntry(consumerGroupName string, topicName string, partitionID int32) {
+func (module *MemoryStorage) deleteOffsetEntry(consumerGroupName string, topicName string, partitionID int32,
+	position kafka.InternalPosition) {
 	key := fmt.Sprintf("%v:%v:%v", consumerGroupName, topicName, partitionID)
 	module.groups.OffsetsLock.Lock()
 	defer module.groups.OffsetsLock.Unlock()
 
+	// A tombstone which is older than the stored commit (e. g. consumed again after a snapshot restore) is outdated
+	if entry, exists := module.groups.Offsets[key]; exists && position.IsBefore(entry.LastAppliedInternalPosition) {
+		return
+	}
 	delete(module.groups.Offsets, key)
 }
 
@@ -266,6 +613,41 @@ func (module *MemoryStorage) ConsumerOffsets() map[string]ConsumerPartitionOffse
 	return mapCopy
 }
 
+// Groups returns copies of the currently known consumer group offsets and group metadata. Both are copied while
+// holding both locks, so that they are consistent with each other even if groups are deleted concurrently.
+func (module *MemoryStorage) Groups() (map[string]ConsumerPartitionOffsetMetric, map[string]kafka.ConsumerGroupMetadata) {
+	module.groups.OffsetsLock.RLock()
+	defer module.groups.OffsetsLock.RUnlock()
+	module.groups.MetadataLock.RLock()
+	defer module.groups.MetadataLock.RUnlock()
+
+	offsetsCopy := make(map[string]ConsumerPartitionOffsetMetric, len(module.groups.Offsets))
+	for key, value := range module.groups.Offsets {
+		offsetsCopy[key] = value
+	}
+	metadataCopy := make(map[string]kafka.ConsumerGroupMetadata, len(module.groups.Metadata))
+	for key, value := range module.groups.Metadata {
+		metadataCopy[key] = value
+	}
+
+	return offsetsCopy, metadataCopy
+}
+
+// GroupOffsets returns a copy of the currently known offsets of a single consumer group
+func (module *MemoryStorage) GroupOffsets(group string) map[string]ConsumerPartitionOffsetMetric {
+	module.groups.OffsetsLock.RLock()
+	defer module.groups.OffsetsLock.RUnlock()
+
+	mapCopy := make(map[string]ConsumerPartitionOffsetMetric)
+	for key, value := range module.groups.Offsets {
+		if value.Group == group {
+			mapCopy[key] = value
+		}
+	}
+
+	return mapCopy
+}
+
 // GroupMetadata returns a copy of the currently known group metadata
 func (module *MemoryStorage) GroupMetadata() map[string]kafka.ConsumerGroupMetadata {
 	module.groups.MetadataLock.RLock()
@@ -327,6 +709,19 @@ func (module *MemoryStorage) PartitionLowWaterMarks() map[string]PartitionWaterM
 	return mapCopy
 }
 
+// ConsumedOffsets returns a copy of the last consumed offsets of the consumer offsets topic by partition ID
+func (module *MemoryStorage) ConsumedOffsets() map[int32]int64 {
+	module.status.Lock.RLock()
+	defer module.status.Lock.RUnlock()
+
+	mapCopy := make(map[int32]int64)
+	for key, value := range module.status.ConsumedOffsets {
+		mapCopy[key] = value
+	}
+
+	return mapCopy
+}
+
 // IsConsumed indicates whether the consumer offsets topic lag has been caught up and therefore
 // the metrics reported by this module are accurate or not
 func (module *MemoryStorage) IsConsumed() bool {
@@ -335,3 +730,17 @@ func (module *MemoryStorage) IsConsumed() bool {
 
 	return module.status.OffsetTopicConsumed
 }
+
+// truncateMetadata shortens the commit metadata to at most MaxCommitMetadataLength bytes and marks it as truncated
+// with a trailing "...". It cuts at a rune boundary, so that multi-byte UTF-8 characters are not split. The truncated
+// string is a copy, hence it doesn't keep the decoded record in memory.
+func truncateMetadata(metadata string) string {
+	maxLength := MaxCommitMetadataLength
+	if len(metadata) <= maxLength {
+		return metadata
+	}
+	for maxLength > 0 && !utf8.RuneStart(metadata[maxLength]) {
+		maxLength--
+	}
+	return metadata[:maxLength] + "..."
+}
@@ -0,0 +1,617 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/google-cloud-tools/kafka-minion/kafka"
+	"github.com/google-cloud-tools/kafka-minion/options"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func newTestStorage() *MemoryStorage {
+	opts := options.NewOptions()
+	opts.StorageGroupExpiry = 7 * 24 * time.Hour
+	return NewMemoryStorage(opts, make(chan *kafka.StorageRequest), make(chan *kafka.StorageRequest))
+}
+
+func TestStoreOffsetEntryConcurrently(t *testing.T) {
+	module := newTestStorage()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		group := fmt.Sprintf("sample-group-%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for offset := int64(1); offset <= 500; offset++ {
+				module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+					Group:     group,
+					Topic:     "important-topic",
+					Partition: int32(offset % 4),
+					Offset:    offset,
+				})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				module.ConsumerOffsets()
+				module.GroupOffsets(group)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i++ {
+		group := fmt.Sprintf("sample-group-%d", i)
+		offsets := module.GroupOffsets(group)
+		if len(offsets) != 4 {
+			t.Fatalf("Expected 4 partition offsets for group %v, Got: %v", group, len(offsets))
+		}
+		var commitCount float64
+		for _, offset := range offsets {
+			if offset.Group != group {
+				t.Errorf("Expected only offsets of group %v, Got: %v", group, offset.Group)
+			}
+			commitCount += offset.TotalCommitCount
+		}
+		if commitCount != 500 {
+			t.Errorf("Expected 500 commits for group %v, Got: %v", group, commitCount)
+		}
+		if offset := offsets[fmt.Sprintf("%v:important-topic:0", group)].Offset; offset != 500 {
+			t.Errorf("Expected latest offset 500 for group %v, Got: %v", group, offset)
+		}
+	}
+}
+
+func TestDeleteExpiredGroups(t *testing.T) {
+	module := newTestStorage()
+	now := time.Now()
+
+	module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+		Group:     "active-group",
+		Topic:     "important-topic",
+		Offset:    1156,
+		Timestamp: now.Add(-time.Hour).UnixNano() / int64(time.Millisecond),
+	})
+	module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+		Group:     "inactive-group",
+		Topic:     "important-topic",
+		Offset:    936,
+		Timestamp: now.Add(-8*24*time.Hour).UnixNano() / int64(time.Millisecond),
+	})
+	module.storeGroupMetadata(&kafka.ConsumerGroupMetadata{Group: "inactive-group"})
+
+	module.deleteExpiredGroups(now)
+
+	if len(module.GroupOffsets("active-group")) != 1 {
+		t.Errorf("Expected active group to be kept")
+	}
+	if len(module.GroupOffsets("inactive-group")) != 0 {
+		t.Errorf("Expected offsets of inactive group to be deleted")
+	}
+	if _, exists := module.GroupMetadata()["inactive-group"]; exists {
+		t.Errorf("Expected metadata of inactive group to be deleted")
+	}
+}
+
+func TestDeleteExpiredGroupsAfterQueuedCommits(t *testing.T) {
+	opts := options.NewOptions()
+	opts.StorageGroupExpiry = 7 * 24 * time.Hour
+	consumerOffsetCh := make(chan *kafka.StorageRequest)
+	module := NewMemoryStorage(opts, consumerOffsetCh, make(chan *kafka.StorageRequest))
+	now := time.Now()
+	module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+		Group:     "returning-group",
+		Topic:     "important-topic",
+		Offset:    936,
+		Timestamp: now.Add(-8*24*time.Hour).UnixNano() / int64(time.Millisecond),
+	})
+
+	go module.consumerOffsetWorker()
+
+	// The group commits again before the expiry is requested, the commit is applied first
+	consumerOffsetCh <- &kafka.StorageRequest{
+		RequestType: kafka.StorageAddConsumerOffset,
+		ConsumerOffset: &kafka.ConsumerPartitionOffset{
+			Group:     "returning-group",
+			Topic:     "important-topic",
+			Offset:    1156,
+			Timestamp: now.UnixNano() / int64(time.Millisecond),
+		},
+	}
+	consumerOffsetCh <- &kafka.StorageRequest{RequestType: kafka.StorageDeleteExpiredGroups}
+	// The worker has applied all previous requests, once it received another one from the unbuffered channel
+	consumerOffsetCh <- &kafka.StorageRequest{RequestType: kafka.StorageMarkOffsetPartitionConsumed, PartitionID: 0}
+
+	offsets := module.GroupOffsets("returning-group")
+	if len(offsets) != 1 {
+		t.Fatalf("Expected the group which committed again to be kept, Got: %v offsets", len(offsets))
+	}
+}
+
+func TestDeleteFilteredGroups(t *testing.T) {
+	module := newTestStorage()
+	module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{Group: "sample-group", Topic: "important-topic", Offset: 1156})
+	module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{Group: "console-consumer-40098", Topic: "important-topic", Offset: 936})
+	module.storeGroupMetadata(&kafka.ConsumerGroupMetadata{Group: "console-consumer-40098"})
+	module.storeGroupMetadata(&kafka.ConsumerGroupMetadata{Group: "metadata-only-group"})
+
+	opts := options.NewOptions()
+	opts.FilterGroupAllowlist = []string{"sample-group"}
+	filter, err := kafka.NewFilter(opts)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+	module.deleteFilteredGroups(filter)
+
+	if len(module.GroupOffsets("sample-group")) != 1 {
+		t.Errorf("Expected allowed group to be kept")
+	}
+	if len(module.GroupOffsets("console-consumer-40098")) != 0 {
+		t.Errorf("Expected offsets of filtered group to be deleted")
+	}
+	if len(module.GroupMetadata()) != 0 {
+		t.Errorf("Expected metadata of filtered groups to be deleted, got: %v", module.GroupMetadata())
+	}
+}
+
+func TestGroupDiscovery(t *testing.T) {
+	module := newTestStorage()
+
+	// Groups which are consumed before the offsets topic has been consumed existed before
+	module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{Group: "existing-group", Topic: "important-topic", Offset: 10})
+	module.registerOffsetPartitions(1)
+	module.markOffsetPartitionReady(0)
+	if discovered := testutil.ToFloat64(module.groupDiscovery); discovered != 0 {
+		t.Fatalf("Expected no discovered groups while consuming the offsets topic, Got: %v", discovered)
+	}
+
+	// The same new group is stored concurrently with commits and metadata, but must be discovered only once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		partition := int32(i)
+		go func() {
+			defer wg.Done()
+			module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{Group: "new-group", Topic: "important-topic", Partition: partition, Offset: 10})
+		}()
+		go func() {
+			defer wg.Done()
+			module.storeGroupMetadata(&kafka.ConsumerGroupMetadata{Group: "new-group"})
+		}()
+	}
+	wg.Wait()
+	module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{Group: "existing-group", Topic: "important-topic", Offset: 20})
+	if discovered := testutil.ToFloat64(module.groupDiscovery); discovered != 1 {
+		t.Errorf("Expected exactly one discovered group, Got: %v", discovered)
+	}
+
+	// A deleted group which shows up again is discovered again
+	module.DeleteGroup("new-group")
+	module.storeGroupMetadata(&kafka.ConsumerGroupMetadata{Group: "new-group"})
+	if discovered := testutil.ToFloat64(module.groupDiscovery); discovered != 2 {
+		t.Errorf("Expected a deleted group to be discovered again, Got: %v", discovered)
+	}
+}
+
+func TestRegisterAdditionalOffsetPartitions(t *testing.T) {
+	module := newTestStorage()
+
+	module.registerOffsetPartitions(2)
+	module.markOffsetPartitionReady(0)
+	// A partition which is discovered before all other partitions are ready must be consumed as well
+	module.registerOffsetPartitions(1)
+	module.markOffsetPartitionReady(1)
+	if module.IsConsumed() {
+		t.Fatalf("Expected offsets topic not to be consumed while partition 2 is not ready")
+	}
+	module.markOffsetPartitionReady(2)
+	if !module.IsConsumed() {
+		t.Fatalf("Expected offsets topic to be consumed")
+	}
+
+	// Partitions which are discovered afterwards don't affect the readiness
+	module.registerOffsetPartitions(1)
+	if !module.IsConsumed() {
+		t.Errorf("Expected offsets topic to stay consumed after registering an additional partition")
+	}
+}
+
+func TestCommitInterval(t *testing.T) {
+	module := newTestStorage()
+	now := time.Now()
+	commit := func(offset int64, commitTime time.Time) {
+		module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+			Group:     "sample-group",
+			Topic:     "important-topic",
+			Offset:    offset,
+			Timestamp: commitTime.UnixNano() / int64(time.Millisecond),
+		})
+	}
+	sampleCount := func() uint64 {
+		metric := &dto.Metric{}
+		module.commitInterval.WithLabelValues("sample-group").(prometheus.Histogram).Write(metric)
+		return metric.GetHistogram().GetSampleCount()
+	}
+
+	commit(10, now.Add(-time.Minute))
+	commit(20, now.Add(-30*time.Second))
+	commit(30, now)
+	if count := sampleCount(); count != 2 {
+		t.Errorf("Expected 2 observed commit intervals, Got: %v", count)
+	}
+
+	// The first commit after a group has been deleted has no previous commit to compare with
+	module.DeleteGroup("sample-group")
+	commit(40, now.Add(time.Second))
+	if count := sampleCount(); count != 0 {
+		t.Errorf("Expected no observed commit interval after the group has been deleted, Got: %v", count)
+	}
+}
+
+func TestOffsetRollback(t *testing.T) {
+	module := newTestStorage()
+	commit := func(offset int64) {
+		module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+			Group:     "sample-group",
+			Topic:     "important-topic",
+			Partition: 3,
+			Offset:    offset,
+		})
+	}
+
+	commit(100)
+	commit(150)
+	commit(150)
+	commit(20)
+	if rollbacks := testutil.ToFloat64(module.offsetRollbacks.WithLabelValues("sample-group", "important-topic", "3")); rollbacks != 1 {
+		t.Errorf("Expected 1 offset rollback, Got: %v", rollbacks)
+	}
+	if offset := module.GroupOffsets("sample-group")["sample-group:important-topic:3"].Offset; offset != 20 {
+		t.Errorf("Expected the lower offset to be stored, Got: %v", offset)
+	}
+}
+
+func TestGroupRebalances(t *testing.T) {
+	module := newTestStorage()
+	store := func(generation int32) {
+		metadata := &kafka.ConsumerGroupMetadata{Group: "sample-group"}
+		metadata.Header.Generation = generation
+		module.storeGroupMetadata(metadata)
+	}
+
+	store(7)
+	store(8)
+	store(8)
+	store(11)
+	if rebalances := testutil.ToFloat64(module.groupRebalances.WithLabelValues("sample-group")); rebalances != 2 {
+		t.Errorf("Expected 2 rebalances, Got: %v", rebalances)
+	}
+
+	// A group which has been deleted starts over with its next generation
+	module.deleteGroupMetadata("sample-group", kafka.InternalPosition{})
+	store(1)
+	if rebalances := testutil.ToFloat64(module.groupRebalances.WithLabelValues("sample-group")); rebalances != 0 {
+		t.Errorf("Expected no rebalances after the group has been deleted, Got: %v", rebalances)
+	}
+}
+
+func TestUpdateTopicPartitionCount(t *testing.T) {
+	module := newTestStorage()
+	module.storeTopicConfig(&kafka.TopicConfiguration{TopicName: "orders", PartitionCount: 6, CleanupPolicy: "delete"})
+
+	module.updateTopicPartitionCount("orders", 12)
+	module.updateTopicPartitionCount("unknown-topic", 3)
+	configs := module.TopicConfigs()
+	expected := map[string]kafka.TopicConfiguration{
+		"orders": {TopicName: "orders", PartitionCount: 12, CleanupPolicy: "delete"},
+	}
+	if !reflect.DeepEqual(configs, expected) {
+		t.Errorf("Expected topic configs %v, Got: %v", expected, configs)
+	}
+}
+
+func TestAppliedRecordCounters(t *testing.T) {
+	module := newTestStorage()
+	commit := func(offset int64, position int64) {
+		module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+			Group:            "sample-group",
+			Topic:            "important-topic",
+			Partition:        0,
+			Offset:           offset,
+			InternalPosition: kafka.InternalPosition{Partition: 0, Offset: position},
+		})
+	}
+	storeMetadata := func(generation int32) {
+		metadata := &kafka.ConsumerGroupMetadata{Group: "sample-group"}
+		metadata.Header.Generation = generation
+		module.storeGroupMetadata(metadata)
+	}
+
+	commit(10, 1)
+	commit(20, 3)
+	// Older than the last applied commit, hence it's discarded
+	commit(15, 2)
+	storeMetadata(2)
+	storeMetadata(1)
+	if commits := testutil.ToFloat64(module.offsetCommits.WithLabelValues("sample-group")); commits != 2 {
+		t.Errorf("Expected 2 applied offset commits, Got: %v", commits)
+	}
+	if records := testutil.ToFloat64(module.metadataRecords.WithLabelValues("sample-group")); records != 1 {
+		t.Errorf("Expected 1 applied group metadata record, Got: %v", records)
+	}
+
+	module.DeleteGroup("sample-group")
+	if commits := testutil.ToFloat64(module.offsetCommits.WithLabelValues("sample-group")); commits != 0 {
+		t.Errorf("Expected the offset commits to be reset after the group has been deleted, Got: %v", commits)
+	}
+}
+
+func TestStoreGroupMetadataDiscardsOlderGenerations(t *testing.T) {
+	module := newTestStorage()
+	store := func(generation int32, leader string) {
+		metadata := &kafka.ConsumerGroupMetadata{Group: "sample-group"}
+		metadata.Header.Generation = generation
+		metadata.Header.Leader = leader
+		module.storeGroupMetadata(metadata)
+	}
+
+	// The records of generation 4 arrive after the ones of generation 5
+	store(3, "member-a")
+	store(5, "member-c")
+	store(4, "member-b")
+	metadata := module.GroupMetadata()["sample-group"]
+	if metadata.Header.Generation != 5 || metadata.Header.Leader != "member-c" {
+		t.Errorf("Expected generation 5 led by member-c, Got: generation %v led by %v", metadata.Header.Generation, metadata.Header.Leader)
+	}
+	if rebalances := testutil.ToFloat64(module.groupRebalances.WithLabelValues("sample-group")); rebalances != 1 {
+		t.Errorf("Expected 1 rebalance, Got: %v", rebalances)
+	}
+
+	// Records of the same generation replace each other (e. g. the assignment after the join)
+	store(5, "member-d")
+	if leader := module.GroupMetadata()["sample-group"].Header.Leader; leader != "member-d" {
+		t.Errorf("Expected the latest record of generation 5 to be stored, Got leader: %v", leader)
+	}
+}
+
+func TestStoreGroupMetadataKeepsLastAppliedRecord(t *testing.T) {
+	module := newTestStorage()
+	store := func(internalOffset int64, leader string) {
+		metadata := &kafka.ConsumerGroupMetadata{
+			Group:            "sample-group",
+			InternalPosition: kafka.InternalPosition{Partition: 12, Offset: internalOffset},
+		}
+		metadata.Header.Generation = 5
+		metadata.Header.Leader = leader
+		module.storeGroupMetadata(metadata)
+	}
+
+	// The record at offset 40 is consumed again after the newer one of the same generation (e. g. after a restore)
+	store(40, "member-a")
+	store(45, "member-b")
+	store(40, "member-a")
+	if leader := module.GroupMetadata()["sample-group"].Header.Leader; leader != "member-b" {
+		t.Errorf("Expected the last applied record to be kept, Got leader: %v", leader)
+	}
+
+	// An older tombstone is outdated, a newer one deletes the group
+	module.deleteGroupMetadata("sample-group", kafka.InternalPosition{Partition: 12, Offset: 42})
+	if _, exists := module.GroupMetadata()["sample-group"]; !exists {
+		t.Errorf("Expected the group metadata to be kept after an older tombstone")
+	}
+	module.deleteGroupMetadata("sample-group", kafka.InternalPosition{Partition: 12, Offset: 46})
+	if _, exists := module.GroupMetadata()["sample-group"]; exists {
+		t.Errorf("Expected the group metadata to be deleted after a newer tombstone")
+	}
+}
+
+func TestStoreOffsetEntryKeepsLastAppliedRecord(t *testing.T) {
+	module := newTestStorage()
+	commit := func(internalOffset int64, offset int64) {
+		module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+			Group:            "sample-group",
+			Topic:            "important-topic",
+			Partition:        3,
+			Offset:           offset,
+			InternalPosition: kafka.InternalPosition{Partition: 12, Offset: internalOffset},
+		})
+	}
+	storedOffset := func() int64 {
+		return module.GroupOffsets("sample-group")["sample-group:important-topic:3"].Offset
+	}
+
+	// Replay the offsets topic up to internal offset 20
+	commit(10, 100)
+	commit(20, 200)
+
+	// The live consumer streams the record at internal offset 10 again (e. g. after a snapshot restore), followed by
+	// new records
+	commit(10, 100)
+	if offset := storedOffset(); offset != 200 {
+		t.Errorf("Expected the older record not to be applied, Got offset: %v", offset)
+	}
+	commit(30, 150)
+	if offset := storedOffset(); offset != 150 {
+		t.Errorf("Expected the newer record to be applied, Got offset: %v", offset)
+	}
+
+	// Tombstones must be newer than the stored commit as well
+	module.deleteOffsetEntry("sample-group", "important-topic", 3, kafka.InternalPosition{Partition: 12, Offset: 25})
+	if offset := storedOffset(); offset != 150 {
+		t.Errorf("Expected the older tombstone not to be applied, Got offset: %v", offset)
+	}
+	module.deleteOffsetEntry("sample-group", "important-topic", 3, kafka.InternalPosition{Partition: 12, Offset: 40})
+	if _, exists := module.GroupOffsets("sample-group")["sample-group:important-topic:3"]; exists {
+		t.Errorf("Expected the newer tombstone to delete the commit")
+	}
+}
+
+func TestOffsetProduceTime(t *testing.T) {
+	module := newTestStorage()
+	start := time.Date(2019, 3, 16, 8, 0, 0, 0, time.UTC)
+	millis := func(d time.Duration) int64 {
+		return start.Add(d).UnixNano() / int64(time.Millisecond)
+	}
+	// The second poll doesn't observe a new high water mark and must not affect the estimation
+	for _, waterMark := range []kafka.PartitionWaterMark{
+		{TopicName: "important-topic", PartitionID: 0, WaterMark: 100, Timestamp: millis(0)},
+		{TopicName: "important-topic", PartitionID: 0, WaterMark: 100, Timestamp: millis(5 * time.Second)},
+		{TopicName: "important-topic", PartitionID: 0, WaterMark: 200, Timestamp: millis(10 * time.Second)},
+		{TopicName: "important-topic", PartitionID: 0, WaterMark: 300, Timestamp: millis(20 * time.Second)},
+	} {
+		module.storePartitionHighWaterMark(&waterMark)
+	}
+
+	tables := []struct {
+		offset      int64
+		produceTime time.Time
+	}{
+		{50, start},
+		{99, start},
+		{149, start.Add(5 * time.Second)},
+		{249, start.Add(15 * time.Second)},
+		{299, start.Add(20 * time.Second)},
+		{300, time.Time{}},
+	}
+	for _, table := range tables {
+		produceTime := module.OffsetProduceTime("important-topic", 0, table.offset)
+		if !produceTime.Equal(table.produceTime) {
+			t.Errorf("Produce time of offset %v was incorrect, got: %v, want: %v", table.offset, produceTime, table.produceTime)
+		}
+	}
+	if produceTime := module.OffsetProduceTime("unknown-topic", 0, 10); !produceTime.IsZero() {
+		t.Errorf("Expected no produce time for an unknown partition, Got: %v", produceTime)
+	}
+}
+
+func TestConsumerOffsetWorkerAppliesCommitsInOrder(t *testing.T) {
+	consumerOffsetCh := make(chan *kafka.StorageRequest)
+	module := NewMemoryStorage(options.NewOptions(), consumerOffsetCh, make(chan *kafka.StorageRequest))
+	go module.consumerOffsetWorker()
+
+	// Each goroutine simulates a partition consumer of the offsets topic, whose commits are interleaved with the
+	// commits of all other partitions. The commits of a group don't ascend, so that only the order decides.
+	commits := []int64{5, 3, 9, 2, 7}
+	var wg sync.WaitGroup
+	for partition := 0; partition < 4; partition++ {
+		group := fmt.Sprintf("sample-group-%d", partition)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 50; round++ {
+				for _, offset := range commits {
+					consumerOffsetCh <- &kafka.StorageRequest{
+						RequestType: kafka.StorageAddConsumerOffset,
+						ConsumerOffset: &kafka.ConsumerPartitionOffset{
+							Group:     group,
+							Topic:     "important-topic",
+							Partition: int32(round % 2),
+							Offset:    offset + int64(round)*10,
+						},
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// The worker has applied all previous requests, once it received another one from the unbuffered channel
+	consumerOffsetCh <- &kafka.StorageRequest{RequestType: kafka.StorageMarkOffsetPartitionConsumed, PartitionID: 0}
+
+	offsets := module.ConsumerOffsets()
+	for partition := 0; partition < 4; partition++ {
+		group := fmt.Sprintf("sample-group-%d", partition)
+		tables := []struct {
+			topicPartition int32
+			offset         int64
+		}{
+			{0, 487},
+			{1, 497},
+		}
+		for _, table := range tables {
+			key := fmt.Sprintf("%v:important-topic:%v", group, table.topicPartition)
+			if offsets[key].Offset != table.offset {
+				t.Errorf("Expected latest commit %v to win for %v, Got: %v", table.offset, key, offsets[key].Offset)
+			}
+		}
+	}
+}
+
+// BenchmarkStoreOffsetEntries replays a synthetic dataset of 100k offsets (1000 groups consuming 5 partitions of
+// the same 20 topics) and reports the heap which is retained by the storage. Group and topic names are copied for
+// each commit, the same way they are allocated while decoding the records of the offsets topic.
+func BenchmarkStoreOffsetEntries(b *testing.B) {
+	var retainedHeap uint64
+	for n := 0; n < b.N; n++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		module := newTestStorage()
+		for group := 0; group < 1000; group++ {
+			for topic := 0; topic < 20; topic++ {
+				for partition := int32(0); partition < 5; partition++ {
+					module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+						Group:     fmt.Sprintf("sample-group-%d", group),
+						Topic:     fmt.Sprintf("important-topic-with-a-rather-long-name-%d", topic),
+						Partition: partition,
+						Offset:    int64(group),
+					})
+				}
+			}
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		retainedHeap += after.HeapAlloc - before.HeapAlloc
+		runtime.KeepAlive(module)
+	}
+	b.ReportMetric(float64(retainedHeap)/float64(b.N), "retained-B/op")
+}
+
+func TestTruncateMetadata(t *testing.T) {
+	tables := []struct {
+		metadata string
+		expected string
+	}{
+		{"checkpoint", "checkpoint"},
+		{strings.Repeat("x", MaxCommitMetadataLength), strings.Repeat("x", MaxCommitMetadataLength)},
+		{strings.Repeat("x", MaxCommitMetadataLength+1), strings.Repeat("x", MaxCommitMetadataLength) + "..."},
+		// "ä" is encoded with two bytes, the cut must not split it
+		{strings.Repeat("x", MaxCommitMetadataLength-1) + "ä", strings.Repeat("x", MaxCommitMetadataLength-1) + "..."},
+	}
+
+	for _, table := range tables {
+		truncated := truncateMetadata(table.metadata)
+		if truncated != table.expected {
+			t.Errorf("Truncating %q was incorrect, got: %q, want: %q", table.metadata, truncated, table.expected)
+		}
+		if !utf8.ValidString(truncated) {
+			t.Errorf("Truncating %q produced invalid UTF-8: %q", table.metadata, truncated)
+		}
+	}
+}
+
+func TestStoreOffsetEntryTruncatesMetadata(t *testing.T) {
+	module := newTestStorage()
+	module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+		Group:    "sample-group",
+		Topic:    "important-topic",
+		Offset:   1156,
+		Metadata: strings.Repeat("x", 4096),
+	})
+
+	metadata := module.GroupOffsets("sample-group")["sample-group:important-topic:0"].Metadata
+	if len(metadata) != MaxCommitMetadataLength+len("...") {
+		t.Errorf("Expected the commit metadata to be truncated when it's stored, Got: %v bytes", len(metadata))
+	}
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"github.com/google-cloud-tools/kafka-minion/kafka"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// commitIntervalBuckets range from 1ms (consumers committing after each message) to 5m (consumers which
+// commit too rarely and therefore risk large replays)
+var commitIntervalBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300}
+
+// newCommitIntervalHistogram creates the histogram which observes the time between two successive
+// offset commits of a consumer group for the same partition
+func newCommitIntervalHistogram(metricsPrefix string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prometheus.BuildFQName(metricsPrefix, "group", "commit_interval_seconds"),
+		Help:    "Time between two successive offset commits of a consumer group for the same partition",
+		Buckets: commitIntervalBuckets,
+	}, []string{"group"})
+}
+
+// newOffsetRollbackCounter creates the counter which is incremented whenever a consumer group commits a lower
+// offset than its previous commit for the same partition
+func newOffsetRollbackCounter(metricsPrefix string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(metricsPrefix, "group", "offset_rollback_total"),
+		Help: "Number of commits which were lower than the previously committed offset of a consumer group for a partition",
+	}, []string{"group", "topic", "partition"})
+}
+
+// newGroupRebalanceCounter creates the counter which is incremented whenever the generation of a consumer group
+// advances, which happens after each completed rebalance
+func newGroupRebalanceCounter(metricsPrefix string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(metricsPrefix, "group", "rebalance_total"),
+		Help: "Number of times the generation of a consumer group has advanced",
+	}, []string{"group"})
+}
+
+// newOffsetCommitCounter creates the counter which is incremented whenever an offset commit of a consumer group has
+// been applied. Commits which are older than the stored one or are filtered are not counted.
+func newOffsetCommitCounter(metricsPrefix string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(metricsPrefix, "", "offset_commits_total"),
+		Help: "Number of offset commits of a consumer group which have been applied",
+	}, []string{"group"})
+}
+
+// newGroupMetadataRecordCounter creates the counter which is incremented whenever a group metadata record of a
+// consumer group has been applied
+func newGroupMetadataRecordCounter(metricsPrefix string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(metricsPrefix, "", "group_metadata_records_total"),
+		Help: "Number of group metadata records of a consumer group which have been applied",
+	}, []string{"group"})
+}
+
+// newGroupDiscoveryCounter creates the counter which is incremented whenever a consumer group shows up which
+// hasn't been known before
+func newGroupDiscoveryCounter(metricsPrefix string) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(metricsPrefix, "", "groups_discovered_total"),
+		Help: "Number of consumer groups which showed up after the offsets topic had been consumed",
+	})
+}
+
+// newQueueLengthGauge creates the gauge which reports the number of requests of the offset consumer which are
+// queued, but not yet applied by the storage
+func newQueueLengthGauge(metricsPrefix string, queue <-chan *kafka.StorageRequest) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(metricsPrefix, "storage", "queue_length"),
+		Help: "Number of requests of the offset consumer which are waiting to be applied by the storage",
+	}, func() float64 { return float64(len(queue)) })
+}
+
+// RegisterMetrics registers the metrics which are observed while storing requests at the given registerer
+func (module *MemoryStorage) RegisterMetrics(registerer prometheus.Registerer) {
+	registerer.MustRegister(module.commitInterval)
+	registerer.MustRegister(module.offsetRollbacks)
+	registerer.MustRegister(module.groupRebalances)
+	registerer.MustRegister(module.offsetCommits)
+	registerer.MustRegister(module.metadataRecords)
+	registerer.MustRegister(module.groupDiscovery)
+	registerer.MustRegister(module.queueLength)
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"github.com/google-cloud-tools/kafka-minion/kafka"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotVersion is the version of written snapshots. Snapshots without a version (0) have been written before the
+// leader epoch of offsets was stored, their offsets are restored with an unknown leader epoch.
+const snapshotVersion = 1
+
+// snapshot contains all information which is needed to resume consuming the consumer offsets topic after a restart
+// without consuming the whole topic again. Group metadata is only written to the offsets topic when a group
+// rebalances, hence it must be part of the snapshot as well.
+type snapshot struct {
+	Version        int
+	Offsets        map[string]ConsumerPartitionOffsetMetric
+	GroupMetadata  map[string]kafka.ConsumerGroupMetadata
+	LastSeen       map[string]time.Time
+	HighWaterMarks map[string]PartitionWaterMarks
+	// HighWaterMarkHistory is missing in snapshots written before it was persisted, the produce times of commits are
+	// unknown then until new high water marks are observed
+	HighWaterMarkHistory map[string]map[int32][]kafka.PartitionWaterMark
+	ConsumedOffsets      map[int32]int64
+}
+
+// Snapshot writes the current consumer offsets, group metadata, the groups' last seen times, partition high water
+// marks along with their history and the consumed offsets of the consumer offsets topic gob encoded into the given
+// writer.
+func (module *MemoryStorage) Snapshot(w io.Writer) error {
+	// Consumed offsets must be copied first. All offsets which have been consumed until then are
+	// already stored and therefore part of the snapshot.
+	s := snapshot{
+		Version:         snapshotVersion,
+		ConsumedOffsets: module.ConsumedOffsets(),
+	}
+	s.Offsets, s.GroupMetadata = module.Groups()
+	s.HighWaterMarks = module.PartitionHighWaterMarks()
+
+	module.partitions.HighWaterMarksLock.RLock()
+	s.HighWaterMarkHistory = make(map[string]map[int32][]kafka.PartitionWaterMark, len(module.partitions.HighWaterMarkHistory))
+	for topic, partitions := range module.partitions.HighWaterMarkHistory {
+		s.HighWaterMarkHistory[topic] = make(map[int32][]kafka.PartitionWaterMark, len(partitions))
+		for partitionID, history := range partitions {
+			s.HighWaterMarkHistory[topic][partitionID] = append([]kafka.PartitionWaterMark(nil), history...)
+		}
+	}
+	module.partitions.HighWaterMarksLock.RUnlock()
+
+	module.groups.LastSeenLock.RLock()
+	s.LastSeen = make(map[string]time.Time, len(module.groups.LastSeen))
+	for group, lastSeen := range module.groups.LastSeen {
+		s.LastSeen[group] = lastSeen
+	}
+	module.groups.LastSeenLock.RUnlock()
+
+	return gob.NewEncoder(w).Encode(&s)
+}
+
+// Restore reads a gob encoded snapshot from the given reader and replaces the consumer offsets, group metadata,
+// partition high water marks (and their history) and the consumed offsets of the consumer offsets topic with the snapshot's content.
+// Snapshots written before group metadata was part of them are restored without any group metadata.
+func (module *MemoryStorage) Restore(r io.Reader) error {
+	s := snapshot{}
+	err := gob.NewDecoder(r).Decode(&s)
+	if err != nil {
+		return fmt.Errorf("failed to decode snapshot: %v", err)
+	}
+
+	module.groups.OffsetsLock.Lock()
+	module.groups.Offsets = make(map[string]ConsumerPartitionOffsetMetric)
+	for key, offset := range s.Offsets {
+		offset.Group = module.names.Intern(offset.Group)
+		offset.Topic = module.names.Intern(offset.Topic)
+		offset.Metadata = truncateMetadata(offset.Metadata)
+		if s.Version < 1 {
+			offset.LeaderEpoch = -1
+		}
+		module.groups.Offsets[key] = offset
+		module.MarkGroupSeen(offset.Group, time.Unix(0, offset.Timestamp*int64(time.Millisecond)))
+		module.markGroupKnown(offset.Group)
+	}
+	module.groups.OffsetsLock.Unlock()
+
+	module.groups.MetadataLock.Lock()
+	module.groups.Metadata = make(map[string]kafka.ConsumerGroupMetadata)
+	for _, metadata := range s.GroupMetadata {
+		metadata.Group = module.names.Intern(metadata.Group)
+		module.groups.Metadata[metadata.Group] = metadata
+		module.markGroupKnown(metadata.Group)
+	}
+	module.groups.MetadataLock.Unlock()
+	for group, lastSeen := range s.LastSeen {
+		module.MarkGroupSeen(module.names.Intern(group), lastSeen)
+	}
+
+	module.partitions.HighWaterMarksLock.Lock()
+	module.partitions.HighWaterMarks = make(map[string]PartitionWaterMarks)
+	for topic, waterMarks := range s.HighWaterMarks {
+		module.partitions.HighWaterMarks[topic] = waterMarks
+	}
+	module.partitions.HighWaterMarkHistory = make(map[string]map[int32][]kafka.PartitionWaterMark)
+	for topic, partitions := range s.HighWaterMarkHistory {
+		module.partitions.HighWaterMarkHistory[topic] = partitions
+	}
+	module.partitions.HighWaterMarksLock.Unlock()
+
+	module.status.Lock.Lock()
+	module.status.ConsumedOffsets = make(map[int32]int64)
+	for partitionID, offset := range s.ConsumedOffsets {
+		module.status.ConsumedOffsets[partitionID] = offset
+	}
+	module.status.Lock.Unlock()
+
+	return nil
+}
+
+// WriteSnapshotFile atomically writes a snapshot to the given path, by writing it into a temporary file
+// in the same directory first and renaming it afterwards.
+func (module *MemoryStorage) WriteSnapshotFile(path string) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary snapshot file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = module.Snapshot(tmpFile)
+	if err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close temporary snapshot file: %v", err)
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// RestoreSnapshotFile restores a snapshot from the given file path. It returns an error which satisfies
+// os.IsNotExist if there is no snapshot yet.
+func (module *MemoryStorage) RestoreSnapshotFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return module.Restore(file)
+}
+
+// snapshotWorker periodically writes a snapshot to the configured snapshot path until the context is cancelled
+func (module *MemoryStorage) snapshotWorker(ctx context.Context) {
+	if module.options.StorageSnapshotPath == "" {
+		return
+	}
+
+	ticker := time.NewTicker(module.options.StorageSnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := module.WriteSnapshotFile(module.options.StorageSnapshotPath)
+			if err != nil {
+				module.logger.WithFields(log.Fields{
+					"path":  module.options.StorageSnapshotPath,
+					"error": err.Error(),
+				}).Error("failed to write storage snapshot")
+				continue
+			}
+			module.logger.WithFields(log.Fields{
+				"path": module.options.StorageSnapshotPath,
+			}).Debug("wrote storage snapshot")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
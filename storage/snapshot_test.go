@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/google-cloud-tools/kafka-minion/kafka"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	module := newTestStorage()
+	module.storeOffsetEntry(&kafka.ConsumerPartitionOffset{
+		Group:       "sample-group",
+		Topic:       "important-topic",
+		Partition:   3,
+		Offset:      1156,
+		Timestamp:   1552723003465,
+		LeaderEpoch: 5,
+	})
+	module.storePartitionHighWaterMark(&kafka.PartitionWaterMark{
+		TopicName:   "important-topic",
+		PartitionID: 3,
+		WaterMark:   1100,
+		Timestamp:   1552723001465,
+	})
+	module.storePartitionHighWaterMark(&kafka.PartitionWaterMark{
+		TopicName:   "important-topic",
+		PartitionID: 3,
+		WaterMark:   1200,
+		Timestamp:   1552723003465,
+	})
+	metadata := &kafka.ConsumerGroupMetadata{Group: "sample-group"}
+	metadata.Header.Generation = 4
+	metadata.Header.Protocol = "range"
+	metadata.AddMember("member-1", "client-1", map[string][]int32{"important-topic": {3}})
+	module.storeGroupMetadata(metadata)
+	// The group has been seen more recently than its last commit
+	module.MarkGroupSeen("sample-group", time.Unix(1552723009, 0))
+	module.markOffsetPartitionConsumed(7, 48213)
+
+	dir, err := ioutil.TempDir("", "kafka-minion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+
+	err = module.WriteSnapshotFile(path)
+	if err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	restored := newTestStorage()
+	err = restored.RestoreSnapshotFile(path)
+	if err != nil {
+		t.Fatalf("Failed to restore snapshot: %v", err)
+	}
+
+	if !reflect.DeepEqual(restored.ConsumerOffsets(), module.ConsumerOffsets()) {
+		t.Errorf("Expected offsets: %v , Got: %v", module.ConsumerOffsets(), restored.ConsumerOffsets())
+	}
+	_, restoredMetadata := restored.Groups()
+	if !reflect.DeepEqual(restoredMetadata, map[string]kafka.ConsumerGroupMetadata{"sample-group": *metadata}) {
+		t.Errorf("Expected group metadata: %v , Got: %v", *metadata, restoredMetadata)
+	}
+	if lastSeen := restored.groups.LastSeen["sample-group"]; !lastSeen.Equal(time.Unix(1552723009, 0)) {
+		t.Errorf("Expected the group to be last seen at %v, Got: %v", time.Unix(1552723009, 0), lastSeen)
+	}
+	if !reflect.DeepEqual(restored.PartitionHighWaterMarks(), module.PartitionHighWaterMarks()) {
+		t.Errorf("Expected high water marks: %v , Got: %v", module.PartitionHighWaterMarks(), restored.PartitionHighWaterMarks())
+	}
+	// The produce time of the commit is interpolated between both high water marks
+	produceTime := restored.OffsetProduceTime("important-topic", 3, 1156)
+	if expected := module.OffsetProduceTime("important-topic", 3, 1156); produceTime.IsZero() || !produceTime.Equal(expected) {
+		t.Errorf("Expected produce time: %v , Got: %v", expected, produceTime)
+	}
+	if !reflect.DeepEqual(restored.ConsumedOffsets(), map[int32]int64{7: 48213}) {
+		t.Errorf("Expected consumed offsets: %v , Got: %v", map[int32]int64{7: 48213}, restored.ConsumedOffsets())
+	}
+}
+
+func TestRestoreUnversionedSnapshot(t *testing.T) {
+	// Snapshots without a version didn't contain leader epochs, gob decodes them as 0
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(&snapshot{
+		Offsets: map[string]ConsumerPartitionOffsetMetric{
+			"sample-group:important-topic:3": {Group: "sample-group", Topic: "important-topic", Partition: 3, Offset: 1156},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	module := newTestStorage()
+	err = module.Restore(buf)
+	if err != nil {
+		t.Fatalf("Failed to restore snapshot: %v", err)
+	}
+	if epoch := module.ConsumerOffsets()["sample-group:important-topic:3"].LeaderEpoch; epoch != -1 {
+		t.Errorf("Expected an unknown leader epoch (-1), Got: %v", epoch)
+	}
+}
+
+func TestRestoreMissingSnapshotFile(t *testing.T) {
+	module := newTestStorage()
+	err := module.RestoreSnapshotFile(filepath.Join(os.TempDir(), "kafka-minion-does-not-exist"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error, Got: %v", err)
+	}
+}
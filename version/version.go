@@ -0,0 +1,38 @@
+// Package version contains the build information of kafka minion. The variables are set at build time, e. g.:
+// go build -ldflags "-X github.com/google-cloud-tools/kafka-minion/version.Version=1.0.0"
+package version
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"runtime"
+)
+
+var (
+	// Version is the released version of this build
+	Version = "dev"
+
+	// Commit is the git commit hash this build has been created from
+	Commit = "unknown"
+
+	// BuildDate is the time this build has been created at
+	BuildDate = "unknown"
+)
+
+// String returns all build information in a human readable format
+func String() string {
+	return fmt.Sprintf("kafka-minion version %v (commit: %v, built: %v, %v)", Version, Commit, BuildDate, runtime.Version())
+}
+
+// NewBuildInfoCollector returns a gauge which is always 1 and carries the build information as labels
+func NewBuildInfoCollector(prefix string) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(prefix, "", "build_info"),
+		Help: "A metric with a constant '1' value labeled by the version, commit and go version kafka minion has been built with",
+		ConstLabels: prometheus.Labels{
+			"version":   Version,
+			"commit":    Commit,
+			"goversion": runtime.Version(),
+		},
+	}, func() float64 { return 1 })
+}